@@ -0,0 +1,122 @@
+// Filename: cmd/api/adjustments.go
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+// The createAdjustmentHandler() posts a credit note against an issued bill for the
+// POST /v1/waterbill/:id/adjustments endpoint
+func (app *application) createAdjustmentHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	var input struct {
+		ReasonCode string `json:"reason_code"`
+		Notes      string `json:"notes"`
+		Amount     int64  `json:"amount"`
+		Refund     bool   `json:"refund"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	// The author is whoever is signed in
+	adjustment := &data.Adjustment{
+		BillID:     id,
+		ReasonCode: input.ReasonCode,
+		Notes:      input.Notes,
+		AuthorID:   app.contextGetUser(r).ID,
+		Amount:     input.Amount,
+	}
+	v := validator.New()
+	if data.ValidateAdjustment(v, adjustment); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Adjustments.Insert(adjustment, input.Refund)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrBillNotIssued):
+			app.errorResponse(w, r, http.StatusConflict, "only issued bills can be adjusted, drafts are edited instead")
+		case errors.Is(err, data.ErrCreditTooLarge):
+			v.AddError("amount", "must not credit more than the amount billed")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRefundRequired):
+			v.AddError("refund", "must be requested as the credit is more than what is owed on the bill")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/adjustments/%d", adjustment.ID))
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"adjustment": adjustment}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listBillAdjustmentsHandler() shows every adjustment posted against a bill
+func (app *application) listBillAdjustmentsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	// Make sure the bill exists so an unknown id is a 404 and not an empty list
+	_, err = app.models.Todo_list.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	adjustments, err := app.models.Adjustments.GetAllForBill(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"adjustments": adjustments}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showAdjustmentHandler() shows a specific adjustment
+func (app *application) showAdjustmentHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	adjustment, err := app.models.Adjustments.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"adjustment": adjustment}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
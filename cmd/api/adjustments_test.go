@@ -0,0 +1,114 @@
+// Filename: cmd/api/adjustments_test.go
+
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/data"
+)
+
+func TestCreateAdjustmentRequiresAdmin(t *testing.T) {
+	customer := &data.User{ID: 7, Name: "Customer", Email: "customer@example.com", Activated: true}
+	tests := []struct {
+		name          string
+		permissions   []string
+		authenticated bool
+		status        int
+	}{
+		{name: "anonymous", status: http.StatusUnauthorized},
+		{name: "customer", authenticated: true, status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t, signedIn(customer, tt.permissions, func(query string, args []driver.Value) stubResult {
+				t.Errorf("the adjustment reached the database: %s", query)
+				return stubResult{}
+			}))
+			body := `{"reason_code":"goodwill","notes":"sorry","amount":-2500,"refund":true}`
+			r := httptest.NewRequest(http.MethodPost, "/v1/waterbill/1/adjustments", strings.NewReader(body))
+			rr := serve(t, app, r, tt.authenticated)
+			if rr.Code != tt.status {
+				t.Errorf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+		})
+	}
+}
+
+func TestCreateAdjustmentRefund(t *testing.T) {
+	admin := &data.User{ID: 1, Name: "Admin", Email: "admin@example.com", Activated: true}
+	tests := []struct {
+		name   string
+		paid   int64
+		refund bool
+		status int
+		// what the bill is credited with and how much of the payments goes back
+		credit, excess int64
+	}{
+		{name: "unpaid", paid: 0, status: http.StatusCreated, credit: 2500, excess: 0},
+		{name: "part paid", paid: 9000, refund: true, status: http.StatusCreated, credit: 2500, excess: 1500},
+		{name: "paid in full", paid: 10000, refund: true, status: http.StatusCreated, credit: 2500, excess: 2500},
+		{name: "refund not requested", paid: 10000, status: http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var updated []driver.Value
+			app := newTestApplication(t, signedIn(admin, []string{data.PermissionAdmin}, func(query string, args []driver.Value) stubResult {
+				switch {
+				case strings.Contains(query, "SELECT amount, amount_paid, amount_credited, user_id, state"):
+					return stubResult{rows: [][]driver.Value{{int64(10000), tt.paid, int64(0), int64(7), data.BillIssued}}}
+				case strings.Contains(query, "INSERT INTO adjustments"), strings.Contains(query, "INSERT INTO refunds"):
+					return stubResult{rows: [][]driver.Value{{int64(1), time.Now()}}}
+				case strings.Contains(query, "SET amount_credited"):
+					updated = args
+					return stubResult{affected: 1}
+				case strings.Contains(query, "SELECT state, amount, amount_paid, amount_credited"):
+					return stubResult{rows: [][]driver.Value{{data.BillIssued, int64(10000), tt.paid - tt.excess, tt.credit}}}
+				case strings.Contains(query, "SET state = $1, version = version + 1"):
+					return stubResult{rows: [][]driver.Value{billRow(&data.Todo_list{ID: 1, State: args[0].(string), Amount: 10000, Version: 3})}}
+				case strings.Contains(query, "INSERT INTO water_system_history"),
+					strings.Contains(query, "INSERT INTO bill_transitions"),
+					strings.Contains(query, "INSERT INTO webhook_deliveries"):
+					return stubResult{affected: 1}
+				}
+				t.Errorf("unexpected statement: %s", query)
+				return stubResult{}
+			}))
+			body := fmt.Sprintf(`{"reason_code":"goodwill","notes":"sorry","amount":-2500,"refund":%t}`, tt.refund)
+			r := httptest.NewRequest(http.MethodPost, "/v1/waterbill/1/adjustments", strings.NewReader(body))
+			rr := serve(t, app, r, true)
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if tt.status != http.StatusCreated {
+				if updated != nil {
+					t.Error("the bill was changed")
+				}
+				return
+			}
+			if updated[0] != tt.credit || updated[1] != tt.excess {
+				t.Errorf("credited %v and took back %v, want %d and %d", updated[0], updated[1], tt.credit, tt.excess)
+			}
+			var response struct {
+				Adjustment data.Adjustment `json:"adjustment"`
+			}
+			err := json.Unmarshal(rr.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch refund := response.Adjustment.Refund; {
+			case tt.excess == 0 && refund != nil:
+				t.Errorf("got a refund of %d, want none", refund.Amount)
+			case tt.excess > 0 && (refund == nil || refund.Amount != tt.excess):
+				t.Errorf("got refund %+v, want %d", refund, tt.excess)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+// Filename: cmd/api/batch.go
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+// batchMaxOperations caps the operations of one batch
+const batchMaxOperations = 100
+
+// The batch modes. In all_or_nothing mode the first operation that fails undoes the
+// whole batch, in best_effort mode only the failed operations are undone
+const (
+	batchAllOrNothing = "all_or_nothing"
+	batchBestEffort   = "best_effort"
+)
+
+// The operations a batch can hold
+const (
+	batchCreate = "create"
+	batchUpdate = "update"
+	batchDelete = "delete"
+)
+
+// A batchOperation is one change in a batch. Updates and deletes name the bill and the
+// version of it they were made against, creates and updates carry the fields in data
+type batchOperation struct {
+	Op      string    `json:"op"`
+	ID      int64     `json:"id"`
+	Version *int32    `json:"version"`
+	Data    billPatch `json:"data"`
+}
+
+// A batchResult is the outcome of one operation, with the status code the operation
+// would have got as a request of its own
+type batchResult struct {
+	Index  int             `json:"index"`
+	Op     string          `json:"op"`
+	Status int             `json:"status"`
+	ID     int64           `json:"id,omitempty"`
+	Bill   *data.Todo_list `json:"waterbill,omitempty"`
+	Error  interface{}     `json:"error,omitempty"`
+}
+
+// The batchBillsHandler() runs a list of creates, updates and deletes in one database
+// transaction and reports the outcome of each
+func (app *application) batchBillsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Mode       string           `json:"mode"`
+		Operations []batchOperation `json:"operations"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if input.Mode == "" {
+		input.Mode = batchAllOrNothing
+	}
+	v := validator.New()
+	v.Check(validator.In(input.Mode, batchAllOrNothing, batchBestEffort), "mode", "must be all_or_nothing or best_effort")
+	v.Check(len(input.Operations) > 0, "operations", "must contain at least one operation")
+	v.Check(len(input.Operations) <= batchMaxOperations, "operations", fmt.Sprintf("must not contain more than %d operations", batchMaxOperations))
+	for i, op := range input.Operations {
+		key := fmt.Sprintf("operations.%d", i)
+		switch op.Op {
+		case batchCreate:
+			v.Check(op.ID == 0 && op.Version == nil, key, "a create must not name an id or version")
+		case batchUpdate, batchDelete:
+			v.Check(op.ID > 0, key+".id", "must be provided")
+			v.Check(op.Version != nil, key+".version", "must be provided")
+		default:
+			v.AddError(key+".op", "must be create, update or delete")
+		}
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	categories, priorities, err := app.activeVocabulary()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	batch, err := app.models.Todo_list.Batch(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	defer batch.Rollback()
+
+	bestEffort := input.Mode == batchBestEffort
+	results := make([]*batchResult, len(input.Operations))
+	applied := 0
+	for i := range input.Operations {
+		if bestEffort {
+			err = batch.Savepoint()
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+		result, err := app.runBatchOperation(batch, &input.Operations[i], categories, priorities)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		result.Index = i
+		results[i] = result
+		failed := result.Status >= http.StatusBadRequest
+		switch {
+		case failed && !bestEffort:
+			// Nothing is saved, so every other operation is reported as not applied
+			for j, op := range input.Operations {
+				if j != i {
+					results[j] = &batchResult{
+						Index:  j,
+						Op:     op.Op,
+						Status: http.StatusFailedDependency,
+						Error:  fmt.Sprintf("not applied, operation %d failed", i),
+					}
+				}
+			}
+			app.batchFailedResponse(w, r, result.Status, results)
+			return
+		case failed:
+			err = batch.RollbackToSavepoint()
+		case bestEffort:
+			err = batch.Release()
+		}
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !failed {
+			applied++
+		}
+	}
+	err = batch.Commit()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	summary := envelope{
+		"mode":    input.Mode,
+		"applied": applied,
+		"failed":  len(results) - applied,
+		"results": results,
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"batch": summary}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// runBatchOperation() carries out one operation of a batch. Failures the client can
+// fix, broken constraints among them, are reported in the result, the error is only
+// for failures of the server and the connection
+func (app *application) runBatchOperation(batch *data.BillBatch, op *batchOperation, categories, priorities []string) (*batchResult, error) {
+	result := &batchResult{Op: op.Op, ID: op.ID}
+	fail := func(status int, message interface{}) (*batchResult, error) {
+		result.Status, result.Error = status, message
+		return result, nil
+	}
+
+	var bill *data.Todo_list
+	if op.Op == batchCreate {
+		bill = &data.Todo_list{}
+	} else {
+		var err error
+		bill, err = batch.Get(op.ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				return fail(http.StatusNotFound, "the requested resource could not be found")
+			default:
+				return nil, err
+			}
+		}
+		if bill.Version != *op.Version {
+			return fail(http.StatusConflict, fmt.Sprintf("edit conflict, the bill is at version %d", bill.Version))
+		}
+		if bill.State != data.BillDraft {
+			return fail(http.StatusConflict, "only draft bills can be changed, post an adjustment against an issued bill instead")
+		}
+	}
+
+	var err error
+	switch op.Op {
+	case batchCreate, batchUpdate:
+		v := validator.New()
+		if app.applyBillPatch(v, bill, &op.Data, categories, priorities); !v.Valid() {
+			return fail(http.StatusUnprocessableEntity, v.Errors)
+		}
+		if op.Op == batchCreate {
+			err = batch.Insert(bill)
+			result.Status = http.StatusCreated
+		} else {
+			err = batch.Update(bill)
+			result.Status = http.StatusOK
+		}
+		result.ID, result.Bill = bill.ID, bill
+	case batchDelete:
+		err = batch.Delete(bill.ID, bill.Version)
+		result.Status = http.StatusOK
+	}
+	var constraint *data.ConstraintError
+	if err != nil {
+		switch {
+		case errors.As(err, &constraint):
+			return fail(http.StatusUnprocessableEntity, map[string]string{constraint.Field: constraint.Message})
+		case errors.Is(err, data.ErrEditConflict):
+			return fail(http.StatusConflict, "unable to update the record due to an edit conflict, please try again")
+		case errors.Is(err, data.ErrBillIssued):
+			return fail(http.StatusConflict, "only draft bills can be changed, post an adjustment against an issued bill instead")
+		default:
+			return nil, err
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,291 @@
+// Filename: cmd/api/batch_test.go
+
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+func TestApplyBillPatch(t *testing.T) {
+	due := time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC)
+	draft := func() *data.Todo_list {
+		return &data.Todo_list{
+			ID: 1, Waterbill: "March", Description: "Meter 4411", Notes: "read", Category: "residential",
+			Priority: "normal", State: data.BillDraft, Amount: 4250, AmountPaid: 1000, DueDate: due,
+		}
+	}
+	str := func(s string) *string { return &s }
+	num := func(n int64) *int64 { return &n }
+	tests := []struct {
+		name   string
+		bill   *data.Todo_list
+		patch  billPatch
+		errors []string
+		check  func(*data.Todo_list) bool
+	}{
+		{name: "nothing sent", bill: draft(), check: func(b *data.Todo_list) bool { return reflect.DeepEqual(b, draft()) }},
+		{name: "notes", bill: draft(), patch: billPatch{Notes: str("meter replaced")}, check: func(b *data.Todo_list) bool {
+			return b.Notes == "meter replaced" && b.Waterbill == "March"
+		}},
+		{name: "every field", bill: draft(), patch: billPatch{
+			Waterbill: str("April"), Description: str("Meter 12"), Notes: str("estimate"), Category: str("commercial"),
+			Priority: str("high"), UserID: num(7), Amount: num(5000), DueDate: str("2024-04-30"),
+		}, check: func(b *data.Todo_list) bool {
+			return b.Waterbill == "April" && b.Description == "Meter 12" && b.Notes == "estimate" && b.Category == "commercial" &&
+				b.Priority == "high" && b.UserID == 7 && b.Amount == 5000 && b.DueDate.Equal(time.Date(2024, 4, 30, 0, 0, 0, 0, time.UTC))
+		}},
+		{name: "retired category", bill: draft(), patch: billPatch{Category: str("industrial")}, errors: []string{"category"}},
+		{name: "retired priority", bill: draft(), patch: billPatch{Priority: str("urgent")}, errors: []string{"priority"}},
+		// A bill keeps a value that has since been retired until the field is changed
+		{name: "kept retired priority", bill: func() *data.Todo_list { b := draft(); b.Priority = "urgent"; return b }(), patch: billPatch{Category: str("commercial")}},
+		{name: "cleared waterbill", bill: draft(), patch: billPatch{Waterbill: str("")}, errors: []string{"waterbill"}},
+		{name: "bad due date", bill: draft(), patch: billPatch{DueDate: str("31/03/2024")}, errors: []string{"due_date"}},
+		{name: "below the amount paid", bill: draft(), patch: billPatch{Amount: num(500)}, errors: []string{"amount"}},
+		{name: "negative account", bill: draft(), patch: billPatch{UserID: num(-1)}, errors: []string{"user_id"}},
+	}
+	app := &application{}
+	for _, tt := range tests {
+		v := validator.New()
+		app.applyBillPatch(v, tt.bill, &tt.patch, []string{"residential", "commercial"}, []string{"normal", "high"})
+		if len(v.Errors) != len(tt.errors) {
+			t.Errorf("%s: got errors %v, want them on %v", tt.name, v.Errors, tt.errors)
+		}
+		for _, key := range tt.errors {
+			if v.Errors[key] == "" {
+				t.Errorf("%s: no error on %s, got %v", tt.name, key, v.Errors)
+			}
+		}
+		if tt.check != nil && !tt.check(tt.bill) {
+			t.Errorf("%s: got %+v", tt.name, tt.bill)
+		}
+	}
+}
+
+func TestBatchRequiresAdmin(t *testing.T) {
+	user := &data.User{ID: 7, Name: "Ana Perez", Email: "ana@example.com", Activated: true}
+	tests := []struct {
+		name          string
+		authenticated bool
+		status        int
+	}{
+		{name: "anonymous", status: http.StatusUnauthorized},
+		{name: "not an admin", authenticated: true, status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t, signedIn(user, nil, func(query string, args []driver.Value) stubResult {
+				t.Errorf("the batch reached the database: %s", query)
+				return stubResult{}
+			}))
+			body := `{"operations":[{"op":"delete","id":2,"version":1}]}`
+			r := httptest.NewRequest(http.MethodPost, "/v1/waterbill/batch", strings.NewReader(body))
+			rr := serve(t, app, r, tt.authenticated)
+			if rr.Code != tt.status {
+				t.Errorf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+		})
+	}
+}
+
+// The batch is run in one transaction. In all_or_nothing mode a failed operation fails
+// the batch, in best_effort mode it is undone on its own
+func TestBatchBills(t *testing.T) {
+	admin := &data.User{ID: 3, Name: "Clerk", Email: "clerk@example.com", Activated: true}
+	body := `{"mode":%q,"operations":[
+		{"op":"update","id":1,"version":1,"data":{"notes":"meter replaced"}},
+		{"op":"delete","id":2,"version":5}
+	]}`
+	tests := []struct {
+		mode       string
+		status     int
+		results    []int
+		statements []string
+	}{
+		{
+			mode:       batchAllOrNothing,
+			status:     http.StatusConflict,
+			results:    []int{http.StatusFailedDependency, http.StatusConflict},
+			statements: []string{"update"},
+		},
+		{
+			mode:       batchBestEffort,
+			status:     http.StatusOK,
+			results:    []int{http.StatusOK, http.StatusConflict},
+			statements: []string{"savepoint", "update", "release", "savepoint", "rollback to"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			var statements []string
+			app := newTestApplication(t, signedIn(admin, []string{data.PermissionAdmin}, func(query string, args []driver.Value) stubResult {
+				switch {
+				case strings.Contains(query, "FROM categories"):
+					return stubResult{rows: [][]driver.Value{{"residential", time.Now(), "Residential", true, int64(1)}}}
+				case strings.Contains(query, "FROM priorities"):
+					return stubResult{rows: [][]driver.Value{{"normal", time.Now(), "Normal", true, int64(1)}}}
+				case strings.HasPrefix(query, "SAVEPOINT"):
+					statements = append(statements, "savepoint")
+					return stubResult{}
+				case strings.HasPrefix(query, "RELEASE"):
+					statements = append(statements, "release")
+					return stubResult{}
+				case strings.HasPrefix(query, "ROLLBACK TO"):
+					statements = append(statements, "rollback to")
+					return stubResult{}
+				case strings.Contains(query, "INSERT INTO water_system_history"), strings.Contains(query, "INSERT INTO webhook_deliveries"):
+					return stubResult{affected: 1}
+				case strings.Contains(query, "UPDATE water_system"):
+					statements = append(statements, "update")
+					return stubResult{rows: [][]driver.Value{{int64(2)}}}
+				case strings.Contains(query, "FROM water_system"):
+					// Bill 2 has moved on to version 6 since the client read it
+					bill := &data.Todo_list{ID: args[0].(int64), Waterbill: "March", Description: "Meter 4411", Notes: "read",
+						Category: "residential", Priority: "normal", State: data.BillDraft, DueDate: time.Now(), Version: 1}
+					if bill.ID == 2 {
+						bill.Version = 6
+					}
+					return stubResult{rows: [][]driver.Value{billRow(bill)}}
+				}
+				t.Errorf("unexpected statement: %s", query)
+				return stubResult{}
+			}))
+			r := httptest.NewRequest(http.MethodPost, "/v1/waterbill/batch", strings.NewReader(fmt.Sprintf(body, tt.mode)))
+			rr := serve(t, app, r, true)
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			var response struct {
+				Batch struct {
+					Results []batchResult `json:"results"`
+				} `json:"batch"`
+				Error struct {
+					Results []batchResult `json:"results"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			results := append(response.Batch.Results, response.Error.Results...)
+			if len(results) != len(tt.results) {
+				t.Fatalf("got %d results, want %d: %s", len(results), len(tt.results), rr.Body)
+			}
+			for i, result := range results {
+				if result.Index != i || result.Status != tt.results[i] {
+					t.Errorf("result %d: got %d with status %d, want %d", i, result.Index, result.Status, tt.results[i])
+				}
+			}
+			if got, want := strings.Join(statements, ", "), strings.Join(tt.statements, ", "); got != want {
+				t.Errorf("got statements %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+// An operation that breaks a constraint of the database, such as giving a bill to an
+// account that does not exist, fails on its own with 422 in best_effort mode rather
+// than failing the whole batch
+func TestBatchBillsConstraint(t *testing.T) {
+	admin := &data.User{ID: 3, Name: "Clerk", Email: "clerk@example.com", Activated: true}
+	body := `{"mode":%q,"operations":[
+		{"op":"create","data":{"waterbill":"April","description":"Meter 4411","notes":"read","category":"residential","priority":"normal","user_id":99,"amount":4250}},
+		{"op":"update","id":1,"version":1,"data":{"notes":"meter replaced"}}
+	]}`
+	tests := []struct {
+		mode       string
+		status     int
+		results    []int
+		statements []string
+	}{
+		{
+			mode:       batchAllOrNothing,
+			status:     http.StatusUnprocessableEntity,
+			results:    []int{http.StatusUnprocessableEntity, http.StatusFailedDependency},
+			statements: []string{"insert"},
+		},
+		{
+			mode:       batchBestEffort,
+			status:     http.StatusOK,
+			results:    []int{http.StatusUnprocessableEntity, http.StatusOK},
+			statements: []string{"savepoint", "insert", "rollback to", "savepoint", "update", "release"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			var statements []string
+			app := newTestApplication(t, signedIn(admin, []string{data.PermissionAdmin}, func(query string, args []driver.Value) stubResult {
+				switch {
+				case strings.Contains(query, "FROM categories"):
+					return stubResult{rows: [][]driver.Value{{"residential", time.Now(), "Residential", true, int64(1)}}}
+				case strings.Contains(query, "FROM priorities"):
+					return stubResult{rows: [][]driver.Value{{"normal", time.Now(), "Normal", true, int64(1)}}}
+				case strings.HasPrefix(query, "SAVEPOINT"):
+					statements = append(statements, "savepoint")
+					return stubResult{}
+				case strings.HasPrefix(query, "RELEASE"):
+					statements = append(statements, "release")
+					return stubResult{}
+				case strings.HasPrefix(query, "ROLLBACK TO"):
+					statements = append(statements, "rollback to")
+					return stubResult{}
+				case strings.Contains(query, "INSERT INTO water_system ("):
+					statements = append(statements, "insert")
+					return stubResult{err: &pq.Error{Code: "23503", Constraint: "water_system_user_id_fkey"}}
+				case strings.Contains(query, "INSERT INTO water_system_history"), strings.Contains(query, "INSERT INTO webhook_deliveries"):
+					return stubResult{affected: 1}
+				case strings.Contains(query, "UPDATE water_system"):
+					statements = append(statements, "update")
+					return stubResult{rows: [][]driver.Value{{int64(2)}}}
+				case strings.Contains(query, "FROM water_system"):
+					bill := &data.Todo_list{ID: 1, Waterbill: "March", Description: "Meter 4411", Notes: "read",
+						Category: "residential", Priority: "normal", State: data.BillDraft, DueDate: time.Now(), Version: 1}
+					return stubResult{rows: [][]driver.Value{billRow(bill)}}
+				}
+				t.Errorf("unexpected statement: %s", query)
+				return stubResult{}
+			}))
+			r := httptest.NewRequest(http.MethodPost, "/v1/waterbill/batch", strings.NewReader(fmt.Sprintf(body, tt.mode)))
+			rr := serve(t, app, r, true)
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			var response struct {
+				Batch struct {
+					Results []batchResult `json:"results"`
+				} `json:"batch"`
+				Error struct {
+					Results []batchResult `json:"results"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			results := append(response.Batch.Results, response.Error.Results...)
+			if len(results) != len(tt.results) {
+				t.Fatalf("got %d results, want %d: %s", len(results), len(tt.results), rr.Body)
+			}
+			for i, result := range results {
+				if result.Status != tt.results[i] {
+					t.Errorf("result %d: got status %d, want %d", i, result.Status, tt.results[i])
+				}
+			}
+			if fields, ok := results[0].Error.(map[string]interface{}); !ok || fields["user_id"] != "no such user" {
+				t.Errorf("got the error %v for the create", results[0].Error)
+			}
+			if got, want := strings.Join(statements, ", "), strings.Join(tt.statements, ", "); got != want {
+				t.Errorf("got statements %s, want %s", got, want)
+			}
+		})
+	}
+}
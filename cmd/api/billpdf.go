@@ -0,0 +1,219 @@
+// Filename: cmd/api/billpdf.go
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/pdf"
+)
+
+// The showBillPDFHandler() renders a printable copy of a bill for the
+// GET /v1/waterbill/:id/pdf endpoint
+func (app *application) showBillPDFHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	bill, err := app.models.Todo_list.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.writeBillPDF(w, r, bill)
+}
+
+// writeBillPDF() sends the rendered bill to the client, or 304 Not Modified when it
+// already has this version. The printed bill carries the name and email of the
+// account holder, so only they and admins can have it
+func (app *application) writeBillPDF(w http.ResponseWriter, r *http.Request, bill *data.Todo_list) {
+	if app.contextGetUser(r).IsAnonymous() {
+		app.authenticationRequiredResponse(w, r)
+		return
+	}
+	if !app.allowAccount(w, r, bill.UserID) {
+		return
+	}
+	if notModified(w, r, bill, billRepresentation(mediaTypePDF, nil, nil)) {
+		return
+	}
+	_, body, err := app.billPDF(bill)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="bill-%d.pdf"`, bill.ID))
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// billPDF() loads the account and the adjustments of the bill and renders it. The
+// account is nil when the bill is not linked to one
+func (app *application) billPDF(bill *data.Todo_list) (*data.User, []byte, error) {
+	var account *data.User
+	if bill.UserID > 0 {
+		user, err := app.models.Users.Get(bill.UserID)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			return nil, nil, err
+		}
+		account = user
+	}
+	adjustments, err := app.models.Adjustments.GetAllForBill(bill.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return account, app.renderBillPDF(bill, account, adjustments), nil
+}
+
+// wantsPDF() reports whether the Accept header prefers a PDF to the formats every
+// response can be rendered in
+func wantsPDF(r *http.Request) bool {
+	return negotiate(r.Header.Get("Accept"), billTypes...) == mediaTypePDF
+}
+
+// renderBillPDF() lays out a bill: the utility header, the account the bill belongs to,
+// the consumption it is for, the line items and the totals. Line items that do not fit
+// on the first page carry on over as many pages as they need, the notes go at the end
+// and every page is numbered in the footer
+func (app *application) renderBillPDF(bill *data.Todo_list, account *data.User, adjustments []*data.Adjustment) []byte {
+	const (
+		left  = 50.0
+		right = pdf.PageWidth - 50
+		// Line items and totals stay above the notes and the footer
+		bottom = 705.0
+		// The space the totals take up
+		totalsHeight = 70.0
+	)
+	doc := pdf.New()
+	page := doc.AddPage()
+	pages := []*pdf.Page{page}
+
+	// Utility header
+	page.Rect(0, 0, pdf.PageWidth, 95, 0.92)
+	page.Text(left, 45, 20, pdf.Bold, app.config.utility.name)
+	contact := []string{}
+	for _, s := range []string{app.config.utility.address, app.config.utility.phone} {
+		if s != "" {
+			contact = append(contact, s)
+		}
+	}
+	page.Text(left, 65, 9, pdf.Regular, strings.Join(contact, "  |  "))
+	page.TextRight(right, 45, 16, pdf.Bold, "WATER BILL")
+	page.TextRight(right, 65, 9, pdf.Mono, fmt.Sprintf("Bill no. %d", bill.ID))
+
+	// Account details on the left, the bill details on the right
+	y := 130.0
+	page.Text(left, y, 11, pdf.Bold, "Account")
+	page.Text(330, y, 11, pdf.Bold, "Bill")
+	y += 18
+	if account != nil {
+		page.Text(left, y, 10, pdf.Regular, account.Name)
+		page.Text(left, y+14, 10, pdf.Regular, account.Email)
+		page.Text(left, y+28, 10, pdf.Regular, fmt.Sprintf("Account no. %d", account.ID))
+	} else {
+		page.Text(left, y, 10, pdf.Regular, "No account linked to this bill")
+	}
+	issued := "Not issued"
+	if bill.IssuedAt != nil {
+		issued = bill.IssuedAt.Format("2 Jan 2006")
+	}
+	details := [][2]string{
+		{"Issued", issued},
+		{"Due date", bill.DueDate.Format("2 Jan 2006")},
+		{"Status", strings.ReplaceAll(bill.State, "_", " ")},
+	}
+	for i, d := range details {
+		page.Text(330, y+14*float64(i), 10, pdf.Regular, d[0])
+		page.Text(410, y+14*float64(i), 10, pdf.Regular, d[1])
+	}
+
+	// Consumption
+	y = 230
+	page.Text(left, y, 11, pdf.Bold, "Consumption")
+	y += 18
+	page.Text(left, y, 10, pdf.Regular, bill.Waterbill)
+	page.Text(left, y+14, 10, pdf.Regular, bill.Description)
+	page.Text(left, y+28, 9, pdf.Regular, fmt.Sprintf("Category: %s    Priority: %s", bill.Category, bill.Priority))
+
+	// Line items
+	columns := func() {
+		page.Rect(left, y-14, right-left, 20, 0.85)
+		page.Text(left+6, y, 10, pdf.Bold, "Description")
+		page.TextRight(right-6, y, 10, pdf.Bold, "Amount")
+		y += 24
+	}
+	// nextPage() carries the bill on to a new page with a short header
+	nextPage := func() {
+		page.Text(left, y, 9, pdf.Regular, "Continued on the next page")
+		page = doc.AddPage()
+		pages = append(pages, page)
+		page.Text(left, 50, 12, pdf.Bold, app.config.utility.name)
+		page.TextRight(right, 50, 9, pdf.Mono, fmt.Sprintf("Bill no. %d (continued)", bill.ID))
+		page.Line(left, 62, right, 62, 0.5)
+		y = 95
+	}
+	y = 320
+	columns()
+	item := func(description string, amount int64) {
+		if y > bottom {
+			nextPage()
+			columns()
+		}
+		page.Text(left+6, y, 10, pdf.Regular, description)
+		page.TextRight(right-6, y, 10, pdf.Mono, data.FormatAmount(amount))
+		y += 18
+	}
+	item(bill.Waterbill, bill.Amount)
+	var credits int64
+	for _, adjustment := range adjustments {
+		item(fmt.Sprintf("Credit note %d (%s)", adjustment.ID, strings.ReplaceAll(adjustment.ReasonCode, "_", " ")), adjustment.Amount)
+		credits += adjustment.Amount
+	}
+	page.Line(left, y-8, right, y-8, 0.5)
+
+	// Totals, kept together on one page
+	y += 10
+	if y+totalsHeight > bottom {
+		nextPage()
+	}
+	total := func(label string, amount int64, font pdf.Font) {
+		page.Text(330, y, 10, font, label)
+		page.TextRight(right-6, y, 10, pdf.Mono, data.FormatAmount(amount))
+		y += 16
+	}
+	total("Charges", bill.Amount, pdf.Regular)
+	total("Credits", credits, pdf.Regular)
+	total("Payments received", -bill.AmountPaid, pdf.Regular)
+	page.Line(330, y-10, right, y-10, 0.5)
+	y += 4
+	total("Amount due", bill.Amount-bill.AmountPaid-bill.AmountCredited, pdf.Bold)
+
+	if bill.Notes != "" {
+		page.Text(left, 720, 9, pdf.Bold, "Notes")
+		page.Text(left, 734, 9, pdf.Regular, bill.Notes)
+	}
+	for i, page := range pages {
+		page.Line(left, 780, right, 780, 0.5)
+		page.Text(left, 795, 8, pdf.Regular, fmt.Sprintf("Please pay %s by %s. Quote bill no. %d with your payment.",
+			data.FormatAmount(bill.Amount-bill.AmountPaid-bill.AmountCredited), bill.DueDate.Format("2 Jan 2006"), bill.ID))
+		if len(pages) > 1 {
+			page.TextRight(right, 795, 8, pdf.Regular, fmt.Sprintf("Page %d of %d", i+1, len(pages)))
+		}
+	}
+
+	return doc.Bytes()
+}
@@ -0,0 +1,145 @@
+// Filename: cmd/api/billpdf_test.go
+
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/data"
+)
+
+// Run go test ./cmd/api -run TestRenderBillPDF -update to rewrite the golden files
+// after a deliberate change to the layout
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestRenderBillPDF(t *testing.T) {
+	app := &application{}
+	app.config.utility.name = "Water Billing System"
+	app.config.utility.address = "1 Reservoir Road"
+	app.config.utility.phone = "555-0100"
+
+	issuedAt := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	due := time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC)
+	account := &data.User{ID: 7, Name: "Ana Perez", Email: "ana@example.com"}
+	credits := func(n int) []*data.Adjustment {
+		adjustments := make([]*data.Adjustment, n)
+		for i := range adjustments {
+			adjustments[i] = &data.Adjustment{ID: int64(i + 1), ReasonCode: "meter_misread", Amount: -10}
+		}
+		return adjustments
+	}
+	tests := []struct {
+		name        string
+		bill        *data.Todo_list
+		account     *data.User
+		adjustments []*data.Adjustment
+		pages       int
+	}{
+		{
+			name:  "draft-no-account",
+			bill:  &data.Todo_list{ID: 1, Waterbill: "March", Description: "Meter 4411", Category: "residential", Priority: "normal", State: data.BillDraft, Amount: 4250, DueDate: due},
+			pages: 1,
+		},
+		{
+			name:        "issued-with-credits",
+			bill:        &data.Todo_list{ID: 2, Waterbill: "April", Description: "Meter 4411 (Café)", Notes: "Meter replaced (read twice)", Category: "residential", Priority: "high", State: data.BillPartiallyPaid, Amount: 10000, AmountPaid: 2500, AmountCredited: 1000, DueDate: due, IssuedAt: &issuedAt},
+			account:     account,
+			adjustments: []*data.Adjustment{{ID: 4, ReasonCode: "billing_error", Amount: -1000}},
+			pages:       1,
+		},
+		{
+			// The line items fill the first page, so the totals move to the second
+			name:        "totals-on-next-page",
+			bill:        &data.Todo_list{ID: 3, Waterbill: "May", Description: "Meter 4411", Category: "residential", Priority: "normal", State: data.BillIssued, Amount: 10000, AmountCredited: 200, DueDate: due, IssuedAt: &issuedAt},
+			account:     account,
+			adjustments: credits(20),
+			pages:       2,
+		},
+		{
+			name:        "long-credit-list",
+			bill:        &data.Todo_list{ID: 4, Waterbill: "June", Description: "Meter 4411", Notes: "Disputed readings", Category: "residential", Priority: "normal", State: data.BillIssued, Amount: 10000, AmountCredited: 600, DueDate: due, IssuedAt: &issuedAt},
+			account:     account,
+			adjustments: credits(60),
+			pages:       3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := app.renderBillPDF(tt.bill, tt.account, tt.adjustments)
+			if pages := bytes.Count(got, []byte("/Type /Page /Parent")); pages != tt.pages {
+				t.Errorf("got %d pages, want %d", pages, tt.pages)
+			}
+			golden := filepath.Join("testdata", tt.name+".pdf")
+			if *update {
+				err := os.WriteFile(golden, got, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("the bill does not match %s, run with -update if the change is intended", golden)
+			}
+		})
+	}
+}
+
+func TestShowBillPDFAccess(t *testing.T) {
+	owner := &data.User{ID: 7, Name: "Ana Perez", Email: "ana@example.com", Activated: true}
+	other := &data.User{ID: 8, Name: "Ben Ortiz", Email: "ben@example.com", Activated: true}
+	tests := []struct {
+		name          string
+		user          *data.User
+		permissions   []string
+		authenticated bool
+		path          string
+		accept        string
+		status        int
+	}{
+		{name: "anonymous", user: owner, path: "/v1/waterbill/1/pdf", status: http.StatusUnauthorized},
+		{name: "anonymous by Accept", user: owner, path: "/v1/waterbill/1", accept: "application/pdf", status: http.StatusUnauthorized},
+		{name: "someone else", user: other, authenticated: true, path: "/v1/waterbill/1/pdf", status: http.StatusForbidden},
+		{name: "someone else by Accept", user: other, authenticated: true, path: "/v1/waterbill/1", accept: "application/pdf", status: http.StatusForbidden},
+		{name: "owner", user: owner, authenticated: true, path: "/v1/waterbill/1/pdf", status: http.StatusOK},
+		{name: "admin", user: other, permissions: []string{data.PermissionAdmin}, authenticated: true, path: "/v1/waterbill/1/pdf", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t, signedIn(tt.user, tt.permissions, func(query string, args []driver.Value) stubResult {
+				switch {
+				case strings.Contains(query, "FROM water_system"):
+					return stubResult{rows: [][]driver.Value{billRow(&data.Todo_list{ID: 1, State: data.BillIssued, UserID: owner.ID, Amount: 4250, Version: 1})}}
+				case strings.Contains(query, "FROM users"):
+					return stubResult{rows: [][]driver.Value{{owner.ID, time.Now(), owner.Name, owner.Email, []byte("hash"), true, int64(1)}}}
+				case strings.Contains(query, "FROM adjustments"):
+					return stubResult{}
+				}
+				t.Errorf("unexpected statement: %s", query)
+				return stubResult{}
+			}))
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			rr := serve(t, app, r, tt.authenticated)
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if rr.Code == http.StatusOK && rr.Header().Get("Content-Type") != "application/pdf" {
+				t.Errorf("got Content-Type %q, want application/pdf", rr.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
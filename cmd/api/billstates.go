@@ -0,0 +1,92 @@
+// Filename: cmd/api/billstates.go
+
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+// The transitionBillHandler() moves a bill through its lifecycle for the
+// POST /v1/waterbill/:id/transitions endpoint
+func (app *application) transitionBillHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	var input struct {
+		To string `json:"to"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateManualTransition(v, "to", input.To); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	bill, err := app.models.Todo_list.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	state := bill.State
+	err = app.models.Todo_list.Transition(bill, input.To, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrIllegalTransition):
+			app.illegalTransitionResponse(w, r, state, input.To)
+		case errors.Is(err, data.ErrBillHasPayments):
+			app.billHasPaymentsResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"waterbill": bill}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listBillTransitionsHandler() shows the state history of a bill
+func (app *application) listBillTransitionsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	_, err = app.models.Todo_list.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	transitions, err := app.models.Todo_list.Transitions(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"transitions": transitions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
@@ -0,0 +1,150 @@
+// Filename: cmd/api/billstates_test.go
+
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/data"
+)
+
+func TestTransitionBill(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions []string
+		body        string
+		status      int
+	}{
+		{name: "customer", body: `{"to":"void"}`, status: http.StatusForbidden},
+		{name: "paid by hand", permissions: []string{data.PermissionAdmin}, body: `{"to":"paid"}`, status: http.StatusUnprocessableEntity},
+		{name: "overdue by hand", permissions: []string{data.PermissionAdmin}, body: `{"to":"overdue"}`, status: http.StatusUnprocessableEntity},
+		{name: "void with payments", permissions: []string{data.PermissionAdmin}, body: `{"to":"void"}`, status: http.StatusConflict},
+	}
+	user := &data.User{ID: 3, Name: "Clerk", Email: "clerk@example.com", Activated: true}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t, signedIn(user, tt.permissions, func(query string, args []driver.Value) stubResult {
+				if strings.Contains(query, "FROM water_system") {
+					return stubResult{rows: [][]driver.Value{billRow(&data.Todo_list{ID: 1, State: data.BillIssued, Amount: 10000, AmountPaid: 2500, Version: 2})}}
+				}
+				t.Errorf("unexpected statement: %s", query)
+				return stubResult{}
+			}))
+			r := httptest.NewRequest(http.MethodPost, "/v1/waterbill/1/transitions", strings.NewReader(tt.body))
+			rr := serve(t, app, r, true)
+			if rr.Code != tt.status {
+				t.Errorf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+		})
+	}
+}
+
+// The webhook is queued by the same transaction as the transition, so a failure to
+// queue it fails the transition
+func TestTransitionBillWebhook(t *testing.T) {
+	tests := []struct {
+		name   string
+		queue  error
+		status int
+	}{
+		{name: "queued", status: http.StatusOK},
+		{name: "queue fails", queue: errors.New("webhook_deliveries is unavailable"), status: http.StatusInternalServerError},
+	}
+	user := &data.User{ID: 3, Name: "Clerk", Email: "clerk@example.com", Activated: true}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var queued bool
+			app := newTestApplication(t, signedIn(user, []string{data.PermissionAdmin}, func(query string, args []driver.Value) stubResult {
+				switch {
+				case strings.Contains(query, "INSERT INTO water_system_history"), strings.Contains(query, "INSERT INTO bill_transitions"):
+					return stubResult{affected: 1}
+				case strings.Contains(query, "UPDATE water_system"):
+					return stubResult{rows: [][]driver.Value{{time.Now(), int64(3)}}}
+				case strings.Contains(query, "INNER JOIN users"):
+					// The bill has no account, so there is nothing to deliver
+					return stubResult{}
+				case strings.Contains(query, "FROM water_system"):
+					return stubResult{rows: [][]driver.Value{billRow(&data.Todo_list{ID: 1, State: data.BillDraft, Amount: 10000, Version: 2})}}
+				case strings.Contains(query, "INSERT INTO webhook_deliveries"):
+					queued = true
+					if args[0] != data.WebhookBillUpdated || !strings.Contains(string(args[1].([]byte)), `"state":"issued"`) {
+						t.Errorf("queued %v with %s", args[0], args[1])
+					}
+					return stubResult{affected: 1, err: tt.queue}
+				}
+				t.Errorf("unexpected statement: %s", query)
+				return stubResult{}
+			}))
+			r := httptest.NewRequest(http.MethodPost, "/v1/waterbill/1/transitions", strings.NewReader(`{"to":"issued"}`))
+			rr := serve(t, app, r, true)
+			if rr.Code != tt.status {
+				t.Errorf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if !queued {
+				t.Error("the webhook was not queued")
+			}
+		})
+	}
+}
+
+// Bills that go overdue are recorded in their history and announced like any other
+// change of state
+func TestMarkOverdueBillsJob(t *testing.T) {
+	var recorded bool
+	var webhooks []string
+	app := newTestApplication(t, func(query string, args []driver.Value) stubResult {
+		switch {
+		case strings.Contains(query, "INSERT INTO water_system_history"):
+			recorded = true
+			return stubResult{affected: 2}
+		case strings.Contains(query, "WITH overdue AS"):
+			return stubResult{rows: [][]driver.Value{
+				billRow(&data.Todo_list{ID: 1, State: data.BillOverdue, Amount: 10000, Version: 3}),
+				billRow(&data.Todo_list{ID: 2, State: data.BillOverdue, Amount: 2000, AmountPaid: 500, Version: 5}),
+			}}
+		case strings.Contains(query, "INSERT INTO webhook_deliveries"):
+			webhooks = append(webhooks, string(args[1].([]byte)))
+			return stubResult{affected: 1}
+		}
+		t.Errorf("unexpected statement: %s", query)
+		return stubResult{}
+	})
+	err := app.markOverdueBillsJob(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !recorded {
+		t.Error("the change was not recorded in the history")
+	}
+	if len(webhooks) != 2 {
+		t.Fatalf("queued %d webhooks, want 2", len(webhooks))
+	}
+	for i, payload := range webhooks {
+		if !strings.Contains(payload, `"state":"overdue"`) || !strings.Contains(payload, fmt.Sprintf(`"id":%d`, i+1)) {
+			t.Errorf("queued %s", payload)
+		}
+	}
+}
+
+// Stopping the scheduler cancels the context of the job, and the job gives up on the
+// database without writing anything
+func TestMarkOverdueBillsJobCancelled(t *testing.T) {
+	app := newTestApplication(t, func(query string, args []driver.Value) stubResult {
+		t.Errorf("unexpected statement: %s", query)
+		return stubResult{}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := app.markOverdueBillsJob(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got the error %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,124 @@
+// Filename: cmd/api/billviews.go
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+// readBillView() reads ?fields= and ?include= from the query string. Names are
+// trimmed and repeats dropped
+func (app *application) readBillView(qs url.Values, v *validator.Validator) ([]string, []string) {
+	fields := uniqueNames(app.readCSV(qs, "fields", nil))
+	include := uniqueNames(app.readCSV(qs, "include", nil))
+	data.ValidateBillView(v, fields, include)
+	return fields, include
+}
+
+func uniqueNames(names []string) []string {
+	var unique []string
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name != "" && !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
+
+// billColumns() returns the fields to read for a view: the picked fields, the ones the
+// included relations are found and checked by and the version the ETag is made from.
+// It returns nil, every field, when none are picked
+func billColumns(fields, include []string) []string {
+	if len(fields) == 0 {
+		return nil
+	}
+	columns := append([]string{"id", "version"}, fields...)
+	if accountIncludes(include) {
+		columns = append(columns, "user_id")
+	}
+	return columns
+}
+
+// accountIncludes() reports whether a view includes relations that belong to the account
+// of the bill: the account holder and the adjustments made to it. Only the owner and
+// admins may see those
+func accountIncludes(include []string) bool {
+	return validator.In(data.IncludeUser, include...) || validator.In(data.IncludeAdjustments, include...)
+}
+
+// allowListIncludes() checks that the signed-in user may see the relations a listing
+// includes, writing the error response itself when they may not. A page holds the
+// bills of many accounts, so the relations of an account are left to admins
+func (app *application) allowListIncludes(w http.ResponseWriter, r *http.Request, include []string) bool {
+	if !accountIncludes(include) {
+		return true
+	}
+	scope, err := app.accountScope(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if app.contextGetUser(r).IsAnonymous() || scope != 0 {
+		app.notPermittedResponse(w, r)
+		return false
+	}
+	return true
+}
+
+// billViews() wraps bills for a response, loading the related resources of the whole
+// page with one query for each relation
+func (app *application) billViews(bills []*data.Todo_list, fields, include []string) ([]*data.BillView, error) {
+	views := make([]*data.BillView, len(bills))
+	ids := make([]int64, len(bills))
+	var userIDs []int64
+	for i, bill := range bills {
+		views[i] = &data.BillView{Bill: bill, Fields: fields, Include: include}
+		ids[i] = bill.ID
+		if bill.UserID > 0 {
+			userIDs = append(userIDs, bill.UserID)
+		}
+	}
+	for _, name := range include {
+		switch name {
+		case data.IncludeUser:
+			users, err := app.models.Users.Summaries(userIDs)
+			if err != nil {
+				return nil, err
+			}
+			for _, view := range views {
+				view.User = users[view.Bill.UserID]
+			}
+		case data.IncludeAdjustments:
+			adjustments, err := app.models.Adjustments.GetAllForBills(ids)
+			if err != nil {
+				return nil, err
+			}
+			for _, view := range views {
+				view.Adjustments = adjustments[view.Bill.ID]
+				if view.Adjustments == nil {
+					view.Adjustments = []*data.Adjustment{}
+				}
+			}
+		case data.IncludeTransitions:
+			transitions, err := app.models.Todo_list.TransitionsForBills(ids)
+			if err != nil {
+				return nil, err
+			}
+			for _, view := range views {
+				view.Transitions = transitions[view.Bill.ID]
+				if view.Transitions == nil {
+					view.Transitions = []*data.BillTransition{}
+				}
+			}
+		}
+	}
+	return views, nil
+}
@@ -0,0 +1,181 @@
+// Filename: cmd/api/billviews_test.go
+
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/data"
+)
+
+// Only the picked fields are read and shown, and included relations are loaded with
+// one query each. The account holder is only included for the owner and admins
+func TestShowBillView(t *testing.T) {
+	bill := &data.Todo_list{ID: 1, Waterbill: "March", State: data.BillIssued, UserID: 7, Amount: 4250, DueDate: time.Now(), Version: 2}
+	owner := &data.User{ID: 7, Name: "Ana Perez", Email: "ana@example.com", Activated: true}
+	stranger := &data.User{ID: 8, Name: "Luis Chan", Email: "luis@example.com", Activated: true}
+	tests := []struct {
+		name    string
+		user    *data.User
+		query   string
+		columns string
+		row     []driver.Value
+		keys    []string
+		errors  []string
+		status  int
+	}{
+		{
+			name:    "picked fields",
+			query:   "fields=amount,waterbill,amount",
+			columns: "id, waterbill, amount, version",
+			row:     []driver.Value{int64(1), "March", int64(4250), int64(2)},
+			keys:    []string{"amount", "waterbill"},
+		},
+		{
+			name:    "picked fields with the account",
+			user:    owner,
+			query:   "fields=waterbill&include=user",
+			columns: "id, waterbill, COALESCE(user_id, 0), version",
+			row:     []driver.Value{int64(1), "March", int64(7), int64(2)},
+			keys:    []string{"user", "waterbill"},
+		},
+		{
+			name:    "every field with the transitions",
+			query:   "include=transitions",
+			columns: "id, created_at, waterbill",
+			row:     billRow(bill),
+			keys:    []string{"amount", "amount_credited", "amount_paid", "category", "created_at", "description", "due_date", "id", "notes", "priority", "state", "status", "transitions", "user_id", "version", "waterbill"},
+		},
+		{
+			name:    "the account to someone else",
+			user:    stranger,
+			query:   "fields=waterbill&include=user",
+			columns: "id, waterbill, COALESCE(user_id, 0), version",
+			row:     []driver.Value{int64(1), "March", int64(7), int64(2)},
+			status:  http.StatusForbidden,
+		},
+		{
+			name:    "the adjustments to an anonymous client",
+			query:   "fields=waterbill&include=adjustments",
+			columns: "id, waterbill, COALESCE(user_id, 0), version",
+			row:     []driver.Value{int64(1), "March", int64(7), int64(2)},
+			status:  http.StatusForbidden,
+		},
+		{name: "unknown field", query: "fields=waterbill,password", errors: []string{"fields"}},
+		{name: "unknown relation", query: "include=payments", errors: []string{"include"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := func(query string, args []driver.Value) stubResult {
+				switch {
+				case strings.Contains(query, "FROM water_system"):
+					if !strings.Contains(query, "SELECT "+tt.columns) {
+						t.Errorf("got %s, want the columns %s", query, tt.columns)
+					}
+					return stubResult{rows: [][]driver.Value{tt.row}}
+				case strings.Contains(query, "FROM users"):
+					return stubResult{rows: [][]driver.Value{{int64(7), "Ana Perez"}}}
+				case strings.Contains(query, "FROM bill_transitions"):
+					return stubResult{rows: [][]driver.Value{{int64(1), time.Now(), int64(1), data.BillDraft, data.BillIssued, int64(3)}}}
+				}
+				t.Errorf("unexpected statement: %s", query)
+				return stubResult{}
+			}
+			if tt.user != nil {
+				handler = signedIn(tt.user, nil, handler)
+			}
+			app := newTestApplication(t, handler)
+			rr := serve(t, app, httptest.NewRequest(http.MethodGet, "/v1/waterbill/1?"+tt.query, nil), tt.user != nil)
+			if tt.status != 0 {
+				if rr.Code != tt.status {
+					t.Errorf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+				}
+				return
+			}
+			var body struct {
+				Waterbill map[string]json.RawMessage `json:"waterbill"`
+				Error     map[string]string          `json:"error"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if tt.errors != nil {
+				if rr.Code != http.StatusUnprocessableEntity {
+					t.Fatalf("got status %d, want 422: %s", rr.Code, rr.Body)
+				}
+				for _, key := range tt.errors {
+					if body.Error[key] == "" {
+						t.Errorf("no error on %s, got %v", key, body.Error)
+					}
+				}
+				return
+			}
+			if rr.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+			}
+			var keys []string
+			for key := range body.Waterbill {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			if !reflect.DeepEqual(keys, tt.keys) {
+				t.Errorf("got the fields %v, want %v", keys, tt.keys)
+			}
+			if user, ok := body.Waterbill["user"]; ok && string(user) != `{"id":7,"name":"Ana Perez"}` {
+				t.Errorf("got the account %s", user)
+			}
+			if transitions, ok := body.Waterbill["transitions"]; ok && !strings.Contains(string(transitions), `"to_state":"issued"`) {
+				t.Errorf("got the transitions %s", transitions)
+			}
+		})
+	}
+}
+
+// A page holds the bills of many accounts, so only admins get the account holders and
+// adjustments included in a listing
+func TestListBillViewIncludes(t *testing.T) {
+	customer := &data.User{ID: 7, Name: "Ana Perez", Email: "ana@example.com", Activated: true}
+	tests := []struct {
+		name          string
+		authenticated bool
+		permissions   []string
+		query         string
+		status        int
+	}{
+		{name: "transitions to an anonymous client", query: "include=transitions", status: http.StatusOK},
+		{name: "the accounts to an anonymous client", query: "include=user", status: http.StatusForbidden},
+		{name: "the adjustments to a customer", authenticated: true, query: "include=adjustments", status: http.StatusForbidden},
+		{name: "the accounts to an admin", authenticated: true, permissions: []string{data.PermissionAdmin}, query: "include=user,adjustments", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var listed bool
+			app := newTestApplication(t, signedIn(customer, tt.permissions, func(query string, args []driver.Value) stubResult {
+				switch {
+				case strings.Contains(query, "FROM water_system"):
+					listed = true
+					return stubResult{}
+				case strings.Contains(query, "FROM users"), strings.Contains(query, "FROM adjustments"), strings.Contains(query, "FROM bill_transitions"):
+					return stubResult{}
+				}
+				t.Errorf("unexpected statement: %s", query)
+				return stubResult{}
+			}))
+			rr := serve(t, app, httptest.NewRequest(http.MethodGet, "/v1/waterbill?"+tt.query, nil), tt.authenticated)
+			if rr.Code != tt.status {
+				t.Errorf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if listed != (tt.status == http.StatusOK) {
+				t.Errorf("listed is %t with status %d", listed, rr.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+// Filename: cmd/api/context.go
+
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"water.biling.system.driane.perez.net/internal/data"
+)
+
+// Define a custom type for the request context keys
+type contextKey string
+
+// The key under which the authenticated user is stored
+const userContextKey = contextKey("user")
+
+// contextSetUser() returns a copy of the request with the user added to its context
+func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	ctx := context.WithValue(r.Context(), userContextKey, user)
+	return r.WithContext(ctx)
+}
+
+// contextGetUser() retrieves the user from the request context. The authenticate
+// middleware always sets one, so a missing user is a programming error
+func (app *application) contextGetUser(r *http.Request) *data.User {
+	user, ok := r.Context().Value(userContextKey).(*data.User)
+	if !ok {
+		panic("missing user value in request context")
+	}
+	return user
+}
@@ -0,0 +1,234 @@
+// Filename: cmd/api/disconnections.go
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+// The runDisconnectionsHandler() flags every account that has been in arrears for too
+// long, opens a disconnection case for it and queues a notice to the customer
+func (app *application) runDisconnectionsHandler(w http.ResponseWriter, r *http.Request) {
+	// Both values are optional and fall back to the configured ones
+	var input struct {
+		Threshold *int64 `json:"threshold"`
+		Days      *int   `json:"days"`
+	}
+	if r.ContentLength != 0 {
+		err := app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+	}
+	threshold := app.config.disconnection.threshold
+	if input.Threshold != nil {
+		threshold = *input.Threshold
+	}
+	days := app.config.disconnection.days
+	if input.Days != nil {
+		days = *input.Days
+	}
+	v := validator.New()
+	v.Check(threshold >= 0, "threshold", "must not be negative")
+	v.Check(days >= 0, "days", "must not be negative")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Find the accounts that qualify
+	accounts, err := app.models.Disconnections.OverdueAccounts(threshold, days)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	disconnections := []*data.Disconnection{}
+	for _, account := range accounts {
+		now := time.Now()
+		disconnection := &data.Disconnection{
+			UserID:       account.UserID,
+			State:        data.DisconnectionNoticeSent,
+			Arrears:      account.Arrears,
+			NoticeSentAt: &now,
+		}
+		notice := &data.EmailMessage{
+			Template: "disconnection_notice.tmpl",
+			Data: map[string]interface{}{
+				"name":         account.Name,
+				"arrears":      data.FormatAmount(account.Arrears),
+				"oldestDue":    account.OldestDue.Format("January 2, 2006"),
+				"reconnectFee": data.FormatAmount(app.config.disconnection.fee),
+			},
+		}
+		err = app.models.Disconnections.Insert(disconnection, notice)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		disconnections = append(disconnections, disconnection)
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"disconnections": disconnections}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listDisconnectionsHandler() shows the disconnection cases
+func (app *application) listDisconnectionsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		State string
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	input.State = app.readString(qs, "state", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortList = []string{"id", "created_at", "arrears", "-id", "-created_at", "-arrears"}
+	if input.State != "" {
+		data.ValidateDisconnectionState(v, input.State)
+	}
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	disconnections, metadata, err := app.models.Disconnections.GetAll(input.State, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"disconnections": disconnections, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showDisconnectionHandler() shows a specific disconnection case
+func (app *application) showDisconnectionHandler(w http.ResponseWriter, r *http.Request) {
+	disconnection, ok := app.fetchDisconnection(w, r)
+	if !ok {
+		return
+	}
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"disconnection": disconnection}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The scheduleDisconnectionHandler() sets the date the service will be cut off
+func (app *application) scheduleDisconnectionHandler(w http.ResponseWriter, r *http.Request) {
+	disconnection, ok := app.fetchDisconnection(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		ScheduledFor string `json:"scheduled_for"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	scheduledFor := app.parseDate(v, "scheduled_for", input.ScheduledFor)
+	v.Check(!scheduledFor.Before(time.Now().Truncate(24*time.Hour)), "scheduled_for", "must not be in the past")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	disconnection.ScheduledFor = &scheduledFor
+	app.transitionDisconnection(w, r, disconnection, data.DisconnectionScheduled)
+}
+
+// The disconnectHandler() records that the service has been cut off
+func (app *application) disconnectHandler(w http.ResponseWriter, r *http.Request) {
+	disconnection, ok := app.fetchDisconnection(w, r)
+	if !ok {
+		return
+	}
+	app.transitionDisconnection(w, r, disconnection, data.DisconnectionDisconnected)
+}
+
+// The cancelDisconnectionHandler() closes a case before the service is cut off
+func (app *application) cancelDisconnectionHandler(w http.ResponseWriter, r *http.Request) {
+	disconnection, ok := app.fetchDisconnection(w, r)
+	if !ok {
+		return
+	}
+	app.transitionDisconnection(w, r, disconnection, data.DisconnectionCancelled)
+}
+
+// The reconnectHandler() restores the service and posts the reconnection fee
+func (app *application) reconnectHandler(w http.ResponseWriter, r *http.Request) {
+	disconnection, ok := app.fetchDisconnection(w, r)
+	if !ok {
+		return
+	}
+	state := disconnection.State
+	err := app.models.Disconnections.Reconnect(disconnection, app.config.disconnection.fee, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrIllegalTransition):
+			app.illegalTransitionResponse(w, r, state, data.DisconnectionReconnected)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"disconnection": disconnection}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// fetchDisconnection() reads the id from the URL and loads the case, writing the
+// error response itself when that fails
+func (app *application) fetchDisconnection(w http.ResponseWriter, r *http.Request) (*data.Disconnection, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	disconnection, err := app.models.Disconnections.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return disconnection, true
+}
+
+// transitionDisconnection() moves the case on and writes the response
+func (app *application) transitionDisconnection(w http.ResponseWriter, r *http.Request, disconnection *data.Disconnection, to string) {
+	state := disconnection.State
+	err := app.models.Disconnections.Transition(disconnection, to)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrIllegalTransition):
+			app.illegalTransitionResponse(w, r, state, to)
+		case errors.Is(err, data.ErrAccountOnHold):
+			app.accountOnHoldResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"disconnection": disconnection}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
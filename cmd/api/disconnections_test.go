@@ -0,0 +1,127 @@
+// Filename: cmd/api/disconnections_test.go
+
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/data"
+)
+
+// disconnectionRow() lays out a case the way DisconnectionModel.Get() scans it
+func disconnectionRow(id, userID int64, state string) []driver.Value {
+	return []driver.Value{id, time.Now(), userID, state, int64(15000), nil, nil, nil, nil, nil, int64(1)}
+}
+
+// The hold is checked in the transaction that moves the case on, with the account
+// locked so that no dispute or payment plan can be opened in between
+func TestTransitionDisconnectionOnHold(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		state  string
+		held   bool
+		status int
+	}{
+		{name: "disconnect on hold", path: "/v1/disconnections/5/disconnect", state: data.DisconnectionScheduled, held: true, status: http.StatusConflict},
+		{name: "disconnect", path: "/v1/disconnections/5/disconnect", state: data.DisconnectionScheduled, status: http.StatusOK},
+		{name: "cancel on hold", path: "/v1/disconnections/5/cancel", state: data.DisconnectionScheduled, held: true, status: http.StatusOK},
+	}
+	admin := &data.User{ID: 1, Name: "Admin", Email: "admin@example.com", Activated: true}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var checked, updated bool
+			app := newTestApplication(t, signedIn(admin, []string{data.PermissionAdmin}, func(query string, args []driver.Value) stubResult {
+				switch {
+				case strings.Contains(query, "FROM disconnections"):
+					return stubResult{rows: [][]driver.Value{disconnectionRow(5, 7, tt.state)}}
+				case strings.Contains(query, "FROM users"):
+					checked = true
+					if !strings.Contains(query, "FOR UPDATE") || args[0] != int64(7) {
+						t.Errorf("the account was not locked: %s %v", query, args)
+					}
+					return stubResult{rows: [][]driver.Value{{tt.held}}}
+				case strings.Contains(query, "UPDATE disconnections"):
+					updated = true
+					return stubResult{rows: [][]driver.Value{{int64(2)}}}
+				}
+				t.Errorf("unexpected statement: %s", query)
+				return stubResult{}
+			}))
+			rr := serve(t, app, httptest.NewRequest(http.MethodPost, tt.path, nil), true)
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if want := strings.HasSuffix(tt.path, "/disconnect"); checked != want {
+				t.Errorf("got hold checked %t, want %t", checked, want)
+			}
+			if want := tt.status == http.StatusOK; updated != want {
+				t.Errorf("got case updated %t, want %t", updated, want)
+			}
+		})
+	}
+}
+
+// The fee bill is created and issued the way any other bill is, in the transaction
+// that reconnects the service
+func TestReconnect(t *testing.T) {
+	admin := &data.User{ID: 1, Name: "Admin", Email: "admin@example.com", Activated: true}
+	var statements []string
+	app := newTestApplication(t, signedIn(admin, []string{data.PermissionAdmin}, func(query string, args []driver.Value) stubResult {
+		switch {
+		case strings.Contains(query, "FROM disconnections"):
+			return stubResult{rows: [][]driver.Value{disconnectionRow(5, 7, data.DisconnectionDisconnected)}}
+		case strings.Contains(query, "INSERT INTO water_system ("):
+			statements = append(statements, "insert bill")
+			if args[5] != int64(7) || args[6] != int64(2500) {
+				t.Errorf("the fee bill is for user %v and amount %v", args[5], args[6])
+			}
+			return stubResult{rows: [][]driver.Value{{int64(30), time.Now(), data.BillDraft, time.Now().AddDate(0, 0, 14), int64(1)}}}
+		case strings.Contains(query, "INSERT INTO water_system_history"):
+			statements = append(statements, "history")
+			return stubResult{affected: 1}
+		case strings.Contains(query, "INSERT INTO webhook_deliveries"):
+			statements = append(statements, "webhook "+args[0].(string))
+			return stubResult{affected: 1}
+		case strings.Contains(query, "UPDATE water_system"):
+			statements = append(statements, "issue bill")
+			return stubResult{rows: [][]driver.Value{{time.Now(), int64(2)}}}
+		case strings.Contains(query, "INSERT INTO bill_transitions"):
+			statements = append(statements, "transition "+args[1].(string)+" to "+args[2].(string))
+			if args[3] != int64(1) {
+				t.Errorf("the transition was recorded for actor %v", args[3])
+			}
+			return stubResult{affected: 1}
+		case strings.Contains(query, "INNER JOIN users"):
+			statements = append(statements, "delivery")
+			return stubResult{}
+		case strings.Contains(query, "UPDATE disconnections"):
+			statements = append(statements, "reconnect")
+			if args[4] != int64(30) {
+				t.Errorf("got fee bill %v, want 30", args[4])
+			}
+			return stubResult{rows: [][]driver.Value{{int64(2)}}}
+		}
+		t.Errorf("unexpected statement: %s", query)
+		return stubResult{}
+	}))
+	app.config.disconnection.fee = 2500
+
+	rr := serve(t, app, httptest.NewRequest(http.MethodPost, "/v1/disconnections/5/reconnect", nil), true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", rr.Code, rr.Body)
+	}
+	want := []string{
+		"insert bill", "history", "webhook " + data.WebhookBillCreated,
+		"history", "issue bill", "transition draft to issued", "delivery", "webhook " + data.WebhookBillUpdated,
+		"reconnect",
+	}
+	if strings.Join(statements, ", ") != strings.Join(want, ", ") {
+		t.Errorf("got statements\n%s\nwant\n%s", strings.Join(statements, ", "), strings.Join(want, ", "))
+	}
+}
@@ -0,0 +1,132 @@
+// Filename: cmd/api/disputes.go
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+// The createDisputeHandler() opens a dispute, which puts the account on hold
+func (app *application) createDisputeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		UserID int64  `json:"user_id"`
+		BillID *int64 `json:"bill_id"`
+		Reason string `json:"reason"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	// Customers open disputes on their own account, so the user defaults to them
+	if input.UserID == 0 {
+		input.UserID = app.contextGetUser(r).ID
+	}
+	dispute := &data.Dispute{
+		UserID: input.UserID,
+		BillID: input.BillID,
+		Reason: input.Reason,
+	}
+	v := validator.New()
+	if data.ValidateDispute(v, dispute); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	if !app.allowAccount(w, r, dispute.UserID) {
+		return
+	}
+	// A disputed bill has to be one of the account's bills
+	if dispute.BillID != nil {
+		bill, err := app.models.Todo_list.Get(*dispute.BillID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddError("bill_id", "must be an existing bill")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		if bill.UserID != dispute.UserID {
+			v.AddError("bill_id", "must be a bill of the account")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+	err = app.models.Disputes.Insert(dispute)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/disputes/%d", dispute.ID))
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"dispute": dispute}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showDisputeHandler() shows a specific dispute
+func (app *application) showDisputeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	dispute, err := app.models.Disputes.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if !app.allowAccount(w, r, dispute.UserID) {
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"dispute": dispute}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The resolveDisputeHandler() closes a dispute and lifts the hold on the account
+func (app *application) resolveDisputeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	dispute, err := app.models.Disputes.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.models.Disputes.Resolve(dispute)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"dispute": dispute}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strings"
 )
 func (app *application) logError(r *http.Request, err error){
 	app.logger.PrintError(err, map[string]string{
@@ -10,11 +11,16 @@ func (app *application) logError(r *http.Request, err error){
 		"request_url":    r.URL.String(),
 	})
 }
-//we want to send json-formatted error message
+//we want to send json-formatted error message, or XML or CSV when the client asks
+//for them. Errors fall back to JSON rather than being refused
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
 	//create json response
 	env := envelope{"error":message}
-	err := app.writeJSON(w, status, env, nil)
+	mediaType := negotiate(r.Header.Get("Accept"), responseTypes...)
+	if mediaType == "" {
+		mediaType = mediaTypeJSON
+	}
+	err := app.render(w, status, mediaType, env, nil)
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -57,4 +63,82 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded"
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
-}
\ No newline at end of file
+}
+// Illegal state transition errors
+func (app *application) illegalTransitionResponse(w http.ResponseWriter, r *http.Request, state, to string) {
+	message := fmt.Sprintf("cannot move from %q to %q", state, to)
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+// The account has an open dispute or payment plan
+func (app *application) accountOnHoldResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the account has an open dispute or active payment plan and cannot be disconnected"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+// Wrong email or password
+func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid authentication credentials"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+// The bearer token was missing, malformed or expired
+func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	message := "invalid or missing authentication token"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+// The endpoint needs an authenticated user
+func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you must be authenticated to access this resource"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+// The endpoint needs an activated user
+func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account must be activated to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+// The bill has been paid on, so voiding it would lose track of the money
+func (app *application) billHasPaymentsResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a bill that has been paid on cannot be voided, post an adjustment to credit it instead"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+// The bill is no longer a draft and can no longer be edited
+func (app *application) billIssuedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "only draft bills can be changed, post an adjustment against an issued bill instead"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+// Some rows of an import failed validation, so none were imported
+func (app *application) importFailedResponse(w http.ResponseWriter, r *http.Request, report interface{}) {
+	message := envelope{
+		"message": "some rows failed validation, nothing was imported",
+		"rows":    report,
+	}
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, message)
+}
+// An operation of an all_or_nothing batch failed, so none of the batch was saved. The
+// status is the one the failed operation got
+func (app *application) batchFailedResponse(w http.ResponseWriter, r *http.Request, status int, results interface{}) {
+	message := envelope{
+		"message": "an operation failed, nothing in the batch was saved",
+		"results": results,
+	}
+	app.errorResponse(w, r, status, message)
+}
+// The Accept header rules out every format the API can respond in
+func (app *application) notAcceptableResponse(w http.ResponseWriter, r *http.Request, types []string) {
+	message := fmt.Sprintf("the requested representation is not available, use %s", strings.Join(types, ", "))
+	app.errorResponse(w, r, http.StatusNotAcceptable, message)
+}
+// The user does not hold the permission the endpoint needs
+func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account doesn't have the necessary permissions to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+// The If-Match header does not name the current version of the resource
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the resource has changed since it was read, fetch it again for the current ETag"
+	app.errorResponse(w, r, http.StatusPreconditionFailed, message)
+}
+// Changes must name the version they were made against with If-Match
+func (app *application) preconditionRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this request must be conditional, send the ETag of the resource in an If-Match header"
+	app.errorResponse(w, r, http.StatusPreconditionRequired, message)
+}
@@ -0,0 +1,100 @@
+// Filename: cmd/api/etags.go
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+
+	"water.biling.system.driane.perez.net/internal/data"
+)
+
+// billETag() returns the entity tag of one representation of a bill. It is made from
+// the id, the version and a hash of the representation, so it changes whenever the
+// bill does and differs between the formats and fieldsets the bill can be shown in.
+// Caches keep a JSON copy and a CSV copy of the same version apart that way
+func billETag(bill *data.Todo_list, representation string) string {
+	h := fnv.New32a()
+	h.Write([]byte(representation))
+	return fmt.Sprintf(`"%d-%d-%08x"`, bill.ID, bill.Version, h.Sum32())
+}
+
+// billRepresentation() names the representation of a bill a request gets: the media
+// type and the fields and relations it asked for
+func billRepresentation(mediaType string, fields, include []string) string {
+	return mediaType + ";fields=" + strings.Join(fields, ",") + ";include=" + strings.Join(include, ",")
+}
+
+// responseETag() returns the entity tag of the full bill in the format the request
+// gets its responses in
+func responseETag(r *http.Request, bill *data.Todo_list) string {
+	return billETag(bill, billRepresentation(negotiate(r.Header.Get("Accept"), responseTypes...), nil, nil))
+}
+
+// etagMatches() reports whether a list of entity tags from an If-None-Match header
+// names the given tag. It compares weakly, ignoring a W/ prefix
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		tag = strings.TrimPrefix(tag, "W/")
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified() answers a GET with 304 Not Modified when the If-None-Match header
+// names the representation of the current version of the bill the request would get.
+// It sets the ETag either way
+func notModified(w http.ResponseWriter, r *http.Request, bill *data.Todo_list, representation string) bool {
+	etag := billETag(bill, representation)
+	w.Header().Set("ETag", etag)
+	varyAccept(w.Header())
+	header := r.Header.Get("If-None-Match")
+	if header == "" || !etagMatches(header, etag) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// currentVersion() reports whether an If-Match header names a representation of the
+// current version of the bill. A change is made to the bill rather than to one of its
+// representations, so a tag read with any format or fieldset will do. Weak tags never
+// match
+func currentVersion(header string, bill *data.Todo_list) bool {
+	prefix := fmt.Sprintf(`"%d-%d-`, bill.ID, bill.Version)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || (strings.HasPrefix(tag, prefix) && strings.HasSuffix(tag, `"`)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch() makes sure a change is made against the version of the bill the
+// client last read. It writes 412 Precondition Failed when If-Match names another
+// version and, in strict mode, 428 Precondition Required when there is no If-Match.
+// It returns whether the request was conditional and whether it may go ahead
+func (app *application) checkIfMatch(w http.ResponseWriter, r *http.Request, bill *data.Todo_list) (bool, bool) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		if app.config.etags.strict {
+			app.preconditionRequiredResponse(w, r)
+			return false, false
+		}
+		return false, true
+	}
+	if !currentVersion(header, bill) {
+		app.preconditionFailedResponse(w, r)
+		return true, false
+	}
+	return true, true
+}
@@ -0,0 +1,194 @@
+// Filename: cmd/api/etags_test.go
+
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/data"
+)
+
+// Each representation of a version has its own tag, the same representation always
+// gets the same one
+func TestBillETag(t *testing.T) {
+	bill := &data.Todo_list{ID: 1, Version: 2}
+	json := billETag(bill, billRepresentation(mediaTypeJSON, nil, nil))
+	tests := []struct {
+		name           string
+		bill           *data.Todo_list
+		representation string
+		same           bool
+	}{
+		{"same representation", bill, billRepresentation(mediaTypeJSON, nil, nil), true},
+		{"another format", bill, billRepresentation(mediaTypeCSV, nil, nil), false},
+		{"the PDF", bill, billRepresentation(mediaTypePDF, nil, nil), false},
+		{"some fields", bill, billRepresentation(mediaTypeJSON, []string{"id", "amount"}, nil), false},
+		{"other fields", bill, billRepresentation(mediaTypeJSON, []string{"id"}, []string{"amount"}), false},
+		{"with relations", bill, billRepresentation(mediaTypeJSON, nil, []string{"payments"}), false},
+		{"another version", &data.Todo_list{ID: 1, Version: 3}, billRepresentation(mediaTypeJSON, nil, nil), false},
+	}
+	for _, tt := range tests {
+		got := billETag(tt.bill, tt.representation)
+		if (got == json) != tt.same {
+			t.Errorf("%s: got %s against %s", tt.name, got, json)
+		}
+		if !strings.HasPrefix(got, `"`) || !strings.HasSuffix(got, `"`) {
+			t.Errorf("%s: %s is not a strong tag", tt.name, got)
+		}
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	tests := []struct {
+		header string
+		match  bool
+	}{
+		{`"1-2-aa"`, true},
+		{`W/"1-2-aa"`, true},
+		{`"1-1-aa", "1-2-aa"`, true},
+		{`*`, true},
+		{`"1-2-bb"`, false},
+		{`"1-2"`, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, `"1-2-aa"`); got != tt.match {
+			t.Errorf("etagMatches(%s) = %t, want %t", tt.header, got, tt.match)
+		}
+	}
+}
+
+// If-Match takes a tag of any representation of the current version
+func TestCurrentVersion(t *testing.T) {
+	bill := &data.Todo_list{ID: 1, Version: 2}
+	tests := []struct {
+		header string
+		match  bool
+	}{
+		{billETag(bill, billRepresentation(mediaTypeJSON, nil, nil)), true},
+		{billETag(bill, billRepresentation(mediaTypeCSV, []string{"id"}, nil)), true},
+		{`"0-0-aa", ` + billETag(bill, ""), true},
+		{`*`, true},
+		{`W/` + billETag(bill, ""), false},
+		{billETag(&data.Todo_list{ID: 1, Version: 1}, ""), false},
+		{billETag(&data.Todo_list{ID: 12, Version: 2}, ""), false},
+		{`"1-2"`, false},
+		{`"1-2-`, false},
+	}
+	for _, tt := range tests {
+		if got := currentVersion(tt.header, bill); got != tt.match {
+			t.Errorf("currentVersion(%s) = %t, want %t", tt.header, got, tt.match)
+		}
+	}
+}
+
+// Conditional GETs only get 304 for the representation the client has, and every
+// answer tells caches it varies by Accept
+func TestShowBillConditional(t *testing.T) {
+	owner := &data.User{ID: 7, Name: "Ana Perez", Email: "ana@example.com", Activated: true}
+	bill := &data.Todo_list{ID: 1, State: data.BillIssued, UserID: owner.ID, Amount: 4250, DueDate: time.Now(), Version: 3}
+	jsonTag := billETag(bill, billRepresentation(mediaTypeJSON, nil, nil))
+	csvTag := billETag(bill, billRepresentation(mediaTypeCSV, nil, nil))
+	pdfTag := billETag(bill, billRepresentation(mediaTypePDF, nil, nil))
+	tests := []struct {
+		name        string
+		path        string
+		accept      string
+		ifNoneMatch string
+		status      int
+		etag        string
+	}{
+		{name: "JSON", path: "/v1/waterbill/1", status: http.StatusOK, etag: jsonTag},
+		{name: "JSON cached", path: "/v1/waterbill/1", ifNoneMatch: jsonTag, status: http.StatusNotModified, etag: jsonTag},
+		{name: "JSON cached weakly", path: "/v1/waterbill/1", ifNoneMatch: "W/" + jsonTag, status: http.StatusNotModified, etag: jsonTag},
+		{name: "CSV with a JSON copy", path: "/v1/waterbill/1", accept: "text/csv", ifNoneMatch: jsonTag, status: http.StatusOK, etag: csvTag},
+		{name: "an older version", path: "/v1/waterbill/1", ifNoneMatch: billETag(&data.Todo_list{ID: 1, Version: 2}, billRepresentation(mediaTypeJSON, nil, nil)), status: http.StatusOK, etag: jsonTag},
+		{name: "PDF", path: "/v1/waterbill/1/pdf", status: http.StatusOK, etag: pdfTag},
+		{name: "PDF cached", path: "/v1/waterbill/1/pdf", ifNoneMatch: pdfTag, status: http.StatusNotModified, etag: pdfTag},
+		{name: "PDF by Accept cached", path: "/v1/waterbill/1", accept: "application/pdf", ifNoneMatch: pdfTag, status: http.StatusNotModified, etag: pdfTag},
+		{name: "PDF with a JSON copy", path: "/v1/waterbill/1/pdf", ifNoneMatch: jsonTag, status: http.StatusOK, etag: pdfTag},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t, signedIn(owner, nil, func(query string, args []driver.Value) stubResult {
+				switch {
+				case strings.Contains(query, "FROM water_system"):
+					return stubResult{rows: [][]driver.Value{billRow(bill)}}
+				case strings.Contains(query, "FROM users"):
+					return stubResult{rows: [][]driver.Value{{owner.ID, time.Now(), owner.Name, owner.Email, []byte("hash"), true, int64(1)}}}
+				case strings.Contains(query, "FROM adjustments"):
+					return stubResult{}
+				}
+				t.Errorf("unexpected statement: %s", query)
+				return stubResult{}
+			}))
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			rr := serve(t, app, r, true)
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if got := rr.Header().Get("ETag"); got != tt.etag {
+				t.Errorf("got ETag %s, want %s", got, tt.etag)
+			}
+			if vary := rr.Header().Values("Vary"); strings.Count(strings.Join(vary, ","), "Accept") != 1 {
+				t.Errorf("got Vary %q, want Accept once", vary)
+			}
+		})
+	}
+}
+
+// Queuing the delivery of an issued bill changes the bill, so it takes a version too
+func TestTransitionBillDeliveryVersion(t *testing.T) {
+	user := &data.User{ID: 3, Name: "Clerk", Email: "clerk@example.com", Activated: true}
+	var marked bool
+	app := newTestApplication(t, signedIn(user, []string{data.PermissionAdmin}, func(query string, args []driver.Value) stubResult {
+		switch {
+		case strings.Contains(query, "INSERT INTO water_system_history"), strings.Contains(query, "INSERT INTO bill_transitions"):
+			return stubResult{affected: 1}
+		case strings.Contains(query, "SET delivery_status"):
+			marked = true
+			if !strings.Contains(query, "version = version + 1") {
+				t.Errorf("the delivery status is set without a new version: %s", query)
+			}
+			return stubResult{affected: 1}
+		case strings.Contains(query, "UPDATE water_system"):
+			return stubResult{rows: [][]driver.Value{{time.Now(), int64(3)}}}
+		case strings.Contains(query, "INNER JOIN users"):
+			return stubResult{rows: [][]driver.Value{{int64(7), "Ana Perez", "March", int64(10000), time.Now()}}}
+		case strings.Contains(query, "notification_preferences"):
+			return stubResult{rows: [][]driver.Value{{"ana@example.com", "", true, false}}}
+		case strings.Contains(query, "INSERT INTO email_outbox"):
+			return stubResult{rows: [][]driver.Value{{int64(1), time.Now(), data.OutboxPending, time.Now(), int64(1)}}}
+		case strings.Contains(query, "FROM water_system"):
+			return stubResult{rows: [][]driver.Value{billRow(&data.Todo_list{ID: 1, State: data.BillDraft, UserID: 7, Amount: 10000, Version: 2})}}
+		case strings.Contains(query, "INSERT INTO webhook_deliveries"):
+			if payload := string(args[1].([]byte)); !strings.Contains(payload, `"version":4`) || !strings.Contains(payload, `"delivery_status":"queued"`) {
+				t.Errorf("queued %s", payload)
+			}
+			return stubResult{affected: 1}
+		}
+		t.Errorf("unexpected statement: %s", query)
+		return stubResult{}
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/v1/waterbill/1/transitions", strings.NewReader(`{"to":"issued"}`))
+	rr := serve(t, app, r, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+	}
+	if !marked {
+		t.Error("the bill was not marked as queued")
+	}
+	if !strings.Contains(rr.Body.String(), `"version": 4`) && !strings.Contains(rr.Body.String(), `"version":4`) {
+		t.Errorf("got %s, want version 4", rr.Body)
+	}
+}
@@ -0,0 +1,171 @@
+// Filename: cmd/api/exports.go
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/validator"
+	"water.biling.system.driane.perez.net/internal/xlsx"
+)
+
+// The formats the bill listing can be downloaded in
+const (
+	formatJSON = "json"
+	formatCSV  = "csv"
+	formatXLSX = "xlsx"
+)
+
+// The media types of the export formats
+const (
+	mediaTypeCSV  = "text/csv"
+	mediaTypeXLSX = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+)
+
+// exportColumns are the columns of an export, in order. They use the same names as
+// the CSV import so that an exported file can be imported again
+var exportColumns = []string{
+	"id", "waterbill", "description", "notes", "category", "priority", "status", "state",
+	"user_id", "amount", "amount_paid", "amount_credited", "due_date", "issued_at",
+	"delivery_status", "created_at", "version",
+}
+
+// listFormat() works out the format of the bill listing. ?format= wins, otherwise the
+// Accept header is followed. CSV and XLSX are streamed as exports, anything else is
+// the ordinary listing that writeResponse() renders as JSON or XML
+func (app *application) listFormat(qs url.Values, r *http.Request, v *validator.Validator) string {
+	if format := app.readString(qs, "format", ""); format != "" {
+		v.Check(validator.In(format, formatJSON, formatCSV, formatXLSX), "format", "must be json, csv or xlsx")
+		return format
+	}
+	switch negotiate(r.Header.Get("Accept"), mediaTypeJSON, mediaTypeXML, mediaTypeCSV, mediaTypeXLSX) {
+	case mediaTypeCSV:
+		return formatCSV
+	case mediaTypeXLSX:
+		return formatXLSX
+	default:
+		return formatJSON
+	}
+}
+
+// exportBills() streams every bill matching the filters of the listing as a CSV or
+// XLSX download. Paging does not apply. Once the first row is out the status can no
+// longer change, so a failure part way through is logged and the download cut short
+func (app *application) exportBills(w http.ResponseWriter, r *http.Request, format string, query data.BillQuery, filters data.Filters) {
+	filename := fmt.Sprintf("waterbills-%s.%s", time.Now().Format("20060102"), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	// The listing is a download or not by the Accept header too
+	varyAccept(w.Header())
+
+	var err error
+	switch format {
+	case formatCSV:
+		w.Header().Set("Content-Type", mediaTypeCSV+"; charset=utf-8")
+		out := csv.NewWriter(w)
+		out.Write(exportColumns)
+		err = app.models.Todo_list.Export(query, filters, func(bill *data.Todo_list) error {
+			return out.Write(csvRecord(bill))
+		})
+		out.Flush()
+		if err == nil {
+			err = out.Error()
+		}
+	case formatXLSX:
+		w.Header().Set("Content-Type", mediaTypeXLSX)
+		var out *xlsx.Writer
+		out, err = xlsx.New(w, "Bills")
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		out.WriteHeader(exportColumns...)
+		err = app.models.Todo_list.Export(query, filters, func(bill *data.Todo_list) error {
+			return out.WriteRow(xlsxRecord(bill)...)
+		})
+		if err == nil {
+			err = out.Close()
+		}
+	}
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// csvRecord() lays a bill out as a CSV row. The csv package quotes fields holding
+// commas, quotes or line breaks. Text a spreadsheet would read as a formula is
+// prefixed with a quote so that opening an export never runs one
+func csvRecord(bill *data.Todo_list) []string {
+	issuedAt := ""
+	if bill.IssuedAt != nil {
+		issuedAt = bill.IssuedAt.Format(time.RFC3339)
+	}
+	userID := ""
+	if bill.UserID > 0 {
+		userID = strconv.FormatInt(bill.UserID, 10)
+	}
+	return []string{
+		strconv.FormatInt(bill.ID, 10),
+		safeCell(bill.Waterbill),
+		safeCell(bill.Description),
+		safeCell(bill.Notes),
+		safeCell(bill.Category),
+		safeCell(bill.Priority),
+		safeCell(strings.Join(bill.Status, ";")),
+		bill.State,
+		userID,
+		strconv.FormatInt(bill.Amount, 10),
+		strconv.FormatInt(bill.AmountPaid, 10),
+		strconv.FormatInt(bill.AmountCredited, 10),
+		bill.DueDate.Format("2006-01-02"),
+		issuedAt,
+		bill.DeliveryStatus,
+		bill.CreatedAt.Format(time.RFC3339),
+		strconv.FormatInt(int64(bill.Version), 10),
+	}
+}
+
+// xlsxRecord() lays a bill out as a spreadsheet row, with amounts as numbers and
+// dates as date cells
+func xlsxRecord(bill *data.Todo_list) []interface{} {
+	var issuedAt, userID interface{}
+	if bill.IssuedAt != nil {
+		issuedAt = *bill.IssuedAt
+	}
+	if bill.UserID > 0 {
+		userID = bill.UserID
+	}
+	return []interface{}{
+		bill.ID,
+		bill.Waterbill,
+		bill.Description,
+		bill.Notes,
+		bill.Category,
+		bill.Priority,
+		strings.Join(bill.Status, ";"),
+		bill.State,
+		userID,
+		bill.Amount,
+		bill.AmountPaid,
+		bill.AmountCredited,
+		xlsx.Date(bill.DueDate),
+		issuedAt,
+		bill.DeliveryStatus,
+		bill.CreatedAt,
+		bill.Version,
+	}
+}
+
+// safeCell() defuses text that a spreadsheet would take for a formula
+func safeCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
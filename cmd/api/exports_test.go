@@ -0,0 +1,104 @@
+// Filename: cmd/api/exports_test.go
+
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/data"
+)
+
+func TestSafeCell(t *testing.T) {
+	tests := []struct {
+		cell, want string
+	}{
+		{"March", "March"},
+		{"", ""},
+		{"=HYPERLINK(\"http://example.com\")", "'=HYPERLINK(\"http://example.com\")"},
+		{"+1", "'+1"},
+		{"-1", "'-1"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\tindented", "'\tindented"},
+		{"a=b", "a=b"},
+	}
+	for _, tt := range tests {
+		if got := safeCell(tt.cell); got != tt.want {
+			t.Errorf("safeCell(%q) = %q, want %q", tt.cell, got, tt.want)
+		}
+	}
+}
+
+// The listing is downloaded when ?format= or the Accept header asks for CSV or XLSX
+func TestExportBills(t *testing.T) {
+	issued := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	bill := &data.Todo_list{
+		ID: 1, CreatedAt: issued, Waterbill: "March", Description: "Meter 4411, kitchen", Notes: `said "read twice"`,
+		Category: "=cmd()", Priority: "normal", State: data.BillIssued, UserID: 7, Amount: 4250, AmountPaid: 1000,
+		DueDate: time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC), IssuedAt: &issued, Version: 3,
+	}
+	tests := []struct {
+		name        string
+		query       string
+		accept      string
+		status      int
+		contentType string
+	}{
+		{name: "CSV by format", query: "?format=csv", status: http.StatusOK, contentType: "text/csv; charset=utf-8"},
+		{name: "CSV by Accept", accept: "text/csv", status: http.StatusOK, contentType: "text/csv; charset=utf-8"},
+		{name: "XLSX by Accept", accept: mediaTypeXLSX, status: http.StatusOK, contentType: mediaTypeXLSX},
+		{name: "unknown format", query: "?format=pdf", status: http.StatusUnprocessableEntity, contentType: "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t, func(query string, args []driver.Value) stubResult {
+				if !strings.Contains(query, "FROM water_system") || strings.Contains(query, "LIMIT") {
+					t.Errorf("unexpected statement: %s", query)
+					return stubResult{}
+				}
+				return stubResult{rows: [][]driver.Value{billRow(bill)[:17]}}
+			})
+			r := httptest.NewRequest(http.MethodGet, "/v1/waterbill"+tt.query, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			rr := serve(t, app, r, false)
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if got := rr.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("got Content-Type %q, want %q", got, tt.contentType)
+			}
+			if got := rr.Header().Values("Vary"); !strings.Contains(strings.Join(got, ","), "Accept") {
+				t.Errorf("got Vary %q, want Accept", got)
+			}
+			switch tt.contentType {
+			case mediaTypeXLSX:
+				if !strings.HasPrefix(rr.Body.String(), "PK") {
+					t.Error("the download is not a zip archive")
+				}
+			case "text/csv; charset=utf-8":
+				if !strings.Contains(rr.Header().Get("Content-Disposition"), `attachment; filename="waterbills-`) {
+					t.Errorf("got Content-Disposition %q", rr.Header().Get("Content-Disposition"))
+				}
+				records, err := csv.NewReader(rr.Body).ReadAll()
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := [][]string{exportColumns, {
+					"1", "March", "Meter 4411, kitchen", `said "read twice"`, "'=cmd()", "normal", "", "issued",
+					"7", "4250", "1000", "0", "2024-03-31", "2024-03-01T09:30:00Z", "", "2024-03-01T09:30:00Z", "3",
+				}}
+				if !reflect.DeepEqual(records, want) {
+					t.Errorf("got %q, want %q", records, want)
+				}
+			}
+		})
+	}
+}
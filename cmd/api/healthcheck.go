@@ -20,7 +20,7 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 	}
 	//simulate a delay
 	//time.Sleep(4 * time.Second)
-	err := app.writeJSON(w, http.StatusOK, data, nil)
+	err := app.writeResponse(w, r, http.StatusOK, data, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"water.biling.system.driane.perez.net/internal/validator"
@@ -29,25 +30,6 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	}
 	return id, nil
 }
-func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
-	//Convert our map into a JSON object
-	js, err := json.MarshalIndent(data, "", "\t")
-	if err != nil {
-		return err
-	}
-	// Add a newline to make viewing on the terminal easier
-	js = append(js, '\n')
-	// Add the headers
-	for key, value := range headers {
-		w.Header()[key] = value
-	}
-	// Specify that we will serve our responses using JSON
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	// Write the []byte slice containing the JSON response body
-	w.Write(js)
-	return nil
-}
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
 	//use thhp.maxbytesreader() to limit the size of the request body to
 	//1 MB 2^20
@@ -141,6 +123,57 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	}
 	return intValue
 }
+// The parseDate() method parses a YYYY-MM-DD date sent by the client. If the value
+// cannot be parsed then a validation error is added to the validations errors map
+func (app *application) parseDate(v *validator.Validator, key string, value string) time.Time {
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		v.AddError(key, "must be a date in YYYY-MM-DD format")
+	}
+	return date
+}
+
+// readTime() reads a point in time from the query string, either a date in YYYY-MM-DD
+// format or an RFC 3339 timestamp. A date stands for the start of that day, or, when
+// it ends a range, the start of the next day so that the whole day is included
+func (app *application) readTime(qs url.Values, key string, end bool, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+	if s == "" {
+		return time.Time{}
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t
+	}
+	date, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		v.AddError(key, "must be a date in YYYY-MM-DD format or an RFC 3339 timestamp")
+		return time.Time{}
+	}
+	if end {
+		date = date.AddDate(0, 0, 1)
+	}
+	return date
+}
+
+// withActions() lets fixed paths such as /v1/waterbill/import sit where the :id of a
+// collection goes, which httprouter does not allow as separate routes. A request whose
+// id is the name of an action goes to that handler, any other request goes to next, or
+// is refused when there is no next
+func (app *application) withActions(actions map[string]http.HandlerFunc, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := httprouter.ParamsFromContext(r.Context()).ByName("id")
+		if action, ok := actions[name]; ok {
+			action(w, r)
+			return
+		}
+		if next == nil {
+			app.methodNotAllowedResponse(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
 //background accepts a function as its parameter
 func (app *application) background (fn func()) {
 	// increment the waitGroup counter
@@ -157,3 +190,30 @@ func (app *application) background (fn func()) {
 		fn()
 	}()
 }
+
+// stopWorkers() tells the outbox and webhook workers to return once they have
+// finished what they are sending
+func (app *application) stopWorkers() {
+	close(app.quit)
+}
+
+// stopping() reports whether the workers have been told to stop
+func (app *application) stopping() bool {
+	select {
+	case <-app.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// idle() waits for d between polls, cutting the wait short when the workers are
+// told to stop
+func (app *application) idle(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-app.quit:
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,78 @@
+// Filename: cmd/api/history.go
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"water.biling.system.driane.perez.net/internal/data"
+)
+
+// The listBillHistoryHandler() shows every recorded change to a bill, oldest first,
+// with the fields each change touched
+func (app *application) listBillHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	history, ok := app.fetchBillHistory(w, r)
+	if !ok {
+		return
+	}
+	// The whole of each version is only shown when it is asked for on its own
+	for _, version := range history {
+		version.Bill = nil
+	}
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"history": history}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showBillVersionHandler() shows one version of a bill in full, along with what
+// changed from the version before it
+func (app *application) showBillVersionHandler(w http.ResponseWriter, r *http.Request) {
+	number, err := strconv.ParseInt(httprouter.ParamsFromContext(r.Context()).ByName("version"), 10, 32)
+	if err != nil || number < 1 {
+		app.notFoundResponse(w, r)
+		return
+	}
+	history, ok := app.fetchBillHistory(w, r)
+	if !ok {
+		return
+	}
+	for _, version := range history {
+		if version.Version == int32(number) && version.Bill != nil {
+			err = app.writeResponse(w, r, http.StatusOK, envelope{"version": version}, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+	app.notFoundResponse(w, r)
+}
+
+// fetchBillHistory() reads the id from the URL and loads the history of the bill for
+// its owner or an admin, writing the error response itself when that fails
+func (app *application) fetchBillHistory(w http.ResponseWriter, r *http.Request) ([]*data.BillVersion, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	history, ownerID, err := app.models.Todo_list.History(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	// Past versions carry the account and who made each change
+	if !app.allowAccount(w, r, ownerID) {
+		return nil, false
+	}
+	return history, true
+}
@@ -0,0 +1,164 @@
+// Filename: cmd/api/history_test.go
+
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/data"
+)
+
+// The history of a bill pairs each version with the one it replaced to work out what
+// changed. The first version has nothing before it
+func TestBillHistory(t *testing.T) {
+	changed := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	history := [][]driver.Value{
+		{int64(1), "created", changed, int64(3), nil},
+		{int64(2), "updated", changed, int64(3), []byte(`{"id": 1, "notes": "first", "amount": 4250, "version": 1}`)},
+		{int64(3), "updated", changed, nil, []byte(`{"id": 1, "notes": "second", "amount": 4250, "version": 2}`)},
+	}
+	owner := &data.User{ID: 7, Name: "Ana Perez", Email: "ana@example.com", Activated: true}
+	handler := signedIn(owner, nil, func(query string, args []driver.Value) stubResult {
+		switch {
+		case strings.Contains(query, "FROM water_system_history"):
+			return stubResult{rows: history}
+		case strings.Contains(query, "FROM water_system"):
+			if args[0] != int64(1) {
+				return stubResult{}
+			}
+			return stubResult{rows: [][]driver.Value{{int64(3), int64(7), []byte(`{"id": 1, "notes": "third", "amount": 5000, "version": 3}`)}}}
+		}
+		t.Errorf("unexpected statement: %s", query)
+		return stubResult{}
+	})
+
+	type version struct {
+		Version   int32                             `json:"version"`
+		Action    string                            `json:"action"`
+		ChangedBy *int64                            `json:"changed_by"`
+		Changes   map[string]map[string]interface{} `json:"changes"`
+		Bill      map[string]interface{}            `json:"waterbill"`
+	}
+	t.Run("listed", func(t *testing.T) {
+		rr := serve(t, newTestApplication(t, handler), httptest.NewRequest(http.MethodGet, "/v1/waterbill/1/history", nil), true)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+		}
+		var body struct {
+			History []version `json:"history"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		want := []struct {
+			action  string
+			changes map[string]map[string]interface{}
+		}{
+			{"created", nil},
+			{"updated", map[string]map[string]interface{}{"notes": {"from": "first", "to": "second"}}},
+			{"updated", map[string]map[string]interface{}{"notes": {"from": "second", "to": "third"}, "amount": {"from": 4250.0, "to": 5000.0}}},
+		}
+		if len(body.History) != len(want) {
+			t.Fatalf("got %d versions, want %d", len(body.History), len(want))
+		}
+		for i, v := range body.History {
+			if v.Version != int32(i+1) || v.Action != want[i].action {
+				t.Errorf("version %d: got %d %s, want %s", i+1, v.Version, v.Action, want[i].action)
+			}
+			if len(v.Changes) != len(want[i].changes) {
+				t.Errorf("version %d: got changes %v, want %v", i+1, v.Changes, want[i].changes)
+			}
+			for key, change := range want[i].changes {
+				if v.Changes[key]["from"] != change["from"] || v.Changes[key]["to"] != change["to"] {
+					t.Errorf("version %d: got %s changed %v, want %v", i+1, key, v.Changes[key], change)
+				}
+			}
+			if v.Bill != nil {
+				t.Errorf("version %d: the listing carries the whole bill", i+1)
+			}
+		}
+		if body.History[2].ChangedBy != nil {
+			t.Errorf("the system change names actor %d", *body.History[2].ChangedBy)
+		}
+	})
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		notes  string
+	}{
+		{name: "the first version", path: "/v1/waterbill/1/history/1", status: http.StatusOK, notes: "first"},
+		{name: "the current version", path: "/v1/waterbill/1/history/3", status: http.StatusOK, notes: "third"},
+		{name: "an unknown version", path: "/v1/waterbill/1/history/4", status: http.StatusNotFound},
+		{name: "version zero", path: "/v1/waterbill/1/history/0", status: http.StatusNotFound},
+		{name: "an unknown bill", path: "/v1/waterbill/2/history/1", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serve(t, newTestApplication(t, handler), httptest.NewRequest(http.MethodGet, tt.path, nil), true)
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var body struct {
+				Version version `json:"version"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Version.Bill["notes"] != tt.notes {
+				t.Errorf("got the bill %v, want the notes %q", body.Version.Bill, tt.notes)
+			}
+		})
+	}
+}
+
+// Past versions carry the account and who made each change, so only the owner of the
+// bill and admins may read them
+func TestBillHistoryAccess(t *testing.T) {
+	tests := []struct {
+		name          string
+		authenticated bool
+		user          *data.User
+		permissions   []string
+		status        int
+	}{
+		{name: "anonymous", status: http.StatusUnauthorized},
+		{name: "someone else", authenticated: true, user: &data.User{ID: 8, Name: "Luis Chan", Email: "luis@example.com", Activated: true}, status: http.StatusForbidden},
+		{name: "the owner", authenticated: true, user: &data.User{ID: 7, Name: "Ana Perez", Email: "ana@example.com", Activated: true}, status: http.StatusOK},
+		{name: "an admin", authenticated: true, user: &data.User{ID: 1, Name: "Clerk", Email: "clerk@example.com", Activated: true}, permissions: []string{data.PermissionAdmin}, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		for _, path := range []string{"/v1/waterbill/1/history", "/v1/waterbill/1/history/1"} {
+			t.Run(tt.name+" "+path, func(t *testing.T) {
+				user := tt.user
+				if user == nil {
+					user = &data.User{ID: 9, Activated: true}
+				}
+				app := newTestApplication(t, signedIn(user, tt.permissions, func(query string, args []driver.Value) stubResult {
+					switch {
+					case strings.Contains(query, "FROM water_system_history"):
+						return stubResult{rows: [][]driver.Value{{int64(1), "created", time.Now(), int64(1), nil}}}
+					case strings.Contains(query, "FROM water_system"):
+						return stubResult{rows: [][]driver.Value{{int64(1), int64(7), []byte(`{"id": 1, "version": 1}`)}}}
+					}
+					t.Errorf("unexpected statement: %s", query)
+					return stubResult{}
+				}))
+				rr := serve(t, app, httptest.NewRequest(http.MethodGet, path, nil), tt.authenticated)
+				if rr.Code != tt.status {
+					t.Errorf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,256 @@
+// Filename: cmd/api/imports.go
+
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+// importMaxBytes caps the size of an uploaded CSV file
+const importMaxBytes = 10 << 20
+
+// The import modes. In all mode a single invalid row stops the whole import, in skip
+// mode the valid rows are imported and the invalid ones are reported
+const (
+	importAll  = "all"
+	importSkip = "skip"
+)
+
+// importFields are the bill fields a CSV column can be mapped to, and whether the
+// column has to be there. By default a column maps to the field of the same name
+var importFields = []struct {
+	name     string
+	required bool
+}{
+	{"waterbill", true},
+	{"description", true},
+	{"notes", true},
+	{"category", true},
+	{"priority", true},
+	{"user_id", false},
+	{"amount", false},
+	{"due_date", false},
+}
+
+// importRowError is the report for a row that failed validation. Rows are counted
+// from the header, which is row 1, the way a spreadsheet numbers them
+type importRowError struct {
+	Row    int               `json:"row"`
+	Errors map[string]string `json:"errors"`
+}
+
+// The importBillsHandler() creates bills from the rows of a CSV file, sent as the
+// request body or as the "file" field of a multipart form. The header row names the
+// columns; map.<field>=<column> in the query string maps a field to a column with a
+// different name
+func (app *application) importBillsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+	mode := app.readString(qs, "mode", importAll)
+	v.Check(validator.In(mode, importAll, importSkip), "mode", "must be all or skip")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	body, err := app.importBody(w, r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	defer body.Close()
+
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+	// Short rows are reported as missing fields rather than failing the whole file
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = errors.New("the CSV file is empty")
+		}
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	columns, errs := importColumns(header, qs)
+	if len(errs) > 0 {
+		app.failedValidationResponse(w, r, errs)
+		return
+	}
+	categories, err := app.models.Categories.ActiveCodes()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	priorities, err := app.models.Priorities.ActiveCodes()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var (
+		bills   []*data.Todo_list
+		rows    []int
+		userIDs []int64
+	)
+	report := []importRowError{}
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+		bill, errs := app.importRow(record, columns, categories, priorities)
+		if len(errs) > 0 {
+			report = append(report, importRowError{Row: row, Errors: errs})
+			continue
+		}
+		bills = append(bills, bill)
+		rows = append(rows, row)
+		if bill.UserID > 0 {
+			userIDs = append(userIDs, bill.UserID)
+		}
+	}
+	// The accounts are checked in one query once every row has been read
+	existing, err := app.models.Users.Existing(userIDs)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	valid := []*data.Todo_list{}
+	for i, bill := range bills {
+		if bill.UserID > 0 && !existing[bill.UserID] {
+			report = append(report, importRowError{Row: rows[i], Errors: map[string]string{"user_id": "no such user"}})
+			continue
+		}
+		valid = append(valid, bill)
+	}
+	bills = valid
+	sort.Slice(report, func(i, j int) bool { return report[i].Row < report[j].Row })
+
+	if mode == importAll && len(report) > 0 {
+		app.importFailedResponse(w, r, report)
+		return
+	}
+	err = app.models.Todo_list.InsertMany(bills, app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	ids := make([]int64, len(bills))
+	for i, bill := range bills {
+		ids[i] = bill.ID
+	}
+	result := envelope{
+		"rows":     len(bills) + len(report),
+		"imported": len(bills),
+		"skipped":  len(report),
+		"ids":      ids,
+		"errors":   report,
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"import": result}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// importBody() returns the uploaded CSV, reading it out of a multipart form when the
+// request is one
+func (app *application) importBody(w http.ResponseWriter, r *http.Request) (io.ReadCloser, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, importMaxBytes)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return r.Body, nil
+	}
+	err := r.ParseMultipartForm(importMaxBytes)
+	if err != nil {
+		return nil, err
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		return nil, errors.New("the form must have the CSV in a field called \"file\"")
+	}
+	return file, nil
+}
+
+// importColumns() works out which column holds each field. A field that is not
+// mapped to a column, and has no column of its own name, gets -1
+func importColumns(header []string, qs url.Values) (map[string]int, map[string]string) {
+	positions := map[string]int{}
+	for i, name := range header {
+		positions[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	columns := map[string]int{}
+	errs := map[string]string{}
+	for _, field := range importFields {
+		name := field.name
+		key := "map." + field.name
+		if mapped, ok := qs[key]; ok && len(mapped) > 0 {
+			name = strings.ToLower(strings.TrimSpace(mapped[0]))
+		}
+		i, ok := positions[name]
+		if !ok {
+			i = -1
+			if _, mapped := qs[key]; mapped {
+				errs[key] = fmt.Sprintf("the header has no %q column", name)
+			} else if field.required {
+				errs[field.name] = "the header must have a column for this field"
+			}
+		}
+		columns[field.name] = i
+	}
+	return columns, errs
+}
+
+// importRow() turns a CSV row into a bill and runs the same checks as creating a
+// bill by hand. It returns the validation errors of the row, if any
+func (app *application) importRow(record []string, columns map[string]int, categories, priorities []string) (*data.Todo_list, map[string]string) {
+	cell := func(field string) string {
+		i := columns[field]
+		if i < 0 || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+	v := validator.New()
+	bill := &data.Todo_list{
+		Waterbill:   cell("waterbill"),
+		Description: cell("description"),
+		Notes:       cell("notes"),
+		Category:    cell("category"),
+		Priority:    cell("priority"),
+	}
+	if s := cell("user_id"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		v.Check(err == nil, "user_id", "must be a whole number")
+		bill.UserID = id
+	}
+	if s := cell("amount"); s != "" {
+		amount, err := strconv.ParseInt(s, 10, 64)
+		v.Check(err == nil, "amount", "must be a whole number of cents")
+		bill.Amount = amount
+	}
+	if s := cell("due_date"); s != "" {
+		bill.DueDate = app.parseDate(v, "due_date", s)
+	}
+	data.ValidateVocabulary(v, bill, categories, priorities)
+	data.ValidateEntires(v, bill)
+	if !v.Valid() {
+		return nil, v.Errors
+	}
+	return bill, nil
+}
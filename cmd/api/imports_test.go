@@ -0,0 +1,138 @@
+// Filename: cmd/api/imports_test.go
+
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/data"
+)
+
+// importCSV has one good row, one with a retired category and one for an account
+// that does not exist. The header is row 1
+const importCSV = `Bill,description,notes,category,priority,user_id,amount,due_date
+March,Meter 4411,read,residential,normal,7,4250,2024-03-31
+April,Meter 4411,read,industrial,normal,,4250,
+May,Meter 12,read,residential,normal,99,1000,2024-05-31
+`
+
+func TestImportBills(t *testing.T) {
+	admin := &data.User{ID: 3, Name: "Clerk", Email: "clerk@example.com", Activated: true}
+	tests := []struct {
+		name      string
+		query     string
+		multipart bool
+		status    int
+		imported  int
+		rows      []int
+		errors    []string
+	}{
+		{name: "all", query: "?map.waterbill=bill", status: http.StatusUnprocessableEntity, rows: []int{3, 4}},
+		{name: "skip", query: "?mode=skip&map.waterbill=bill", status: http.StatusOK, imported: 1, rows: []int{3, 4}},
+		{name: "skip from a form", query: "?mode=skip&map.waterbill=bill", multipart: true, status: http.StatusOK, imported: 1, rows: []int{3, 4}},
+		{name: "no waterbill column", status: http.StatusUnprocessableEntity, errors: []string{"waterbill"}},
+		{name: "mapped to a missing column", query: "?map.waterbill=title", status: http.StatusUnprocessableEntity, errors: []string{"map.waterbill"}},
+		{name: "unknown mode", query: "?mode=some", status: http.StatusUnprocessableEntity, errors: []string{"mode"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var inserted []driver.Value
+			app := newTestApplication(t, signedIn(admin, []string{data.PermissionAdmin}, func(query string, args []driver.Value) stubResult {
+				switch {
+				case strings.Contains(query, "FROM categories"):
+					return stubResult{rows: [][]driver.Value{{"residential", time.Now(), "Residential", true, int64(1)}}}
+				case strings.Contains(query, "FROM priorities"):
+					return stubResult{rows: [][]driver.Value{{"normal", time.Now(), "Normal", true, int64(1)}}}
+				case strings.Contains(query, "SELECT id FROM users"):
+					return stubResult{rows: [][]driver.Value{{int64(7)}}}
+				case strings.Contains(query, "INSERT INTO water_system ("):
+					inserted = args
+					return stubResult{rows: [][]driver.Value{{int64(11), time.Now(), data.BillDraft, time.Now(), int64(1)}}}
+				case strings.Contains(query, "INSERT INTO water_system_history"), strings.Contains(query, "INSERT INTO webhook_deliveries"):
+					return stubResult{affected: 1}
+				}
+				t.Errorf("unexpected statement: %s", query)
+				return stubResult{}
+			}))
+			body, contentType := strings.NewReader(importCSV), "text/csv"
+			if tt.multipart {
+				var buf bytes.Buffer
+				form := multipart.NewWriter(&buf)
+				part, _ := form.CreateFormFile("file", "bills.csv")
+				part.Write([]byte(importCSV))
+				form.Close()
+				body, contentType = strings.NewReader(buf.String()), form.FormDataContentType()
+			}
+			r := httptest.NewRequest(http.MethodPost, "/v1/waterbill/import"+tt.query, body)
+			r.Header.Set("Content-Type", contentType)
+			rr := serve(t, app, r, true)
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			var response struct {
+				Import struct {
+					Imported int              `json:"imported"`
+					Skipped  int              `json:"skipped"`
+					IDs      []int64          `json:"ids"`
+					Errors   []importRowError `json:"errors"`
+				} `json:"import"`
+				Error json.RawMessage `json:"error"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if tt.errors != nil {
+				var errs map[string]string
+				if err := json.Unmarshal(response.Error, &errs); err != nil {
+					t.Fatal(err)
+				}
+				for _, key := range tt.errors {
+					if errs[key] == "" {
+						t.Errorf("no error on %s, got %v", key, errs)
+					}
+				}
+				return
+			}
+			report := response.Import.Errors
+			if tt.status != http.StatusOK {
+				var failed struct {
+					Rows []importRowError `json:"rows"`
+				}
+				if err := json.Unmarshal(response.Error, &failed); err != nil {
+					t.Fatal(err)
+				}
+				report = failed.Rows
+				if inserted != nil {
+					t.Error("a failed import inserted bills")
+				}
+			}
+			var rows []int
+			for _, row := range report {
+				rows = append(rows, row.Row)
+			}
+			if !reflect.DeepEqual(rows, tt.rows) {
+				t.Errorf("got the rows %v reported, want %v", rows, tt.rows)
+			}
+			if response.Import.Imported != tt.imported {
+				t.Errorf("imported %d bills, want %d", response.Import.Imported, tt.imported)
+			}
+			if tt.imported > 0 {
+				if len(inserted) != 8 || inserted[0] != "March" || inserted[5] != int64(7) || inserted[6] != int64(4250) {
+					t.Errorf("inserted %v", inserted)
+				}
+				if !reflect.DeepEqual(response.Import.IDs, []int64{11}) || response.Import.Skipped != 2 {
+					t.Errorf("got %+v", response.Import)
+				}
+			}
+		})
+	}
+}
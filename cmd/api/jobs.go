@@ -0,0 +1,135 @@
+// Filename: cmd/api/jobs.go
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+// registerJobs() sets up the periodic work. The schedules are cron expressions, only
+// one instance of the API runs each job. Each job hands its context on to the models,
+// so that stopping the scheduler cancels the work in flight
+func (app *application) registerJobs() error {
+	jobs := []struct {
+		name string
+		spec string
+		fn   func(ctx context.Context) error
+	}{
+		{"mark-overdue-bills", "0 * * * *", app.markOverdueBillsJob},
+		{"detect-plan-defaults", "5 * * * *", app.detectPlanDefaultsJob},
+		{"queue-reminders", "10 * * * *", app.queueRemindersJob},
+		{"delete-expired-tokens", "30 3 * * *", app.deleteExpiredTokensJob},
+		{"purge-deleted-bills", "45 3 * * *", app.purgeDeletedBillsJob},
+	}
+	for _, job := range jobs {
+		err := app.jobs.Register(job.name, job.spec, job.fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markOverdueBillsJob() moves every open bill that is past its due date to overdue
+func (app *application) markOverdueBillsJob(ctx context.Context) error {
+	count, err := app.models.Todo_list.MarkOverdue(ctx)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		app.logger.PrintInfo("bills marked overdue", map[string]string{
+			"count": strconv.Itoa(count),
+		})
+	}
+	return nil
+}
+
+// detectPlanDefaultsJob() marks the plans with missed installments as defaulted
+func (app *application) detectPlanDefaultsJob(ctx context.Context) error {
+	plans, err := app.models.PaymentPlans.DetectDefaults(ctx, app.config.plans.graceDays)
+	if err != nil {
+		return err
+	}
+	for _, plan := range plans {
+		app.logger.PrintInfo("payment plan defaulted", map[string]string{
+			"plan_id": strconv.FormatInt(plan.ID, 10),
+			"user_id": strconv.FormatInt(plan.UserID, 10),
+		})
+	}
+	return nil
+}
+
+// queueRemindersJob() queues the due-date reminders. Reminders are recorded per bill,
+// so the runs after the first one on a day find nothing new to send
+func (app *application) queueRemindersJob(ctx context.Context) error {
+	err := app.queueReminders(ctx, data.ReminderUpcoming, app.config.reminders.before)
+	if err != nil {
+		return err
+	}
+	return app.queueReminders(ctx, data.ReminderOverdue, app.config.reminders.after)
+}
+
+// deleteExpiredTokensJob() clears out the activation and authentication tokens that
+// have expired
+func (app *application) deleteExpiredTokensJob(ctx context.Context) error {
+	count, err := app.models.Tokens.DeleteExpired(ctx)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		app.logger.PrintInfo("expired tokens deleted", map[string]string{
+			"count": strconv.FormatInt(count, 10),
+		})
+	}
+	return nil
+}
+
+// purgeDeletedBillsJob() permanently removes the bills that have been in the trash for
+// longer than the retention period
+func (app *application) purgeDeletedBillsJob(ctx context.Context) error {
+	count, err := app.models.Todo_list.Purge(ctx, app.config.trash.retention)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		app.logger.PrintInfo("deleted bills purged", map[string]string{
+			"count": strconv.FormatInt(count, 10),
+		})
+	}
+	return nil
+}
+
+// The listJobsHandler() shows the registered jobs and when they run next
+func (app *application) listJobsHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"jobs": app.jobs.Jobs()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listJobRunsHandler() shows the most recent runs, optionally of one job
+func (app *application) listJobRunsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+	job := app.readString(qs, "job", "")
+	limit := app.readInt(qs, "limit", 50, v)
+	v.Check(limit > 0 && limit <= 500, "limit", "must be between 1 and 500")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	runs, err := app.jobs.Runs(job, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"runs": runs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
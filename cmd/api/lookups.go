@@ -0,0 +1,201 @@
+// Filename: cmd/api/lookups.go
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+// The category endpoints
+func (app *application) listCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	app.listLookups(w, r, app.models.Categories, "categories")
+}
+
+func (app *application) createCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	app.createLookup(w, r, app.models.Categories, "category", "/v1/categories")
+}
+
+func (app *application) showCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	app.showLookup(w, r, app.models.Categories, "category")
+}
+
+func (app *application) updateCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	app.updateLookup(w, r, app.models.Categories, "category")
+}
+
+// The priority endpoints
+func (app *application) listPrioritiesHandler(w http.ResponseWriter, r *http.Request) {
+	app.listLookups(w, r, app.models.Priorities, "priorities")
+}
+
+func (app *application) createPriorityHandler(w http.ResponseWriter, r *http.Request) {
+	app.createLookup(w, r, app.models.Priorities, "priority", "/v1/priorities")
+}
+
+func (app *application) showPriorityHandler(w http.ResponseWriter, r *http.Request) {
+	app.showLookup(w, r, app.models.Priorities, "priority")
+}
+
+func (app *application) updatePriorityHandler(w http.ResponseWriter, r *http.Request) {
+	app.updateLookup(w, r, app.models.Priorities, "priority")
+}
+
+// listLookups() returns the vocabulary for dropdowns. Only the active entries are
+// returned unless ?all=true is given
+func (app *application) listLookups(w http.ResponseWriter, r *http.Request, model data.LookupModel, key string) {
+	all := app.readString(r.URL.Query(), "all", "false") == "true"
+	lookups, err := model.GetAll(all)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{key: lookups}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createLookup() adds an entry to the vocabulary
+func (app *application) createLookup(w http.ResponseWriter, r *http.Request, model data.LookupModel, key, path string) {
+	var input struct {
+		Code   string `json:"code"`
+		Label  string `json:"label"`
+		Active *bool  `json:"active"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	lookup := &data.Lookup{
+		Code:   input.Code,
+		Label:  input.Label,
+		Active: true,
+	}
+	if input.Active != nil {
+		lookup.Active = *input.Active
+	}
+	v := validator.New()
+	if data.ValidateLookup(v, lookup); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = model.Insert(lookup)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateCode):
+			v.AddError("code", "already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("%s/%s", path, lookup.Code))
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{key: lookup}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showLookup() returns a specific entry
+func (app *application) showLookup(w http.ResponseWriter, r *http.Request, model data.LookupModel, key string) {
+	lookup, ok := app.fetchLookup(w, r, model)
+	if !ok {
+		return
+	}
+	err := app.writeResponse(w, r, http.StatusOK, envelope{key: lookup}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateLookup() changes the label of an entry or (de)activates it
+func (app *application) updateLookup(w http.ResponseWriter, r *http.Request, model data.LookupModel, key string) {
+	lookup, ok := app.fetchLookup(w, r, model)
+	if !ok {
+		return
+	}
+	var input struct {
+		Label  *string `json:"label"`
+		Active *bool   `json:"active"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if input.Label != nil {
+		lookup.Label = *input.Label
+	}
+	if input.Active != nil {
+		lookup.Active = *input.Active
+	}
+	v := validator.New()
+	if data.ValidateLookup(v, lookup); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = model.Update(lookup)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{key: lookup}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// fetchLookup() reads the code from the URL and loads the entry, writing the error
+// response itself when that fails
+func (app *application) fetchLookup(w http.ResponseWriter, r *http.Request, model data.LookupModel) (*data.Lookup, bool) {
+	code := httprouter.ParamsFromContext(r.Context()).ByName("code")
+	lookup, err := model.Get(code)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return lookup, true
+}
+
+// validateVocabulary() checks the category and priority of a bill against the active
+// entries of the managed vocabularies
+func (app *application) validateVocabulary(v *validator.Validator, entries *data.Todo_list) error {
+	categories, priorities, err := app.activeVocabulary()
+	if err != nil {
+		return err
+	}
+	data.ValidateVocabulary(v, entries, categories, priorities)
+	return nil
+}
+
+// activeVocabulary() returns the active category and priority codes
+func (app *application) activeVocabulary() ([]string, []string, error) {
+	categories, err := app.models.Categories.ActiveCodes()
+	if err != nil {
+		return nil, nil, err
+	}
+	priorities, err := app.models.Priorities.ActiveCodes()
+	if err != nil {
+		return nil, nil, err
+	}
+	return categories, priorities, nil
+}
@@ -0,0 +1,156 @@
+// Filename: cmd/api/lookups_test.go
+
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/data"
+)
+
+// lookupRows() answers a vocabulary query with active entries for the codes
+func lookupRows(codes ...string) [][]driver.Value {
+	rows := [][]driver.Value{}
+	for _, code := range codes {
+		rows = append(rows, []driver.Value{code, time.Now(), strings.ToUpper(code), true, int64(1)})
+	}
+	return rows
+}
+
+// Only administrators manage the vocabularies, and the others are turned away before
+// anything is written
+func TestCreateCategory(t *testing.T) {
+	tests := []struct {
+		name          string
+		authenticated bool
+		permissions   []string
+		body          string
+		status        int
+	}{
+		{name: "anonymous", body: `{"code":"sewer","label":"Sewer"}`, status: http.StatusUnauthorized},
+		{name: "customer", authenticated: true, body: `{"code":"sewer","label":"Sewer"}`, status: http.StatusForbidden},
+		{name: "admin", authenticated: true, permissions: []string{data.PermissionAdmin}, body: `{"code":"sewer","label":"Sewer"}`, status: http.StatusCreated},
+		{name: "bad code", authenticated: true, permissions: []string{data.PermissionAdmin}, body: `{"code":"Sewer Line","label":"Sewer"}`, status: http.StatusUnprocessableEntity},
+	}
+	user := &data.User{ID: 3, Name: "Clerk", Email: "clerk@example.com", Activated: true}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var inserted bool
+			app := newTestApplication(t, signedIn(user, tt.permissions, func(query string, args []driver.Value) stubResult {
+				if strings.Contains(query, "INSERT INTO categories") {
+					inserted = true
+					return stubResult{rows: [][]driver.Value{{time.Now(), int64(1)}}}
+				}
+				t.Errorf("unexpected statement: %s", query)
+				return stubResult{}
+			}))
+			r := httptest.NewRequest(http.MethodPost, "/v1/categories", strings.NewReader(tt.body))
+			rr := serve(t, app, r, tt.authenticated)
+			if rr.Code != tt.status {
+				t.Errorf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if inserted != (tt.status == http.StatusCreated) {
+				t.Errorf("inserted is %t with status %d", inserted, rr.Code)
+			}
+			if tt.status == http.StatusCreated && rr.Header().Get("Location") != "/v1/categories/sewer" {
+				t.Errorf("got Location %q", rr.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+// The listing leaves out the inactive entries unless ?all=true is given
+func TestListCategories(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		all  bool
+	}{
+		{name: "active", url: "/v1/categories", all: false},
+		{name: "all", url: "/v1/categories?all=true", all: true},
+		{name: "not true", url: "/v1/categories?all=yes", all: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t, func(query string, args []driver.Value) stubResult {
+				if strings.Contains(query, "FROM categories") {
+					if args[0] != tt.all {
+						t.Errorf("got all %v, want %t", args[0], tt.all)
+					}
+					return stubResult{rows: lookupRows("residential", "commercial")}
+				}
+				t.Errorf("unexpected statement: %s", query)
+				return stubResult{}
+			})
+			r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			rr := serve(t, app, r, false)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+			}
+			var body struct {
+				Categories []data.Lookup `json:"categories"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if len(body.Categories) != 2 || body.Categories[0].Code != "residential" {
+				t.Errorf("got categories %+v", body.Categories)
+			}
+		})
+	}
+}
+
+// A bill may only take a category and a priority that are active
+func TestCreateBillVocabulary(t *testing.T) {
+	tests := []struct {
+		name     string
+		category string
+		priority string
+		errors   []string
+	}{
+		{name: "inactive category", category: "retired", priority: "normal", errors: []string{"category"}},
+		{name: "unknown priority", category: "residential", priority: "urgent", errors: []string{"priority"}},
+		{name: "both", category: "retired", priority: "urgent", errors: []string{"category", "priority"}},
+	}
+	user := &data.User{ID: 3, Name: "Clerk", Email: "clerk@example.com", Activated: true}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t, signedIn(user, []string{data.PermissionAdmin}, func(query string, args []driver.Value) stubResult {
+				switch {
+				case strings.Contains(query, "FROM categories"):
+					return stubResult{rows: lookupRows("residential")}
+				case strings.Contains(query, "FROM priorities"):
+					return stubResult{rows: lookupRows("normal")}
+				}
+				t.Errorf("unexpected statement: %s", query)
+				return stubResult{}
+			}))
+			body := `{"waterbill":"March","description":"Meter 12","notes":"None","category":"` + tt.category + `","priority":"` + tt.priority + `","user_id":3,"amount":10000}`
+			r := httptest.NewRequest(http.MethodPost, "/v1/waterbill", strings.NewReader(body))
+			rr := serve(t, app, r, true)
+			if rr.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+			}
+			var response struct {
+				Error map[string]string `json:"error"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if len(response.Error) != len(tt.errors) {
+				t.Errorf("got errors %v, want %v", response.Error, tt.errors)
+			}
+			for _, key := range tt.errors {
+				if _, ok := response.Error[key]; !ok {
+					t.Errorf("no error for %s in %v", key, response.Error)
+				}
+			}
+		})
+	}
+}
@@ -4,15 +4,23 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"flag"
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	_ "github.com/lib/pq"
 	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/jobs"
 	"water.biling.system.driane.perez.net/internal/jsonlog"
 	"water.biling.system.driane.perez.net/internal/mailer"
+	"water.biling.system.driane.perez.net/internal/sms"
+	"water.biling.system.driane.perez.net/internal/validator"
+	"water.biling.system.driane.perez.net/internal/webhooks"
 )
 
 // The Application version number
@@ -38,19 +46,71 @@ type config struct {
 	smtp struct {
 		host string
 		port int
-		username string // from MailTrap setting 
+		username string
 		password string 
 		sender string
 	}
+	mail struct {
+		transport string // smtp, dir or log
+		dir       string // where the dir transport writes .eml files
+	}
+	sms struct {
+		provider    string // http or file
+		url         string // the gateway the http provider posts to
+		token       string
+		from        string
+		file        string // where the file provider writes messages
+		countryCode string // put in front of local phone numbers
+	}
+	disconnection struct {
+		threshold int64 // arrears in minor units (cents)
+		days      int   // days the oldest unpaid bill must be overdue
+		fee       int64 // reconnection fee in minor units (cents)
+	}
+	plans struct {
+		graceDays int // days an installment may be late before the plan defaults
+	}
+	outbox struct {
+		workers     int // number of goroutines sending queued email
+		maxAttempts int // attempts before a message is moved to dead
+	}
+	webhooks struct {
+		workers      int           // number of goroutines sending queued deliveries
+		maxAttempts  int           // attempts before a delivery is marked as failed
+		timeout      time.Duration // how long a receiver has to answer
+		allowPrivate bool          // deliver to loopback and private addresses, for development
+	}
+	search struct {
+		language string // text search configuration used when a search does not name one
+	}
+	etags struct {
+		strict bool // changes to a bill must send If-Match
+	}
+	trash struct {
+		retention time.Duration // how long deleted bills are kept before they are purged
+	}
+	reminders struct {
+		before []int // days before the due date an upcoming reminder goes out
+		after  []int // days after the due date an overdue reminder goes out
+	}
+	utility struct {
+		name    string // printed in the header of bills
+		address string
+		phone   string
+	}
 }
 
 // Dependency Injection
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	config   config
+	logger   *jsonlog.Logger
+	models   data.Models
+	mailer   mailer.Mailer
+	sms      sms.Messenger
+	webhooks *webhooks.Client
+	jobs     *jobs.Scheduler
+	quit     chan struct{} // closed to stop the outbox and webhook workers
+	wg       sync.WaitGroup
 }
 
 func main() {
@@ -68,15 +128,56 @@ func main() {
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
 	// These are our flags for the mailer 
-	flag.StringVar(&cfg.smtp.host, "smtp-host", "smtp.mailtrap.io", "SMTP host")
+	flag.StringVar(&cfg.smtp.host, "smtp-host", os.Getenv("WATER_SMTP_HOST"), "SMTP host")
 	flag.IntVar(&cfg.smtp.port, "smtp-port", 2525, "SMTP port")
-	flag.StringVar(&cfg.smtp.username, "smtp-username", "43bb77a475c5df", "SMTP username")
-	flag.StringVar(&cfg.smtp.password, "smtp-password", "4cef1f3306ce81", "SMTP password")
+	flag.StringVar(&cfg.smtp.username, "smtp-username", os.Getenv("WATER_SMTP_USERNAME"), "SMTP username")
+	flag.StringVar(&cfg.smtp.password, "smtp-password", os.Getenv("WATER_SMTP_PASSWORD"), "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "WaterBillingSystem <no-reply@water.biling.system.driane.perez.net>", "SMTP sender")
+	flag.StringVar(&cfg.mail.transport, "mail-transport", "smtp", "How email is delivered (smtp | dir | log)")
+	flag.StringVar(&cfg.mail.dir, "mail-dir", "./tmp/mail", "Directory the dir mail transport writes .eml files to")
+	// These are flags for the SMS channel
+	flag.StringVar(&cfg.sms.provider, "sms-provider", "file", "How text messages are delivered (http | file)")
+	flag.StringVar(&cfg.sms.url, "sms-url", os.Getenv("WATER_SMS_URL"), "SMS gateway URL for the http provider")
+	flag.StringVar(&cfg.sms.token, "sms-token", os.Getenv("WATER_SMS_TOKEN"), "SMS gateway token for the http provider")
+	flag.StringVar(&cfg.sms.from, "sms-from", "WaterBill", "SMS sender id")
+	flag.StringVar(&cfg.sms.file, "sms-file", "./tmp/sms.log", "File the file SMS provider writes messages to")
+	flag.StringVar(&cfg.sms.countryCode, "sms-country-code", "1", "Country calling code put in front of local phone numbers")
+	// These are flags for the disconnection workflow
+	flag.Int64Var(&cfg.disconnection.threshold, "disconnect-threshold", 10000, "Arrears (in cents) above which an account is flagged for disconnection")
+	flag.IntVar(&cfg.disconnection.days, "disconnect-days", 30, "Days an account must be in arrears before it is flagged for disconnection")
+	flag.Int64Var(&cfg.disconnection.fee, "reconnection-fee", 2500, "Reconnection fee in cents")
+	flag.IntVar(&cfg.plans.graceDays, "plan-grace-days", 7, "Days an installment may be late before the payment plan defaults")
+	// These are flags for the email outbox
+	flag.IntVar(&cfg.outbox.workers, "outbox-workers", 2, "Number of workers sending queued email")
+	flag.IntVar(&cfg.outbox.maxAttempts, "outbox-max-attempts", 8, "Attempts to send an email before it is dead-lettered")
+	// These are flags for the outgoing webhooks
+	flag.IntVar(&cfg.webhooks.workers, "webhook-workers", 2, "Number of workers sending webhook deliveries")
+	flag.IntVar(&cfg.webhooks.maxAttempts, "webhook-max-attempts", 10, "Attempts to deliver a webhook before it is marked as failed")
+	flag.DurationVar(&cfg.webhooks.timeout, "webhook-timeout", 10*time.Second, "How long a webhook receiver has to answer")
+	flag.BoolVar(&cfg.webhooks.allowPrivate, "webhook-allow-private", false, "Deliver webhooks to loopback and private addresses (development only)")
+	flag.DurationVar(&cfg.trash.retention, "trash-retention", 30*24*time.Hour, "How long deleted bills stay in the trash before they are purged")
+	flag.BoolVar(&cfg.etags.strict, "require-if-match", false, "Refuse PATCH and DELETE of bills that do not send If-Match")
+	flag.StringVar(&cfg.search.language, "search-language", "simple", "Default text search language (simple | english | spanish)")
+	// These are flags for the due-date reminders
+	cfg.reminders.before = []int{3}
+	cfg.reminders.after = []int{7, 14}
+	flag.Func("reminder-days-before", "Comma separated days before the due date to send reminders (default 3)", func(s string) error {
+		return parseDays(s, &cfg.reminders.before)
+	})
+	flag.Func("reminder-days-after", "Comma separated days after the due date to send overdue reminders (default 7,14)", func(s string) error {
+		return parseDays(s, &cfg.reminders.after)
+	})
+	// These are printed on the bills
+	flag.StringVar(&cfg.utility.name, "utility-name", "Water Billing System", "Utility name printed on bills")
+	flag.StringVar(&cfg.utility.address, "utility-address", "", "Utility address printed on bills")
+	flag.StringVar(&cfg.utility.phone, "utility-phone", "", "Utility phone number printed on bills")
 
 	flag.Parse()
 	//create a logger
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
+	if !validator.In(cfg.search.language, data.SearchLanguages...) {
+		logger.PrintFatal(fmt.Errorf("unknown search language %q", cfg.search.language), nil)
+	}
 	//create the connection pool
 	db, err := openDB(cfg)
 	if err != nil {
@@ -86,13 +187,35 @@ func main() {
 	defer db.Close()
 	//Log the seccessful connection pool
 	logger.PrintInfo("database connection pool established", nil)
+	// pick the mail transport
+	transport, err := newMailSender(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	// pick the SMS provider
+	provider, err := newSMSProvider(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
 	//create an instance of our application struct
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:   cfg,
+		logger:   logger,
+		models:   data.NewModels(db),
+		mailer:   mailer.New(transport, cfg.smtp.sender),
+		sms:      sms.New(provider),
+		webhooks: webhooks.NewClient(cfg.webhooks.timeout, cfg.webhooks.allowPrivate),
+		quit:     make(chan struct{}),
+	}
+	app.jobs = jobs.New(db, logger, &app.wg)
+	// Schedule the periodic work and start sending queued notifications
+	err = app.registerJobs()
+	if err != nil {
+		logger.PrintFatal(err, nil)
 	}
+	app.jobs.Start()
+	app.startOutboxWorkers()
+	app.startWebhookWorkers()
 	// Call app.serve to start the server
 	err = app.serve()
 	if err != nil {
@@ -101,6 +224,57 @@ func main() {
 }
 
 
+// parseDays() reads a comma separated list of day counts from a flag
+func parseDays(s string, days *[]int) error {
+	*days = nil
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%q is not a number of days", part)
+		}
+		*days = append(*days, n)
+	}
+	return nil
+}
+
+// newMailSender() returns the mail transport chosen with the -mail-transport flag.
+// SMTP is the default, so a server without an SMTP host refuses to start rather than
+// quietly not sending mail
+func newMailSender(cfg config) (mailer.Sender, error) {
+	switch cfg.mail.transport {
+	case "smtp":
+		if cfg.smtp.host == "" {
+			return nil, errors.New("the smtp mail transport needs -smtp-host")
+		}
+		return mailer.NewSMTPSender(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password), nil
+	case "dir":
+		return mailer.NewDirSender(cfg.mail.dir)
+	case "log":
+		return mailer.NewLogSender(os.Stdout), nil
+	default:
+		return nil, fmt.Errorf("unknown mail transport %q", cfg.mail.transport)
+	}
+}
+
+// newSMSProvider() returns the SMS provider chosen with the -sms-provider flag
+func newSMSProvider(cfg config) (sms.Provider, error) {
+	switch cfg.sms.provider {
+	case "http":
+		if cfg.sms.url == "" {
+			return nil, errors.New("the http SMS provider needs -sms-url")
+		}
+		return sms.NewHTTPProvider(cfg.sms.url, cfg.sms.token, cfg.sms.from), nil
+	case "file":
+		return sms.NewFileProvider(cfg.sms.file)
+	default:
+		return nil, fmt.Errorf("unknown SMS provider %q", cfg.sms.provider)
+	}
+}
+
 // openDB() function returns a pointer *sql.DB connection pool
 func openDB(cfg config) (*sql.DB, error) {
 	db, err := sql.Open("postgres", cfg.db.dsn)
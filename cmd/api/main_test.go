@@ -0,0 +1,38 @@
+// Filename: cmd/api/main_test.go
+
+package main
+
+import (
+	"testing"
+)
+
+func TestNewMailSender(t *testing.T) {
+	tests := []struct {
+		name      string
+		transport string
+		host      string
+		ok        bool
+	}{
+		{name: "smtp", transport: "smtp", host: "smtp.example.com", ok: true},
+		{name: "smtp without a host", transport: "smtp"},
+		{name: "dir", transport: "dir", ok: true},
+		{name: "log", transport: "log", ok: true},
+		{name: "unknown", transport: "pigeon"},
+		{name: "empty", transport: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			cfg.mail.transport = tt.transport
+			cfg.mail.dir = t.TempDir()
+			cfg.smtp.host = tt.host
+			sender, err := newMailSender(cfg)
+			if ok := err == nil; ok != tt.ok {
+				t.Fatalf("got error %v, want ok %t", err, tt.ok)
+			}
+			if tt.ok && sender == nil {
+				t.Error("got no sender")
+			}
+		})
+	}
+}
@@ -3,13 +3,17 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	"golang.org/x/time/rate"
+	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/validator"
 )
 
 func (app *application) recoverPanic(next http.Handler) http.Handler {
@@ -83,4 +87,134 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 		} // end of enabled conditional
 		next.ServeHTTP(w, r)
 	})
-}
\ No newline at end of file
+}
+
+// authenticate() looks for a bearer token and adds the user it belongs to to the
+// request context. Requests without a token carry on as the anonymous user
+func (app *application) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The response depends on the Authorization header
+		w.Header().Add("Vary", "Authorization")
+		authorizationHeader := r.Header.Get("Authorization")
+		if authorizationHeader == "" {
+			r = app.contextSetUser(r, data.AnonymousUser)
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The header should look like "Bearer <token>"
+		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+		token := headerParts[1]
+		v := validator.New()
+		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		r = app.contextSetUser(r, user)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireAuthenticatedUser() turns away anonymous clients
+func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+		if user.IsAnonymous() {
+			app.authenticationRequiredResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireActivatedUser() turns away anonymous clients and users who have not activated
+func (app *application) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+		if !user.Activated {
+			app.inactiveAccountResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+	return app.requireAuthenticatedUser(fn)
+}
+
+// requirePermission() only lets activated users who hold the permission code through
+func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !permissions.Include(code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return app.requireActivatedUser(fn)
+}
+
+// isAdmin() reports whether the user holds the admin permission
+func (app *application) isAdmin(user *data.User) (bool, error) {
+	if user.IsAnonymous() {
+		return false, nil
+	}
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return false, err
+	}
+	return permissions.Include(data.PermissionAdmin), nil
+}
+
+// canAccessAccount() reports whether the signed-in user may see or act on the account
+// of the given user, which only the account holder and admins may
+func (app *application) canAccessAccount(r *http.Request, ownerID int64) (bool, error) {
+	user := app.contextGetUser(r)
+	if !user.IsAnonymous() && user.ID == ownerID {
+		return true, nil
+	}
+	return app.isAdmin(user)
+}
+
+// accountScope() returns the account the signed-in user is limited to: none, 0, for
+// admins and their own for everyone else
+func (app *application) accountScope(r *http.Request) (int64, error) {
+	user := app.contextGetUser(r)
+	admin, err := app.isAdmin(user)
+	if err != nil || admin {
+		return 0, err
+	}
+	return user.ID, nil
+}
+
+// allowAccount() checks that the signed-in user may act on the account of the given
+// user, writing the error response itself when they may not
+func (app *application) allowAccount(w http.ResponseWriter, r *http.Request, ownerID int64) bool {
+	allowed, err := app.canAccessAccount(r, ownerID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if !allowed {
+		app.notPermittedResponse(w, r)
+		return false
+	}
+	return true
+}
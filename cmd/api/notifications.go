@@ -0,0 +1,99 @@
+// Filename: cmd/api/notifications.go
+
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+// The showNotificationPreferencesHandler() shows what the signed in user is notified
+// about and on which channels for the GET /v1/users/me/notifications endpoint
+func (app *application) showNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	prefs, err := app.models.NotificationPreferences.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"notifications": prefs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateNotificationPreferencesHandler() changes the phone number and the
+// switches of the signed in user for the PUT /v1/users/me/notifications endpoint.
+// Only the switches that are sent are changed, the phone number is stored in E.164 form
+func (app *application) updateNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	prefs, err := app.models.NotificationPreferences.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	var input struct {
+		Phone       *string                    `json:"phone"`
+		Preferences map[string]map[string]bool `json:"preferences"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if input.Phone != nil {
+		prefs.Phone = ""
+		if *input.Phone != "" {
+			phone, ok := validator.NormalizeE164(*input.Phone, app.config.sms.countryCode)
+			v.Check(ok, "phone", "must be a valid phone number")
+			prefs.Phone = phone
+		}
+	}
+	// Validate the switches that were sent against the merged result, so that turning
+	// on text messages needs a phone number either way
+	changes := &data.NotificationPreferences{Phone: prefs.Phone, Preferences: input.Preferences}
+	for event, channels := range input.Preferences {
+		for channel, enabled := range channels {
+			if prefs.Preferences[event] != nil {
+				prefs.Preferences[event][channel] = enabled
+			}
+		}
+	}
+	data.ValidateNotificationPreferences(v, changes)
+	if prefs.Phone == "" {
+		for _, channels := range prefs.Preferences {
+			v.Check(!channels[data.ChannelSMS], "phone", "must be provided to receive text messages")
+		}
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.NotificationPreferences.Update(user.ID, changes)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"notifications": prefs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
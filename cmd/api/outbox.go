@@ -0,0 +1,201 @@
+// Filename: cmd/api/outbox.go
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/mailer"
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+// How long a failed message waits before it is retried. The wait doubles with every
+// attempt up to the maximum
+const (
+	outboxBaseBackoff = 30 * time.Second
+	outboxMaxBackoff  = time.Hour
+	outboxPollEvery   = 5 * time.Second
+)
+
+// startOutboxWorkers() starts the pool of workers sending the queued email. They are
+// tracked by the wait group so that a graceful shutdown waits for them
+func (app *application) startOutboxWorkers() {
+	for i := 0; i < app.config.outbox.workers; i++ {
+		app.background(app.outboxWorker)
+	}
+}
+
+// outboxWorker() sends due messages one at a time and waits for a while whenever
+// the outbox is empty. It returns once the workers are told to stop
+func (app *application) outboxWorker() {
+	for !app.stopping() {
+		msg, err := app.models.Outbox.Claim()
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+		if msg == nil {
+			app.idle(outboxPollEvery)
+			continue
+		}
+		app.deliverEmail(msg)
+	}
+}
+
+// deliverEmail() sends a claimed message and records the outcome
+func (app *application) deliverEmail(msg *data.EmailMessage) {
+	sendErr := app.sendNotification(msg)
+	if sendErr == nil {
+		err := app.models.Outbox.MarkSent(msg)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+		return
+	}
+	err := app.models.Outbox.MarkFailed(msg, sendErr, outboxBackoff(msg.Attempts), app.config.outbox.maxAttempts)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+	app.logger.PrintError(sendErr, map[string]string{
+		"outbox_id": strconv.FormatInt(msg.ID, 10),
+		"attempts":  strconv.Itoa(msg.Attempts),
+		"state":     msg.State,
+	})
+}
+
+// sendNotification() renders and sends a message on its channel
+func (app *application) sendNotification(msg *data.EmailMessage) error {
+	switch msg.Channel {
+	case data.ChannelSMS:
+		return app.sms.Send(msg.Recipient, msg.Template, msg.Data)
+	default:
+		return app.sendEmail(msg)
+	}
+}
+
+// sendEmail() renders and sends an email. A message delivering a bill gets the
+// printable bill attached
+func (app *application) sendEmail(msg *data.EmailMessage) error {
+	var attachments []mailer.Attachment
+	if msg.BillID != nil {
+		bill, err := app.models.Todo_list.Get(*msg.BillID)
+		if err != nil {
+			return err
+		}
+		_, body, err := app.billPDF(bill)
+		if err != nil {
+			return err
+		}
+		attachments = append(attachments, mailer.Attachment{
+			Filename:    fmt.Sprintf("bill-%d.pdf", bill.ID),
+			ContentType: "application/pdf",
+			Data:        body,
+		})
+	}
+	return app.mailer.Send(msg.Recipient, msg.Template, msg.Data, attachments...)
+}
+
+// outboxBackoff() returns the wait before the next attempt
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxBaseBackoff
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > outboxMaxBackoff {
+		backoff = outboxMaxBackoff
+	}
+	return backoff
+}
+
+// The listOutboxHandler() shows the queued, sent and dead messages
+func (app *application) listOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		State string
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	input.State = app.readString(qs, "state", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortList = []string{"id", "created_at", "next_attempt_at", "-id", "-created_at", "-next_attempt_at"}
+	if input.State != "" {
+		v.Check(validator.In(input.State, data.OutboxPending, data.OutboxSent, data.OutboxDead), "state", "invalid outbox state")
+	}
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	messages, metadata, err := app.models.Outbox.GetAll(input.State, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"messages": messages, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showOutboxHandler() shows a specific message
+func (app *application) showOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	msg, ok := app.fetchEmailMessage(w, r)
+	if !ok {
+		return
+	}
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"message": msg}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The requeueOutboxHandler() gives a dead message another round of attempts
+func (app *application) requeueOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	msg, ok := app.fetchEmailMessage(w, r)
+	if !ok {
+		return
+	}
+	state := msg.State
+	err := app.models.Outbox.Requeue(msg)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrIllegalTransition):
+			app.illegalTransitionResponse(w, r, state, data.OutboxPending)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": msg}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// fetchEmailMessage() reads the id from the URL and loads the message, writing the
+// error response itself when that fails
+func (app *application) fetchEmailMessage(w http.ResponseWriter, r *http.Request) (*data.EmailMessage, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	msg, err := app.models.Outbox.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return msg, true
+}
@@ -0,0 +1,162 @@
+// Filename: cmd/api/outbox_test.go
+
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/mailer"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{50, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := outboxBackoff(tt.attempts); got != tt.want {
+			t.Errorf("outboxBackoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+// The idle workers return as soon as they are told to stop, rather than finishing
+// their poll interval
+func TestWorkersStop(t *testing.T) {
+	var claims int32
+	app := newTestApplication(t, func(query string, args []driver.Value) stubResult {
+		if strings.Contains(query, "email_outbox") || strings.Contains(query, "webhook_deliveries") {
+			atomic.AddInt32(&claims, 1)
+			return stubResult{}
+		}
+		t.Errorf("unexpected statement: %s", query)
+		return stubResult{}
+	})
+	app.config.outbox.workers = 2
+	app.config.webhooks.workers = 2
+	app.startOutboxWorkers()
+	app.startWebhookWorkers()
+	for atomic.LoadInt32(&claims) < 4 {
+		time.Sleep(time.Millisecond)
+	}
+	app.stopWorkers()
+
+	done := make(chan struct{})
+	go func() {
+		app.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the workers did not stop")
+	}
+}
+
+// A queued bill goes out with the printable bill attached, and is marked as sent
+// under the lease it was claimed with
+func TestDeliverEmailBill(t *testing.T) {
+	owner := &data.User{ID: 7, Name: "Ana Perez", Email: "ana@example.com", Activated: true}
+	var marked bool
+	app := newTestApplication(t, func(query string, args []driver.Value) stubResult {
+		switch {
+		case strings.Contains(query, "FROM water_system"):
+			return stubResult{rows: [][]driver.Value{billRow(&data.Todo_list{ID: 1, Waterbill: "March", State: data.BillIssued, UserID: owner.ID, Amount: 4250, Version: 1})}}
+		case strings.Contains(query, "FROM users"):
+			return stubResult{rows: [][]driver.Value{{owner.ID, time.Now(), owner.Name, owner.Email, []byte("hash"), true, int64(1)}}}
+		case strings.Contains(query, "FROM adjustments"):
+			return stubResult{}
+		case strings.Contains(query, "UPDATE email_outbox"):
+			marked = true
+			if !strings.Contains(query, "lease = $2") || args[1] != int64(4) {
+				t.Errorf("the message was marked without the lease: %s %v", query, args)
+			}
+			if !strings.Contains(query, "data = '{}'::jsonb") {
+				t.Errorf("the template data was kept: %s", query)
+			}
+			return stubResult{rows: [][]driver.Value{{time.Now(), data.OutboxSent, int64(2)}}}
+		case strings.Contains(query, "UPDATE water_system"):
+			return stubResult{affected: 1}
+		}
+		t.Errorf("unexpected statement: %s", query)
+		return stubResult{}
+	})
+	sender := mailer.NewMemorySender()
+	app.mailer = mailer.New(sender, "no-reply@example.com")
+
+	billID := int64(1)
+	msg := &data.EmailMessage{
+		ID:        3,
+		Channel:   data.ChannelEmail,
+		Recipient: owner.Email,
+		Template:  "bill_issued.tmpl",
+		Data:      map[string]interface{}{"name": owner.Name, "billID": billID, "waterbill": "March", "amountDue": "42.50", "dueDate": "March 31, 2024"},
+		BillID:    &billID,
+		State:     data.OutboxPending,
+		Attempts:  1,
+		Lease:     4,
+	}
+	app.deliverEmail(msg)
+	if !marked || msg.State != data.OutboxSent {
+		t.Fatalf("the message was not marked as sent, it is %q", msg.State)
+	}
+	messages := sender.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(messages))
+	}
+	sent := messages[0]
+	if sent.To != owner.Email || sent.Template != "bill_issued.tmpl" {
+		t.Errorf("got a message to %q using %q", sent.To, sent.Template)
+	}
+	if len(sent.Attachments) != 1 || sent.Attachments[0].Filename != "bill-1.pdf" || !bytes.HasPrefix(sent.Attachments[0].Data, []byte("%PDF-")) {
+		t.Errorf("the bill is not attached: %v", sent.Attachments)
+	}
+}
+
+// A message that has used up its attempts is moved to dead and its template data,
+// which can hold an activation token, is cleared
+func TestDeliverEmailDead(t *testing.T) {
+	var marked bool
+	app := newTestApplication(t, func(query string, args []driver.Value) stubResult {
+		if strings.Contains(query, "UPDATE email_outbox") {
+			marked = true
+			if !strings.Contains(query, "state = 'dead'") || !strings.Contains(query, "data = '{}'::jsonb") {
+				t.Errorf("the message was not cleared when it died: %s", query)
+			}
+			return stubResult{rows: [][]driver.Value{{nil, data.OutboxDead, int64(2)}}}
+		}
+		t.Errorf("unexpected statement: %s", query)
+		return stubResult{}
+	})
+	app.config.outbox.maxAttempts = 3
+	app.mailer = mailer.New(mailer.NewMemorySender(), "no-reply@example.com")
+
+	msg := &data.EmailMessage{
+		ID:        3,
+		Channel:   data.ChannelEmail,
+		Recipient: "ana@example.com",
+		Template:  "missing.tmpl",
+		Data:      map[string]interface{}{"activationToken": "SECRET"},
+		State:     data.OutboxPending,
+		Attempts:  3,
+		Lease:     4,
+	}
+	app.deliverEmail(msg)
+	if !marked || msg.State != data.OutboxDead {
+		t.Fatalf("the message was not moved to dead, it is %q", msg.State)
+	}
+}
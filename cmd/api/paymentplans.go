@@ -0,0 +1,177 @@
+// Filename: cmd/api/paymentplans.go
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+// The createPaymentPlanHandler() sets up an installment plan for an account's arrears
+func (app *application) createPaymentPlanHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		UserID       int64  `json:"user_id"`
+		Total        *int64 `json:"total"`
+		Installments int    `json:"installments"`
+		Frequency    string `json:"frequency"`
+		FirstDueDate string `json:"first_due_date"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	plan := &data.PaymentPlan{
+		UserID:    input.UserID,
+		Frequency: input.Frequency,
+	}
+	// The plan covers the whole outstanding balance unless told otherwise
+	if input.Total != nil {
+		plan.Total = *input.Total
+	} else if input.UserID > 0 {
+		plan.Total, err = app.models.Payments.Balance(input.UserID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	v := validator.New()
+	var firstDue time.Time
+	if input.FirstDueDate != "" {
+		firstDue = app.parseDate(v, "first_due_date", input.FirstDueDate)
+	}
+	if data.ValidatePaymentPlan(v, plan, input.Installments, firstDue); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	plan.Installments = data.BuildInstallments(plan.Total, input.Installments, firstDue, plan.Frequency)
+
+	err = app.models.PaymentPlans.Insert(plan)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrActivePlanExists):
+			v.AddError("user_id", "the account already has an active payment plan")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/payment-plans/%d", plan.ID))
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"payment_plan": plan}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showPaymentPlanHandler() shows a plan and its installment schedule
+func (app *application) showPaymentPlanHandler(w http.ResponseWriter, r *http.Request) {
+	plan, ok := app.fetchPaymentPlan(w, r)
+	if !ok || !app.allowAccount(w, r, plan.UserID) {
+		return
+	}
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"payment_plan": plan}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listPaymentPlansHandler() lists the plans, optionally for one account or state
+func (app *application) listPaymentPlansHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		UserID int64
+		State  string
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	input.UserID = int64(app.readInt(qs, "user_id", 0, v))
+	input.State = app.readString(qs, "state", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortList = []string{"id", "created_at", "total", "-id", "-created_at", "-total"}
+	if input.State != "" {
+		v.Check(validator.In(input.State, data.PlanActive, data.PlanCompleted, data.PlanDefaulted, data.PlanCancelled), "state", "invalid payment plan state")
+	}
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Customers only see their own plans
+	user := app.contextGetUser(r)
+	admin, err := app.isAdmin(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !admin {
+		if input.UserID != 0 && input.UserID != user.ID {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		input.UserID = user.ID
+	}
+	plans, metadata, err := app.models.PaymentPlans.GetAll(input.UserID, input.State, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"payment_plans": plans, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The cancelPaymentPlanHandler() stops an active plan
+func (app *application) cancelPaymentPlanHandler(w http.ResponseWriter, r *http.Request) {
+	plan, ok := app.fetchPaymentPlan(w, r)
+	if !ok {
+		return
+	}
+	state := plan.State
+	err := app.models.PaymentPlans.Cancel(plan)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrIllegalTransition):
+			app.illegalTransitionResponse(w, r, state, data.PlanCancelled)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"payment_plan": plan}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// fetchPaymentPlan() reads the id from the URL and loads the plan, writing the
+// error response itself when that fails
+func (app *application) fetchPaymentPlan(w http.ResponseWriter, r *http.Request) (*data.PaymentPlan, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	plan, err := app.models.PaymentPlans.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return plan, true
+}
+
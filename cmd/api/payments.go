@@ -0,0 +1,74 @@
+// Filename: cmd/api/payments.go
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+// The createPaymentHandler() records an incoming payment and matches it against the
+// account's bills and payment plan installments
+func (app *application) createPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		UserID    int64  `json:"user_id"`
+		Amount    int64  `json:"amount"`
+		Reference string `json:"reference"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	payment := &data.Payment{
+		UserID:    input.UserID,
+		Amount:    input.Amount,
+		Reference: input.Reference,
+	}
+	v := validator.New()
+	if data.ValidatePayment(v, payment); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Payments.Insert(payment, app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/payments/%d", payment.ID))
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"payment": payment}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showPaymentHandler() shows a payment and how it was allocated
+func (app *application) showPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	payment, err := app.models.Payments.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if !app.allowAccount(w, r, payment.UserID) {
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"payment": payment}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
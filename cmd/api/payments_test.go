@@ -0,0 +1,172 @@
+// Filename: cmd/api/payments_test.go
+
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/data"
+)
+
+// The bills a payment is posted against record the admin who posted it in their history.
+// A bill it settles moves to paid as a change of its own, made by the system, that
+// takes a version and queues the webhook
+func TestCreatePaymentActor(t *testing.T) {
+	admin := &data.User{ID: 3, Name: "Clerk", Email: "clerk@example.com", Activated: true}
+	var actors, webhooks []driver.Value
+	app := newTestApplication(t, signedIn(admin, []string{data.PermissionAdmin}, func(query string, args []driver.Value) stubResult {
+		switch {
+		case strings.Contains(query, "INSERT INTO payments"):
+			return stubResult{rows: [][]driver.Value{{int64(10), time.Now()}}}
+		case strings.Contains(query, "INSERT INTO water_system_history"):
+			actors = append(actors, args[1])
+			return stubResult{affected: 1}
+		case strings.Contains(query, "SELECT state, amount"):
+			return stubResult{rows: [][]driver.Value{{data.BillIssued, int64(5000), int64(5000), int64(0)}}}
+		case strings.Contains(query, "SET state = $1, version = version + 1"):
+			if args[0] != data.BillPaid {
+				t.Errorf("moved the bill to %v", args[0])
+			}
+			return stubResult{rows: [][]driver.Value{billRow(&data.Todo_list{ID: 1, State: data.BillPaid, UserID: 7, Amount: 5000, AmountPaid: 5000, Version: 3})}}
+		case strings.Contains(query, "FROM water_system"):
+			return stubResult{rows: [][]driver.Value{{int64(1), int64(5000)}}}
+		case strings.Contains(query, "FROM payment_plans"), strings.Contains(query, "FROM users"):
+			return stubResult{}
+		case strings.Contains(query, "INSERT INTO webhook_deliveries"):
+			webhooks = append(webhooks, args[0])
+			return stubResult{affected: 1}
+		case strings.Contains(query, "UPDATE"), strings.Contains(query, "INSERT INTO"):
+			return stubResult{affected: 1}
+		}
+		t.Errorf("unexpected statement: %s", query)
+		return stubResult{}
+	}))
+	body := `{"user_id":7,"amount":5000,"reference":"RCPT-1"}`
+	rr := serve(t, app, httptest.NewRequest(http.MethodPost, "/v1/payments", strings.NewReader(body)), true)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+	}
+	if !reflect.DeepEqual(actors, []driver.Value{admin.ID, int64(0)}) {
+		t.Errorf("got the history actors %v, want the admin and then the system", actors)
+	}
+	if !reflect.DeepEqual(webhooks, []driver.Value{data.WebhookBillUpdated, data.WebhookPaymentCreated}) {
+		t.Errorf("queued the webhooks %v", webhooks)
+	}
+	var response struct {
+		Payment data.Payment `json:"payment"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Payment.Allocations) != 1 || response.Payment.Unapplied != 0 {
+		t.Errorf("got the payment %+v", response.Payment)
+	}
+}
+
+// A payment goes to the installments of an active plan first and then to the bills. What
+// the plan takes is posted against the bills too but allocated once, so the allocations
+// always add up to the amount less the unapplied credit
+func TestCreatePaymentAllocations(t *testing.T) {
+	tests := []struct {
+		name        string
+		plan        bool
+		amount      int64
+		allocations []string
+		posted      map[int64]int64
+		unapplied   int64
+		completed   bool
+	}{
+		{name: "no plan", amount: 5000, allocations: []string{"bill 1: 3000", "bill 2: 2000"}, posted: map[int64]int64{1: 3000, 2: 2000}},
+		{name: "no plan, overpaid", amount: 9000, allocations: []string{"bill 1: 3000", "bill 2: 4000"}, posted: map[int64]int64{1: 3000, 2: 4000}, unapplied: 2000},
+		{name: "one installment", plan: true, amount: 2500, allocations: []string{"installment 11: 2500"}, posted: map[int64]int64{1: 2500}},
+		{name: "the plan and more", plan: true, amount: 6000, allocations: []string{"installment 11: 2500", "installment 12: 2500", "bill 2: 1000"}, posted: map[int64]int64{1: 3000, 2: 3000}, completed: true},
+		{name: "everything and more", plan: true, amount: 8000, allocations: []string{"installment 11: 2500", "installment 12: 2500", "bill 2: 2000"}, posted: map[int64]int64{1: 3000, 2: 4000}, unapplied: 1000, completed: true},
+	}
+	admin := &data.User{ID: 3, Name: "Clerk", Email: "clerk@example.com", Activated: true}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			posted := map[int64]int64{}
+			var completed bool
+			app := newTestApplication(t, signedIn(admin, []string{data.PermissionAdmin}, func(query string, args []driver.Value) stubResult {
+				switch {
+				case strings.Contains(query, "INSERT INTO payments"):
+					return stubResult{rows: [][]driver.Value{{int64(10), time.Now()}}}
+				case strings.Contains(query, "SELECT id FROM payment_plans"):
+					if !tt.plan {
+						return stubResult{}
+					}
+					return stubResult{rows: [][]driver.Value{{int64(5)}}}
+				case strings.Contains(query, "FROM plan_installments"):
+					return stubResult{rows: [][]driver.Value{{int64(11), int64(2500)}, {int64(12), int64(2500)}}}
+				case strings.Contains(query, "UPDATE payment_plans"):
+					completed = true
+					return stubResult{affected: 1}
+				case strings.Contains(query, "SELECT state, amount"):
+					return stubResult{rows: [][]driver.Value{{data.BillIssued, int64(100000), int64(0), int64(0)}}}
+				case strings.Contains(query, "SET amount_paid = amount_paid + $1, version"):
+					posted[args[1].(int64)] += args[0].(int64)
+					return stubResult{affected: 1}
+				case strings.Contains(query, "INSERT INTO water_system_history"):
+					return stubResult{affected: 1}
+				case strings.Contains(query, "FROM water_system"):
+					return stubResult{rows: [][]driver.Value{{int64(1), int64(3000)}, {int64(2), int64(4000)}}}
+				case strings.Contains(query, "FROM users"):
+					return stubResult{}
+				case strings.Contains(query, "UPDATE"), strings.Contains(query, "INSERT INTO"):
+					return stubResult{affected: 1}
+				}
+				t.Errorf("unexpected statement: %s", query)
+				return stubResult{}
+			}))
+			body := fmt.Sprintf(`{"user_id":7,"amount":%d,"reference":"RCPT-1"}`, tt.amount)
+			rr := serve(t, app, httptest.NewRequest(http.MethodPost, "/v1/payments", strings.NewReader(body)), true)
+			if rr.Code != http.StatusCreated {
+				t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+			}
+			var response struct {
+				Payment data.Payment `json:"payment"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			payment := response.Payment
+			var allocations []string
+			var sum int64
+			for _, allocation := range payment.Allocations {
+				switch {
+				case allocation.BillID != nil:
+					allocations = append(allocations, fmt.Sprintf("bill %d: %d", *allocation.BillID, allocation.Amount))
+				case allocation.InstallmentID != nil:
+					allocations = append(allocations, fmt.Sprintf("installment %d: %d", *allocation.InstallmentID, allocation.Amount))
+				}
+				sum += allocation.Amount
+			}
+			if !reflect.DeepEqual(allocations, tt.allocations) {
+				t.Errorf("got the allocations %v, want %v", allocations, tt.allocations)
+			}
+			if payment.Unapplied != tt.unapplied {
+				t.Errorf("got %d unapplied, want %d", payment.Unapplied, tt.unapplied)
+			}
+			if sum != payment.Amount-payment.Unapplied {
+				t.Errorf("the allocations add up to %d, want %d", sum, payment.Amount-payment.Unapplied)
+			}
+			if !reflect.DeepEqual(posted, tt.posted) {
+				t.Errorf("posted %v against the bills, want %v", posted, tt.posted)
+			}
+			if completed != tt.completed {
+				t.Errorf("completed the plan is %t, want %t", completed, tt.completed)
+			}
+			if (payment.PlanID != nil) != tt.plan {
+				t.Errorf("got the plan %v", payment.PlanID)
+			}
+		})
+	}
+}
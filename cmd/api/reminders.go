@@ -0,0 +1,31 @@
+// Filename: cmd/api/reminders.go
+
+package main
+
+import (
+	"context"
+	"strconv"
+)
+
+// queueReminders() queues one kind of reminder for each configured offset. Every
+// offset is tried, the first error is returned
+func (app *application) queueReminders(ctx context.Context, kind string, offsets []int) error {
+	var firstErr error
+	for _, offset := range offsets {
+		count, err := app.models.Reminders.Queue(ctx, kind, offset)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if count > 0 {
+			app.logger.PrintInfo("bill reminders queued", map[string]string{
+				"kind":  kind,
+				"days":  strconv.Itoa(offset),
+				"count": strconv.Itoa(count),
+			})
+		}
+	}
+	return firstErr
+}
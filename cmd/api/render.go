@@ -0,0 +1,450 @@
+// Filename: cmd/api/render.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The media types responses can be rendered in
+const (
+	mediaTypeJSON = "application/json"
+	mediaTypeXML  = "application/xml"
+	mediaTypePDF  = "application/pdf"
+)
+
+// The formats each endpoint produces, the first one is used when the client does not
+// say. Every endpoint renders its envelope in the responseTypes, a few also produce a
+// printable bill or a spreadsheet
+var (
+	responseTypes = []string{mediaTypeJSON, mediaTypeXML, mediaTypeCSV}
+	billTypes     = []string{mediaTypeJSON, mediaTypeXML, mediaTypeCSV, mediaTypePDF}
+	listTypes     = []string{mediaTypeJSON, mediaTypeXML, mediaTypeCSV, mediaTypeXLSX}
+	pdfTypes      = []string{mediaTypePDF}
+)
+
+// produces() refuses requests whose Accept header rules out every format the handler
+// produces, before any work is done for them
+func (app *application) produces(types []string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if negotiate(r.Header.Get("Accept"), types...) == "" {
+			app.notAcceptableResponse(w, r, types)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// writeResponse() renders the envelope in the format the Accept header asks for: JSON,
+// XML or CSV. A client that accepts none of the three gets 406 Not Acceptable
+func (app *application) writeResponse(w http.ResponseWriter, r *http.Request, status int, data envelope, headers http.Header) error {
+	mediaType := negotiate(r.Header.Get("Accept"), responseTypes...)
+	if mediaType == "" {
+		app.notAcceptableResponse(w, r, responseTypes)
+		return nil
+	}
+	return app.render(w, status, mediaType, data, headers)
+}
+
+// render() writes the envelope in one of the responseTypes. JSON is indented in
+// development and compact everywhere else
+func (app *application) render(w http.ResponseWriter, status int, mediaType string, data envelope, headers http.Header) error {
+	pretty := app.config.env == "development"
+
+	var (
+		body []byte
+		err  error
+	)
+	switch mediaType {
+	case mediaTypeXML:
+		body, err = renderXML(data, pretty)
+		mediaType += "; charset=utf-8"
+	case mediaTypeCSV:
+		body, err = renderCSV(data)
+		mediaType += "; charset=utf-8"
+	default:
+		if pretty {
+			body, err = json.MarshalIndent(data, "", "\t")
+		} else {
+			body, err = json.Marshal(data)
+		}
+		// Add a newline to make viewing on the terminal easier
+		body = append(body, '\n')
+	}
+	if err != nil {
+		return err
+	}
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+	w.Header().Set("Content-Type", mediaType)
+	varyAccept(w.Header())
+	w.WriteHeader(status)
+	w.Write(body)
+	return nil
+}
+
+// varyAccept() tells caches that the response depends on the Accept header, once
+func varyAccept(h http.Header) {
+	for _, value := range h.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), "Accept") {
+				return
+			}
+		}
+	}
+	h.Add("Vary", "Accept")
+}
+
+// negotiate() picks the offer the Accept header likes best, following the q values
+// and letting the most specific matching range decide each offer's q. Ties go to the
+// offer listed first. It returns the first offer when there is no Accept header and
+// an empty string when nothing offered is acceptable
+func negotiate(accept string, offers ...string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+	type acceptRange struct {
+		typ, subtype string
+		q            float64
+	}
+	var ranges []acceptRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		typ, subtype, _ := strings.Cut(mediaType, "/")
+		ranges = append(ranges, acceptRange{typ, subtype, q})
+	}
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		typ, subtype, _ := strings.Cut(offer, "/")
+		q, specificity := 0.0, -1
+		for _, rng := range ranges {
+			s := -1
+			switch {
+			case rng.typ == typ && rng.subtype == subtype:
+				s = 2
+			case rng.typ == typ && rng.subtype == "*":
+				s = 1
+			case rng.typ == "*" && rng.subtype == "*":
+				s = 0
+			}
+			if s > specificity {
+				q, specificity = rng.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// The XML and CSV renderers work from the JSON of the envelope, so that they follow
+// the same json tags as the JSON output. Objects are decoded into ordered maps to keep
+// the fields in the order they are declared in
+
+// orderedObject is a JSON object that remembers the order of its keys
+type orderedObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+// toOrdered() turns a value into plain JSON values with ordered objects
+func toOrdered(v interface{}) (interface{}, error) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	return decodeOrdered(dec)
+}
+
+func decodeOrdered(dec *json.Decoder) (interface{}, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		object := &orderedObject{values: map[string]interface{}{}}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			object.keys = append(object.keys, key.(string))
+			object.values[key.(string)] = value
+		}
+		_, err = dec.Token()
+		return object, err
+	case json.Delim('['):
+		array := []interface{}{}
+		for dec.More() {
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		_, err = dec.Token()
+		return array, err
+	default:
+		return token, nil
+	}
+}
+
+// renderXML() writes the envelope as a <response> element. Each key becomes an
+// element, the members of arrays become <item> elements and keys that are not valid
+// element names are written as <entry key="...">
+func renderXML(data envelope, pretty bool) ([]byte, error) {
+	value, err := toOrdered(data)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	if pretty {
+		enc.Indent("", "\t")
+	}
+	err = encodeXML(enc, "response", value)
+	if err == nil {
+		err = enc.Flush()
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), err
+}
+
+func encodeXML(enc *xml.Encoder, name string, value interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if !validXMLName(name) {
+		start = xml.StartElement{
+			Name: xml.Name{Local: "entry"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: name}},
+		}
+	}
+	if value == nil {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "null"}, Value: "true"})
+	}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case *orderedObject:
+		for _, key := range v.keys {
+			if err := encodeXML(enc, key, v.values[key]); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if err := encodeXML(enc, "item", item); err != nil {
+				return err
+			}
+		}
+	case nil:
+	default:
+		if err := enc.EncodeToken(xml.CharData(scalarText(v))); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// validXMLName() reports whether a key can be used as an element name as it is
+func validXMLName(name string) bool {
+	if name == "" || strings.HasPrefix(strings.ToLower(name), "xml") {
+		return false
+	}
+	for i, r := range name {
+		letter := r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+		if i == 0 && !letter {
+			return false
+		}
+		if !letter && !(r >= '0' && r <= '9') && r != '-' && r != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// renderCSV() writes the main value of the envelope, leaving out the pagination
+// metadata, as a table. A list becomes a row per member, an object a single row, and
+// an envelope holding several values a single row with a column for each. Nested
+// lists of plain values are joined with semicolons, other nested values are written
+// as JSON
+func renderCSV(data envelope) ([]byte, error) {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		if key != "metadata" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	value, err := toOrdered(data)
+	if err != nil {
+		return nil, err
+	}
+	envelope := value.(*orderedObject)
+
+	single := &orderedObject{keys: keys, values: envelope.values}
+	rows := []*orderedObject{single}
+	if len(keys) == 1 {
+		switch v := envelope.values[keys[0]].(type) {
+		case []interface{}:
+			rows = nil
+			for _, item := range v {
+				row, ok := item.(*orderedObject)
+				if !ok {
+					row = &orderedObject{keys: keys, values: map[string]interface{}{keys[0]: item}}
+				}
+				rows = append(rows, row)
+			}
+		case *orderedObject:
+			rows = []*orderedObject{v}
+		}
+	}
+
+	// The columns are the keys of every row, in the order they first appear
+	var columns []string
+	seen := map[string]bool{}
+	for _, row := range rows {
+		for _, key := range row.keys {
+			if !seen[key] {
+				seen[key] = true
+				columns = append(columns, key)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	out := csv.NewWriter(&buf)
+	out.Write(columns)
+	for _, row := range rows {
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			cell, err := csvCell(row.values[column])
+			if err != nil {
+				return nil, err
+			}
+			record[i] = cell
+		}
+		out.Write(record)
+	}
+	out.Flush()
+	return buf.Bytes(), out.Error()
+}
+
+func isArray(v interface{}) bool {
+	_, ok := v.([]interface{})
+	return ok
+}
+
+// csvCell() writes one value as the text of a cell
+func csvCell(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return safeCell(v), nil
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			if _, ok := item.(*orderedObject); ok || isArray(item) {
+				return jsonText(value)
+			}
+			parts[i] = scalarText(item)
+		}
+		return safeCell(strings.Join(parts, ";")), nil
+	case *orderedObject:
+		return jsonText(value)
+	default:
+		return scalarText(v), nil
+	}
+}
+
+// scalarText() writes a string, number or boolean as text
+func scalarText(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// jsonText() writes a nested value back out as compact JSON
+func jsonText(value interface{}) (string, error) {
+	var buf bytes.Buffer
+	err := writeOrderedJSON(&buf, value)
+	return buf.String(), err
+}
+
+func writeOrderedJSON(w io.Writer, value interface{}) error {
+	switch v := value.(type) {
+	case *orderedObject:
+		io.WriteString(w, "{")
+		for i, key := range v.keys {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			k, _ := json.Marshal(key)
+			w.Write(k)
+			io.WriteString(w, ":")
+			if err := writeOrderedJSON(w, v.values[key]); err != nil {
+				return err
+			}
+		}
+		_, err := io.WriteString(w, "}")
+		return err
+	case []interface{}:
+		io.WriteString(w, "[")
+		for i, item := range v {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			if err := writeOrderedJSON(w, item); err != nil {
+				return err
+			}
+		}
+		_, err := io.WriteString(w, "]")
+		return err
+	default:
+		js, err := json.Marshal(v)
+		if err != nil {
+			return errors.New("cannot render value as JSON")
+		}
+		_, err = w.Write(js)
+		return err
+	}
+}
@@ -0,0 +1,92 @@
+// Filename: cmd/api/render_test.go
+
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept string
+		offers []string
+		want   string
+	}{
+		{"", responseTypes, mediaTypeJSON},
+		{"*/*", responseTypes, mediaTypeJSON},
+		{"application/xml", responseTypes, mediaTypeXML},
+		{"text/*", responseTypes, mediaTypeCSV},
+		{"application/xml;q=0.5, text/csv", responseTypes, mediaTypeCSV},
+		{"application/json;q=0, */*", responseTypes, mediaTypeXML},
+		{"application/pdf", responseTypes, ""},
+		{"application/pdf", billTypes, mediaTypePDF},
+		{"application/pdf, application/json;q=0.9", billTypes, mediaTypePDF},
+		{"image/png", listTypes, ""},
+		{"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", listTypes, mediaTypeXLSX},
+		{"not a media type", responseTypes, ""},
+	}
+	for _, tt := range tests {
+		if got := negotiate(tt.accept, tt.offers...); got != tt.want {
+			t.Errorf("negotiate(%q, %v) = %q, want %q", tt.accept, tt.offers, got, tt.want)
+		}
+	}
+}
+
+// Requests accepting none of the formats a route produces are refused before the
+// handler does any work. Errors fall back to JSON
+func TestProduces(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		accept      string
+		status      int
+		contentType string
+	}{
+		{name: "healthcheck as JSON", method: http.MethodGet, path: "/v1/healthcheck", status: http.StatusOK, contentType: "application/json"},
+		{name: "healthcheck as CSV", method: http.MethodGet, path: "/v1/healthcheck", accept: "text/csv", status: http.StatusOK, contentType: "text/csv; charset=utf-8"},
+		{name: "healthcheck as PDF", method: http.MethodGet, path: "/v1/healthcheck", accept: "application/pdf", status: http.StatusNotAcceptable, contentType: "application/json"},
+		{name: "listing as an image", method: http.MethodGet, path: "/v1/waterbill", accept: "image/png", status: http.StatusNotAcceptable, contentType: "application/json"},
+		{name: "create as PDF", method: http.MethodPost, path: "/v1/waterbill", accept: "application/pdf", status: http.StatusNotAcceptable, contentType: "application/json"},
+		{name: "trash as PDF", method: http.MethodGet, path: "/v1/waterbill/trash", accept: "application/pdf", status: http.StatusNotAcceptable, contentType: "application/json"},
+		{name: "printable bill as JSON", method: http.MethodGet, path: "/v1/waterbill/1/pdf", accept: "application/json", status: http.StatusNotAcceptable, contentType: "application/json"},
+		{name: "unknown route as PDF", method: http.MethodGet, path: "/v1/nowhere", accept: "application/pdf", status: http.StatusNotFound, contentType: "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t, func(query string, args []driver.Value) stubResult {
+				t.Errorf("unexpected statement: %s", query)
+				return stubResult{}
+			})
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{}`))
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			rr := serve(t, app, r, false)
+			if rr.Code != tt.status {
+				t.Errorf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if got := rr.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("got Content-Type %q, want %q", got, tt.contentType)
+			}
+		})
+	}
+}
+
+func TestWriteResponseNotAcceptable(t *testing.T) {
+	app := newTestApplication(t, nil)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept", "application/pdf")
+	rr := httptest.NewRecorder()
+	err := app.writeResponse(rr, r, http.StatusOK, envelope{"ok": true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusNotAcceptable {
+		t.Errorf("got status %d, want 406", rr.Code)
+	}
+}
@@ -4,29 +4,94 @@ package main
 import (
 	"net/http"
 	"github.com/julienschmidt/httprouter"
+	"water.biling.system.driane.perez.net/internal/data"
 )
 func (app *application) routes () http.Handler{
 	//create a new httprouter router instance
 	router := httprouter.New()
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
-	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.produces(responseTypes, app.healthcheckHandler))
 
-	router.HandlerFunc(http.MethodGet, "/v1/waterbill", app.waterbill_listHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/waterbill", app.produces(listTypes, app.waterbill_listHandler))
 
-	router.HandlerFunc(http.MethodPost, "/v1/waterbill", app.createwaterbill_listHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/waterbill/:id", app.showwaterbill_listHandler)
-	router.HandlerFunc(http.MethodPatch, "/v1/waterbill/:id", app.updatewaterbill_listHandler)
-	router.HandlerFunc(http.MethodDelete, "/v1/waterbill/:id", app.deletewaterbill_listItemHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/waterbill", app.produces(responseTypes, app.requireActivatedUser(app.createwaterbill_listHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/waterbill/:id", app.produces(responseTypes, app.withActions(map[string]http.HandlerFunc{
+		"import": app.requirePermission(data.PermissionAdmin, app.importBillsHandler),
+		"batch":  app.requirePermission(data.PermissionAdmin, app.batchBillsHandler),
+	}, nil)))
+	router.HandlerFunc(http.MethodGet, "/v1/waterbill/:id", app.withActions(map[string]http.HandlerFunc{
+		"trash": app.produces(responseTypes, app.requireActivatedUser(app.listTrashHandler)),
+	}, app.produces(billTypes, app.showwaterbill_listHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/waterbill/:id/restore", app.produces(responseTypes, app.requireActivatedUser(app.restoreBillHandler)))
+	router.HandlerFunc(http.MethodPatch, "/v1/waterbill/:id", app.produces(responseTypes, app.requireActivatedUser(app.updatewaterbill_listHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/waterbill/:id", app.produces(responseTypes, app.requireActivatedUser(app.deletewaterbill_listItemHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/waterbill/:id/pdf", app.produces(pdfTypes, app.requireActivatedUser(app.showBillPDFHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/waterbill/:id/transitions", app.produces(responseTypes, app.listBillTransitionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/waterbill/:id/history", app.produces(responseTypes, app.requireActivatedUser(app.listBillHistoryHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/waterbill/:id/history/:version", app.produces(responseTypes, app.requireActivatedUser(app.showBillVersionHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/waterbill/:id/transitions", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.transitionBillHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/waterbill/:id/adjustments", app.produces(responseTypes, app.listBillAdjustmentsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/waterbill/:id/adjustments", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.createAdjustmentHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/adjustments/:id", app.produces(responseTypes, app.showAdjustmentHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/search", app.produces(responseTypes, app.searchHandler))
 
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
-	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/jobs", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.listJobsHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/jobs/runs", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.listJobRunsHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/outbox", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.listOutboxHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/outbox/:id", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.showOutboxHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/outbox/:id/requeue", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.requeueOutboxHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.listWebhooksHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/webhooks", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.createWebhookHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.showWebhookHandler)))
+	router.HandlerFunc(http.MethodPatch, "/v1/webhooks/:id", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.updateWebhookHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/webhooks/:id", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.deleteWebhookHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id/deliveries", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.listWebhookDeliveriesHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/webhooks/:id/test", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.testWebhookHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/categories", app.produces(responseTypes, app.listCategoriesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/categories", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.createCategoryHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/categories/:code", app.produces(responseTypes, app.showCategoryHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/categories/:code", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.updateCategoryHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/priorities", app.produces(responseTypes, app.listPrioritiesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/priorities", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.createPriorityHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/priorities/:code", app.produces(responseTypes, app.showPriorityHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/priorities/:code", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.updatePriorityHandler)))
+
+	router.HandlerFunc(http.MethodPost, "/v1/users", app.produces(responseTypes, app.registerUserHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.produces(responseTypes, app.activateUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/notifications", app.produces(responseTypes, app.requireActivatedUser(app.showNotificationPreferencesHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/notifications", app.produces(responseTypes, app.requireActivatedUser(app.updateNotificationPreferencesHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.produces(responseTypes, app.createAuthenticationTokenHandler))
+
+	router.HandlerFunc(http.MethodPost, "/v1/disconnections", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.runDisconnectionsHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/disconnections", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.listDisconnectionsHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/disconnections/:id", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.showDisconnectionHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/disconnections/:id/schedule", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.scheduleDisconnectionHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/disconnections/:id/disconnect", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.disconnectHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/disconnections/:id/reconnect", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.reconnectHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/disconnections/:id/cancel", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.cancelDisconnectionHandler)))
+
+	router.HandlerFunc(http.MethodPost, "/v1/disputes", app.produces(responseTypes, app.requireActivatedUser(app.createDisputeHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/disputes/:id", app.produces(responseTypes, app.requireActivatedUser(app.showDisputeHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/disputes/:id/resolved", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.resolveDisputeHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/payment-plans", app.produces(responseTypes, app.requireActivatedUser(app.listPaymentPlansHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/payment-plans", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.createPaymentPlanHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/payment-plans/:id", app.produces(responseTypes, app.requireActivatedUser(app.showPaymentPlanHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/payment-plans/:id/cancel", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.cancelPaymentPlanHandler)))
+
+	router.HandlerFunc(http.MethodPost, "/v1/payments", app.produces(responseTypes, app.requirePermission(data.PermissionAdmin, app.createPaymentHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/payments/:id", app.produces(responseTypes, app.requireActivatedUser(app.showPaymentHandler)))
 
 
 
 
 
 	//we wrap router with recoverpanic will call router if everthing is okay
-	//then we pass to the rate limit and the process the actual request
-	return app.recoverPanic(app.rateLimit(router))
+	//then we pass to the rate limit, work out who the user is and the process the
+	//actual request. Each route refuses clients that accept none of the formats it produces
+	return app.recoverPanic(app.rateLimit(app.authenticate(router)))
 }
\ No newline at end of file
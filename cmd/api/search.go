@@ -0,0 +1,44 @@
+// Filename: cmd/api/search.go
+
+package main
+
+import (
+	"net/http"
+
+	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+// The searchHandler() finds bills by the words in q, best match first, with a snippet
+// of each bill showing the words it matched. The last word also matches longer words
+// it is the start of. language picks how words are stemmed, see data.SearchLanguages
+func (app *application) searchHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Q        string
+		Language string
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	input.Q = app.readString(qs, "q", "")
+	input.Language = app.readString(qs, "language", app.config.search.language)
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	// Results always come in order of rank
+	input.Filters.Sort = "rank"
+	input.Filters.SortList = []string{"rank"}
+	data.ValidateSearch(v, input.Q, input.Language)
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	results, metadata, err := app.models.Todo_list.Search(input.Q, input.Language, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"results": results, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
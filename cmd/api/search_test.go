@@ -0,0 +1,63 @@
+// Filename: cmd/api/search_test.go
+
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/data"
+)
+
+func TestSearchHandler(t *testing.T) {
+	bill := &data.Todo_list{ID: 7, Waterbill: "<script>alert(1)</script> leak", State: data.BillIssued, DueDate: time.Now(), Version: 1}
+	tests := []struct {
+		name    string
+		query   string
+		status  int
+		snippet string
+	}{
+		{name: "snippet escaped", query: "q=leak", status: http.StatusOK, snippet: "&lt;script&gt;alert(1)&lt;/script&gt; <mark>leak</mark>"},
+		{name: "no words", query: "q=%26%7C", status: http.StatusUnprocessableEntity},
+		{name: "unknown language", query: "q=leak&language=klingon", status: http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t, func(query string, args []driver.Value) stubResult {
+				if tt.status != http.StatusOK {
+					t.Errorf("unexpected statement: %s", query)
+					return stubResult{}
+				}
+				if args[0] != "simple" || args[1] != "'leak':*" {
+					t.Errorf("got language %v and query %v", args[0], args[1])
+				}
+				row := append([]driver.Value{int64(1)}, billRow(bill)[:17]...)
+				row = append(row, 0.5, "<script>alert(1)</script> \x01leak\x02")
+				return stubResult{rows: [][]driver.Value{row}}
+			})
+			app.config.search.language = "simple"
+			rr := serve(t, app, httptest.NewRequest(http.MethodGet, "/v1/search?"+tt.query, nil), false)
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var body struct {
+				Results []struct {
+					Snippet string `json:"snippet"`
+				} `json:"results"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if len(body.Results) != 1 || body.Results[0].Snippet != tt.snippet {
+				t.Errorf("got results %+v, want the snippet %q", body.Results, tt.snippet)
+			}
+		})
+	}
+}
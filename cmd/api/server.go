@@ -51,6 +51,10 @@ func (app *application) serve() error {
 		app.logger.PrintInfo("Completing background tasks", map[string]string{
 			"addr": srv.Addr,
 		})
+		// Stop scheduling jobs and sending queued notifications, the running work is
+		// waited for below
+		app.jobs.Stop()
+		app.stopWorkers()
 		app.wg.Wait()
 		shutdownError <- nil
 	}()
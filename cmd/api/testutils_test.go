@@ -0,0 +1,213 @@
+// Filename: cmd/api/testutils_test.go
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/jsonlog"
+)
+
+// The handlers are tested against a stub database driver that hands every statement to
+// a function of the test, so that they run without PostgreSQL
+
+// A stubResult is what the stub database answers a statement with. A query with no
+// rows makes QueryRow() fail with sql.ErrNoRows
+type stubResult struct {
+	rows     [][]driver.Value
+	affected int64
+	err      error
+}
+
+// A stubHandler answers the statements sent to the stub database
+type stubHandler func(query string, args []driver.Value) stubResult
+
+var (
+	stubMu       sync.Mutex
+	stubHandlers = map[string]stubHandler{}
+	stubCount    int
+)
+
+func init() {
+	sql.Register("stub", stubDriver{})
+}
+
+type stubDriver struct{}
+
+func (stubDriver) Open(name string) (driver.Conn, error) {
+	stubMu.Lock()
+	defer stubMu.Unlock()
+	handler, ok := stubHandlers[name]
+	if !ok {
+		return nil, fmt.Errorf("no stub database named %q", name)
+	}
+	return &stubConn{handler: handler}, nil
+}
+
+type stubConn struct {
+	handler stubHandler
+}
+
+func (c *stubConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("the stub database does not prepare statements")
+}
+
+func (c *stubConn) Close() error { return nil }
+
+func (c *stubConn) Begin() (driver.Tx, error) { return stubTx{}, nil }
+
+func (c *stubConn) QueryContext(ctx context.Context, query string, named []driver.NamedValue) (driver.Rows, error) {
+	result := c.handler(query, values(named))
+	if result.err != nil {
+		return nil, result.err
+	}
+	return &stubRows{rows: result.rows}, nil
+}
+
+func (c *stubConn) ExecContext(ctx context.Context, query string, named []driver.NamedValue) (driver.Result, error) {
+	result := c.handler(query, values(named))
+	if result.err != nil {
+		return nil, result.err
+	}
+	return driver.RowsAffected(result.affected), nil
+}
+
+// The stub database converts the arguments the way database/sql does for a driver
+// without a converter of its own, so pointers and pq.Array() arrive as plain values
+func (c *stubConn) CheckNamedValue(nv *driver.NamedValue) error {
+	value, err := driver.DefaultParameterConverter.ConvertValue(nv.Value)
+	if err != nil {
+		return err
+	}
+	nv.Value = value
+	return nil
+}
+
+func values(named []driver.NamedValue) []driver.Value {
+	args := make([]driver.Value, len(named))
+	for i, nv := range named {
+		args[i] = nv.Value
+	}
+	return args
+}
+
+type stubTx struct{}
+
+func (stubTx) Commit() error   { return nil }
+func (stubTx) Rollback() error { return nil }
+
+type stubRows struct {
+	rows [][]driver.Value
+	next int
+}
+
+func (r *stubRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	columns := make([]string, len(r.rows[0]))
+	for i := range columns {
+		columns[i] = fmt.Sprintf("column%d", i)
+	}
+	return columns
+}
+
+func (r *stubRows) Close() error { return nil }
+
+func (r *stubRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
+
+// newTestApplication() returns an application whose models talk to a stub database
+// answering with the handler
+func newTestApplication(t *testing.T, handler stubHandler) *application {
+	t.Helper()
+	stubMu.Lock()
+	stubCount++
+	name := fmt.Sprintf("%s-%d", t.Name(), stubCount)
+	stubHandlers[name] = handler
+	stubMu.Unlock()
+
+	db, err := sql.Open("stub", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	app := &application{
+		logger: jsonlog.New(io.Discard, jsonlog.LevelOff),
+		models: data.NewModels(db),
+		quit:   make(chan struct{}),
+	}
+	app.config.env = "testing"
+	return app
+}
+
+// testToken is the bearer token the signed-in test user sends
+const testToken = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// signedIn() answers the authentication and permission lookups for the user, and hands
+// every other statement on to next
+func signedIn(user *data.User, permissions []string, next stubHandler) stubHandler {
+	return func(query string, args []driver.Value) stubResult {
+		switch {
+		case strings.Contains(query, "INNER JOIN tokens"):
+			return stubResult{rows: [][]driver.Value{{
+				user.ID, time.Now(), user.Name, user.Email, []byte("hash"), user.Activated, int64(1),
+			}}}
+		case strings.Contains(query, "FROM permissions"):
+			rows := [][]driver.Value{}
+			for _, code := range permissions {
+				rows = append(rows, []driver.Value{code})
+			}
+			return stubResult{rows: rows}
+		case next != nil:
+			return next(query, args)
+		}
+		return stubResult{err: fmt.Errorf("unexpected statement: %s", query)}
+	}
+}
+
+// serve() sends the request through the routes and middleware of the application as
+// the signed-in user, or anonymously when authenticated is false
+func serve(t *testing.T, app *application, r *http.Request, authenticated bool) *httptest.ResponseRecorder {
+	t.Helper()
+	if authenticated {
+		r.Header.Set("Authorization", "Bearer "+testToken)
+	}
+	rr := httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, r)
+	return rr
+}
+
+// billRow() is the row the stub database answers a query for every field of the bill
+// with, in the order the data models select them
+func billRow(bill *data.Todo_list) []driver.Value {
+	var issuedAt, deletedAt driver.Value
+	if bill.IssuedAt != nil {
+		issuedAt = *bill.IssuedAt
+	}
+	if bill.DeletedAt != nil {
+		deletedAt = *bill.DeletedAt
+	}
+	return []driver.Value{
+		bill.ID, bill.CreatedAt, bill.Waterbill, bill.Description, bill.Notes, bill.Category, bill.Priority,
+		[]byte("{}"), bill.State, bill.UserID, bill.Amount, bill.AmountPaid, bill.AmountCredited,
+		bill.DueDate, issuedAt, bill.DeliveryStatus, int64(bill.Version), deletedAt, bill.DeletedBy,
+	}
+}
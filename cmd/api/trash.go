@@ -0,0 +1,87 @@
+// Filename: cmd/api/trash.go
+
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+// The listTrashHandler() shows the deleted bills that have not been purged yet, most
+// recently deleted first. Admins see every deleted bill, everyone else the ones of
+// their own account
+func (app *application) listTrashHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.BillQuery
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	input.Deleted = true
+	input.StatusMatch = data.StatusMatchAll
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.After = app.readString(qs, "after", "")
+	input.Filters.Before = app.readString(qs, "before", "")
+	input.Filters.Sort = app.readString(qs, "sort", "-deleted_at")
+	input.Filters.SortList = []string{"id", "deleted_at", "-id", "-deleted_at"}
+	fields, include := app.readBillView(qs, v)
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	userID, err := app.accountScope(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	input.UserID = userID
+	bills, metadata, err := app.models.Todo_list.GetAll(input.BillQuery, input.Filters, billColumns(fields, include))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	views, err := app.billViews(bills, fields, include)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"waterbill": views, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The restoreBillHandler() takes a bill out of the trash. Admins can restore any bill,
+// everyone else the bills of their own account. Other bills are not found
+func (app *application) restoreBillHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	ownerID, err := app.accountScope(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	bill, err := app.models.Todo_list.Restore(id, ownerID, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("ETag", responseETag(r, bill))
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"waterbill": bill}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,180 @@
+// Filename: cmd/api/trash_test.go
+
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/data"
+)
+
+// Admins see the whole trash, everyone else only the bills of their own account
+func TestListTrashAccess(t *testing.T) {
+	user := &data.User{ID: 7, Name: "Ana Perez", Email: "ana@example.com", Activated: true}
+	inactive := &data.User{ID: 8, Name: "Ben Ortiz", Email: "ben@example.com"}
+	tests := []struct {
+		name          string
+		user          *data.User
+		permissions   []string
+		authenticated bool
+		status        int
+		scope         int64
+	}{
+		{name: "anonymous", user: user, status: http.StatusUnauthorized},
+		{name: "not activated", user: inactive, authenticated: true, status: http.StatusForbidden},
+		{name: "account holder", user: user, authenticated: true, status: http.StatusOK, scope: user.ID},
+		{name: "admin", user: user, permissions: []string{data.PermissionAdmin}, authenticated: true, status: http.StatusOK, scope: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listed := false
+			app := newTestApplication(t, signedIn(tt.user, tt.permissions, func(query string, args []driver.Value) stubResult {
+				if !strings.Contains(query, "FROM water_system") {
+					t.Errorf("unexpected statement: %s", query)
+					return stubResult{}
+				}
+				listed = true
+				if args[10] != true || args[11] != tt.scope {
+					t.Errorf("listed deleted=%v for account %v, want the trash of %d", args[10], args[11], tt.scope)
+				}
+				return stubResult{}
+			}))
+			rr := serve(t, app, httptest.NewRequest(http.MethodGet, "/v1/waterbill/trash", nil), tt.authenticated)
+			if rr.Code != tt.status {
+				t.Errorf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if listed != (tt.status == http.StatusOK) {
+				t.Errorf("listed the trash: %t", listed)
+			}
+		})
+	}
+}
+
+// Bills of other accounts are not found, admins restore any bill
+func TestRestoreBillAccess(t *testing.T) {
+	owner := &data.User{ID: 7, Name: "Ana Perez", Email: "ana@example.com", Activated: true}
+	other := &data.User{ID: 8, Name: "Ben Ortiz", Email: "ben@example.com", Activated: true}
+	deleted := time.Now()
+	bill := &data.Todo_list{ID: 1, State: data.BillDraft, UserID: owner.ID, DueDate: time.Now(), Version: 2, DeletedAt: &deleted}
+	tests := []struct {
+		name          string
+		user          *data.User
+		permissions   []string
+		authenticated bool
+		status        int
+	}{
+		{name: "anonymous", user: owner, status: http.StatusUnauthorized},
+		{name: "account holder", user: owner, authenticated: true, status: http.StatusOK},
+		{name: "someone else", user: other, authenticated: true, status: http.StatusNotFound},
+		{name: "admin", user: other, permissions: []string{data.PermissionAdmin}, authenticated: true, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t, signedIn(tt.user, tt.permissions, func(query string, args []driver.Value) stubResult {
+				switch {
+				case strings.Contains(query, "INSERT INTO water_system_history"):
+					return stubResult{affected: 1}
+				case strings.Contains(query, "UPDATE water_system"):
+					// The stub stands in for the user_id condition of the query
+					if owner := args[1].(int64); owner != 0 && owner != bill.UserID {
+						return stubResult{}
+					}
+					restored := *bill
+					restored.DeletedAt, restored.Version = nil, 3
+					return stubResult{rows: [][]driver.Value{billRow(&restored)}}
+				case strings.Contains(query, "INSERT INTO webhook_deliveries"):
+					return stubResult{affected: 1}
+				}
+				t.Errorf("unexpected statement: %s", query)
+				return stubResult{}
+			}))
+			rr := serve(t, app, httptest.NewRequest(http.MethodPost, "/v1/waterbill/1/restore", nil), tt.authenticated)
+			if rr.Code != tt.status {
+				t.Errorf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+		})
+	}
+}
+
+// Purging keeps the history of the bills, ending it with the bill as it last was
+func TestPurgeKeepsHistory(t *testing.T) {
+	var statements []string
+	app := newTestApplication(t, func(query string, args []driver.Value) stubResult {
+		switch {
+		case strings.Contains(query, "INSERT INTO water_system_history"):
+			statements = append(statements, "history")
+			if args[0] != data.HistoryPurged || args[2] != int64(3600) {
+				t.Errorf("recorded %v for bills older than %v", args[0], args[2])
+			}
+			return stubResult{affected: 2}
+		case strings.Contains(query, "DELETE FROM water_system"):
+			statements = append(statements, "delete")
+			return stubResult{affected: 2}
+		}
+		t.Errorf("unexpected statement: %s", query)
+		return stubResult{}
+	})
+	count, err := app.models.Todo_list.Purge(context.Background(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("purged %d bills, want 2", count)
+	}
+	if got := strings.Join(statements, ", "); got != "history, delete" {
+		t.Errorf("got statements %s, want history, delete", got)
+	}
+}
+
+// Only the owner of a bill and admins may put it in the trash
+func TestDeleteBillAccess(t *testing.T) {
+	owner := &data.User{ID: 7, Name: "Ana Perez", Email: "ana@example.com", Activated: true}
+	other := &data.User{ID: 8, Name: "Ben Ortiz", Email: "ben@example.com", Activated: true}
+	bill := &data.Todo_list{ID: 1, State: data.BillDraft, UserID: owner.ID, DueDate: time.Now(), Version: 2}
+	tests := []struct {
+		name          string
+		user          *data.User
+		permissions   []string
+		authenticated bool
+		status        int
+	}{
+		{name: "anonymous", user: owner, status: http.StatusUnauthorized},
+		{name: "account holder", user: owner, authenticated: true, status: http.StatusOK},
+		{name: "someone else", user: other, authenticated: true, status: http.StatusForbidden},
+		{name: "admin", user: other, permissions: []string{data.PermissionAdmin}, authenticated: true, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var deleted bool
+			app := newTestApplication(t, signedIn(tt.user, tt.permissions, func(query string, args []driver.Value) stubResult {
+				switch {
+				case strings.Contains(query, "INSERT INTO water_system_history"), strings.Contains(query, "INSERT INTO webhook_deliveries"):
+					return stubResult{affected: 1}
+				case strings.Contains(query, "UPDATE water_system"):
+					deleted = true
+					trashed := *bill
+					now := time.Now()
+					trashed.DeletedAt, trashed.Version = &now, 3
+					return stubResult{rows: [][]driver.Value{billRow(&trashed)}}
+				case strings.Contains(query, "FROM water_system"):
+					return stubResult{rows: [][]driver.Value{billRow(bill)}}
+				}
+				t.Errorf("unexpected statement: %s", query)
+				return stubResult{}
+			}))
+			rr := serve(t, app, httptest.NewRequest(http.MethodDelete, "/v1/waterbill/1", nil), tt.authenticated)
+			if rr.Code != tt.status {
+				t.Errorf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if deleted != (tt.status == http.StatusOK) {
+				t.Errorf("deleted is %t with status %d", deleted, rr.Code)
+			}
+		})
+	}
+}
@@ -47,8 +47,9 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	//Insert the datain the database
-	err = app.models.Users.Insert(user)
+	// Insert the data in the database, along with the activation token and the
+	// welcome email which the outbox workers send
+	_, err = app.models.Users.Register(user, 1*24*time.Hour)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
@@ -60,29 +61,8 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Generate a token for the newly created user 
-	token, err := app.models.Tokens.New(user.ID, 1*24*time.Hour, data.ScopeActivation)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-	
-	app.background(func() {
-		data := map[string]interface{} {
-			"activationToken" : token.Plaintext, 
-			"userID" : user.ID,
-		}
-		// Send the email to the new user
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
-		if err != nil {
-			// log errors
-			app.logger.PrintError(err, nil)
-		}
-
-	})
-
 	//write a 202 Accepted status
-	err = app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil)
+	err = app.writeResponse(w, r, http.StatusAccepted, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -118,10 +98,8 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 			}
 			return
 		}
-		//Update the user status
-		user.Activated = true
-		//Save the update user's record in our database
-		err = app.models.Users.Update(user)
+		//Activate the user and delete the tokens that could activate them
+		err = app.models.Users.Activate(user)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrEditConflict):
@@ -131,14 +109,8 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 			}
 			return
 		}
-		//Delete the user's token that was used for activation
-		err = app.models.Tokens.DeleteAllForUsers(data.ScopeActivation, user.ID)
-		if err != nil {
-			app.serverErrorResponse(w, r, err)
-			return
-		}
 		// Send a json response with the updated details 
-		err = app.writeJSON(w, http.StatusOK, envelope{"user":user}, nil)
+		err = app.writeResponse(w, r, http.StatusOK, envelope{"user":user}, nil)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -14,12 +14,14 @@ import (
 func (app *application) createwaterbill_listHandler(w http.ResponseWriter, r *http.Request) {
 	//our target decode destination
 	var todo_listtodolistdata struct {
-		Waterbill   string   `json:"waterbill"`
-		Description string   `json:"description"`
-		Notes       string   `json:"notes"`
-		Category    string   `json:"category"`
-		Priority    string   `json:"priority"`
-		Status      []string `json:"status"`
+		Waterbill   string `json:"waterbill"`
+		Description string `json:"description"`
+		Notes       string `json:"notes"`
+		Category    string `json:"category"`
+		Priority    string `json:"priority"`
+		UserID      int64  `json:"user_id"`
+		Amount      int64  `json:"amount"`
+		DueDate     string `json:"due_date"`
 	}
 	err := app.readJSON(w, r, &todo_listtodolistdata)
 	if err != nil {
@@ -33,28 +35,54 @@ func (app *application) createwaterbill_listHandler(w http.ResponseWriter, r *ht
 		Notes:       todo_listtodolistdata.Notes,
 		Category:    todo_listtodolistdata.Category,
 		Priority:    todo_listtodolistdata.Priority,
-		Status:      todo_listtodolistdata.Status,
+		UserID:      todo_listtodolistdata.UserID,
+		Amount:      todo_listtodolistdata.Amount,
 	}
 
 	//initialize a new validator instance
 	v := validator.New()
+	// the due date is optional, the database defaults it to 30 days out
+	if todo_listtodolistdata.DueDate != "" {
+		entries.DueDate = app.parseDate(v, "due_date", todo_listtodolistdata.DueDate)
+	}
 
+	// the category and priority must come from the managed vocabularies
+	err = app.validateVocabulary(v, entries)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 	//check the map to determine if there were any validation errors
 	if data.ValidateEntires(v, entries); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
+	// Customers can only bill their own account, and the account must exist
+	if !app.allowAccount(w, r, entries.UserID) {
+		return
+	}
+	err = app.checkAccount(v, entries.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
 	//create a todo_list
-	err = app.models.Todo_list.Insert(entries)
+	err = app.models.Todo_list.Insert(entries, app.contextGetUser(r).ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
 	}
 	//creates a location header for newly created resource/todo_list
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/waterbill/%d", entries.ID))
+	headers.Set("ETag", responseETag(r, entries))
 	//write the JSON response with 201 - created status code with a the body
 	//being the school todolistdata and the header being the headers map
-	err = app.writeJSON(w, http.StatusCreated, envelope{"waterrbill": entries}, headers)
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"waterrbill": entries}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -69,8 +97,21 @@ func (app *application) showwaterbill_listHandler(w http.ResponseWriter, r *http
 		return
 	}
 
+	// Clients can pick the fields they want and include related resources
+	v := validator.New()
+	fields, include := app.readBillView(r.URL.Query(), v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// The printable bill needs every field
+	pdf := wantsPDF(r)
+	columns := billColumns(fields, include)
+	if pdf {
+		columns = nil
+	}
 	//fetch the specific todolist
-	todolistdata_todolist, err := app.models.Todo_list.Get(id)
+	todolistdata_todolist, err := app.models.Todo_list.GetFields(id, columns)
 	//handle errors
 	if err != nil {
 		switch {
@@ -81,8 +122,27 @@ func (app *application) showwaterbill_listHandler(w http.ResponseWriter, r *http
 		}
 		return
 	}
+	// Clients that ask for a PDF get the printable bill instead
+	if pdf {
+		app.writeBillPDF(w, r, todolistdata_todolist)
+		return
+	}
+	// The account holder and the adjustments are only shown to the owner and admins
+	if accountIncludes(include) && !app.allowAccount(w, r, todolistdata_todolist.UserID) {
+		return
+	}
+	// A client that already has this version gets 304 Not Modified
+	representation := billRepresentation(negotiate(r.Header.Get("Accept"), billTypes...), fields, include)
+	if notModified(w, r, todolistdata_todolist, representation) {
+		return
+	}
+	views, err := app.billViews([]*data.Todo_list{todolistdata_todolist}, fields, include)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 	//write the todolistdata returned by Get()
-	err = app.writeJSON(w, http.StatusOK, envelope{"waterbill": todolistdata_todolist}, nil)
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"waterbill": views[0]}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -90,6 +150,75 @@ func (app *application) showwaterbill_listHandler(w http.ResponseWriter, r *http
 
 }
 
+// A billPatch holds the fields of a bill a client sends to change it. Fields left out
+// stay as they are
+type billPatch struct {
+	Waterbill   *string `json:"waterbill"`
+	Description *string `json:"description"`
+	Notes       *string `json:"notes"`
+	Category    *string `json:"category"`
+	Priority    *string `json:"priority"`
+	UserID      *int64  `json:"user_id"`
+	Amount      *int64  `json:"amount"`
+	DueDate     *string `json:"due_date"`
+}
+
+// applyBillPatch() copies the fields of the patch onto the bill and validates the
+// result. A changed category or priority must come from the active codes passed in,
+// bills keep values that have since been deactivated until they are changed
+func (app *application) applyBillPatch(v *validator.Validator, bill *data.Todo_list, patch *billPatch, categories, priorities []string) {
+	if patch.Waterbill != nil {
+		bill.Waterbill = *patch.Waterbill
+	}
+	if patch.Description != nil {
+		bill.Description = *patch.Description
+	}
+	if patch.Notes != nil {
+		bill.Notes = *patch.Notes
+	}
+	if patch.Category != nil {
+		bill.Category = *patch.Category
+	}
+	if patch.Priority != nil {
+		bill.Priority = *patch.Priority
+	}
+	if patch.UserID != nil {
+		bill.UserID = *patch.UserID
+	}
+	if patch.Amount != nil {
+		bill.Amount = *patch.Amount
+	}
+	if patch.DueDate != nil {
+		bill.DueDate = app.parseDate(v, "due_date", *patch.DueDate)
+	}
+	if patch.Category != nil || patch.Priority != nil {
+		check := validator.New()
+		data.ValidateVocabulary(check, bill, categories, priorities)
+		if patch.Category != nil && check.Errors["category"] != "" {
+			v.AddError("category", check.Errors["category"])
+		}
+		if patch.Priority != nil && check.Errors["priority"] != "" {
+			v.AddError("priority", check.Errors["priority"])
+		}
+	}
+	data.ValidateEntires(v, bill)
+}
+
+// checkAccount() adds an error on user_id when a bill is given to an account that does
+// not exist, which the foreign key would otherwise turn into a server error. Bills
+// without an account are left alone
+func (app *application) checkAccount(v *validator.Validator, userID int64) error {
+	if userID == 0 {
+		return nil
+	}
+	existing, err := app.models.Users.Existing([]int64{userID})
+	if err != nil {
+		return err
+	}
+	v.Check(existing[userID], "user_id", "no such user")
+	return nil
+}
+
 func (app *application) updatewaterbill_listHandler(w http.ResponseWriter, r *http.Request) {
 	// This method does a partial replacement
 	// Get the id for the todo_list item that needs updating
@@ -110,19 +239,24 @@ func (app *application) updatewaterbill_listHandler(w http.ResponseWriter, r *ht
 		}
 		return
 	}
+	// Only the owner of the bill and admins may change it
+	if !app.allowAccount(w, r, todolist.UserID) {
+		return
+	}
+	// The change must be made against the version the client last read
+	conditional, ok := app.checkIfMatch(w, r, todolist)
+	if !ok {
+		return
+	}
+	// Only drafts can be edited, issued bills are corrected with adjustments
+	if todolist.State != data.BillDraft {
+		app.billIssuedResponse(w, r)
+		return
+	}
 	// Create an input struct to hold todolistdata read in from the client
-	// We update the input struct to use pointers because pointers have a
-	// default value of nil
+	// The patch uses pointers because pointers have a default value of nil,
 	// if a field remains nil then we know that the client did not update it
-	//create an input struct to hold the todo_list data
-	var todolistdata struct {
-		Waterbill   *string  `json:"waterbill"`
-		Description *string  `json:"description"`
-		Notes       *string  `json:"notes"`
-		Category    *string  `json:"category"`
-		Priority    *string  `json:"priority"`
-		Status      []string `json:"status"`
-	}
+	var todolistdata billPatch
 
 	//Initalize a new json.Decoder instance
 	err = app.readJSON(w, r, &todolistdata)
@@ -130,40 +264,46 @@ func (app *application) updatewaterbill_listHandler(w http.ResponseWriter, r *ht
 		app.badRequestResponse(w, r, err)
 		return
 	}
-	// Check for updates
-	if todolistdata.Waterbill != nil {
-		todolist.Waterbill = *todolistdata.Waterbill
-	}
-	if todolistdata.Description != nil {
-		todolist.Description = *todolistdata.Description
-	}
-	if todolistdata.Notes != nil {
-		todolist.Notes = *todolistdata.Notes
-	}
-	if todolistdata.Category != nil {
-		todolist.Category = *todolistdata.Category
-	}
-	if todolistdata.Priority != nil {
-		todolist.Priority = *todolistdata.Priority
-	}
-	if todolistdata.Status != nil {
-		todolist.Status = todolistdata.Status
-	}
-
 	// Perform Validation on the updated Todo_list item. If validation fails then
 	// we send a 422 - unprocessable entity response to the client
 	// initialize a new Validator instance
 	v := validator.New()
-
+	var categories, priorities []string
+	if todolistdata.Category != nil || todolistdata.Priority != nil {
+		categories, priorities, err = app.activeVocabulary()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
 	//Check the map to determine if there were any validation errors
-	if data.ValidateEntires(v, todolist); !v.Valid() {
+	if app.applyBillPatch(v, todolist, &todolistdata, categories, priorities); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
+	// A bill moved to another account must go to one the user may bill, that exists
+	if todolistdata.UserID != nil {
+		if !app.allowAccount(w, r, todolist.UserID) {
+			return
+		}
+		err = app.checkAccount(v, todolist.UserID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
 	// Pass the update todo record to the Update() method
-	err = app.models.Todo_list.Update(todolist)
+	err = app.models.Todo_list.Update(todolist, app.contextGetUser(r).ID)
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrBillIssued):
+			app.billIssuedResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict) && conditional:
+			app.preconditionFailedResponse(w, r)
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
 		default:
@@ -171,7 +311,9 @@ func (app *application) updatewaterbill_listHandler(w http.ResponseWriter, r *ht
 		}
 		return
 	}
-	err = app.writeJSON(w, http.StatusCreated, envelope{"todo_list": todolist}, nil)
+	headers := make(http.Header)
+	headers.Set("ETag", responseETag(r, todolist))
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"todo_list": todolist}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -184,10 +326,8 @@ func (app *application) deletewaterbill_listItemHandler(w http.ResponseWriter, r
 		app.notFoundResponse(w, r)
 		return
 	}
-	// Delete the todo item from the database. Send a 404 Not Found status code to the
-	// client if there is no matching record
-	err = app.models.Todo_list.Delete(id)
-	// Error handling
+	// Only drafts can be deleted, issued bills are part of the billing history
+	todolist, err := app.models.Todo_list.Get(id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -197,8 +337,34 @@ func (app *application) deletewaterbill_listItemHandler(w http.ResponseWriter, r
 		}
 		return
 	}
+	// Only the owner of the bill and admins may put it in the trash
+	if !app.allowAccount(w, r, todolist.UserID) {
+		return
+	}
+	conditional, ok := app.checkIfMatch(w, r, todolist)
+	if !ok {
+		return
+	}
+	if todolist.State != data.BillDraft {
+		app.billIssuedResponse(w, r)
+		return
+	}
+	// Move the bill to the trash, as long as it has not changed since it was read above
+	err = app.models.Todo_list.Delete(id, todolist.Version, app.contextGetUser(r).ID)
+	// Error handling
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict) && conditional:
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
 	// Return 200 Status OK to the client with a success message
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "todo item successfully deleted"}, nil)
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "todo item successfully deleted"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -208,9 +374,7 @@ func (app *application) deletewaterbill_listItemHandler(w http.ResponseWriter, r
 func (app *application) waterbill_listHandler(w http.ResponseWriter, r *http.Request) {
 	// Create an input struct to hold our query parameter
 	var input struct {
-		Waterbill string
-		Priority  string
-		Status    []string
+		data.BillQuery
 		data.Filters
 	}
 	// Initialize a validator
@@ -221,26 +385,63 @@ func (app *application) waterbill_listHandler(w http.ResponseWriter, r *http.Req
 	input.Waterbill = app.readString(qs, "waterbill", "")
 	input.Priority = app.readString(qs, "priority", "")
 	input.Status = app.readCSV(qs, "status", []string{})
+	input.State = app.readString(qs, "state", "")
+	if input.State != "" {
+		data.ValidateBillState(v, "state", input.State)
+	}
+	// A bill must have all of the statuses asked for, or with status_match=any one of them
+	input.StatusMatch = app.readString(qs, "status_match", data.StatusMatchAll)
+	v.Check(validator.In(input.StatusMatch, data.StatusMatchAll, data.StatusMatchAny), "status_match", "must be all or any")
+	input.Category = app.readString(qs, "category", "")
+	// text searches the description and the notes
+	input.Text = app.readString(qs, "text", "")
+	input.Version = app.readInt(qs, "version", 0, v)
+	v.Check(input.Version >= 0, "version", "must not be negative")
+	input.CreatedFrom = app.readTime(qs, "created_from", false, v)
+	input.CreatedTo = app.readTime(qs, "created_to", true, v)
+	if !input.CreatedFrom.IsZero() && !input.CreatedTo.IsZero() {
+		v.Check(input.CreatedFrom.Before(input.CreatedTo), "created_to", "must be after created_from")
+	}
 	// Get the page information using the read int method
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	// Deep pages are read from the cursors in the metadata instead of by number
+	input.Filters.After = app.readString(qs, "after", "")
+	input.Filters.Before = app.readString(qs, "before", "")
 	// Get the sort information
 	input.Filters.Sort = app.readString(qs, "sort", "id")
 	// Specify the allowed sort values
-	input.Filters.SortList = []string{"id", "waterbill", "priority", "-id", "-waterbill", "-priority"}
+	input.Filters.SortList = []string{"id", "waterbill", "priority", "created_at", "-id", "-waterbill", "-priority", "-created_at"}
+	// The listing can also be downloaded as a spreadsheet
+	format := app.listFormat(qs, r, v)
+	// Clients can pick the fields they want and include related resources
+	fields, include := app.readBillView(qs, v)
 	// Check for validation errors
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
+	if format != formatJSON {
+		app.exportBills(w, r, format, input.BillQuery, input.Filters)
+		return
+	}
+	// The relations of an account are only included for those who may see every account
+	if !app.allowListIncludes(w, r, include) {
+		return
+	}
 	// Get a listing of all todo items
-	todo_list, metadata, err := app.models.Todo_list.GetAll(input.Waterbill, input.Priority, input.Status, input.Filters)
+	todo_list, metadata, err := app.models.Todo_list.GetAll(input.BillQuery, input.Filters, billColumns(fields, include))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	views, err := app.billViews(todo_list, fields, include)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 	// Send a JSON response containing all the todo_list items
-	err = app.writeJSON(w, http.StatusOK, envelope{"waterbill": todo_list, "metadata": metadata}, nil)
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"waterbill": views, "metadata": metadata}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -0,0 +1,290 @@
+// Filename: cmd/api/waterbill_test.go
+
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/data"
+)
+
+// The cursor in the metadata of a page reads the page after it from the last row of
+// the first, under the same sort
+func TestListBillsCursor(t *testing.T) {
+	bills := []*data.Todo_list{
+		{ID: 4, Waterbill: "April", DueDate: time.Now(), Version: 1},
+		{ID: 2, Waterbill: "February", DueDate: time.Now(), Version: 1},
+		{ID: 3, Waterbill: "March", DueDate: time.Now(), Version: 1},
+	}
+	tests := []struct {
+		sort    string
+		keyset  string
+		reverse bool
+	}{
+		{sort: "waterbill", keyset: "(waterbill, id) > ($13::text, $14)"},
+		{sort: "-waterbill", keyset: "(waterbill, id) < ($13::text, $14)", reverse: true},
+		{sort: "id", keyset: "id > $13"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sort, func(t *testing.T) {
+			rows := make([]*data.Todo_list, len(bills))
+			copy(rows, bills)
+			if tt.sort == "id" {
+				rows[0], rows[1], rows[2] = bills[1], bills[2], bills[0]
+			}
+			if tt.reverse {
+				rows[0], rows[2] = rows[2], rows[0]
+			}
+			var last *data.Todo_list
+			app := newTestApplication(t, func(query string, args []driver.Value) stubResult {
+				paged := strings.Contains(query, tt.keyset)
+				var page []*data.Todo_list
+				switch {
+				case !paged && len(args) == 14:
+					// The first page, by number
+					page = rows[:2]
+					last = rows[1]
+				case paged:
+					key := args[12]
+					if tt.sort != "id" {
+						if key != last.Waterbill || args[13] != last.ID {
+							t.Errorf("read from %v and %v, want the last row %d", key, args[13], last.ID)
+						}
+					} else if key != last.ID {
+						t.Errorf("read from %v, want the last row %d", key, last.ID)
+					}
+					// One row past the page size would mean another page
+					page = rows[2:]
+				default:
+					t.Errorf("unexpected statement: %s %v", query, args)
+				}
+				result := stubResult{}
+				for _, bill := range page {
+					result.rows = append(result.rows, append([]driver.Value{int64(len(rows))}, billRow(bill)...))
+				}
+				return result
+			})
+			next := readPage(t, app, "/v1/waterbill?page_size=2&sort="+tt.sort, 2)
+			if next == "" {
+				t.Fatal("the first page has no next cursor")
+			}
+			if after := readPage(t, app, "/v1/waterbill?page_size=2&sort="+tt.sort+"&after="+url.QueryEscape(next), 1); after != "" {
+				t.Errorf("the last page has a next cursor %q", after)
+			}
+			// A cursor is only good for the sort it was made under
+			r := httptest.NewRequest(http.MethodGet, "/v1/waterbill?sort=priority&after="+url.QueryEscape(next), nil)
+			if rr := serve(t, app, r, false); rr.Code != http.StatusUnprocessableEntity {
+				t.Errorf("a cursor of another sort got status %d", rr.Code)
+			}
+		})
+	}
+}
+
+// readPage() reads a page of the listing, checks its length and returns the next cursor
+func readPage(t *testing.T, app *application, path string, length int) string {
+	t.Helper()
+	rr := serve(t, app, httptest.NewRequest(http.MethodGet, path, nil), false)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rr.Code, rr.Body)
+	}
+	var body struct {
+		Waterbill []json.RawMessage `json:"waterbill"`
+		Metadata  data.Metadata     `json:"metadata"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Waterbill) != length {
+		t.Errorf("%s: got %d bills, want %d", path, len(body.Waterbill), length)
+	}
+	return body.Metadata.NextCursor
+}
+
+// The filters of the listing reach the query as its first twelve arguments, in the
+// order of data.BillQuery
+func TestListBillsFilters(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	defaults := func() []driver.Value {
+		return []driver.Value{"", "", "{}", "all", "", "", "", nil, nil, int64(0), false, int64(0)}
+	}
+	with := func(changes map[int]driver.Value) []driver.Value {
+		args := defaults()
+		for i, value := range changes {
+			args[i] = value
+		}
+		return args
+	}
+	tests := []struct {
+		name   string
+		query  string
+		args   []driver.Value
+		errors []string
+	}{
+		{name: "no filters", args: defaults()},
+		{name: "full text", query: "waterbill=march&priority=high&text=leaking+meter", args: with(map[int]driver.Value{0: "march", 1: "high", 6: "leaking meter"})},
+		{name: "any status", query: "status=open,metered&status_match=any", args: with(map[int]driver.Value{2: "{\"open\",\"metered\"}", 3: "any"})},
+		{name: "state and category", query: "state=overdue&category=residential", args: with(map[int]driver.Value{4: "overdue", 5: "residential"})},
+		{name: "whole days", query: "created_from=2024-01-01&created_to=2024-03-31", args: with(map[int]driver.Value{7: day("2024-01-01"), 8: day("2024-04-01")})},
+		{name: "timestamps", query: "created_from=2024-01-01T08:00:00Z&created_to=2024-01-01T17:00:00Z", args: with(map[int]driver.Value{
+			7: time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC), 8: time.Date(2024, 1, 1, 17, 0, 0, 0, time.UTC),
+		})},
+		{name: "version", query: "version=3", args: with(map[int]driver.Value{9: int64(3)})},
+		{name: "bad month", query: "created_from=2024-13-01", errors: []string{"created_from"}},
+		{name: "backwards range", query: "created_from=2024-03-01&created_to=2024-01-01", errors: []string{"created_to"}},
+		{name: "unknown state", query: "state=settled", errors: []string{"state"}},
+		{name: "unknown status match", query: "status_match=some", errors: []string{"status_match"}},
+		{name: "negative version", query: "version=-1", errors: []string{"version"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listed := false
+			app := newTestApplication(t, func(query string, args []driver.Value) stubResult {
+				listed = true
+				for i, want := range tt.args {
+					if got, ok := args[i].(time.Time); ok {
+						if !got.Equal(want.(time.Time)) {
+							t.Errorf("argument %d: got %v, want %v", i+1, got, want)
+						}
+					} else if args[i] != want {
+						t.Errorf("argument %d: got %#v, want %#v", i+1, args[i], want)
+					}
+				}
+				return stubResult{}
+			})
+			rr := serve(t, app, httptest.NewRequest(http.MethodGet, "/v1/waterbill?"+tt.query, nil), false)
+			if tt.errors == nil {
+				if rr.Code != http.StatusOK || !listed {
+					t.Errorf("got status %d: %s", rr.Code, rr.Body)
+				}
+				return
+			}
+			if rr.Code != http.StatusUnprocessableEntity || listed {
+				t.Fatalf("got status %d, want 422 without a query: %s", rr.Code, rr.Body)
+			}
+			var body struct {
+				Error map[string]string `json:"error"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range tt.errors {
+				if body.Error[key] == "" {
+					t.Errorf("no error on %s, got %v", key, body.Error)
+				}
+			}
+		})
+	}
+}
+
+// Customers can only bill their own account and admins any account that exists. An
+// unknown account is a validation error rather than a failed foreign key
+func TestCreateBillAccount(t *testing.T) {
+	customer := &data.User{ID: 7, Name: "Ana Perez", Email: "ana@example.com", Activated: true}
+	tests := []struct {
+		name          string
+		authenticated bool
+		permissions   []string
+		userID        int64
+		status        int
+	}{
+		{name: "anonymous", userID: 7, status: http.StatusUnauthorized},
+		{name: "a customer for someone else", authenticated: true, userID: 8, status: http.StatusForbidden},
+		{name: "a customer for themselves", authenticated: true, userID: 7, status: http.StatusCreated},
+		{name: "an admin for an unknown account", authenticated: true, permissions: []string{data.PermissionAdmin}, userID: 99, status: http.StatusUnprocessableEntity},
+		{name: "an admin for another account", authenticated: true, permissions: []string{data.PermissionAdmin}, userID: 8, status: http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var inserted bool
+			app := newTestApplication(t, signedIn(customer, tt.permissions, func(query string, args []driver.Value) stubResult {
+				switch {
+				case strings.Contains(query, "FROM categories"):
+					return stubResult{rows: [][]driver.Value{{"residential", time.Now(), "Residential", true, int64(1)}}}
+				case strings.Contains(query, "FROM priorities"):
+					return stubResult{rows: [][]driver.Value{{"normal", time.Now(), "Normal", true, int64(1)}}}
+				case strings.Contains(query, "FROM users WHERE id = ANY"):
+					return stubResult{rows: [][]driver.Value{{int64(7)}, {int64(8)}}}
+				case strings.Contains(query, "INSERT INTO water_system ("):
+					inserted = true
+					return stubResult{rows: [][]driver.Value{{int64(1), time.Now(), data.BillDraft, time.Now(), int64(1)}}}
+				case strings.Contains(query, "INSERT INTO water_system_history"), strings.Contains(query, "INSERT INTO webhook_deliveries"):
+					return stubResult{affected: 1}
+				}
+				t.Errorf("unexpected statement: %s", query)
+				return stubResult{}
+			}))
+			body := fmt.Sprintf(`{"waterbill":"March","description":"Meter 12","notes":"None","category":"residential","priority":"normal","user_id":%d,"amount":10000}`, tt.userID)
+			rr := serve(t, app, httptest.NewRequest(http.MethodPost, "/v1/waterbill", strings.NewReader(body)), tt.authenticated)
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if inserted != (tt.status == http.StatusCreated) {
+				t.Errorf("inserted is %t with status %d", inserted, rr.Code)
+			}
+			if tt.status == http.StatusUnprocessableEntity && !strings.Contains(rr.Body.String(), `"user_id"`) {
+				t.Errorf("no error on user_id: %s", rr.Body)
+			}
+		})
+	}
+}
+
+// Only the owner of a bill and admins may change it, and a bill can only be moved to an
+// account that exists
+func TestUpdateBillAccount(t *testing.T) {
+	owner := &data.User{ID: 7, Name: "Ana Perez", Email: "ana@example.com", Activated: true}
+	stranger := &data.User{ID: 8, Name: "Luis Chan", Email: "luis@example.com", Activated: true}
+	tests := []struct {
+		name          string
+		user          *data.User
+		authenticated bool
+		permissions   []string
+		body          string
+		status        int
+	}{
+		{name: "anonymous", user: owner, body: `{"notes":"Read again"}`, status: http.StatusUnauthorized},
+		{name: "someone else", user: stranger, authenticated: true, body: `{"notes":"Read again"}`, status: http.StatusForbidden},
+		{name: "the owner", user: owner, authenticated: true, body: `{"notes":"Read again"}`, status: http.StatusCreated},
+		{name: "the owner to another account", user: owner, authenticated: true, body: `{"user_id":8}`, status: http.StatusForbidden},
+		{name: "an admin to an unknown account", user: stranger, authenticated: true, permissions: []string{data.PermissionAdmin}, body: `{"user_id":99}`, status: http.StatusUnprocessableEntity},
+		{name: "an admin to another account", user: stranger, authenticated: true, permissions: []string{data.PermissionAdmin}, body: `{"user_id":8}`, status: http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var updated bool
+			app := newTestApplication(t, signedIn(tt.user, tt.permissions, func(query string, args []driver.Value) stubResult {
+				switch {
+				case strings.Contains(query, "FROM users WHERE id = ANY"):
+					return stubResult{rows: [][]driver.Value{{int64(7)}, {int64(8)}}}
+				case strings.Contains(query, "INSERT INTO water_system_history"), strings.Contains(query, "INSERT INTO webhook_deliveries"):
+					return stubResult{affected: 1}
+				case strings.Contains(query, "UPDATE water_system"):
+					updated = true
+					return stubResult{rows: [][]driver.Value{{int64(2)}}}
+				case strings.Contains(query, "FROM water_system"):
+					return stubResult{rows: [][]driver.Value{billRow(&data.Todo_list{ID: 1, Waterbill: "March", Description: "Meter 12", Notes: "None", Category: "residential", Priority: "normal", State: data.BillDraft, UserID: 7, Amount: 10000, DueDate: time.Now(), Version: 1})}}
+				}
+				t.Errorf("unexpected statement: %s", query)
+				return stubResult{}
+			}))
+			r := httptest.NewRequest(http.MethodPatch, "/v1/waterbill/1", strings.NewReader(tt.body))
+			rr := serve(t, app, r, tt.authenticated)
+			if rr.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+			if updated != (tt.status == http.StatusCreated) {
+				t.Errorf("updated is %t with status %d", updated, rr.Code)
+			}
+		})
+	}
+}
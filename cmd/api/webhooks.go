@@ -0,0 +1,314 @@
+// Filename: cmd/api/webhooks.go
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+// How long a failed delivery waits before it is retried. The wait doubles with every
+// attempt up to the maximum
+const (
+	webhookBaseBackoff = 30 * time.Second
+	webhookMaxBackoff  = 6 * time.Hour
+	webhookPollEvery   = 2 * time.Second
+)
+
+// startWebhookWorkers() starts the pool of workers sending queued deliveries. They
+// are tracked by the wait group so that a graceful shutdown waits for them
+func (app *application) startWebhookWorkers() {
+	for i := 0; i < app.config.webhooks.workers; i++ {
+		app.background(app.webhookWorker)
+	}
+}
+
+// webhookWorker() sends due deliveries one at a time and waits for a while whenever
+// nothing is due. It returns once the workers are told to stop
+func (app *application) webhookWorker() {
+	for !app.stopping() {
+		delivery, err := app.models.Webhooks.Claim()
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+		if delivery == nil {
+			app.idle(webhookPollEvery)
+			continue
+		}
+		app.deliverWebhook(delivery)
+	}
+}
+
+// deliverWebhook() sends a claimed delivery and records the outcome
+func (app *application) deliverWebhook(delivery *data.WebhookDelivery) {
+	status, sendErr := app.webhooks.Deliver(delivery.URL, delivery.Secret, delivery.Event, delivery.ID, delivery.Payload)
+	if sendErr == nil {
+		err := app.models.Webhooks.MarkDelivered(delivery, status)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+		return
+	}
+	err := app.models.Webhooks.MarkFailed(delivery, status, sendErr, webhookBackoff(delivery.Attempts), app.config.webhooks.maxAttempts)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+	app.logger.PrintError(sendErr, map[string]string{
+		"webhook_delivery_id": strconv.FormatInt(delivery.ID, 10),
+		"attempts":            strconv.Itoa(delivery.Attempts),
+		"state":               delivery.State,
+	})
+}
+
+// webhookBackoff() returns the wait before the next attempt
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := 1; i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > webhookMaxBackoff {
+		backoff = webhookMaxBackoff
+	}
+	return backoff
+}
+
+// The createWebhookHandler() subscribes a URL to some events. The signing secret is
+// only ever returned here
+func (app *application) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	webhook := &data.Webhook{
+		URL:    input.URL,
+		Events: input.Events,
+		Active: true,
+	}
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+	v := validator.New()
+	if data.ValidateWebhook(v, webhook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Webhooks.Insert(webhook)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/webhooks/%d", webhook.ID))
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"webhook": webhook, "secret": webhook.Secret}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listWebhooksHandler() shows every subscription
+func (app *application) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := app.models.Webhooks.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"webhooks": webhooks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showWebhookHandler() shows a specific subscription
+func (app *application) showWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.fetchWebhook(w, r)
+	if !ok {
+		return
+	}
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"webhook": webhook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateWebhookHandler() changes the URL or events of a subscription, or pauses it
+func (app *application) updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.fetchWebhook(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		URL    *string  `json:"url"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if input.URL != nil {
+		webhook.URL = *input.URL
+	}
+	if input.Events != nil {
+		webhook.Events = input.Events
+	}
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+	v := validator.New()
+	if data.ValidateWebhook(v, webhook); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Webhooks.Update(webhook)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"webhook": webhook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteWebhookHandler() removes a subscription and its delivery log
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	err = app.models.Webhooks.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "webhook successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listWebhookDeliveriesHandler() shows the delivery log of a subscription
+func (app *application) listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.fetchWebhook(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		State string
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	input.State = app.readString(qs, "state", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-id")
+	input.Filters.SortList = []string{"id", "created_at", "next_attempt_at", "-id", "-created_at", "-next_attempt_at"}
+	if input.State != "" {
+		v.Check(validator.In(input.State, data.WebhookPending, data.WebhookDelivered, data.WebhookFailed), "state", "invalid delivery state")
+	}
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	deliveries, metadata, err := app.models.Webhooks.Deliveries(webhook.ID, input.State, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"deliveries": deliveries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The testWebhookHandler() sends a ping to the subscription straight away, whether or
+// not it is active, and reports how the receiver answered. The attempt is kept in the
+// delivery log but never retried
+func (app *application) testWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.fetchWebhook(w, r)
+	if !ok {
+		return
+	}
+	body, err := data.WebhookPayload(data.WebhookPing, map[string]interface{}{
+		"webhook_id": webhook.ID,
+		"events":     webhook.Events,
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	delivery := &data.WebhookDelivery{
+		SubscriptionID: webhook.ID,
+		Event:          data.WebhookPing,
+		Payload:        body,
+		Attempts:       1,
+	}
+	// The ping is sent before it is logged, so it carries a delivery id of zero
+	status, sendErr := app.webhooks.Deliver(webhook.URL, webhook.Secret, data.WebhookPing, 0, body)
+	if status != 0 {
+		delivery.ResponseStatus = &status
+	}
+	if sendErr != nil {
+		delivery.State = data.WebhookFailed
+		delivery.LastError = sendErr.Error()
+	} else {
+		now := time.Now()
+		delivery.State = data.WebhookDelivered
+		delivery.DeliveredAt = &now
+	}
+	err = app.models.Webhooks.Record(delivery)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"delivery": delivery}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// fetchWebhook() reads the id from the URL and loads the subscription, writing the
+// error response itself when that fails
+func (app *application) fetchWebhook(w http.ResponseWriter, r *http.Request) (*data.Webhook, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	webhook, err := app.models.Webhooks.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return webhook, true
+}
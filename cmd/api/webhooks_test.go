@@ -0,0 +1,129 @@
+// Filename: cmd/api/webhooks_test.go
+
+package main
+
+import (
+	"database/sql/driver"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/data"
+	"water.biling.system.driane.perez.net/internal/webhooks"
+)
+
+// The outcome of a delivery is only recorded under the lease it was claimed with
+func TestDeliverWebhookLease(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	tests := []struct {
+		name  string
+		rows  [][]driver.Value
+		state string
+	}{
+		{name: "lease held", rows: [][]driver.Value{{data.WebhookDelivered, int64(204), "", time.Now()}}, state: data.WebhookDelivered},
+		{name: "lease lost", state: data.WebhookPending},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t, func(query string, args []driver.Value) stubResult {
+				if !strings.Contains(query, "UPDATE webhook_deliveries") {
+					t.Errorf("unexpected statement: %s", query)
+					return stubResult{}
+				}
+				if !strings.Contains(query, "lease = $2") || args[1] != int64(3) {
+					t.Errorf("the outcome was recorded without the lease: %s %v", query, args)
+				}
+				return stubResult{rows: tt.rows}
+			})
+			app.webhooks = webhooks.NewClient(time.Second, true)
+			delivery := &data.WebhookDelivery{ID: 9, Event: data.WebhookPing, Payload: []byte(`{}`), State: data.WebhookPending, Attempts: 1, Lease: 3, URL: receiver.URL, Secret: "secret"}
+			app.deliverWebhook(delivery)
+			if delivery.State != tt.state {
+				t.Errorf("got state %q, want %q", delivery.State, tt.state)
+			}
+		})
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{5, 8 * time.Minute},
+		{10, 256 * time.Minute},
+		{11, 6 * time.Hour},
+		{100, 6 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := webhookBackoff(tt.attempts); got != tt.want {
+			t.Errorf("webhookBackoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+// A receiver answering 500 gets the delivery again after the backoff, until the
+// attempts run out and the delivery is marked as failed
+func TestDeliverWebhookRetry(t *testing.T) {
+	var signed int
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(webhooks.HeaderTimestamp), 10, 64)
+		if webhooks.Verify("secret", timestamp, body, r.Header.Get(webhooks.HeaderSignature), time.Minute) {
+			signed++
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	tests := []struct {
+		attempts int
+		state    string
+	}{
+		{attempts: 1, state: data.WebhookPending},
+		{attempts: 3, state: data.WebhookPending},
+		{attempts: 5, state: data.WebhookFailed},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.attempts), func(t *testing.T) {
+			app := newTestApplication(t, func(query string, args []driver.Value) stubResult {
+				if !strings.Contains(query, "UPDATE webhook_deliveries") {
+					t.Errorf("unexpected statement: %s", query)
+					return stubResult{}
+				}
+				// id, lease, state, status, error, backoff
+				if args[2] != tt.state || args[3] != int64(http.StatusInternalServerError) {
+					t.Errorf("got state %v and status %v, want %s and 500", args[2], args[3], tt.state)
+				}
+				if want := webhookBackoff(tt.attempts).Seconds(); args[5] != want {
+					t.Errorf("got backoff %v, want %v", args[5], want)
+				}
+				return stubResult{rows: [][]driver.Value{{args[2], args[3], args[4], nil}}}
+			})
+			app.config.webhooks.maxAttempts = 5
+			app.webhooks = webhooks.NewClient(time.Second, true)
+			delivery := &data.WebhookDelivery{ID: 9, Event: data.WebhookPing, Payload: []byte(`{"event":"ping"}`), State: data.WebhookPending, Attempts: tt.attempts, Lease: 1, URL: receiver.URL, Secret: "secret"}
+			app.deliverWebhook(delivery)
+			if delivery.State != tt.state {
+				t.Errorf("got state %q, want %q", delivery.State, tt.state)
+			}
+			if delivery.ResponseStatus == nil || *delivery.ResponseStatus != http.StatusInternalServerError {
+				t.Errorf("got response status %v, want 500", delivery.ResponseStatus)
+			}
+		})
+	}
+	if signed != len(tests) {
+		t.Errorf("%d of %d deliveries were signed", signed, len(tests))
+	}
+}
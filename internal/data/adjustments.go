@@ -0,0 +1,281 @@
+// Filename: internal/data/adjustments.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+var (
+	ErrBillNotIssued  = errors.New("bill not issued")
+	ErrCreditTooLarge = errors.New("credit larger than bill")
+	ErrRefundRequired = errors.New("refund required")
+)
+
+// The reasons an issued bill can be adjusted for
+var ReasonCodes = []string{
+	"billing_error",
+	"meter_misread",
+	"duplicate_bill",
+	"tariff_correction",
+	"goodwill",
+	"other",
+}
+
+// An Adjustment (credit note) corrects an issued bill. It always posts a negative
+// amount against the bill, the bill itself is never edited
+type Adjustment struct {
+	ID         int64     `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	BillID     int64     `json:"bill_id"`
+	ReasonCode string    `json:"reason_code"`
+	Notes      string    `json:"notes"`
+	AuthorID   int64     `json:"author_id"`
+	Amount     int64     `json:"amount"`
+	Refund     *Refund   `json:"refund,omitempty"`
+}
+
+// A Refund records money paid back to the customer when a credit is larger than
+// what was still owing on the bill
+type Refund struct {
+	ID           int64     `json:"id"`
+	CreatedAt    time.Time `json:"created_at"`
+	AdjustmentID int64     `json:"adjustment_id"`
+	BillID       int64     `json:"bill_id"`
+	UserID       *int64    `json:"user_id,omitempty"`
+	Amount       int64     `json:"amount"`
+}
+
+func ValidateAdjustment(v *validator.Validator, adjustment *Adjustment) {
+	v.Check(adjustment.Amount < 0, "amount", "must be negative")
+	v.Check(validator.In(adjustment.ReasonCode, ReasonCodes...), "reason_code", "invalid reason code")
+	v.Check(adjustment.Notes != "", "notes", "must be provided")
+	v.Check(len(adjustment.Notes) <= 500, "notes", "must not be more than 500 bytes long")
+}
+
+// Define the adjustment model
+type AdjustmentModel struct {
+	DB *sql.DB
+}
+
+// Insert() posts a credit against an issued bill. When the credit is more than what is
+// still owing, the difference has already been paid and has to go back to the customer,
+// so a refund record is issued if the caller asked for one and ErrRefundRequired is
+// returned if they did not
+func (m AdjustmentModel) Insert(adjustment *Adjustment, refund bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the bill while we work out the amounts
+	var (
+		amount, paid, credited int64
+		userID                 *int64
+		state                  string
+	)
+	query := `
+		SELECT amount, amount_paid, amount_credited, user_id, state
+		FROM water_system
+		WHERE id = $1
+		FOR UPDATE
+	`
+	err = tx.QueryRowContext(ctx, query, adjustment.BillID).Scan(&amount, &paid, &credited, &userID, &state)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	// Drafts are edited directly and void bills are no longer owed
+	if state == BillDraft || state == BillVoid {
+		return ErrBillNotIssued
+	}
+	credit := -adjustment.Amount
+	excess, err := creditExcess(amount, paid, credited, credit)
+	if err != nil {
+		return err
+	}
+	if excess > 0 && !refund {
+		return ErrRefundRequired
+	}
+
+	query = `
+		INSERT INTO adjustments (bill_id, reason_code, notes, author_id, amount)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`
+	args := []interface{}{
+		adjustment.BillID,
+		adjustment.ReasonCode,
+		adjustment.Notes,
+		adjustment.AuthorID,
+		adjustment.Amount,
+	}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&adjustment.ID, &adjustment.CreatedAt)
+	if err != nil {
+		return err
+	}
+	err = recordBillHistory(ctx, tx, HistoryAdjusted, adjustment.AuthorID, `id = $3`, adjustment.BillID)
+	if err != nil {
+		return err
+	}
+	// The overpaid part is handed back, so it no longer counts as paid
+	query = `
+		UPDATE water_system
+		SET amount_credited = amount_credited + $1, amount_paid = amount_paid - $2, version = version + 1
+		WHERE id = $3
+	`
+	_, err = tx.ExecContext(ctx, query, credit, excess, adjustment.BillID)
+	if err != nil {
+		return err
+	}
+	// A credit can settle what was left on the bill
+	err = settleBillState(ctx, tx, adjustment.BillID)
+	if err != nil {
+		return err
+	}
+	if excess > 0 {
+		adjustment.Refund = &Refund{
+			AdjustmentID: adjustment.ID,
+			BillID:       adjustment.BillID,
+			UserID:       userID,
+			Amount:       excess,
+		}
+		query = `
+			INSERT INTO refunds (adjustment_id, bill_id, user_id, amount)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id, created_at
+		`
+		err = tx.QueryRowContext(ctx, query, adjustment.ID, adjustment.BillID, userID, excess).Scan(
+			&adjustment.Refund.ID,
+			&adjustment.Refund.CreatedAt,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// creditExcess() works out how much of a credit has already been paid on the bill and
+// so has to be refunded rather than taken off what is owing. A credit can never be more
+// than what is left of the bill once earlier credits are taken off
+func creditExcess(amount, paid, credited, credit int64) (int64, error) {
+	if credit > amount-credited {
+		return 0, ErrCreditTooLarge
+	}
+	excess := credit - (amount - paid - credited)
+	if excess < 0 {
+		excess = 0
+	}
+	return excess, nil
+}
+
+// Get() returns a specific adjustment along with its refund, if one was issued
+func (m AdjustmentModel) Get(id int64) (*Adjustment, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	adjustments, err := m.query(`WHERE adjustments.id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(adjustments) == 0 {
+		return nil, ErrRecordNotFound
+	}
+	return adjustments[0], nil
+}
+
+// GetAllForBill() returns every adjustment posted against a bill, oldest first
+func (m AdjustmentModel) GetAllForBill(billID int64) ([]*Adjustment, error) {
+	return m.query(`WHERE adjustments.bill_id = $1`, billID)
+}
+
+// GetAllForBills() returns the adjustments of several bills by bill, oldest first
+func (m AdjustmentModel) GetAllForBills(billIDs []int64) (map[int64][]*Adjustment, error) {
+	adjustments, err := m.query(`WHERE adjustments.bill_id = ANY($1)`, pq.Array(billIDs))
+	if err != nil {
+		return nil, err
+	}
+	byBill := map[int64][]*Adjustment{}
+	for _, adjustment := range adjustments {
+		byBill[adjustment.BillID] = append(byBill[adjustment.BillID], adjustment)
+	}
+	return byBill, nil
+}
+
+// query() loads adjustments and their refunds matching the WHERE clause
+func (m AdjustmentModel) query(where string, arg interface{}) ([]*Adjustment, error) {
+	query := `
+		SELECT adjustments.id, adjustments.created_at, adjustments.bill_id, adjustments.reason_code,
+		adjustments.notes, adjustments.author_id, adjustments.amount,
+		refunds.id, refunds.created_at, refunds.user_id, refunds.amount
+		FROM adjustments
+		LEFT JOIN refunds ON refunds.adjustment_id = adjustments.id
+		` + where + `
+		ORDER BY adjustments.id
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	adjustments := []*Adjustment{}
+	for rows.Next() {
+		var (
+			adjustment      Adjustment
+			refundID        *int64
+			refundCreatedAt *time.Time
+			refundUserID    *int64
+			refundAmount    *int64
+		)
+		err := rows.Scan(
+			&adjustment.ID,
+			&adjustment.CreatedAt,
+			&adjustment.BillID,
+			&adjustment.ReasonCode,
+			&adjustment.Notes,
+			&adjustment.AuthorID,
+			&adjustment.Amount,
+			&refundID,
+			&refundCreatedAt,
+			&refundUserID,
+			&refundAmount,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if refundID != nil {
+			adjustment.Refund = &Refund{
+				ID:           *refundID,
+				CreatedAt:    *refundCreatedAt,
+				AdjustmentID: adjustment.ID,
+				BillID:       adjustment.BillID,
+				UserID:       refundUserID,
+				Amount:       *refundAmount,
+			}
+		}
+		adjustments = append(adjustments, &adjustment)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return adjustments, nil
+}
@@ -0,0 +1,39 @@
+// Filename: internal/data/adjustments_test.go
+
+package data
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCreditExcess(t *testing.T) {
+	tests := []struct {
+		name                   string
+		amount, paid, credited int64
+		credit                 int64
+		excess                 int64
+		err                    error
+	}{
+		{name: "unpaid bill", amount: 10000, credit: 2500, excess: 0},
+		{name: "credit the whole unpaid bill", amount: 10000, credit: 10000, excess: 0},
+		{name: "credit covered by what is owing", amount: 10000, paid: 4000, credit: 6000, excess: 0},
+		{name: "credit eats into what was paid", amount: 10000, paid: 4000, credit: 7500, excess: 1500},
+		{name: "paid in full", amount: 10000, paid: 10000, credit: 2500, excess: 2500},
+		{name: "earlier credit", amount: 10000, paid: 5000, credited: 3000, credit: 4000, excess: 2000},
+		{name: "credit the rest of a credited bill", amount: 10000, credited: 3000, credit: 7000, excess: 0},
+		{name: "credit more than billed", amount: 10000, credit: 10001, err: ErrCreditTooLarge},
+		{name: "credit more than what is left", amount: 10000, paid: 10000, credited: 6000, credit: 4001, err: ErrCreditTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			excess, err := creditExcess(tt.amount, tt.paid, tt.credited, tt.credit)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if excess != tt.excess {
+				t.Errorf("got excess %d, want %d", excess, tt.excess)
+			}
+		})
+	}
+}
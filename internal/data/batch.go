@@ -0,0 +1,141 @@
+// Filename: internal/data/batch.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// batchTimeout bounds the whole of a batch, however many operations it has
+const batchTimeout = 30 * time.Second
+
+// A BillBatch runs a number of changes to bills in one transaction. Each operation can
+// be run under a savepoint so that a failed one is undone on its own and the rest of
+// the batch carries on. Nothing is saved until Commit() is called
+type BillBatch struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	tx      *sql.Tx
+	actorID int64
+}
+
+// Batch() starts a batch of changes made by the given user
+func (m Todo_listModel) Batch(actorID int64) (*BillBatch, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), batchTimeout)
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &BillBatch{ctx: ctx, cancel: cancel, tx: tx, actorID: actorID}, nil
+}
+
+// Get() returns a bill as the batch sees it, with the changes made so far
+func (b *BillBatch) Get(id int64) (*Todo_list, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	columns, dests := billSelect(nil)
+	query := `SELECT ` + columns + ` FROM water_system WHERE id = $1 AND deleted_at IS NULL`
+	var bill Todo_list
+	err := b.tx.QueryRowContext(b.ctx, query, id).Scan(dests(&bill)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &bill, nil
+}
+
+// A ConstraintError is a change that broke a constraint of the database, such as a
+// foreign key or a check. The data of the change is to blame rather than the server,
+// so it names the field to report the problem on
+type ConstraintError struct {
+	Field      string
+	Message    string
+	Constraint string
+}
+
+func (e *ConstraintError) Error() string {
+	return "constraint " + e.Constraint + " violated: " + e.Field + " " + e.Message
+}
+
+// The constraints of a bill that a change can break, by the field to blame
+var billConstraints = map[string]ConstraintError{
+	"water_system_user_id_fkey": {Field: "user_id", Message: "no such user"},
+}
+
+// constraintError() turns an integrity constraint violation into a ConstraintError and
+// returns every other error as it is
+func constraintError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code.Class() != "23" {
+		return err
+	}
+	known, ok := billConstraints[pqErr.Constraint]
+	if !ok {
+		known = ConstraintError{Field: pqErr.Column, Message: "is not allowed"}
+		if known.Field == "" {
+			known.Field = "data"
+		}
+	}
+	known.Constraint = pqErr.Constraint
+	return &known
+}
+
+// Insert(), Update() and Delete() work as the Todo_listModel methods of the same name.
+// A broken constraint is returned as a ConstraintError, since the batch carries on
+// after it once the savepoint is rolled back
+func (b *BillBatch) Insert(bill *Todo_list) error {
+	return constraintError(insertBill(b.ctx, b.tx, bill, b.actorID))
+}
+
+func (b *BillBatch) Update(bill *Todo_list) error {
+	return constraintError(updateBill(b.ctx, b.tx, bill, b.actorID))
+}
+
+func (b *BillBatch) Delete(id int64, version int32) error {
+	return constraintError(deleteBill(b.ctx, b.tx, id, version, b.actorID))
+}
+
+// Savepoint() marks the start of an operation. Release() keeps what it did and
+// RollbackToSavepoint() undoes it, leaving the batch usable
+func (b *BillBatch) Savepoint() error {
+	_, err := b.tx.ExecContext(b.ctx, `SAVEPOINT batch_operation`)
+	return err
+}
+
+func (b *BillBatch) Release() error {
+	_, err := b.tx.ExecContext(b.ctx, `RELEASE SAVEPOINT batch_operation`)
+	return err
+}
+
+func (b *BillBatch) RollbackToSavepoint() error {
+	_, err := b.tx.ExecContext(b.ctx, `ROLLBACK TO SAVEPOINT batch_operation`)
+	return err
+}
+
+// Commit() saves every change in the batch
+func (b *BillBatch) Commit() error {
+	defer b.cancel()
+	return b.tx.Commit()
+}
+
+// Rollback() throws the batch away. It does nothing once the batch is committed, so
+// it can be deferred
+func (b *BillBatch) Rollback() error {
+	defer b.cancel()
+	err := b.tx.Rollback()
+	if errors.Is(err, sql.ErrTxDone) {
+		return nil
+	}
+	return err
+}
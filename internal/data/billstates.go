@@ -0,0 +1,343 @@
+// Filename: internal/data/billstates.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+// The lifecycle of a bill
+const (
+	BillDraft         = "draft"
+	BillIssued        = "issued"
+	BillPartiallyPaid = "partially_paid"
+	BillPaid          = "paid"
+	BillOverdue       = "overdue"
+	BillVoid          = "void"
+)
+
+// BillStates lists every state in lifecycle order
+var BillStates = []string{BillDraft, BillIssued, BillPartiallyPaid, BillPaid, BillOverdue, BillVoid}
+
+// billTransitions is the transition table, it lists the states each state may move on to.
+// Paid and void bills are final
+var billTransitions = map[string][]string{
+	BillDraft:         {BillIssued, BillVoid},
+	BillIssued:        {BillPartiallyPaid, BillPaid, BillOverdue, BillVoid},
+	BillPartiallyPaid: {BillPaid, BillOverdue},
+	BillOverdue:       {BillPartiallyPaid, BillPaid},
+}
+
+// ManualBillStates are the states a person can move a bill to. Partially paid, paid and
+// overdue follow from the money posted against a bill and its due date, so only
+// payments, adjustments and the overdue job move bills there
+var ManualBillStates = []string{BillIssued, BillVoid}
+
+// ErrBillHasPayments is returned when a bill that has been paid on is voided. It has to
+// be credited instead, so that the money is accounted for
+var ErrBillHasPayments = errors.New("bill has payments")
+
+// openBillStates are the states in which a bill is still owed
+const openBillStates = `('issued', 'partially_paid', 'overdue')`
+
+// A BillTransition is one entry in a bill's state history. ActorID is empty when the
+// system moved the bill, for example when a payment settled it
+type BillTransition struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	BillID    int64     `json:"bill_id"`
+	FromState string    `json:"from_state"`
+	ToState   string    `json:"to_state"`
+	ActorID   *int64    `json:"actor_id,omitempty"`
+}
+
+func ValidateBillState(v *validator.Validator, key, state string) {
+	v.Check(validator.In(state, BillStates...), key, "invalid bill state")
+}
+
+// ValidateManualTransition() checks the state a person asked to move a bill to
+func ValidateManualTransition(v *validator.Validator, key, state string) {
+	if ValidateBillState(v, key, state); v.Valid() {
+		v.Check(validator.In(state, ManualBillStates...), key, "must be issued or void, the other states follow from payments and due dates")
+	}
+}
+
+// CanTransition() reports whether the bill may move on to the given state
+func (t *Todo_list) CanTransition(to string) bool {
+	return validator.In(to, billTransitions[t.State]...)
+}
+
+// Transition() moves a bill to a new state on behalf of the actor and records it in the
+// bill's history. Only the manual states can be reached this way. Issuing a bill stamps
+// issued_at and queues the email delivering it. The waterbill.updated webhook is queued
+// in the same transaction
+func (m Todo_listModel) Transition(Todo_list *Todo_list, to string, actorID int64) error {
+	if !validator.In(to, ManualBillStates...) || !Todo_list.CanTransition(to) {
+		return ErrIllegalTransition
+	}
+	// Payments bump the version, so the version check below also catches a payment
+	// posted after the bill was read
+	if to == BillVoid && Todo_list.AmountPaid > 0 {
+		return ErrBillHasPayments
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = transitionBill(ctx, tx, Todo_list, to, actorID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// transitionBill() does the work of Transition() inside the caller's transaction,
+// without the checks on which states a person may ask for
+func transitionBill(ctx context.Context, tx *sql.Tx, Todo_list *Todo_list, to string, actorID int64) error {
+	query := `
+		UPDATE water_system
+		SET state = $1,
+		issued_at = CASE WHEN $1 = 'issued' THEN NOW() ELSE issued_at END,
+		version = version + 1
+		WHERE id = $2
+		AND version = $3
+		AND state = $4
+		RETURNING issued_at, version
+	`
+	err := recordBillHistory(ctx, tx, HistoryTransitioned, actorID, `id = $3 AND version = $4 AND state = $5`, Todo_list.ID, Todo_list.Version, Todo_list.State)
+	if err != nil {
+		return err
+	}
+	args := []interface{}{to, Todo_list.ID, Todo_list.Version, Todo_list.State}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&Todo_list.IssuedAt, &Todo_list.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	err = recordBillTransition(ctx, tx, Todo_list.ID, Todo_list.State, to, &actorID)
+	if err != nil {
+		return err
+	}
+	if to == BillIssued {
+		queued, err := enqueueBillDelivery(ctx, tx, Todo_list.ID)
+		if err != nil {
+			return err
+		}
+		if queued {
+			// Marking the delivery took another version
+			Todo_list.DeliveryStatus = DeliveryQueued
+			Todo_list.Version++
+		}
+	}
+	Todo_list.State = to
+	return enqueueWebhook(ctx, tx, WebhookBillUpdated, Todo_list)
+}
+
+// Transitions() returns the state history of a bill, oldest first
+func (m Todo_listModel) Transitions(id int64) ([]*BillTransition, error) {
+	return m.transitions(`bill_id = $1`, id)
+}
+
+// TransitionsForBills() returns the state histories of several bills by bill
+func (m Todo_listModel) TransitionsForBills(ids []int64) (map[int64][]*BillTransition, error) {
+	transitions, err := m.transitions(`bill_id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	byBill := map[int64][]*BillTransition{}
+	for _, transition := range transitions {
+		byBill[transition.BillID] = append(byBill[transition.BillID], transition)
+	}
+	return byBill, nil
+}
+
+// transitions() loads the transitions matching the WHERE clause, oldest first
+func (m Todo_listModel) transitions(where string, arg interface{}) ([]*BillTransition, error) {
+	query := `
+		SELECT id, created_at, bill_id, from_state, to_state, actor_id
+		FROM bill_transitions
+		WHERE ` + where + `
+		ORDER BY id
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transitions := []*BillTransition{}
+	for rows.Next() {
+		var transition BillTransition
+		err := rows.Scan(
+			&transition.ID,
+			&transition.CreatedAt,
+			&transition.BillID,
+			&transition.FromState,
+			&transition.ToState,
+			&transition.ActorID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		transitions = append(transitions, &transition)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return transitions, nil
+}
+
+// MarkOverdue() moves every open bill that is past its due date to overdue, recording
+// the change in the history of each and queueing its waterbill.updated webhook. It
+// gives up when ctx is cancelled
+func (m Todo_listModel) MarkOverdue(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	err = recordBillHistory(ctx, tx, HistoryTransitioned, 0, `state IN ('issued', 'partially_paid') AND due_date < CURRENT_DATE`)
+	if err != nil {
+		return 0, err
+	}
+	columns, dests := billSelect(nil)
+	query := `
+		WITH overdue AS (
+			UPDATE water_system
+			SET state = 'overdue', version = water_system.version + 1
+			FROM (
+				SELECT id AS bill_id, state AS from_state FROM water_system
+				WHERE state IN ('issued', 'partially_paid')
+				AND due_date < CURRENT_DATE
+				FOR UPDATE
+			) AS before
+			WHERE water_system.id = before.bill_id
+			RETURNING water_system.*, before.from_state
+		), transitions AS (
+			INSERT INTO bill_transitions (bill_id, from_state, to_state)
+			SELECT id, from_state, 'overdue' FROM overdue
+		)
+		SELECT ` + columns + `
+		FROM overdue
+		ORDER BY id
+	`
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	bills := []*Todo_list{}
+	for rows.Next() {
+		var bill Todo_list
+		err := rows.Scan(dests(&bill)...)
+		if err != nil {
+			return 0, err
+		}
+		bills = append(bills, &bill)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+	// The webhooks are queued once the rows are read, the connection takes one
+	// statement at a time
+	for _, bill := range bills {
+		err = enqueueWebhook(ctx, tx, WebhookBillUpdated, bill)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(bills), tx.Commit()
+}
+
+// recordBillTransition() adds an entry to the state history of a bill
+func recordBillTransition(ctx context.Context, tx *sql.Tx, billID int64, from, to string, actorID *int64) error {
+	query := `
+		INSERT INTO bill_transitions (bill_id, from_state, to_state, actor_id)
+		VALUES ($1, $2, $3, $4)
+	`
+	_, err := tx.ExecContext(ctx, query, billID, from, to, actorID)
+	return err
+}
+
+// settleBillState() moves a bill that has just had money posted against it to paid or
+// partially paid, following the transition table, and records the change as made by
+// the system. The move takes a version of its own, goes into the history and queues
+// the waterbill.updated webhook. It must run inside the transaction that changed the
+// amounts
+func settleBillState(ctx context.Context, tx *sql.Tx, billID int64) error {
+	var (
+		state                  string
+		amount, paid, credited int64
+	)
+	query := `
+		SELECT state, amount, amount_paid, amount_credited
+		FROM water_system
+		WHERE id = $1
+		FOR UPDATE
+	`
+	err := tx.QueryRowContext(ctx, query, billID).Scan(&state, &amount, &paid, &credited)
+	if err != nil {
+		return err
+	}
+	to := state
+	switch {
+	case paid+credited >= amount:
+		to = BillPaid
+	case paid > 0 && state == BillIssued:
+		to = BillPartiallyPaid
+	}
+	if to == state || !validator.In(to, billTransitions[state]...) {
+		return nil
+	}
+	err = recordBillHistory(ctx, tx, HistoryTransitioned, 0, `id = $3`, billID)
+	if err != nil {
+		return err
+	}
+	columns, dests := billSelect(nil)
+	query = `
+		UPDATE water_system
+		SET state = $1, version = version + 1
+		WHERE id = $2
+		RETURNING ` + columns
+	var bill Todo_list
+	err = tx.QueryRowContext(ctx, query, to, billID).Scan(dests(&bill)...)
+	if err != nil {
+		return err
+	}
+	err = recordBillTransition(ctx, tx, billID, state, to, nil)
+	if err != nil {
+		return err
+	}
+	return enqueueWebhook(ctx, tx, WebhookBillUpdated, &bill)
+}
+
+// The delivery states of an issued bill that is emailed to its account
+const (
+	DeliveryQueued = "queued"
+	DeliverySent   = "sent"
+	DeliveryFailed = "failed"
+)
@@ -0,0 +1,75 @@
+// Filename: internal/data/billstates_test.go
+
+package data
+
+import (
+	"errors"
+	"testing"
+
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		ok       bool
+	}{
+		{BillDraft, BillIssued, true},
+		{BillDraft, BillVoid, true},
+		{BillDraft, BillPaid, false},
+		{BillIssued, BillPartiallyPaid, true},
+		{BillIssued, BillOverdue, true},
+		{BillIssued, BillDraft, false},
+		{BillPartiallyPaid, BillVoid, false},
+		{BillOverdue, BillPaid, true},
+		{BillOverdue, BillIssued, false},
+		{BillPaid, BillVoid, false},
+		{BillVoid, BillIssued, false},
+	}
+	for _, tt := range tests {
+		bill := &Todo_list{State: tt.from}
+		if ok := bill.CanTransition(tt.to); ok != tt.ok {
+			t.Errorf("%s to %s: got %t, want %t", tt.from, tt.to, ok, tt.ok)
+		}
+	}
+}
+
+// The refused transitions are turned away before the database is used
+func TestTransitionRefused(t *testing.T) {
+	tests := []struct {
+		name string
+		bill Todo_list
+		to   string
+		err  error
+	}{
+		{name: "paid by hand", bill: Todo_list{State: BillIssued}, to: BillPaid, err: ErrIllegalTransition},
+		{name: "partially paid by hand", bill: Todo_list{State: BillIssued, AmountPaid: 100}, to: BillPartiallyPaid, err: ErrIllegalTransition},
+		{name: "overdue by hand", bill: Todo_list{State: BillIssued}, to: BillOverdue, err: ErrIllegalTransition},
+		{name: "void a paid bill", bill: Todo_list{State: BillPaid}, to: BillVoid, err: ErrIllegalTransition},
+		{name: "void an issued bill with payments", bill: Todo_list{State: BillIssued, Amount: 1000, AmountPaid: 1}, to: BillVoid, err: ErrBillHasPayments},
+		{name: "issue twice", bill: Todo_list{State: BillIssued}, to: BillIssued, err: ErrIllegalTransition},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Todo_listModel{}.Transition(&tt.bill, tt.to, 1)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestValidateManualTransition(t *testing.T) {
+	for _, state := range BillStates {
+		v := validator.New()
+		ValidateManualTransition(v, "to", state)
+		want := state == BillIssued || state == BillVoid
+		if v.Valid() != want {
+			t.Errorf("%s: got valid %t, want %t", state, v.Valid(), want)
+		}
+	}
+	v := validator.New()
+	if ValidateManualTransition(v, "to", "closed"); v.Valid() {
+		t.Error("an unknown state was accepted")
+	}
+}
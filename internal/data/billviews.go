@@ -0,0 +1,97 @@
+// Filename: internal/data/billviews.go
+
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+// The related resources a bill can be shown with
+const (
+	IncludeUser        = "user"
+	IncludeAdjustments = "adjustments"
+	IncludeTransitions = "transitions"
+)
+
+var BillIncludes = []string{IncludeUser, IncludeAdjustments, IncludeTransitions}
+
+// A BillView is a bill the way a response shows it: only the fields the client picked,
+// or all of them, followed by the related resources it asked to include. Included lists
+// should be empty rather than nil so they render as []
+type BillView struct {
+	Bill        *Todo_list
+	Fields      []string
+	Include     []string
+	User        *UserSummary
+	Adjustments []*Adjustment
+	Transitions []*BillTransition
+}
+
+func ValidateBillView(v *validator.Validator, fields, include []string) {
+	names := BillFieldNames()
+	for _, field := range fields {
+		v.Check(validator.In(field, names...), "fields", fmt.Sprintf("unknown field %q", field))
+	}
+	for _, name := range include {
+		v.Check(validator.In(name, BillIncludes...), "include", fmt.Sprintf("unknown relation %q", name))
+	}
+}
+
+// MarshalJSON() writes the picked fields in their usual order. Fields the bill leaves
+// out when they are empty are left out here too
+func (view *BillView) MarshalJSON() ([]byte, error) {
+	js, err := json.Marshal(view.Bill)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(js, &values); err != nil {
+		return nil, err
+	}
+	picked := map[string]bool{}
+	for _, field := range view.Fields {
+		picked[field] = true
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	write := func(key string, value []byte) {
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	for _, field := range billFields {
+		value, ok := values[field.name]
+		if ok && (len(view.Fields) == 0 || picked[field.name]) {
+			write(field.name, value)
+		}
+	}
+	for _, name := range view.Include {
+		var related interface{}
+		switch name {
+		case IncludeUser:
+			related = view.User
+		case IncludeAdjustments:
+			related = view.Adjustments
+		case IncludeTransitions:
+			related = view.Transitions
+		default:
+			continue
+		}
+		value, err := json.Marshal(related)
+		if err != nil {
+			return nil, err
+		}
+		write(name, value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
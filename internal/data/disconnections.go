@@ -0,0 +1,395 @@
+// Filename: internal/data/disconnections.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+var (
+	ErrAccountOnHold = errors.New("account on hold")
+)
+
+// The states a disconnection case moves through
+const (
+	DisconnectionNoticeSent   = "notice_sent"
+	DisconnectionScheduled    = "scheduled"
+	DisconnectionDisconnected = "disconnected"
+	DisconnectionReconnected  = "reconnected"
+	DisconnectionCancelled    = "cancelled"
+)
+
+// disconnectionTransitions lists the states each state is allowed to move on to
+var disconnectionTransitions = map[string][]string{
+	DisconnectionNoticeSent:   {DisconnectionScheduled, DisconnectionCancelled},
+	DisconnectionScheduled:    {DisconnectionDisconnected, DisconnectionCancelled},
+	DisconnectionDisconnected: {DisconnectionReconnected},
+}
+
+// accountOnHold is a SQL condition that is true when an account has something
+// open that must stop a disconnection, %[1]s is the user id column/placeholder
+const accountOnHold = `
+	(EXISTS (SELECT 1 FROM disputes WHERE disputes.user_id = %[1]s AND disputes.resolved_at IS NULL)
+	OR EXISTS (SELECT 1 FROM payment_plans WHERE payment_plans.user_id = %[1]s AND payment_plans.state = 'active'))`
+
+type Disconnection struct {
+	ID             int64      `json:"id"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UserID         int64      `json:"user_id"`
+	State          string     `json:"state"`
+	Arrears        int64      `json:"arrears"`
+	NoticeSentAt   *time.Time `json:"notice_sent_at,omitempty"`
+	ScheduledFor   *time.Time `json:"scheduled_for,omitempty"`
+	DisconnectedAt *time.Time `json:"disconnected_at,omitempty"`
+	ReconnectedAt  *time.Time `json:"reconnected_at,omitempty"`
+	FeeBillID      *int64     `json:"fee_bill_id,omitempty"`
+	Version        int32      `json:"version"`
+}
+
+// OverdueAccount is an account whose unpaid, past-due bills add up to more than the threshold
+type OverdueAccount struct {
+	UserID    int64     `json:"user_id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Arrears   int64     `json:"arrears"`
+	OldestDue time.Time `json:"oldest_due"`
+}
+
+func ValidateDisconnectionState(v *validator.Validator, state string) {
+	v.Check(validator.In(state, DisconnectionNoticeSent, DisconnectionScheduled, DisconnectionDisconnected,
+		DisconnectionReconnected, DisconnectionCancelled), "state", "invalid disconnection state")
+}
+
+// CanTransition() reports whether the case may move on to the given state
+func (d *Disconnection) CanTransition(to string) bool {
+	return validator.In(to, disconnectionTransitions[d.State]...)
+}
+
+// Define the disconnection model
+type DisconnectionModel struct {
+	DB *sql.DB
+}
+
+// OverdueAccounts() finds the accounts whose arrears exceed the threshold and whose
+// oldest unpaid bill has been overdue for at least the given number of days. Accounts
+// that already have an open case, or are on hold, are left out
+func (m DisconnectionModel) OverdueAccounts(threshold int64, days int) ([]*OverdueAccount, error) {
+	query := fmt.Sprintf(`
+		SELECT users.id, users.name, users.email,
+		SUM(water_system.amount - water_system.amount_paid - water_system.amount_credited), MIN(water_system.due_date)
+		FROM water_system
+		INNER JOIN users ON users.id = water_system.user_id
+		WHERE water_system.amount > water_system.amount_paid + water_system.amount_credited
+		AND water_system.state IN `+openBillStates+`
+		AND water_system.due_date < CURRENT_DATE
+		AND NOT EXISTS (
+			SELECT 1 FROM disconnections
+			WHERE disconnections.user_id = users.id
+			AND disconnections.state = ANY($3)
+		)
+		AND NOT %s
+		GROUP BY users.id
+		HAVING SUM(water_system.amount - water_system.amount_paid - water_system.amount_credited) > $1
+		AND MIN(water_system.due_date) <= CURRENT_DATE - $2::int
+		ORDER BY users.id`, fmt.Sprintf(accountOnHold, "users.id"))
+
+	openStates := []string{DisconnectionNoticeSent, DisconnectionScheduled, DisconnectionDisconnected}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, threshold, days, pq.Array(openStates))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []*OverdueAccount{}
+	for rows.Next() {
+		var account OverdueAccount
+		err := rows.Scan(
+			&account.UserID,
+			&account.Name,
+			&account.Email,
+			&account.Arrears,
+			&account.OldestDue,
+		)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, &account)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// accountHeld() reports whether the account has an open dispute or an active payment
+// plan. The account is locked FOR UPDATE, which conflicts with the lock the foreign key
+// of a new dispute or payment plan takes on it, so none can be opened until tx ends
+func accountHeld(ctx context.Context, tx *sql.Tx, userID int64) (bool, error) {
+	query := fmt.Sprintf(`SELECT %s FROM users WHERE id = $1 FOR UPDATE`, fmt.Sprintf(accountOnHold, "users.id"))
+
+	var held bool
+	err := tx.QueryRowContext(ctx, query, userID).Scan(&held)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, ErrRecordNotFound
+	}
+	return held, err
+}
+
+// Insert() opens a new disconnection case and queues the notice, if one is given, in
+// the same transaction. The notice cannot be turned off by the user. The case number is added to the
+// notice's data as caseID
+func (m DisconnectionModel) Insert(d *Disconnection, notice *EmailMessage) error {
+	query := `
+		INSERT INTO disconnections (user_id, state, arrears, notice_sent_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, version
+	`
+	args := []interface{}{
+		d.UserID,
+		d.State,
+		d.Arrears,
+		d.NoticeSentAt,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&d.ID, &d.CreatedAt, &d.Version)
+	if err != nil {
+		return err
+	}
+	if notice != nil {
+		notice.Data["caseID"] = d.ID
+		_, err = enqueueNotification(ctx, tx, d.UserID, "", notice)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Get() returns a specific disconnection case
+func (m DisconnectionModel) Get(id int64) (*Disconnection, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT id, created_at, user_id, state, arrears, notice_sent_at, scheduled_for,
+		disconnected_at, reconnected_at, fee_bill_id, version
+		FROM disconnections
+		WHERE id = $1
+	`
+	var d Disconnection
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&d.ID,
+		&d.CreatedAt,
+		&d.UserID,
+		&d.State,
+		&d.Arrears,
+		&d.NoticeSentAt,
+		&d.ScheduledFor,
+		&d.DisconnectedAt,
+		&d.ReconnectedAt,
+		&d.FeeBillID,
+		&d.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &d, nil
+}
+
+// GetAll() returns the disconnection cases, optionally only those in one state
+func (m DisconnectionModel) GetAll(state string, filters Filters) ([]*Disconnection, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(),
+		id, created_at, user_id, state, arrears, notice_sent_at, scheduled_for,
+		disconnected_at, reconnected_at, fee_bill_id, version
+		FROM disconnections
+		WHERE (state = $1 OR $1 = '')
+		ORDER BY %s %s, id ASC
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortOrder())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, state, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	disconnections := []*Disconnection{}
+	for rows.Next() {
+		var d Disconnection
+		err := rows.Scan(
+			&totalRecords,
+			&d.ID,
+			&d.CreatedAt,
+			&d.UserID,
+			&d.State,
+			&d.Arrears,
+			&d.NoticeSentAt,
+			&d.ScheduledFor,
+			&d.DisconnectedAt,
+			&d.ReconnectedAt,
+			&d.FeeBillID,
+			&d.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		disconnections = append(disconnections, &d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return disconnections, metadata, nil
+}
+
+// Transition() moves a case on to its next state. Scheduling or carrying out a
+// disconnection is refused while the account is on hold, which is checked in the same
+// transaction so that a dispute or payment plan cannot be opened in between
+func (m DisconnectionModel) Transition(d *Disconnection, to string) error {
+	if !d.CanTransition(to) {
+		return ErrIllegalTransition
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if to == DisconnectionScheduled || to == DisconnectionDisconnected {
+		held, err := accountHeld(ctx, tx, d.UserID)
+		if err != nil {
+			return err
+		}
+		if held {
+			return ErrAccountOnHold
+		}
+	}
+	now := time.Now()
+	switch to {
+	case DisconnectionDisconnected:
+		d.DisconnectedAt = &now
+	case DisconnectionReconnected:
+		d.ReconnectedAt = &now
+	}
+	d.State = to
+
+	err = updateDisconnection(ctx, tx, d)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Reconnect() restores the service and posts the reconnection fee as a new bill on
+// the account, both in the same transaction and on behalf of the actor. The fee bill
+// is created and issued the way any other bill is, so it has a history, its delivery
+// is queued and the webhooks for it are sent
+func (m DisconnectionModel) Reconnect(d *Disconnection, fee int64, actorID int64) error {
+	if !d.CanTransition(DisconnectionReconnected) {
+		return ErrIllegalTransition
+	}
+	now := time.Now()
+	d.State = DisconnectionReconnected
+	d.ReconnectedAt = &now
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if fee > 0 {
+		bill := &Todo_list{
+			Waterbill:   "Reconnection fee",
+			Description: fmt.Sprintf("Reconnection of service for disconnection case %d", d.ID),
+			Notes:       "Posted automatically on reconnection",
+			Category:    "fees",
+			Priority:    "high",
+			UserID:      d.UserID,
+			Amount:      fee,
+			DueDate:     time.Now().AddDate(0, 0, 14),
+		}
+		err = insertBill(ctx, tx, bill, actorID)
+		if err != nil {
+			return err
+		}
+		err = transitionBill(ctx, tx, bill, BillIssued, actorID)
+		if err != nil {
+			return err
+		}
+		d.FeeBillID = &bill.ID
+	}
+	err = updateDisconnection(ctx, tx, d)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// updateDisconnection() writes the case back using the version for optimistic locking
+func updateDisconnection(ctx context.Context, tx *sql.Tx, d *Disconnection) error {
+	query := `
+		UPDATE disconnections
+		SET state = $1, scheduled_for = $2, disconnected_at = $3, reconnected_at = $4,
+		fee_bill_id = $5, version = version + 1
+		WHERE id = $6 AND version = $7
+		RETURNING version
+	`
+	args := []interface{}{
+		d.State,
+		d.ScheduledFor,
+		d.DisconnectedAt,
+		d.ReconnectedAt,
+		d.FeeBillID,
+		d.ID,
+		d.Version,
+	}
+	err := tx.QueryRowContext(ctx, query, args...).Scan(&d.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
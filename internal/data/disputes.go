@@ -0,0 +1,112 @@
+// Filename: internal/data/disputes.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+// A Dispute is raised by a customer who does not agree with what they were billed.
+// While a dispute is open the account cannot be disconnected
+type Dispute struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UserID     int64      `json:"user_id"`
+	BillID     *int64     `json:"bill_id,omitempty"`
+	Reason     string     `json:"reason"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	Version    int32      `json:"version"`
+}
+
+func ValidateDispute(v *validator.Validator, dispute *Dispute) {
+	v.Check(dispute.UserID > 0, "user_id", "must be provided")
+	v.Check(dispute.BillID == nil || *dispute.BillID > 0, "bill_id", "must be a valid bill id")
+	v.Check(dispute.Reason != "", "reason", "must be provided")
+	v.Check(len(dispute.Reason) <= 500, "reason", "must not be more than 500 bytes long")
+}
+
+// Define the dispute model
+type DisputeModel struct {
+	DB *sql.DB
+}
+
+// Insert() opens a new dispute
+func (m DisputeModel) Insert(dispute *Dispute) error {
+	query := `
+		INSERT INTO disputes (user_id, bill_id, reason)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, version
+	`
+	args := []interface{}{
+		dispute.UserID,
+		dispute.BillID,
+		dispute.Reason,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&dispute.ID, &dispute.CreatedAt, &dispute.Version)
+}
+
+// Get() returns a specific dispute
+func (m DisputeModel) Get(id int64) (*Dispute, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT id, created_at, user_id, bill_id, reason, resolved_at, version
+		FROM disputes
+		WHERE id = $1
+	`
+	var dispute Dispute
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&dispute.ID,
+		&dispute.CreatedAt,
+		&dispute.UserID,
+		&dispute.BillID,
+		&dispute.Reason,
+		&dispute.ResolvedAt,
+		&dispute.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &dispute, nil
+}
+
+// Resolve() closes an open dispute, which lifts the hold on the account
+func (m DisputeModel) Resolve(dispute *Dispute) error {
+	query := `
+		UPDATE disputes
+		SET resolved_at = NOW(), version = version + 1
+		WHERE id = $1 AND version = $2 AND resolved_at IS NULL
+		RETURNING resolved_at, version
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, dispute.ID, dispute.Version).Scan(&dispute.ResolvedAt, &dispute.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
@@ -3,6 +3,9 @@
 package data
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"math"
 	"strings"
 
@@ -14,6 +17,10 @@ type Filters struct {
 	PageSize int
 	Sort     string
 	SortList []string
+	// After and Before are cursors from the metadata of an earlier page. When one is
+	// given the page is read from that position rather than by page number
+	After  string
+	Before string
 }
 
 func ValidateFilters(v *validator.Validator, f Filters) {
@@ -24,6 +31,57 @@ func ValidateFilters(v *validator.Validator, f Filters) {
 	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100 records per page")
 	// Check that the sort parameter matches a value in the acceptable sort list
 	v.Check(validator.In(f.Sort, f.SortList...), "sort", "invalid sort value")
+	v.Check(f.After == "" || f.Before == "", "after", "cannot be used together with before")
+	if f.After != "" {
+		_, err := decodeCursor(f.After, f.Sort)
+		v.Check(err == nil, "after", "must be a cursor from a page with the same sort")
+	}
+	if f.Before != "" {
+		_, err := decodeCursor(f.Before, f.Sort)
+		v.Check(err == nil, "before", "must be a cursor from a page with the same sort")
+	}
+}
+
+// A cursor marks a position in a sorted listing: the value of the sort column and the
+// id of the row there. It is handed to clients as opaque URL safe text. The sort it
+// was made for is kept in it, as the position means nothing under another sort
+type cursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   int64  `json:"i"`
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+func encodeCursor(sort, key string, id int64) string {
+	js, _ := json.Marshal(cursor{Sort: sort, Key: key, ID: id})
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+func decodeCursor(s, sort string) (*cursor, error) {
+	js, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var c cursor
+	if err := json.Unmarshal(js, &c); err != nil || c.Sort != sort || c.ID < 1 {
+		return nil, errInvalidCursor
+	}
+	return &c, nil
+}
+
+// cursor() returns the cursor the page is read from and whether the page comes
+// before it rather than after it. It returns nil when paging by number
+func (f Filters) cursor() (*cursor, bool) {
+	switch {
+	case f.After != "":
+		c, _ := decodeCursor(f.After, f.Sort)
+		return c, false
+	case f.Before != "":
+		c, _ := decodeCursor(f.Before, f.Sort)
+		return c, true
+	}
+	return nil, false
 }
 
 // The sortColumn() method safely extracts the sort field query parameter
@@ -43,6 +101,7 @@ func (f Filters) sortOrder() string {
 	}
 	return "ASC"
 }
+
 // The limit() method determines the LIMIT
 func (f Filters) limit() int {
 	return f.PageSize
@@ -52,13 +111,16 @@ func (f Filters) limit() int {
 func (f Filters) offset() int {
 	return (f.Page - 1) * f.PageSize
 }
+
 // Metadata type contains metaData to help with pagination
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+	PrevCursor   string `json:"prev_cursor,omitempty"`
 }
 
 // calculateMetadata() functions computes the values for the metadata fields
@@ -74,5 +136,3 @@ func calculateMetadata(totalRecords int, page int, pageSize int) Metadata {
 		TotalRecords: totalRecords,
 	}
 }
-
-
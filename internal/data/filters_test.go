@@ -0,0 +1,134 @@
+// Filename: internal/data/filters_test.go
+
+package data
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	tests := []struct {
+		sort string
+		key  string
+		id   int64
+	}{
+		{"id", "42", 42},
+		{"-waterbill", "March, \"final\" reading", 7},
+		{"priority", "", 1},
+		{"created_at", "2024-03-01T09:30:00.123456Z", 9007199254740993},
+		{"-deleted_at", "2024-03-01T09:30:00-06:00", 3},
+		{"waterbill", "Café / año ✓", 5},
+	}
+	for _, tt := range tests {
+		s := encodeCursor(tt.sort, tt.key, tt.id)
+		if _, err := base64.RawURLEncoding.DecodeString(s); err != nil {
+			t.Errorf("cursor %q is not URL safe: %v", s, err)
+		}
+		c, err := decodeCursor(s, tt.sort)
+		if err != nil {
+			t.Errorf("decodeCursor(%q, %q): %v", s, tt.sort, err)
+			continue
+		}
+		if c.Sort != tt.sort || c.Key != tt.key || c.ID != tt.id {
+			t.Errorf("got %+v back, want sort %q, key %q and id %d", c, tt.sort, tt.key, tt.id)
+		}
+	}
+}
+
+func TestDecodeCursorInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor string
+		sort   string
+	}{
+		{"another sort", encodeCursor("waterbill", "March", 1), "-waterbill"},
+		{"no id", encodeCursor("id", "0", 0), "id"},
+		{"not base64", "%%%", "id"},
+		{"not JSON", base64.RawURLEncoding.EncodeToString([]byte("id:1")), "id"},
+		{"empty", "", "id"},
+	}
+	for _, tt := range tests {
+		if _, err := decodeCursor(tt.cursor, tt.sort); err != errInvalidCursor {
+			t.Errorf("%s: got %v, want errInvalidCursor", tt.name, err)
+		}
+	}
+}
+
+func TestValidateFiltersCursors(t *testing.T) {
+	sorts := []string{"id", "waterbill", "-id", "-waterbill"}
+	tests := []struct {
+		name          string
+		sort          string
+		after, before string
+		errors        []string
+	}{
+		{name: "page numbers", sort: "id"},
+		{name: "after", sort: "waterbill", after: encodeCursor("waterbill", "March", 3)},
+		{name: "before", sort: "-id", before: encodeCursor("-id", "3", 3)},
+		{name: "both", sort: "id", after: encodeCursor("id", "3", 3), before: encodeCursor("id", "1", 1), errors: []string{"after"}},
+		{name: "after with another sort", sort: "-waterbill", after: encodeCursor("waterbill", "March", 3), errors: []string{"after"}},
+		{name: "broken before", sort: "id", before: "broken", errors: []string{"before"}},
+	}
+	for _, tt := range tests {
+		v := validator.New()
+		ValidateFilters(v, Filters{Page: 1, PageSize: 20, Sort: tt.sort, SortList: sorts, After: tt.after, Before: tt.before})
+		if len(v.Errors) != len(tt.errors) {
+			t.Errorf("%s: got errors %v, want them on %v", tt.name, v.Errors, tt.errors)
+		}
+		for _, key := range tt.errors {
+			if v.Errors[key] == "" {
+				t.Errorf("%s: no error on %s, got %v", tt.name, key, v.Errors)
+			}
+		}
+	}
+}
+
+// The key a cursor holds reads back as the value it was made from
+func TestBillSortKeys(t *testing.T) {
+	created := time.Date(2024, 3, 1, 9, 30, 0, 123456000, time.FixedZone("CST", -6*3600))
+	deleted := created.Add(time.Hour)
+	bill := &Todo_list{ID: 42, Waterbill: "March", Priority: "high", CreatedAt: created, DeletedAt: &deleted}
+	tests := []struct {
+		column, typ, key string
+	}{
+		{"id", "bigint", "42"},
+		{"waterbill", "text", "March"},
+		{"priority", "text", "high"},
+		{"created_at", "timestamptz", "2024-03-01T09:30:00.123456-06:00"},
+		{"deleted_at", "timestamptz", "2024-03-01T10:30:00.123456-06:00"},
+	}
+	for _, tt := range tests {
+		sortKey, ok := billSortKeys[tt.column]
+		if !ok {
+			t.Errorf("no sort key for %s", tt.column)
+			continue
+		}
+		if sortKey.typ != tt.typ {
+			t.Errorf("%s: got type %s, want %s", tt.column, sortKey.typ, tt.typ)
+		}
+		key := sortKey.value(bill)
+		if key != tt.key {
+			t.Errorf("%s: got key %q, want %q", tt.column, key, tt.key)
+		}
+		if tt.typ == "timestamptz" {
+			parsed, err := time.Parse(time.RFC3339Nano, key)
+			if err != nil || !(parsed.Equal(created) || parsed.Equal(deleted)) {
+				t.Errorf("%s: %q does not read back as the time it was made from", tt.column, key)
+			}
+		}
+		c, err := decodeCursor(encodeCursor(tt.column, key, bill.ID), tt.column)
+		if err != nil || c.Key != key {
+			t.Errorf("%s: the key did not survive the cursor: %+v, %v", tt.column, c, err)
+		}
+	}
+	if key := billSortKeys["deleted_at"].value(&Todo_list{}); key != "" {
+		t.Errorf("a bill that is not deleted has the deleted_at key %q", key)
+	}
+	if len(billSortKeys) != len(tests) {
+		t.Errorf("got %d sort keys, the test covers %d", len(billSortKeys), len(tests))
+	}
+}
@@ -0,0 +1,168 @@
+// Filename: internal/data/history.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The changes that make a new version of a bill
+const (
+	HistoryCreated      = "created"
+	HistoryUpdated      = "updated"
+	HistoryDeleted      = "deleted"
+	HistoryRestored     = "restored"
+	HistoryTransitioned = "transitioned"
+	HistoryAdjusted     = "adjusted"
+	HistoryPaid         = "paid"
+	HistoryPurged       = "purged"
+)
+
+// A BillVersion is one entry in the history of a bill: the change that made the
+// version, who made it and when, and how the fields differ from the version before.
+// Bill holds the whole version, it is only filled in when a single version is read
+type BillVersion struct {
+	Version   int32                   `json:"version"`
+	Action    string                  `json:"action"`
+	ChangedAt time.Time               `json:"changed_at"`
+	ChangedBy *int64                  `json:"changed_by,omitempty"`
+	Changes   map[string]*FieldChange `json:"changes,omitempty"`
+	Bill      map[string]interface{}  `json:"waterbill,omitempty"`
+}
+
+// A FieldChange is the value of a field before and after a change
+type FieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// recordBillHistory() keeps the bills matching the WHERE clause, as they are before
+// tx changes them, in the history along with the change about to be made. It locks
+// the rows so that what is kept is exactly what the change replaces. The WHERE clause
+// takes its arguments from $3
+func recordBillHistory(ctx context.Context, tx *sql.Tx, action string, actorID int64, where string, args ...interface{}) error {
+	query := `
+		INSERT INTO water_system_history (bill_id, version, action, actor_id, prior)
+		SELECT id, version + 1, $1, NULLIF($2::bigint, 0), to_jsonb(water_system) - 'search'
+		FROM water_system
+		WHERE ` + where + `
+		FOR UPDATE`
+	_, err := tx.ExecContext(ctx, query, append([]interface{}{action, actorID}, args...)...)
+	return err
+}
+
+// recordBillsCreated() starts the history of newly inserted bills
+func recordBillsCreated(ctx context.Context, tx *sql.Tx, ids []int64, actorID int64) error {
+	query := `
+		INSERT INTO water_system_history (bill_id, version, action, actor_id)
+		SELECT id, version, $2, NULLIF($3::bigint, 0)
+		FROM water_system
+		WHERE id = ANY($1)`
+	_, err := tx.ExecContext(ctx, query, pq.Array(ids), HistoryCreated, actorID)
+	return err
+}
+
+// History() returns the recorded history of a bill, oldest first. A version is only
+// known in full once a later change has replaced it, or while it is the current one,
+// so the changes are left out where either side of them is not known. The account the
+// bill belongs to is returned with it, for the handlers to check who may read it
+func (m Todo_listModel) History(id int64) ([]*BillVersion, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Deleted bills keep their history. Purged bills keep it too, for the audit trail,
+	// but it is no longer served
+	snapshots := map[int32]map[string]interface{}{}
+	var (
+		current int32
+		ownerID int64
+		js      []byte
+	)
+	query := `SELECT version, COALESCE(user_id, 0), to_jsonb(water_system) - 'search' FROM water_system WHERE id = $1`
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&current, &ownerID, &js)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, 0, ErrRecordNotFound
+		default:
+			return nil, 0, err
+		}
+	}
+	snapshot, err := decodeSnapshot(js)
+	if err != nil {
+		return nil, 0, err
+	}
+	snapshots[current] = snapshot
+
+	query = `
+		SELECT version, action, changed_at, actor_id, prior
+		FROM water_system_history
+		WHERE bill_id = $1
+		ORDER BY version, id`
+	rows, err := m.DB.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	history := []*BillVersion{}
+	for rows.Next() {
+		var version BillVersion
+		var prior []byte
+		err := rows.Scan(&version.Version, &version.Action, &version.ChangedAt, &version.ChangedBy, &prior)
+		if err != nil {
+			return nil, 0, err
+		}
+		if prior != nil {
+			snapshot, err := decodeSnapshot(prior)
+			if err != nil {
+				return nil, 0, err
+			}
+			snapshots[version.Version-1] = snapshot
+		}
+		history = append(history, &version)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	for _, version := range history {
+		version.Bill = snapshots[version.Version]
+		before, ok := snapshots[version.Version-1]
+		if ok && version.Bill != nil {
+			version.Changes = diffSnapshots(before, version.Bill)
+		}
+	}
+	return history, ownerID, nil
+}
+
+// decodeSnapshot() reads a version of a bill kept as JSON
+func decodeSnapshot(js []byte) (map[string]interface{}, error) {
+	var snapshot map[string]interface{}
+	err := json.Unmarshal(js, &snapshot)
+	return snapshot, err
+}
+
+// diffSnapshots() returns the fields that differ between two versions of a bill. The
+// version number itself always differs and is left out
+func diffSnapshots(before, after map[string]interface{}) map[string]*FieldChange {
+	changes := map[string]*FieldChange{}
+	for key, to := range after {
+		from := before[key]
+		if key != "version" && !reflect.DeepEqual(from, to) {
+			changes[key] = &FieldChange{From: from, To: to}
+		}
+	}
+	for key, from := range before {
+		if _, ok := after[key]; !ok {
+			changes[key] = &FieldChange{From: from}
+		}
+	}
+	return changes
+}
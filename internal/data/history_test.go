@@ -0,0 +1,71 @@
+// Filename: internal/data/history_test.go
+
+package data
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after map[string]interface{}
+		want          map[string]*FieldChange
+	}{
+		{
+			name:   "nothing changed",
+			before: map[string]interface{}{"id": 1.0, "notes": "a", "version": 1.0},
+			after:  map[string]interface{}{"id": 1.0, "notes": "a", "version": 2.0},
+			want:   map[string]*FieldChange{},
+		},
+		{
+			name:   "a field changed",
+			before: map[string]interface{}{"notes": "a", "amount": 4250.0, "version": 1.0},
+			after:  map[string]interface{}{"notes": "b", "amount": 4250.0, "version": 2.0},
+			want:   map[string]*FieldChange{"notes": {From: "a", To: "b"}},
+		},
+		{
+			name:   "set and cleared",
+			before: map[string]interface{}{"deleted_at": nil, "issued_at": "2024-03-01T09:30:00Z"},
+			after:  map[string]interface{}{"deleted_at": "2024-03-02T10:00:00Z", "issued_at": nil},
+			want: map[string]*FieldChange{
+				"deleted_at": {From: nil, To: "2024-03-02T10:00:00Z"},
+				"issued_at":  {From: "2024-03-01T09:30:00Z", To: nil},
+			},
+		},
+		{
+			name:   "lists compared whole",
+			before: map[string]interface{}{"status": []interface{}{"open", "metered"}, "tags": []interface{}{"a"}},
+			after:  map[string]interface{}{"status": []interface{}{"open", "metered"}, "tags": []interface{}{"a", "b"}},
+			want:   map[string]*FieldChange{"tags": {From: []interface{}{"a"}, To: []interface{}{"a", "b"}}},
+		},
+		{
+			name:   "a column added",
+			before: map[string]interface{}{"notes": "a"},
+			after:  map[string]interface{}{"notes": "a", "lease": 0.0},
+			want:   map[string]*FieldChange{"lease": {From: nil, To: 0.0}},
+		},
+		{
+			name:   "a column dropped",
+			before: map[string]interface{}{"notes": "a", "search": "'a':1"},
+			after:  map[string]interface{}{"notes": "a"},
+			want:   map[string]*FieldChange{"search": {From: "'a':1"}},
+		},
+	}
+	for _, tt := range tests {
+		got := diffSnapshots(tt.before, tt.after)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, describeChanges(got), describeChanges(tt.want))
+		}
+	}
+}
+
+// describeChanges() spells the changes out for a failure message
+func describeChanges(changes map[string]*FieldChange) map[string]FieldChange {
+	described := map[string]FieldChange{}
+	for key, change := range changes {
+		described[key] = *change
+	}
+	return described
+}
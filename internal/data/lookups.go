@@ -0,0 +1,178 @@
+// Filename: internal/data/lookups.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+var (
+	ErrDuplicateCode = errors.New("duplicate code")
+)
+
+// Lookup codes are lower case words joined by underscores
+var lookupCodeRX = regexp.MustCompile(`^[a-z0-9]+(_[a-z0-9]+)*$`)
+
+// A Lookup is one entry in a managed vocabulary such as the bill categories or
+// priorities. Inactive entries stay on old bills but can not be used on new ones
+type Lookup struct {
+	Code      string    `json:"code"`
+	CreatedAt time.Time `json:"-"`
+	Label     string    `json:"label"`
+	Active    bool      `json:"active"`
+	Version   int32     `json:"version"`
+}
+
+func ValidateLookup(v *validator.Validator, lookup *Lookup) {
+	v.Check(lookup.Code != "", "code", "must be provided")
+	v.Check(len(lookup.Code) <= 50, "code", "must not be more than 50 bytes long")
+	v.Check(validator.Matches(lookup.Code, lookupCodeRX), "code", "must be lower case letters and digits separated by underscores")
+	v.Check(lookup.Label != "", "label", "must be provided")
+	v.Check(len(lookup.Label) <= 200, "label", "must not be more than 200 bytes long")
+}
+
+// ValidateVocabulary() checks that the category and priority of a bill are active codes
+func ValidateVocabulary(v *validator.Validator, entries *Todo_list, categories, priorities []string) {
+	v.Check(validator.In(entries.Category, categories...), "category", "must be one of the active categories")
+	v.Check(validator.In(entries.Priority, priorities...), "priority", "must be one of the active priorities")
+}
+
+// Define the lookup model, one is created for each vocabulary table
+type LookupModel struct {
+	DB    *sql.DB
+	table string
+}
+
+// Insert() adds a new entry to the vocabulary
+func (m LookupModel) Insert(lookup *Lookup) error {
+	query := fmt.Sprintf(`
+		INSERT INTO %s (code, label, active)
+		VALUES ($1, $2, $3)
+		RETURNING created_at, version`, m.table)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, lookup.Code, lookup.Label, lookup.Active).Scan(&lookup.CreatedAt, &lookup.Version)
+	if err != nil {
+		switch {
+		case err.Error() == fmt.Sprintf(`pq: duplicate key value violates unique constraint "%s_pkey"`, m.table):
+			return ErrDuplicateCode
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Get() returns a specific entry
+func (m LookupModel) Get(code string) (*Lookup, error) {
+	query := fmt.Sprintf(`
+		SELECT code, created_at, label, active, version
+		FROM %s
+		WHERE code = $1`, m.table)
+
+	var lookup Lookup
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, code).Scan(
+		&lookup.Code,
+		&lookup.CreatedAt,
+		&lookup.Label,
+		&lookup.Active,
+		&lookup.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &lookup, nil
+}
+
+// GetAll() returns the vocabulary ordered by label, only the active entries unless
+// all is set
+func (m LookupModel) GetAll(all bool) ([]*Lookup, error) {
+	query := fmt.Sprintf(`
+		SELECT code, created_at, label, active, version
+		FROM %s
+		WHERE (active OR $1)
+		ORDER BY label, code`, m.table)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, all)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lookups := []*Lookup{}
+	for rows.Next() {
+		var lookup Lookup
+		err := rows.Scan(
+			&lookup.Code,
+			&lookup.CreatedAt,
+			&lookup.Label,
+			&lookup.Active,
+			&lookup.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		lookups = append(lookups, &lookup)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return lookups, nil
+}
+
+// ActiveCodes() returns the codes that may be used on new or edited bills
+func (m LookupModel) ActiveCodes() ([]string, error) {
+	lookups, err := m.GetAll(false)
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]string, len(lookups))
+	for i, lookup := range lookups {
+		codes[i] = lookup.Code
+	}
+	return codes, nil
+}
+
+// Update() changes the label or active flag of an entry. Codes never change
+func (m LookupModel) Update(lookup *Lookup) error {
+	query := fmt.Sprintf(`
+		UPDATE %s
+		SET label = $1, active = $2, version = version + 1
+		WHERE code = $3 AND version = $4
+		RETURNING version`, m.table)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, lookup.Label, lookup.Active, lookup.Code, lookup.Version).Scan(&lookup.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
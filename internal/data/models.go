@@ -10,6 +10,8 @@ import (
 var (
 	ErrRecordNotFound = errors.New("record not found")
 	ErrEditConflict   = errors.New("edit conflict")
+	// returned when a record is asked to move to a state it cannot reach from where it is
+	ErrIllegalTransition = errors.New("illegal state transition")
 )
 
 // Create a Wrapper for our data models
@@ -18,6 +20,18 @@ type Models struct {
 	Todo_list Todo_listModel
 	Tokens TokenModel
 	Users UserModel
+	Disputes DisputeModel
+	Disconnections DisconnectionModel
+	PaymentPlans PaymentPlanModel
+	Payments PaymentModel
+	Adjustments AdjustmentModel
+	Permissions PermissionModel
+	Categories LookupModel
+	Priorities LookupModel
+	Outbox OutboxModel
+	Reminders ReminderModel
+	NotificationPreferences NotificationPreferenceModel
+	Webhooks WebhookModel
 }
 
 // NewModels() allows us to create a new Models
@@ -26,6 +40,18 @@ func NewModels(db *sql.DB) Models {
 		Todo_list: Todo_listModel{DB: db},
 		Tokens: TokenModel{DB: db},
 		Users: UserModel{DB: db},
-		
+		Disputes: DisputeModel{DB: db},
+		Disconnections: DisconnectionModel{DB: db},
+		PaymentPlans: PaymentPlanModel{DB: db},
+		Payments: PaymentModel{DB: db},
+		Adjustments: AdjustmentModel{DB: db},
+		Permissions: PermissionModel{DB: db},
+		Categories: LookupModel{DB: db, table: "categories"},
+		Priorities: LookupModel{DB: db, table: "priorities"},
+		Outbox: OutboxModel{DB: db},
+		Reminders: ReminderModel{DB: db},
+		NotificationPreferences: NotificationPreferenceModel{DB: db},
+		Webhooks: WebhookModel{DB: db},
+
 	}
 }
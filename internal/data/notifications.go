@@ -0,0 +1,214 @@
+// Filename: internal/data/notifications.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+// The channels a notification can go out on
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+)
+
+// The events a user can choose to be notified about
+const (
+	EventBillIssued      = "bill_issued"
+	EventReminder        = "reminder"
+	EventPaymentReceived = "payment_received"
+	EventOutage          = "outage"
+)
+
+// Channels and Events list every channel and event
+var (
+	Channels = []string{ChannelEmail, ChannelSMS}
+	Events   = []string{EventBillIssued, EventReminder, EventPaymentReceived, EventOutage}
+)
+
+// defaultEnabled is used for a switch the user never set: email is on, text
+// messages are off until the user turns them on
+var defaultEnabled = map[string]bool{
+	ChannelEmail: true,
+	ChannelSMS:   false,
+}
+
+// NotificationPreferences hold the phone number text messages go to, stored in E.164
+// form, and a switch for every event and channel
+type NotificationPreferences struct {
+	Phone       string                     `json:"phone"`
+	Preferences map[string]map[string]bool `json:"preferences"`
+}
+
+func ValidateNotificationPreferences(v *validator.Validator, prefs *NotificationPreferences) {
+	for event, channels := range prefs.Preferences {
+		v.Check(validator.In(event, Events...), "preferences", "contains an unknown event")
+		for channel, enabled := range channels {
+			v.Check(validator.In(channel, Channels...), "preferences", "contains an unknown channel")
+			if channel == ChannelSMS && enabled {
+				v.Check(prefs.Phone != "", "phone", "must be provided to receive text messages")
+			}
+		}
+	}
+}
+
+// Define the notification preference model
+type NotificationPreferenceModel struct {
+	DB *sql.DB
+}
+
+// Get() returns the preferences of a user with the defaults filled in for the
+// switches they never set
+func (m NotificationPreferenceModel) Get(userID int64) (*NotificationPreferences, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	prefs := &NotificationPreferences{Preferences: map[string]map[string]bool{}}
+	for _, event := range Events {
+		prefs.Preferences[event] = map[string]bool{}
+		for _, channel := range Channels {
+			prefs.Preferences[event][channel] = defaultEnabled[channel]
+		}
+	}
+	err := m.DB.QueryRowContext(ctx, `SELECT phone FROM users WHERE id = $1`, userID).Scan(&prefs.Phone)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	query := `
+		SELECT event, channel, enabled
+		FROM notification_preferences
+		WHERE user_id = $1
+	`
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			event, channel string
+			enabled        bool
+		)
+		err := rows.Scan(&event, &channel, &enabled)
+		if err != nil {
+			return nil, err
+		}
+		prefs.Preferences[event][channel] = enabled
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return prefs, nil
+}
+
+// Update() saves the phone number and the switches that were given, the others are
+// left as they were
+func (m NotificationPreferenceModel) Update(userID int64, prefs *NotificationPreferences) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `UPDATE users SET phone = $1 WHERE id = $2`, prefs.Phone, userID)
+	if err != nil {
+		return err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrRecordNotFound
+	}
+	query := `
+		INSERT INTO notification_preferences (user_id, event, channel, enabled)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, event, channel) DO UPDATE SET enabled = EXCLUDED.enabled
+	`
+	for event, channels := range prefs.Preferences {
+		for channel, enabled := range channels {
+			_, err = tx.ExecContext(ctx, query, userID, event, channel, enabled)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// enqueueNotification() queues a notification about the event for a user on every
+// channel they have switched on for it. An empty event is a notice the user cannot
+// turn off, such as a disconnection notice: it always goes by email, and by text
+// message too when the user has a phone number. The message is used as a template,
+// the recipient and channel are filled in for each copy. It returns the number of
+// messages queued
+func enqueueNotification(ctx context.Context, tx *sql.Tx, userID int64, event string, msg *EmailMessage) (int, error) {
+	var (
+		email, phone   string
+		emailOn, smsOn bool
+	)
+	query := `
+		SELECT users.email, users.phone,
+		COALESCE(by_email.enabled, $3), COALESCE(by_sms.enabled, $4)
+		FROM users
+		LEFT JOIN notification_preferences AS by_email
+		ON by_email.user_id = users.id AND by_email.event = $2 AND by_email.channel = 'email'
+		LEFT JOIN notification_preferences AS by_sms
+		ON by_sms.user_id = users.id AND by_sms.event = $2 AND by_sms.channel = 'sms'
+		WHERE users.id = $1
+	`
+	args := []interface{}{userID, event, defaultEnabled[ChannelEmail], defaultEnabled[ChannelSMS]}
+	err := tx.QueryRowContext(ctx, query, args...).Scan(&email, &phone, &emailOn, &smsOn)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, nil
+		default:
+			return 0, err
+		}
+	}
+	if event == "" {
+		emailOn, smsOn = true, true
+	}
+	recipients := map[string]string{}
+	if emailOn {
+		recipients[ChannelEmail] = email
+	}
+	if smsOn && phone != "" {
+		recipients[ChannelSMS] = phone
+	}
+	queued := 0
+	for _, channel := range Channels {
+		recipient, ok := recipients[channel]
+		if !ok {
+			continue
+		}
+		notification := *msg
+		notification.Channel = channel
+		notification.Recipient = recipient
+		err = enqueueEmail(ctx, tx, &notification)
+		if err != nil {
+			return 0, err
+		}
+		if queued == 0 {
+			msg.ID = notification.ID
+		}
+		queued++
+	}
+	return queued, nil
+}
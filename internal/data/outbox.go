@@ -0,0 +1,343 @@
+// Filename: internal/data/outbox.go
+
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The states of a message in the outbox. A message that keeps failing is moved to
+// dead once it has used up its attempts and stays there until it is requeued
+const (
+	OutboxPending = "pending"
+	OutboxSent    = "sent"
+	OutboxDead    = "dead"
+)
+
+// outboxLease is how long a claimed message is hidden from the other workers. If the
+// process dies while sending, the message becomes due again once the lease runs out
+const outboxLease = 5 * time.Minute
+
+// An EmailMessage is a notification waiting in the outbox. Despite the name it can go
+// out as an email or as a text message, the recipient is an email address or an E.164
+// phone number to match the channel. The template data is kept out of the JSON as it
+// can hold secrets such as activation tokens. BillID is set when the message delivers
+// a bill, the worker attaches the rendered bill when sending it by email. Lease is
+// the claim the worker holds on the message while sending it
+type EmailMessage struct {
+	ID            int64                  `json:"id"`
+	CreatedAt     time.Time              `json:"created_at"`
+	Channel       string                 `json:"channel"`
+	Recipient     string                 `json:"recipient"`
+	Template      string                 `json:"template"`
+	Data          map[string]interface{} `json:"-"`
+	BillID        *int64                 `json:"bill_id,omitempty"`
+	State         string                 `json:"state"`
+	Attempts      int                    `json:"attempts"`
+	NextAttemptAt time.Time              `json:"next_attempt_at"`
+	LastError     string                 `json:"last_error,omitempty"`
+	SentAt        *time.Time             `json:"sent_at,omitempty"`
+	Version       int32                  `json:"version"`
+	Lease         int64                  `json:"-"`
+}
+
+// Define the outbox model
+type OutboxModel struct {
+	DB *sql.DB
+}
+
+// enqueueEmail() adds a message to the outbox. It runs inside the transaction of the
+// change the message is about, so the message is only kept if the change is
+func enqueueEmail(ctx context.Context, tx *sql.Tx, msg *EmailMessage) error {
+	payload, err := json.Marshal(msg.Data)
+	if err != nil {
+		return err
+	}
+	if msg.Channel == "" {
+		msg.Channel = ChannelEmail
+	}
+	query := `
+		INSERT INTO email_outbox (channel, recipient, template, data, bill_id)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, state, next_attempt_at, version
+	`
+	args := []interface{}{msg.Channel, msg.Recipient, msg.Template, payload, msg.BillID}
+	return tx.QueryRowContext(ctx, query, args...).Scan(&msg.ID, &msg.CreatedAt, &msg.State, &msg.NextAttemptAt, &msg.Version)
+}
+
+// enqueueBillDelivery() queues the notifications that deliver a newly issued bill to
+// its account, on the channels chosen for issued bills, and marks the bill as queued.
+// The delivery status is part of the bill, so marking it takes a new version. Bills
+// without an account are left alone, it reports whether anything was queued
+func enqueueBillDelivery(ctx context.Context, tx *sql.Tx, billID int64) (bool, error) {
+	var (
+		userID          int64
+		name, waterbill string
+		owed            int64
+		dueDate         time.Time
+	)
+	query := `
+		SELECT users.id, users.name, water_system.waterbill,
+		water_system.amount - water_system.amount_paid - water_system.amount_credited, water_system.due_date
+		FROM water_system
+		INNER JOIN users ON users.id = water_system.user_id
+		WHERE water_system.id = $1
+	`
+	err := tx.QueryRowContext(ctx, query, billID).Scan(&userID, &name, &waterbill, &owed, &dueDate)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	msg := &EmailMessage{
+		Template: "bill_issued.tmpl",
+		Data: map[string]interface{}{
+			"name":      name,
+			"billID":    billID,
+			"waterbill": waterbill,
+			"amountDue": FormatAmount(owed),
+			"dueDate":   dueDate.Format("January 2, 2006"),
+		},
+		BillID: &billID,
+	}
+	queued, err := enqueueNotification(ctx, tx, userID, EventBillIssued, msg)
+	if err != nil || queued == 0 {
+		return false, err
+	}
+	_, err = tx.ExecContext(ctx, `
+		UPDATE water_system
+		SET delivery_status = $1, delivery_updated_at = NOW(), version = version + 1
+		WHERE id = $2`, DeliveryQueued, billID)
+	return err == nil, err
+}
+
+// Claim() hands the oldest due message to a worker. The attempt is counted and the
+// message is leased so that no other worker picks it up. Each claim takes a new lease
+// number, so a worker whose lease ran out can no longer record an outcome. It returns
+// nil when nothing is due
+func (m OutboxModel) Claim() (*EmailMessage, error) {
+	query := `
+		UPDATE email_outbox
+		SET attempts = attempts + 1, lease = lease + 1, next_attempt_at = NOW() + $1 * INTERVAL '1 second'
+		WHERE id = (
+			SELECT id FROM email_outbox
+			WHERE state = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at, id
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		)
+		RETURNING ` + outboxColumns
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	msg, err := scanEmailMessage(m.DB.QueryRowContext(ctx, query, outboxLease.Seconds()))
+	if errors.Is(err, ErrRecordNotFound) {
+		return nil, nil
+	}
+	return msg, err
+}
+
+// MarkSent() records a successful delivery, and that the bill it carried went out.
+// The template data is cleared, so secrets such as activation tokens are not kept
+// once they are no longer needed. It fails with ErrEditConflict when the lease on
+// the message has been lost
+func (m OutboxModel) MarkSent(msg *EmailMessage) error {
+	query := `
+		UPDATE email_outbox
+		SET state = 'sent', sent_at = NOW(), last_error = '', data = '{}'::jsonb, version = version + 1
+		WHERE id = $1 AND lease = $2 AND state = 'pending'
+		RETURNING sent_at, state, version
+	`
+	return m.finish(msg, query, DeliverySent, msg.ID, msg.Lease)
+}
+
+// MarkFailed() records a failed attempt. The message is retried after the backoff
+// unless it has used up its attempts, in which case it is moved to dead, its template
+// data is cleared and the bill it carried is marked as failed. Like MarkSent() it
+// needs the lease to still be held
+func (m OutboxModel) MarkFailed(msg *EmailMessage, sendErr error, backoff time.Duration, maxAttempts int) error {
+	if msg.Attempts >= maxAttempts {
+		query := `
+			UPDATE email_outbox
+			SET state = 'dead', last_error = $3, data = '{}'::jsonb, version = version + 1
+			WHERE id = $1 AND lease = $2 AND state = 'pending'
+			RETURNING sent_at, state, version
+		`
+		return m.finish(msg, query, DeliveryFailed, msg.ID, msg.Lease, sendErr.Error())
+	}
+	query := `
+		UPDATE email_outbox
+		SET next_attempt_at = NOW() + $3 * INTERVAL '1 second', last_error = $4, version = version + 1
+		WHERE id = $1 AND lease = $2 AND state = 'pending'
+		RETURNING sent_at, state, version
+	`
+	return m.finish(msg, query, "", msg.ID, msg.Lease, backoff.Seconds(), sendErr.Error())
+}
+
+// Requeue() gives a dead message a fresh set of attempts. Its template data was cleared
+// when it died, so it goes out again without it
+func (m OutboxModel) Requeue(msg *EmailMessage) error {
+	if msg.State != OutboxDead {
+		return ErrIllegalTransition
+	}
+	query := `
+		UPDATE email_outbox
+		SET state = 'pending', attempts = 0, next_attempt_at = NOW(), version = version + 1
+		WHERE id = $1 AND version = $2
+		RETURNING sent_at, state, version
+	`
+	return m.finish(msg, query, DeliveryQueued, msg.ID, msg.Version)
+}
+
+// finish() runs one of the state changes above and carries the outcome over to the
+// delivery status of the bill, when the message is delivering one. That takes a new
+// version of the bill, so cached copies and pending edits see the change
+func (m OutboxModel) finish(msg *EmailMessage, query, delivery string, args ...interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&msg.SentAt, &msg.State, &msg.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	if msg.BillID != nil && delivery != "" {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE water_system
+			SET delivery_status = $1, delivery_updated_at = NOW(), version = version + 1
+			WHERE id = $2`, delivery, *msg.BillID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Get() returns a specific message
+func (m OutboxModel) Get(id int64) (*EmailMessage, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `SELECT ` + outboxColumns + ` FROM email_outbox WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return scanEmailMessage(m.DB.QueryRowContext(ctx, query, id))
+}
+
+// GetAll() returns the messages in the outbox, optionally only those in one state
+func (m OutboxModel) GetAll(state string, filters Filters) ([]*EmailMessage, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(), %s
+		FROM email_outbox
+		WHERE (state = $1 OR $1 = '')
+		ORDER BY %s %s, id ASC
+		LIMIT $2 OFFSET $3`, outboxColumns, filters.sortColumn(), filters.sortOrder())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, state, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	messages := []*EmailMessage{}
+	for rows.Next() {
+		var (
+			msg     EmailMessage
+			payload []byte
+		)
+		err := rows.Scan(append([]interface{}{&totalRecords}, msg.fields(&payload)...)...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		err = decodeEmailData(payload, &msg.Data)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		messages = append(messages, &msg)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return messages, metadata, nil
+}
+
+// The columns scanned by fields(), in order
+const outboxColumns = `id, created_at, channel, recipient, template, data, bill_id, state, attempts,
+	next_attempt_at, last_error, sent_at, version, lease`
+
+// fields() returns the scan destinations for outboxColumns, the data is scanned into payload
+func (msg *EmailMessage) fields(payload *[]byte) []interface{} {
+	return []interface{}{
+		&msg.ID,
+		&msg.CreatedAt,
+		&msg.Channel,
+		&msg.Recipient,
+		&msg.Template,
+		payload,
+		&msg.BillID,
+		&msg.State,
+		&msg.Attempts,
+		&msg.NextAttemptAt,
+		&msg.LastError,
+		&msg.SentAt,
+		&msg.Version,
+		&msg.Lease,
+	}
+}
+
+// scanEmailMessage() reads a single message
+func scanEmailMessage(row *sql.Row) (*EmailMessage, error) {
+	var (
+		msg     EmailMessage
+		payload []byte
+	)
+	err := row.Scan(msg.fields(&payload)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	err = decodeEmailData(payload, &msg.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// decodeEmailData() reads the template data back, keeping numbers such as ids as
+// they were written rather than turning them into floats
+func decodeEmailData(payload []byte, data *map[string]interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	return dec.Decode(data)
+}
@@ -0,0 +1,350 @@
+// Filename: internal/data/paymentplans.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+var (
+	ErrActivePlanExists = errors.New("active payment plan exists")
+)
+
+// The states a payment plan can be in
+const (
+	PlanActive    = "active"
+	PlanCompleted = "completed"
+	PlanDefaulted = "defaulted"
+	PlanCancelled = "cancelled"
+)
+
+// How far apart the installments of a plan fall
+const (
+	FrequencyWeekly      = "weekly"
+	FrequencyFortnightly = "fortnightly"
+	FrequencyMonthly     = "monthly"
+)
+
+type PaymentPlan struct {
+	ID           int64          `json:"id"`
+	CreatedAt    time.Time      `json:"created_at"`
+	UserID       int64          `json:"user_id"`
+	Total        int64          `json:"total"`
+	Frequency    string         `json:"frequency"`
+	State        string         `json:"state"`
+	ClosedAt     *time.Time     `json:"closed_at,omitempty"`
+	Installments []*Installment `json:"installments,omitempty"`
+	Version      int32          `json:"version"`
+}
+
+type Installment struct {
+	ID         int64     `json:"id"`
+	Seq        int       `json:"seq"`
+	DueDate    time.Time `json:"due_date"`
+	Amount     int64     `json:"amount"`
+	AmountPaid int64     `json:"amount_paid"`
+}
+
+func ValidatePaymentPlan(v *validator.Validator, plan *PaymentPlan, count int, firstDue time.Time) {
+	v.Check(plan.UserID > 0, "user_id", "must be provided")
+	v.Check(plan.Total > 0, "total", "must be greater than zero")
+	v.Check(count >= 2, "installments", "must be at least 2")
+	v.Check(count <= 60, "installments", "must not be more than 60")
+	v.Check(int64(count) <= plan.Total, "installments", "must not be more than the total in cents")
+	v.Check(validator.In(plan.Frequency, FrequencyWeekly, FrequencyFortnightly, FrequencyMonthly), "frequency", "must be weekly, fortnightly or monthly")
+	v.Check(!firstDue.IsZero(), "first_due_date", "must be provided")
+}
+
+// BuildInstallments() splits the total into count installments. All the math is done
+// in minor units: each installment gets total/count and the remainder is spread one
+// cent at a time over the first installments so the schedule always adds up exactly
+func BuildInstallments(total int64, count int, firstDue time.Time, frequency string) []*Installment {
+	base := total / int64(count)
+	remainder := total % int64(count)
+
+	installments := make([]*Installment, count)
+	for i := 0; i < count; i++ {
+		amount := base
+		if int64(i) < remainder {
+			amount++
+		}
+		installments[i] = &Installment{
+			Seq:     i + 1,
+			DueDate: installmentDueDate(firstDue, frequency, i),
+			Amount:  amount,
+		}
+	}
+	return installments
+}
+
+// installmentDueDate() works out the due date of the n-th (zero based) installment.
+// Monthly dates that fall past the end of a short month are pulled back to its last day
+func installmentDueDate(firstDue time.Time, frequency string, n int) time.Time {
+	switch frequency {
+	case FrequencyWeekly:
+		return firstDue.AddDate(0, 0, 7*n)
+	case FrequencyFortnightly:
+		return firstDue.AddDate(0, 0, 14*n)
+	default:
+		year, month, day := firstDue.Date()
+		first := time.Date(year, month+time.Month(n), 1, 0, 0, 0, 0, firstDue.Location())
+		last := first.AddDate(0, 1, -1).Day()
+		if day > last {
+			day = last
+		}
+		return time.Date(first.Year(), first.Month(), day, 0, 0, 0, 0, firstDue.Location())
+	}
+}
+
+// Define the payment plan model
+type PaymentPlanModel struct {
+	DB *sql.DB
+}
+
+// Insert() creates the plan together with its installment schedule
+func (m PaymentPlanModel) Insert(plan *PaymentPlan) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO payment_plans (user_id, total, frequency)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, state, version
+	`
+	err = tx.QueryRowContext(ctx, query, plan.UserID, plan.Total, plan.Frequency).Scan(
+		&plan.ID,
+		&plan.CreatedAt,
+		&plan.State,
+		&plan.Version,
+	)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "payment_plans_active_user_idx"`:
+			return ErrActivePlanExists
+		default:
+			return err
+		}
+	}
+	query = `
+		INSERT INTO plan_installments (plan_id, seq, due_date, amount)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`
+	for _, installment := range plan.Installments {
+		err = tx.QueryRowContext(ctx, query, plan.ID, installment.Seq, installment.DueDate, installment.Amount).Scan(&installment.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Get() returns a specific plan with its installments
+func (m PaymentPlanModel) Get(id int64) (*PaymentPlan, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT id, created_at, user_id, total, frequency, state, closed_at, version
+		FROM payment_plans
+		WHERE id = $1
+	`
+	var plan PaymentPlan
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&plan.ID,
+		&plan.CreatedAt,
+		&plan.UserID,
+		&plan.Total,
+		&plan.Frequency,
+		&plan.State,
+		&plan.ClosedAt,
+		&plan.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	plan.Installments, err = m.installments(ctx, plan.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// installments() loads the schedule of a plan in order
+func (m PaymentPlanModel) installments(ctx context.Context, planID int64) ([]*Installment, error) {
+	query := `
+		SELECT id, seq, due_date, amount, amount_paid
+		FROM plan_installments
+		WHERE plan_id = $1
+		ORDER BY seq
+	`
+	rows, err := m.DB.QueryContext(ctx, query, planID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	installments := []*Installment{}
+	for rows.Next() {
+		var installment Installment
+		err := rows.Scan(
+			&installment.ID,
+			&installment.Seq,
+			&installment.DueDate,
+			&installment.Amount,
+			&installment.AmountPaid,
+		)
+		if err != nil {
+			return nil, err
+		}
+		installments = append(installments, &installment)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return installments, nil
+}
+
+// GetAll() lists the plans, optionally for a single account and/or state. The
+// installments are not loaded for listings
+func (m PaymentPlanModel) GetAll(userID int64, state string, filters Filters) ([]*PaymentPlan, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(),
+		id, created_at, user_id, total, frequency, state, closed_at, version
+		FROM payment_plans
+		WHERE (user_id = $1 OR $1 = 0)
+		AND (state = $2 OR $2 = '')
+		ORDER BY %s %s, id ASC
+		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortOrder())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, state, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	plans := []*PaymentPlan{}
+	for rows.Next() {
+		var plan PaymentPlan
+		err := rows.Scan(
+			&totalRecords,
+			&plan.ID,
+			&plan.CreatedAt,
+			&plan.UserID,
+			&plan.Total,
+			&plan.Frequency,
+			&plan.State,
+			&plan.ClosedAt,
+			&plan.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		plans = append(plans, &plan)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return plans, metadata, nil
+}
+
+// Cancel() stops an active plan
+func (m PaymentPlanModel) Cancel(plan *PaymentPlan) error {
+	if plan.State != PlanActive {
+		return ErrIllegalTransition
+	}
+	query := `
+		UPDATE payment_plans
+		SET state = $1, closed_at = NOW(), version = version + 1
+		WHERE id = $2 AND version = $3
+		RETURNING state, closed_at, version
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, PlanCancelled, plan.ID, plan.Version).Scan(&plan.State, &plan.ClosedAt, &plan.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// DetectDefaults() marks every active plan with an installment still unpaid more than
+// graceDays after its due date as defaulted, and returns the plans it changed. It gives
+// up when ctx is cancelled
+func (m PaymentPlanModel) DetectDefaults(ctx context.Context, graceDays int) ([]*PaymentPlan, error) {
+	query := `
+		UPDATE payment_plans
+		SET state = $1, closed_at = NOW(), version = version + 1
+		WHERE state = $2
+		AND EXISTS (
+			SELECT 1 FROM plan_installments
+			WHERE plan_installments.plan_id = payment_plans.id
+			AND plan_installments.amount_paid < plan_installments.amount
+			AND plan_installments.due_date < CURRENT_DATE - $3::int
+		)
+		RETURNING id, created_at, user_id, total, frequency, state, closed_at, version
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, PlanDefaulted, PlanActive, graceDays)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plans := []*PaymentPlan{}
+	for rows.Next() {
+		var plan PaymentPlan
+		err := rows.Scan(
+			&plan.ID,
+			&plan.CreatedAt,
+			&plan.UserID,
+			&plan.Total,
+			&plan.Frequency,
+			&plan.State,
+			&plan.ClosedAt,
+			&plan.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, &plan)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return plans, nil
+}
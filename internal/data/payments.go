@@ -0,0 +1,322 @@
+// Filename: internal/data/payments.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+type Payment struct {
+	ID          int64         `json:"id"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UserID      int64         `json:"user_id"`
+	Amount      int64         `json:"amount"`
+	Reference   string        `json:"reference"`
+	PlanID      *int64        `json:"plan_id,omitempty"`
+	Unapplied   int64         `json:"unapplied"`
+	Allocations []*Allocation `json:"allocations"`
+}
+
+// An Allocation is the part of a payment that was matched to a bill or to a plan installment
+type Allocation struct {
+	BillID        *int64 `json:"bill_id,omitempty"`
+	InstallmentID *int64 `json:"installment_id,omitempty"`
+	Amount        int64  `json:"amount"`
+}
+
+func ValidatePayment(v *validator.Validator, payment *Payment) {
+	v.Check(payment.UserID > 0, "user_id", "must be provided")
+	v.Check(payment.Amount > 0, "amount", "must be greater than zero")
+	v.Check(payment.Reference != "", "reference", "must be provided")
+	v.Check(len(payment.Reference) <= 200, "reference", "must not be more than 200 bytes long")
+}
+
+// Define the payment model
+type PaymentModel struct {
+	DB *sql.DB
+}
+
+// Balance() returns the total still owed across all of an account's open bills
+func (m PaymentModel) Balance(userID int64) (int64, error) {
+	query := `
+		SELECT COALESCE(SUM(amount - amount_paid - amount_credited), 0)
+		FROM water_system
+		WHERE user_id = $1 AND state IN ` + openBillStates
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var balance int64
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&balance)
+	return balance, err
+}
+
+// Insert() records an incoming payment and matches it, in the same transaction, against
+// the installments of the account's active payment plan, in order, and then against the
+// account's open bills, oldest due first. Each cent is allocated once, to an installment
+// or to a bill, and what the plan takes is still posted against the bills it pays off.
+// Anything left over is kept as unapplied credit on the payment, so the allocations add
+// up to the amount less the unapplied credit. A receipt is queued on the channels the
+// account chose for received payments, along with the payment.created webhook. The
+// history of each bill paid names the user who posted the payment
+func (m PaymentModel) Insert(payment *Payment, actorID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO payments (user_id, amount, reference)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`
+	err = tx.QueryRowContext(ctx, query, payment.UserID, payment.Amount, payment.Reference).Scan(&payment.ID, &payment.CreatedAt)
+	if err != nil {
+		return err
+	}
+	payment.Allocations = []*Allocation{}
+
+	// Match the payment against the installments of the active plan, if there is one
+	var (
+		planID  int64
+		planned int64
+	)
+	err = tx.QueryRowContext(ctx, `
+		SELECT id FROM payment_plans
+		WHERE user_id = $1 AND state = $2
+		FOR UPDATE`, payment.UserID, PlanActive).Scan(&planID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return err
+	default:
+		payment.PlanID = &planID
+		installments, err := lockOutstanding(ctx, tx, `
+			SELECT id, amount - amount_paid
+			FROM plan_installments
+			WHERE plan_id = $1 AND amount > amount_paid
+			ORDER BY seq
+			FOR UPDATE`, planID)
+		if err != nil {
+			return err
+		}
+		settled := 0
+		for _, installment := range installments {
+			if planned == payment.Amount {
+				break
+			}
+			applied := min64(payment.Amount-planned, installment.owed)
+			_, err = tx.ExecContext(ctx, `
+				UPDATE plan_installments
+				SET amount_paid = amount_paid + $1
+				WHERE id = $2`, applied, installment.id)
+			if err != nil {
+				return err
+			}
+			installmentID := installment.id
+			payment.Allocations = append(payment.Allocations, &Allocation{InstallmentID: &installmentID, Amount: applied})
+			if applied == installment.owed {
+				settled++
+			}
+			planned += applied
+		}
+		// The plan is complete once every installment has been paid
+		if settled == len(installments) {
+			_, err = tx.ExecContext(ctx, `
+				UPDATE payment_plans
+				SET state = $1, closed_at = NOW(), version = version + 1
+				WHERE id = $2`, PlanCompleted, planID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Settle the bills. The plan pays off the arrears on them, so what went to its
+	// installments is posted against the bills first; only what the bills take beyond
+	// that is allocated to them directly
+	bills, err := lockOutstanding(ctx, tx, `
+		SELECT id, amount - amount_paid - amount_credited
+		FROM water_system
+		WHERE user_id = $1 AND state IN `+openBillStates+`
+		AND amount > amount_paid + amount_credited
+		ORDER BY due_date, id
+		FOR UPDATE`, payment.UserID)
+	if err != nil {
+		return err
+	}
+	remaining := payment.Amount
+	viaPlan := planned
+	for _, bill := range bills {
+		if remaining == 0 {
+			break
+		}
+		applied := min64(remaining, bill.owed)
+		err = recordBillHistory(ctx, tx, HistoryPaid, actorID, `id = $3`, bill.id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE water_system
+			SET amount_paid = amount_paid + $1, version = version + 1
+			WHERE id = $2`, applied, bill.id)
+		if err != nil {
+			return err
+		}
+		err = settleBillState(ctx, tx, bill.id)
+		if err != nil {
+			return err
+		}
+		remaining -= applied
+		fromPlan := min64(viaPlan, applied)
+		viaPlan -= fromPlan
+		if applied > fromPlan {
+			billID := bill.id
+			payment.Allocations = append(payment.Allocations, &Allocation{BillID: &billID, Amount: applied - fromPlan})
+		}
+	}
+	// Plan money the bills could not take stays on the plan, it is not unapplied
+	payment.Unapplied = remaining - viaPlan
+
+	query = `
+		UPDATE payments SET plan_id = $1, unapplied = $2 WHERE id = $3
+	`
+	_, err = tx.ExecContext(ctx, query, payment.PlanID, payment.Unapplied, payment.ID)
+	if err != nil {
+		return err
+	}
+	query = `
+		INSERT INTO payment_allocations (payment_id, bill_id, installment_id, amount)
+		VALUES ($1, $2, $3, $4)
+	`
+	for _, allocation := range payment.Allocations {
+		_, err = tx.ExecContext(ctx, query, payment.ID, allocation.BillID, allocation.InstallmentID, allocation.Amount)
+		if err != nil {
+			return err
+		}
+	}
+	var name string
+	err = tx.QueryRowContext(ctx, `SELECT name FROM users WHERE id = $1`, payment.UserID).Scan(&name)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	receipt := &EmailMessage{
+		Template: "payment_received.tmpl",
+		Data: map[string]interface{}{
+			"name":      name,
+			"paymentID": payment.ID,
+			"amount":    FormatAmount(payment.Amount),
+			"reference": payment.Reference,
+			"unapplied": FormatAmount(payment.Unapplied),
+		},
+	}
+	_, err = enqueueNotification(ctx, tx, payment.UserID, EventPaymentReceived, receipt)
+	if err != nil {
+		return err
+	}
+	err = enqueueWebhook(ctx, tx, WebhookPaymentCreated, payment)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get() returns a specific payment and how it was allocated
+func (m PaymentModel) Get(id int64) (*Payment, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT id, created_at, user_id, amount, reference, plan_id, unapplied
+		FROM payments
+		WHERE id = $1
+	`
+	var payment Payment
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&payment.ID,
+		&payment.CreatedAt,
+		&payment.UserID,
+		&payment.Amount,
+		&payment.Reference,
+		&payment.PlanID,
+		&payment.Unapplied,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	query = `
+		SELECT bill_id, installment_id, amount
+		FROM payment_allocations
+		WHERE payment_id = $1
+		ORDER BY id
+	`
+	rows, err := m.DB.QueryContext(ctx, query, payment.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payment.Allocations = []*Allocation{}
+	for rows.Next() {
+		var allocation Allocation
+		err := rows.Scan(&allocation.BillID, &allocation.InstallmentID, &allocation.Amount)
+		if err != nil {
+			return nil, err
+		}
+		payment.Allocations = append(payment.Allocations, &allocation)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+// outstanding is a row that still has an amount owing on it
+type outstanding struct {
+	id   int64
+	owed int64
+}
+
+// lockOutstanding() runs a SELECT ... FOR UPDATE returning (id, owed) rows
+func lockOutstanding(ctx context.Context, tx *sql.Tx, query string, id int64) ([]outstanding, error) {
+	rows, err := tx.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var owing []outstanding
+	for rows.Next() {
+		var o outstanding
+		err := rows.Scan(&o.id, &o.owed)
+		if err != nil {
+			return nil, err
+		}
+		owing = append(owing, o)
+	}
+	return owing, rows.Err()
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
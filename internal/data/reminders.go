@@ -0,0 +1,124 @@
+// Filename: internal/data/reminders.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// The kinds of reminder. Upcoming reminders go out a number of days before a bill is
+// due, overdue reminders a number of days after
+const (
+	ReminderUpcoming = "upcoming"
+	ReminderOverdue  = "overdue"
+)
+
+// The template used for each kind of reminder
+var reminderTemplates = map[string]string{
+	ReminderUpcoming: "bill_reminder_upcoming.tmpl",
+	ReminderOverdue:  "bill_reminder_overdue.tmpl",
+}
+
+// Define the reminder model
+type ReminderModel struct {
+	DB *sql.DB
+}
+
+// Queue() finds the open bills that are due in, or overdue by, exactly the given number
+// of days and queues a reminder for each of them on the channels the account chose for
+// reminders. Every reminder is recorded against the bill, so running it again on the
+// same day sends nothing twice. It returns the number of bills reminded
+func (m ReminderModel) Queue(ctx context.Context, kind string, offset int) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// An upcoming reminder is due offset days before the due date, an overdue one
+	// offset days after it
+	days := offset
+	if kind == ReminderOverdue {
+		days = -offset
+	}
+	query := `
+		INSERT INTO bill_reminders (bill_id, kind, offset_days)
+		SELECT water_system.id, $1::text, $2::int
+		FROM water_system
+		INNER JOIN users ON users.id = water_system.user_id
+		WHERE water_system.state IN ` + openBillStates + `
+		AND water_system.amount > water_system.amount_paid + water_system.amount_credited
+		AND water_system.due_date = CURRENT_DATE + $3::int
+		ON CONFLICT (bill_id, kind, offset_days) DO NOTHING
+		RETURNING id, bill_id
+	`
+	rows, err := tx.QueryContext(ctx, query, kind, offset, days)
+	if err != nil {
+		return 0, err
+	}
+	type pending struct{ id, billID int64 }
+	var reminders []pending
+	for rows.Next() {
+		var p pending
+		err := rows.Scan(&p.id, &p.billID)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		reminders = append(reminders, p)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	reminded := 0
+	for _, reminder := range reminders {
+		var (
+			userID          int64
+			name, waterbill string
+			owed            int64
+			dueDate         time.Time
+		)
+		query = `
+			SELECT users.id, users.name, water_system.waterbill,
+			water_system.amount - water_system.amount_paid - water_system.amount_credited, water_system.due_date
+			FROM water_system
+			INNER JOIN users ON users.id = water_system.user_id
+			WHERE water_system.id = $1
+		`
+		err = tx.QueryRowContext(ctx, query, reminder.billID).Scan(&userID, &name, &waterbill, &owed, &dueDate)
+		if err != nil {
+			return 0, err
+		}
+		msg := &EmailMessage{
+			Template: reminderTemplates[kind],
+			Data: map[string]interface{}{
+				"name":      name,
+				"billID":    reminder.billID,
+				"waterbill": waterbill,
+				"amountDue": FormatAmount(owed),
+				"dueDate":   dueDate.Format("January 2, 2006"),
+				"days":      offset,
+			},
+		}
+		queued, err := enqueueNotification(ctx, tx, userID, EventReminder, msg)
+		if err != nil {
+			return 0, err
+		}
+		if queued == 0 {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE bill_reminders SET outbox_id = $1 WHERE id = $2`, msg.ID, reminder.id)
+		if err != nil {
+			return 0, err
+		}
+		reminded++
+	}
+	return reminded, tx.Commit()
+}
@@ -0,0 +1,178 @@
+// Filename: internal/data/search.go
+
+package data
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lib/pq"
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+// SearchLanguages are the text search configurations a search can use. The search
+// column of water_system is built with simple, which neither stems words nor drops
+// stop words, so it suits bills in any language. The others stem words in their
+// language and are served by the expression indexes of migration 000030, which must
+// be kept in step with searchDocument()
+var SearchLanguages = []string{"simple", "english", "spanish"}
+
+// searchMaxTerms caps the words of a search
+const searchMaxTerms = 10
+
+// searchHeadline sets out the snippets: up to two fragments of the bill text with the
+// matching words between markers. ts_headline does not escape the text around them, so
+// the markers are control characters that markSnippet() turns into <mark> tags once the
+// text is escaped. They are stripped from the bill text first
+const searchHeadline = "StartSel=" + snippetStart + ", StopSel=" + snippetStop + `, MaxWords=35, MinWords=15, MaxFragments=2, FragmentDelimiter=" ... "`
+
+const (
+	snippetStart = "\x01"
+	snippetStop  = "\x02"
+)
+
+// markSnippet() HTML-escapes a snippet made by ts_headline and marks the matching words
+func markSnippet(s string) string {
+	s = html.EscapeString(s)
+	s = strings.ReplaceAll(s, snippetStart, "<mark>")
+	return strings.ReplaceAll(s, snippetStop, "</mark>")
+}
+
+// A SearchResult is a bill that matched a search, how well it matched and a snippet
+// of its text showing where
+type SearchResult struct {
+	Bill    *Todo_list `json:"waterbill"`
+	Rank    float32    `json:"rank"`
+	Snippet string     `json:"snippet"`
+}
+
+// SearchTerms() splits what was typed into words, dropping punctuation, so it can be
+// turned into a tsquery without the user having to know its syntax
+func SearchTerms(q string) []string {
+	return strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func ValidateSearch(v *validator.Validator, q, language string) {
+	v.Check(strings.TrimSpace(q) != "", "q", "must be provided")
+	v.Check(len(q) <= 200, "q", "must not be more than 200 bytes long")
+	if strings.TrimSpace(q) != "" {
+		v.Check(len(SearchTerms(q)) > 0, "q", "must contain a word")
+	}
+	v.Check(len(SearchTerms(q)) <= searchMaxTerms, "q", fmt.Sprintf("must not contain more than %d words", searchMaxTerms))
+	v.Check(validator.In(language, SearchLanguages...), "language", "must be simple, english or spanish")
+}
+
+// searchQuery() builds a tsquery that matches bills holding every word, the last one
+// also as the start of a longer word so that results show up while a word is typed
+func searchQuery(terms []string) string {
+	parts := make([]string, len(terms))
+	for i, term := range terms {
+		parts[i] = "'" + term + "'"
+	}
+	parts[len(parts)-1] += ":*"
+	return strings.Join(parts, " & ")
+}
+
+// searchDocument() returns the weighted document a search in the language matches
+// against. The waterbill weighs most, then the description, the notes and the
+// category. Apart from simple, which has the search column, the expression is written
+// out with the language inlined so that it is the one its index was built on. The
+// language must be one of SearchLanguages
+func searchDocument(language string) string {
+	if language == "simple" {
+		return "search"
+	}
+	return strings.NewReplacer("$lang", pq.QuoteLiteral(language)).Replace(`(setweight(to_tsvector($lang::regconfig, coalesce(waterbill, '')), 'A') ||
+			setweight(to_tsvector($lang::regconfig, coalesce(description, '')), 'B') ||
+			setweight(to_tsvector($lang::regconfig, coalesce(notes, '')), 'C') ||
+			setweight(to_tsvector($lang::regconfig, coalesce(category, '')), 'D'))`)
+}
+
+// Search() returns the bills matching the words of q, best match first, with an
+// HTML-escaped snippet of each
+func (m Todo_listModel) Search(q, language string, filters Filters) ([]*SearchResult, Metadata, error) {
+	if !validator.In(language, SearchLanguages...) {
+		return nil, Metadata{}, fmt.Errorf("unknown search language %q", language)
+	}
+	document := searchDocument(language)
+	// The snippets are only made for the rows on the page
+	query := fmt.Sprintf(`
+		WITH query AS (SELECT to_tsquery($1::regconfig, $2) AS q),
+		matches AS (
+			SELECT COUNT(*) OVER() AS total, water_system.*, ts_rank(%[1]s, query.q) AS rank, query.q
+			FROM water_system, query
+			WHERE %[1]s @@ query.q
+			AND deleted_at IS NULL
+			ORDER BY rank DESC, id ASC
+			LIMIT $4 OFFSET $5
+		)
+		SELECT total,
+		id, created_at,
+		waterbill, description,
+		notes, category,
+		priority,
+		status, state,
+		COALESCE(user_id, 0), amount,
+		amount_paid, amount_credited,
+		due_date, issued_at,
+		COALESCE(delivery_status, ''),
+		version,
+		rank,
+		ts_headline($1::regconfig, translate(waterbill || ' ' || description || ' ' || notes, E'\x01\x02', ''), q, $3)
+		FROM matches
+		ORDER BY rank DESC, id ASC`, document)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	args := []interface{}{language, searchQuery(SearchTerms(q)), searchHeadline, filters.limit(), filters.offset()}
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	results := []*SearchResult{}
+	for rows.Next() {
+		var bill Todo_list
+		var result SearchResult
+		err := rows.Scan(
+			&totalRecords,
+			&bill.ID,
+			&bill.CreatedAt,
+			&bill.Waterbill,
+			&bill.Description,
+			&bill.Notes,
+			&bill.Category,
+			&bill.Priority,
+			pq.Array(&bill.Status),
+			&bill.State,
+			&bill.UserID,
+			&bill.Amount,
+			&bill.AmountPaid,
+			&bill.AmountCredited,
+			&bill.DueDate,
+			&bill.IssuedAt,
+			&bill.DeliveryStatus,
+			&bill.Version,
+			&result.Rank,
+			&result.Snippet,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		result.Snippet = markSnippet(result.Snippet)
+		result.Bill = &bill
+		results = append(results, &result)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return results, metadata, nil
+}
@@ -0,0 +1,86 @@
+// Filename: internal/data/search_test.go
+
+package data
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSearchTerms(t *testing.T) {
+	tests := []struct {
+		q    string
+		want []string
+	}{
+		{"Leak", []string{"leak"}},
+		{"  meter   reading ", []string{"meter", "reading"}},
+		{"O'Brien & sons | !", []string{"o", "brien", "sons"}},
+		{"año 2024", []string{"año", "2024"}},
+		{"&|!():*", []string{}},
+	}
+	for _, tt := range tests {
+		got := SearchTerms(tt.q)
+		if len(got) == 0 && len(tt.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SearchTerms(%q) = %q, want %q", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestSearchQuery(t *testing.T) {
+	tests := []struct {
+		terms []string
+		want  string
+	}{
+		{[]string{"leak"}, "'leak':*"},
+		{[]string{"meter", "read"}, "'meter' & 'read':*"},
+	}
+	for _, tt := range tests {
+		if got := searchQuery(tt.terms); got != tt.want {
+			t.Errorf("searchQuery(%q) = %q, want %q", tt.terms, got, tt.want)
+		}
+	}
+}
+
+// Bill text is escaped, only the markers ts_headline put around the matches become tags
+func TestMarkSnippet(t *testing.T) {
+	tests := []struct {
+		snippet, want string
+	}{
+		{"a \x01leak\x02 at the meter", "a <mark>leak</mark> at the meter"},
+		{"<script>alert(1)</script> \x01leak\x02", "&lt;script&gt;alert(1)&lt;/script&gt; <mark>leak</mark>"},
+		{`"<mark>" & 'x'`, "&#34;&lt;mark&gt;&#34; &amp; &#39;x&#39;"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := markSnippet(tt.snippet); got != tt.want {
+			t.Errorf("markSnippet(%q) = %q, want %q", tt.snippet, got, tt.want)
+		}
+	}
+}
+
+// Each language that stems words has an index on exactly the document it searches,
+// otherwise its searches scan the table
+func TestSearchDocumentIndexed(t *testing.T) {
+	if got := searchDocument("simple"); got != "search" {
+		t.Errorf("simple searches the %q document, want the search column", got)
+	}
+	migration, err := os.ReadFile("../../migrations/000030_add_water_search_language_indexes.up.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexed := strings.Join(strings.Fields(string(migration)), "")
+	for _, language := range SearchLanguages {
+		if language == "simple" {
+			continue
+		}
+		document := strings.Join(strings.Fields(searchDocument(language)), "")
+		if !strings.Contains(indexed, "GIN("+document+")") {
+			t.Errorf("no index on the %s document %s", language, document)
+		}
+	}
+}
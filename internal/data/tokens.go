@@ -16,15 +16,16 @@ import (
 // Token categories/scopes
 
 const (
-	ScopeActivation = "activation"
+	ScopeActivation     = "activation"
+	ScopeAuthentication = "authentication"
 )
 // Define the token type 
 type Token struct {
-	Plaintext string
-	Hash []byte 
-	UserID int64
-	Expiry time.Time
-	Scope string
+	Plaintext string    `json:"token"`
+	Hash      []byte    `json:"-"`
+	UserID    int64     `json:"-"`
+	Expiry    time.Time `json:"expiry"`
+	Scope     string    `json:"-"`
 }
 // The generate token function returns a token 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -98,4 +99,20 @@ func (m TokenModel) DeleteAllForUsers(scope string, userID int64) error {
 
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 		return err
-}
\ No newline at end of file
+}
+// DeleteExpired() removes the tokens that can no longer be used. It gives up when ctx
+// is cancelled
+func (m TokenModel) DeleteExpired(ctx context.Context) (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE expiry < NOW()
+	`
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -9,6 +9,7 @@ import (
 	"errors"
 	"time"
 
+	"github.com/lib/pq"
 	"water.biling.system.driane.perez.net/internal/validator"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -17,6 +18,9 @@ var (
 	ErrDuplicateEmail = errors.New("duplicate email")
 )
 
+// AnonymousUser stands in for a client that did not authenticate
+var AnonymousUser = &User{}
+
 type User struct {
 	ID        int64     `json:"id"`
 	CreatedAt time.Time `json:"created_at"`
@@ -27,6 +31,11 @@ type User struct {
 	Version   int       `json:"-"`
 }
 
+// IsAnonymous() checks whether the user is the anonymous user
+func (u *User) IsAnonymous() bool {
+	return u == AnonymousUser
+}
+
 // create a custom password type
 type password struct {
 	plaintext *string
@@ -121,6 +130,151 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
+// Register() creates a new user along with their activation token and queues the
+// welcome email carrying the token, all in one transaction
+func (m UserModel) Register(user *User, ttl time.Duration) (*Token, error) {
+	token, err := generateToken(0, ttl, ScopeActivation)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO users (name, email, password_hash, activated)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, version
+	`
+	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+			return nil, ErrDuplicateEmail
+		default:
+			return nil, err
+		}
+	}
+	token.UserID = user.ID
+	query = `
+		INSERT INTO tokens (hash, user_id, expiry, scope)
+		VALUES ($1, $2, $3, $4)
+	`
+	_, err = tx.ExecContext(ctx, query, token.Hash, token.UserID, token.Expiry, token.Scope)
+	if err != nil {
+		return nil, err
+	}
+	welcome := &EmailMessage{
+		Recipient: user.Email,
+		Template:  "user_welcome.tmpl",
+		Data: map[string]interface{}{
+			"activationToken": token.Plaintext,
+			"userID":          user.ID,
+		},
+	}
+	err = enqueueEmail(ctx, tx, welcome)
+	if err != nil {
+		return nil, err
+	}
+	return token, tx.Commit()
+}
+
+// Get() returns a specific user
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, version
+		FROM users
+		WHERE id = $1
+	`
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// Existing() returns which of the ids belong to a user
+func (m UserModel) Existing(ids []int64) (map[int64]bool, error) {
+	existing := map[int64]bool{}
+	if len(ids) == 0 {
+		return existing, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT id FROM users WHERE id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		existing[id] = true
+	}
+	return existing, rows.Err()
+}
+
+// A UserSummary is the part of an account that is shown alongside its bills
+type UserSummary struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// Summaries() returns the summaries of the users with the given ids by id
+func (m UserModel) Summaries(ids []int64) (map[int64]*UserSummary, error) {
+	summaries := map[int64]*UserSummary{}
+	if len(ids) == 0 {
+		return summaries, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT id, name FROM users WHERE id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var summary UserSummary
+		if err := rows.Scan(&summary.ID, &summary.Name); err != nil {
+			return nil, err
+		}
+		summaries[summary.ID] = &summary
+	}
+	return summaries, rows.Err()
+}
+
 // get user based on their email
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
@@ -185,6 +339,45 @@ func (m UserModel) Update(user *User) error {
 	return nil
 }
 
+// Activate() marks the user as activated, removes their activation tokens and queues
+// the user.activated webhook, all in one transaction
+func (m UserModel) Activate(user *User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users
+		SET activated = true, version = version + 1
+		WHERE id = $1 AND version = $2
+		RETURNING version
+	`
+	err = tx.QueryRowContext(ctx, query, user.ID, user.Version).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	user.Activated = true
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE scope = $1 AND user_id = $2`, ScopeActivation, user.ID)
+	if err != nil {
+		return err
+	}
+	err = enqueueWebhook(ctx, tx, WebhookUserActivated, user)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 	// Setup query
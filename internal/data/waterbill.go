@@ -6,22 +6,39 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
 	"water.biling.system.driane.perez.net/internal/validator"
 )
 
+var (
+	// returned when something tries to change a bill that is no longer a draft
+	ErrBillIssued = errors.New("bill already issued")
+)
+
 type Todo_list struct {
-	ID          int64     `json:"id"`
-	CreatedAt   time.Time `json:"-"`
-	Waterbill   string    `json:"waterbill"`
-	Description string    `json:"description"`
-	Notes       string    `json:"notes"`
-	Category    string    `json:"category"`
-	Priority    string    `json:"priority"`
-	Status      []string  `json:"status"`
-	Version     int32     `json:"version"`
+	ID             int64      `json:"id"`
+	CreatedAt      time.Time  `json:"created_at"`
+	Waterbill      string     `json:"waterbill"`
+	Description    string     `json:"description"`
+	Notes          string     `json:"notes"`
+	Category       string     `json:"category"`
+	Priority       string     `json:"priority"`
+	Status         []string   `json:"status"`
+	State          string     `json:"state"`
+	UserID         int64      `json:"user_id,omitempty"`
+	Amount         int64      `json:"amount"`
+	AmountPaid     int64      `json:"amount_paid"`
+	AmountCredited int64      `json:"amount_credited"`
+	DueDate        time.Time  `json:"due_date"`
+	IssuedAt       *time.Time `json:"issued_at,omitempty"`
+	DeliveryStatus string     `json:"delivery_status,omitempty"`
+	Version        int32      `json:"version"`
+	DeletedAt      *time.Time `json:"deleted_at,omitempty"`
+	DeletedBy      int64      `json:"deleted_by,omitempty"`
 }
 
 func ValidateEntires(v *validator.Validator, entries *Todo_list) {
@@ -41,10 +58,10 @@ func ValidateEntires(v *validator.Validator, entries *Todo_list) {
 	v.Check(entries.Priority != "", "priority", "must be provided")
 	v.Check(len(entries.Priority) <= 200, "priority", "must not be more than 200 bytes long")
 
-	v.Check(entries.Status != nil, "status", "must be provided")
-	v.Check(len(entries.Status) >= 1, "status", "must contain one Status")
-	v.Check(len(entries.Status) <= 5, "status", "must contain at least five Status")
-	v.Check(validator.Unique(entries.Status), "status", "must not contain duplicate Status")
+	// amounts are kept in minor units (cents) so they are always whole numbers
+	v.Check(entries.UserID >= 0, "user_id", "must be a valid user id")
+	v.Check(entries.Amount >= 0, "amount", "must not be negative")
+	v.Check(entries.AmountPaid+entries.AmountCredited <= entries.Amount, "amount", "must not be less than the amount already paid and credited")
 
 }
 
@@ -53,17 +70,33 @@ type Todo_listModel struct {
 	DB *sql.DB
 }
 
-// Insert() allows us to create a new todo_list
-func (m Todo_listModel) Insert(Todo_list *Todo_list) error {
-	query := `
-	INSERT INTO water_system (waterbill, description, notes, category, priority, status)
-	VALUES ($1, $2, $3, $4, $5, $6)
-	RETURNING id, created_at, version
-	`
+// Insert() allows us to create a new todo_list and starts its history. Like every
+// change to a bill, it queues the webhook for the change in the same transaction
+func (m Todo_listModel) Insert(Todo_list *Todo_list, actorID int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	// Cleanup to prevent memory leaks
 	defer cancel()
 
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = insertBill(ctx, tx, Todo_list, actorID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertBill() does the work of Insert() inside the caller's transaction
+func insertBill(ctx context.Context, tx *sql.Tx, Todo_list *Todo_list, actorID int64) error {
+	query := `
+	INSERT INTO water_system (waterbill, description, notes, category, priority, user_id, amount, due_date)
+	VALUES ($1, $2, $3, $4, $5, NULLIF($6::bigint, 0), $7, COALESCE($8::date, CURRENT_DATE + 30))
+	RETURNING id, created_at, state, due_date, version
+	`
 	// Collect the data fields into a slice
 	args := []interface{}{
 		Todo_list.Waterbill,
@@ -71,23 +104,126 @@ func (m Todo_listModel) Insert(Todo_list *Todo_list) error {
 		Todo_list.Notes,
 		Todo_list.Category,
 		Todo_list.Priority,
-		pq.Array(Todo_list.Status),
+		Todo_list.UserID,
+		Todo_list.Amount,
+		nullDate(Todo_list.DueDate),
+	}
+	err := tx.QueryRowContext(ctx, query, args...).Scan(&Todo_list.ID, &Todo_list.CreatedAt, &Todo_list.State, &Todo_list.DueDate, &Todo_list.Version)
+	if err != nil {
+		return err
+	}
+	err = recordBillsCreated(ctx, tx, []int64{Todo_list.ID}, actorID)
+	if err != nil {
+		return err
 	}
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&Todo_list.ID, &Todo_list.CreatedAt, &Todo_list.Version)
+	return enqueueWebhook(ctx, tx, WebhookBillCreated, Todo_list)
+}
+
+// insertBatchSize is the number of bills InsertMany() sends in one statement
+const insertBatchSize = 500
+
+// InsertMany() creates a number of bills in one transaction, so either all of them
+// are saved or none are. They are sent in multi-row batches to keep large imports fast
+func (m Todo_listModel) InsertMany(bills []*Todo_list, actorID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for start := 0; start < len(bills); start += insertBatchSize {
+		end := start + insertBatchSize
+		if end > len(bills) {
+			end = len(bills)
+		}
+		batch := bills[start:end]
+		values := make([]string, len(batch))
+		args := make([]interface{}, 0, len(batch)*8)
+		for i, bill := range batch {
+			n := i * 8
+			values[i] = fmt.Sprintf("($%d::text, $%d::text, $%d::text, $%d::text, $%d::text, NULLIF($%d::bigint, 0), $%d::bigint, COALESCE($%d::date, CURRENT_DATE + 30), %d)",
+				n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8, i)
+			args = append(args,
+				bill.Waterbill,
+				bill.Description,
+				bill.Notes,
+				bill.Category,
+				bill.Priority,
+				bill.UserID,
+				bill.Amount,
+				nullDate(bill.DueDate),
+			)
+		}
+		// The rows are inserted in the order of the batch, so their ids go up with it
+		// and sorting the returned rows by id matches them back to the bills
+		query := fmt.Sprintf(`
+			WITH batch (waterbill, description, notes, category, priority, user_id, amount, due_date, position) AS (
+				VALUES %s
+			), inserted AS (
+				INSERT INTO water_system (waterbill, description, notes, category, priority, user_id, amount, due_date)
+				SELECT waterbill, description, notes, category, priority, user_id, amount, due_date
+				FROM batch
+				ORDER BY position
+				RETURNING id, created_at, state, due_date, version
+			)
+			SELECT id, created_at, state, due_date, version
+			FROM inserted
+			ORDER BY id`, strings.Join(values, ", "))
+
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		i := 0
+		for rows.Next() {
+			bill := batch[i]
+			err := rows.Scan(&bill.ID, &bill.CreatedAt, &bill.State, &bill.DueDate, &bill.Version)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			i++
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+	}
+	ids := make([]int64, len(bills))
+	for i, bill := range bills {
+		ids[i] = bill.ID
+	}
+	err = recordBillsCreated(ctx, tx, ids, actorID)
+	if err != nil {
+		return err
+	}
+	for _, bill := range bills {
+		err = enqueueWebhook(ctx, tx, WebhookBillCreated, bill)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
 // GET () allow us to retrieve a specific todo_list
 func (m Todo_listModel) Get(id int64) (*Todo_list, error) {
+	return m.GetFields(id, nil)
+}
+
+// GetFields() returns a specific bill with only the given fields read, or every field
+// when fields is empty
+func (m Todo_listModel) GetFields(id int64, fields []string) (*Todo_list, error) {
 	//ensure that there is a valid id
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
+	columns, dests := billSelect(fields)
 	// Create query
-	query := `
-		SELECT id, created_at, waterbill, description, notes, category, priority, status, version
-		FROM water_system
-		WHERE id = $1
-	`
+	query := `SELECT ` + columns + ` FROM water_system WHERE id = $1 AND deleted_at IS NULL`
 	// Declare a Todo_list variable to hold the return data
 	var todo_list Todo_list
 	//create a context
@@ -96,17 +232,7 @@ func (m Todo_listModel) Get(id int64) (*Todo_list, error) {
 	// Cleanup to prevent memory leaks
 	defer cancel()
 	// Execute Query using the QueryRowContext()
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
-		&todo_list.ID,
-		&todo_list.CreatedAt,
-		&todo_list.Waterbill,
-		&todo_list.Description,
-		&todo_list.Notes,
-		&todo_list.Category,
-		&todo_list.Priority,
-		pq.Array(&todo_list.Status),
-		&todo_list.Version,
-	)
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(dests(&todo_list)...)
 	// Handle any errors
 	if err != nil {
 		// Check the type of error
@@ -122,8 +248,34 @@ func (m Todo_listModel) Get(id int64) (*Todo_list, error) {
 }
 
 // Update() allows us to edit/alter a specific Todolist
-//optimistic locking (version number)
-func (m Todo_listModel) Update(Todo_list *Todo_list) error {
+//optimistic locking (version number). Only draft bills can be changed, mistakes
+//on issued bills are fixed with an adjustment
+func (m Todo_listModel) Update(Todo_list *Todo_list, actorID int64) error {
+	if Todo_list.State != BillDraft {
+		return ErrBillIssued
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// Cleanup to prevent memory leaks
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = updateBill(ctx, tx, Todo_list, actorID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// updateBill() does the work of Update() inside the caller's transaction
+func updateBill(ctx context.Context, tx *sql.Tx, Todo_list *Todo_list, actorID int64) error {
+	if Todo_list.State != BillDraft {
+		return ErrBillIssued
+	}
 	//created a query
 	query := `
 	UPDATE water_system 
@@ -132,28 +284,33 @@ func (m Todo_listModel) Update(Todo_list *Todo_list) error {
 	notes = $3,
 	category = $4, 
 	priority = $5,
-	status = $6, 
+	user_id = NULLIF($6::bigint, 0),
+	amount = $7,
+	due_date = $8,
 	version = version + 1
-	WHERE id = $7
-	AND version = $8
+	WHERE id = $9
+	AND version = $10
+	AND state = 'draft'
 	RETURNING version
 	`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	// Cleanup to prevent memory leaks
-	defer cancel()
-
 	args := []interface{}{
 		Todo_list.Waterbill,
 		Todo_list.Description,
 		Todo_list.Notes,
 		Todo_list.Category,
 		Todo_list.Priority,
-		pq.Array(Todo_list.Status),
+		Todo_list.UserID,
+		Todo_list.Amount,
+		Todo_list.DueDate,
 		Todo_list.ID,
 		Todo_list.Version,
 	}
-	// Check for edit conflicts
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&Todo_list.Version)
+	// Keep the version being replaced, then check for edit conflicts
+	err := recordBillHistory(ctx, tx, HistoryUpdated, actorID, `id = $3 AND version = $4 AND state = 'draft'`, Todo_list.ID, Todo_list.Version)
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&Todo_list.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -162,63 +319,329 @@ func (m Todo_listModel) Update(Todo_list *Todo_list) error {
 			return err
 		}
 	}
-	return nil
+	return enqueueWebhook(ctx, tx, WebhookBillUpdated, Todo_list)
 }
 
-// deletes() removes a specific todolist
-func (m Todo_listModel) Delete(id int64) error {
+// Delete() moves a draft bill to the trash, as long as it is still the version the
+// caller looked at. It stays there, out of every listing, until it is restored or the
+// retention job purges it
+func (m Todo_listModel) Delete(id int64, version int32, actorID int64) error {
 	// Ensure that there is a valid id
 	if id < 1 {
 		return ErrRecordNotFound
 	}
-	// Create the delete query
-	query := `
-		DELETE FROM water_system
-		WHERE id = $1
-	`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	// Cleanup to prevent memory leaks
 	defer cancel()
-	// Execute the query
-	results, err := m.DB.ExecContext(ctx, query, id)
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	// Check how many rows were affected by the delete operations. We
-	// call the RowsAffected() method on the result variable
-	rowsAffected, err := results.RowsAffected()
+	defer tx.Rollback()
+
+	err = deleteBill(ctx, tx, id, version, actorID)
 	if err != nil {
 		return err
 	}
-	// Check if no rows were affected
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
+	return tx.Commit()
+}
+
+// deleteBill() does the work of Delete() inside the caller's transaction
+func deleteBill(ctx context.Context, tx *sql.Tx, id int64, version int32, actorID int64) error {
+	columns, dests := billSelect(nil)
+	query := `
+		UPDATE water_system
+		SET deleted_at = NOW(),
+		deleted_by = NULLIF($3::bigint, 0),
+		version = version + 1
+		WHERE id = $1
+		AND version = $2
+		AND state = 'draft'
+		AND deleted_at IS NULL
+		RETURNING ` + columns
+	err := recordBillHistory(ctx, tx, HistoryDeleted, actorID, `id = $3 AND version = $4 AND state = 'draft' AND deleted_at IS NULL`, id, version)
+	if err != nil {
+		return err
+	}
+	// Execute the query
+	var bill Todo_list
+	err = tx.QueryRowContext(ctx, query, id, version, actorID).Scan(dests(&bill)...)
+	if err != nil {
+		switch {
+		// No rows means the bill was changed or removed since it was read
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
 	}
-	return nil
+	return enqueueWebhook(ctx, tx, WebhookBillDeleted, &bill)
 }
 
-// The GetAll() returns a list of all the todo items sorted by ID
-func (m Todo_listModel) GetAll(waterbill string, priority string, status []string, filters Filters) ([]*Todo_list, Metadata, error) {
-	// Construct the query
+// Restore() takes a bill out of the trash and returns it, queueing the
+// waterbill.restored webhook. A non-zero ownerID only restores the bill when it
+// belongs to that account, any other bill is not found
+func (m Todo_listModel) Restore(id int64, ownerID int64, actorID int64) (*Todo_list, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	columns, dests := billSelect(nil)
+	query := `
+		UPDATE water_system
+		SET deleted_at = NULL,
+		deleted_by = NULL,
+		version = version + 1
+		WHERE id = $1
+		AND deleted_at IS NOT NULL
+		AND (user_id = $2 OR $2 = 0)
+		RETURNING ` + columns
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = recordBillHistory(ctx, tx, HistoryRestored, actorID, `id = $3 AND deleted_at IS NOT NULL AND (user_id = $4 OR $4 = 0)`, id, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	var bill Todo_list
+	err = tx.QueryRowContext(ctx, query, id, ownerID).Scan(dests(&bill)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	err = enqueueWebhook(ctx, tx, WebhookBillRestored, &bill)
+	if err != nil {
+		return nil, err
+	}
+	return &bill, tx.Commit()
+}
+
+// Purge() permanently removes the bills that have been in the trash for longer than
+// the retention period and returns how many there were. Their history is kept for
+// the audit trail, ending in a purged entry that holds the bill as it last was
+func (m Todo_listModel) Purge(ctx context.Context, retention time.Duration) (int64, error) {
+	query := `
+		DELETE FROM water_system
+		WHERE deleted_at < NOW() - $1 * INTERVAL '1 second'
+	`
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	seconds := int64(retention.Seconds())
+	err = recordBillHistory(ctx, tx, HistoryPurged, 0, `deleted_at < NOW() - $3 * INTERVAL '1 second'`, seconds)
+	if err != nil {
+		return 0, err
+	}
+	results, err := tx.ExecContext(ctx, query, seconds)
+	if err != nil {
+		return 0, err
+	}
+	count, err := results.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return count, tx.Commit()
+}
+
+// How the statuses of a BillQuery are matched: a bill must have all of them, or any
+const (
+	StatusMatchAll = "all"
+	StatusMatchAny = "any"
+)
+
+// A BillQuery holds the filters of the bill listing. Empty and zero fields do not
+// filter. Waterbill, Priority and Text are full-text matches, Text searching the
+// description and the notes together. CreatedTo is exclusive. Bills in the trash are
+// only listed, on their own, when Deleted is set. UserID limits the listing to the
+// bills of one account
+type BillQuery struct {
+	Waterbill   string
+	Priority    string
+	Status      []string
+	StatusMatch string
+	State       string
+	Category    string
+	Text        string
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	Version     int
+	Deleted     bool
+	UserID      int64
+}
+
+// billListFilter is the WHERE clause the listing and the export share. It takes the
+// fields of a BillQuery, in the order args() returns them, as $1 to $12
+const billListFilter = `(to_tsvector('simple',waterbill) @@ plainto_tsquery('simple', $1) OR $1 = '')
+		AND (to_tsvector('simple',priority) @@ plainto_tsquery('simple', $2) OR $2 = '')
+		AND ($3 = '{}' OR ($4 = 'any' AND status && $3) OR ($4 <> 'any' AND status @> $3))
+		AND (state = $5 OR $5 = '')
+		AND (category = $6 OR $6 = '')
+		AND (to_tsvector('simple', description || ' ' || notes) @@ plainto_tsquery('simple', $7) OR $7 = '')
+		AND ($8::timestamptz IS NULL OR created_at >= $8::timestamptz)
+		AND ($9::timestamptz IS NULL OR created_at < $9::timestamptz)
+		AND (version = $10 OR $10 = 0)
+		AND (deleted_at IS NOT NULL) = $11
+		AND (user_id = $12 OR $12 = 0)`
+
+// args() returns the parameters of billListFilter
+func (q BillQuery) args() []interface{} {
+	return []interface{}{
+		q.Waterbill,
+		q.Priority,
+		pq.Array(q.Status),
+		q.StatusMatch,
+		q.State,
+		q.Category,
+		q.Text,
+		nullDate(q.CreatedFrom),
+		nullDate(q.CreatedTo),
+		q.Version,
+		q.Deleted,
+		q.UserID,
+	}
+}
+
+// Export() hands every bill matching the filters to fn, in the order of the sort.
+// Unlike GetAll() it is not paged, the rows are read one at a time so that any number
+// of them can be streamed to the client
+func (m Todo_listModel) Export(q BillQuery, filters Filters, fn func(*Todo_list) error) error {
 	query := fmt.Sprintf(`
-		SELECT COUNT(*) OVER(), 
-		id, created_at, 
-		waterbill, description, 
-		notes, category, 
-		priority, 
-		status, 
-		version
+		SELECT id, created_at, waterbill, description, notes, category, priority, status, state,
+		COALESCE(user_id, 0), amount, amount_paid, amount_credited, due_date, issued_at,
+		COALESCE(delivery_status, ''), version
 		FROM water_system
-		WHERE (to_tsvector('simple',waterbill) @@ plainto_tsquery('simple', $1) OR $1 = '')
-		AND (to_tsvector('simple',priority) @@ plainto_tsquery('simple', $2) OR $2 = '')
-		AND (status @> $3 OR $3 = '{}')
-		ORDER BY %s %s, id ASC
-		LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortOrder())
+		WHERE %s
+		ORDER BY %s %s, id ASC`, billListFilter, filters.sortColumn(), filters.sortOrder())
+
+	// Large exports take a while to send, so they get longer than the usual queries
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, q.args()...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bill Todo_list
+		err := rows.Scan(
+			&bill.ID,
+			&bill.CreatedAt,
+			&bill.Waterbill,
+			&bill.Description,
+			&bill.Notes,
+			&bill.Category,
+			&bill.Priority,
+			pq.Array(&bill.Status),
+			&bill.State,
+			&bill.UserID,
+			&bill.Amount,
+			&bill.AmountPaid,
+			&bill.AmountCredited,
+			&bill.DueDate,
+			&bill.IssuedAt,
+			&bill.DeliveryStatus,
+			&bill.Version,
+		)
+		if err != nil {
+			return err
+		}
+		if err := fn(&bill); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// billSortKeys describe the columns the listing can be sorted on: the type of the
+// column, for casting a cursor back, and how to read its value off a bill to build one
+var billSortKeys = map[string]struct {
+	typ   string
+	value func(*Todo_list) string
+}{
+	"id":         {"bigint", func(b *Todo_list) string { return strconv.FormatInt(b.ID, 10) }},
+	"waterbill":  {"text", func(b *Todo_list) string { return b.Waterbill }},
+	"priority":   {"text", func(b *Todo_list) string { return b.Priority }},
+	"created_at": {"timestamptz", func(b *Todo_list) string { return b.CreatedAt.Format(time.RFC3339Nano) }},
+	"deleted_at": {"timestamptz", func(b *Todo_list) string {
+		if b.DeletedAt == nil {
+			return ""
+		}
+		return b.DeletedAt.Format(time.RFC3339Nano)
+	}},
+}
+
+// The GetAll() returns a page of the bills matching the filters. Pages are read by
+// number, or from a cursor in the metadata of another page. Reading from a cursor
+// skips the count and the offset, so it stays fast however deep the page is
+func (m Todo_listModel) GetAll(q BillQuery, filters Filters, fields []string) ([]*Todo_list, Metadata, error) {
+	column, order := filters.sortColumn(), filters.sortOrder()
+	sortKey, ok := billSortKeys[column]
+	if !ok {
+		return nil, Metadata{}, fmt.Errorf("no sort key for %q", column)
+	}
+	// The cursors are made from the id and the sort column, so those are always read
+	if len(fields) > 0 {
+		fields = append([]string{"id", column}, fields...)
+	}
+	columns, dests := billSelect(fields)
+	args := q.args()
+	from, before := filters.cursor()
+
+	// The id breaks ties in the same direction as the sort, so that the sort column
+	// and the id can be compared as a pair to find the rows past a cursor
+	n := len(args)
+	count, keyset, limit := "COUNT(*) OVER()", "", fmt.Sprintf("LIMIT $%d OFFSET $%d", n+1, n+2)
+	if from != nil {
+		comparison := ">"
+		if order == "DESC" {
+			comparison = "<"
+		}
+		if before {
+			// Read backwards from the cursor and put the rows back in order afterwards
+			comparison = map[string]string{">": "<", "<": ">"}[comparison]
+			order = map[string]string{"ASC": "DESC", "DESC": "ASC"}[order]
+		}
+		if column == "id" {
+			keyset = fmt.Sprintf("AND id %s $%d", comparison, n+1)
+			args = append(args, from.ID)
+		} else {
+			keyset = fmt.Sprintf("AND (%s, id) %s ($%d::%s, $%d)", column, comparison, n+1, sortKey.typ, n+2)
+			args = append(args, from.Key, from.ID)
+		}
+		// One row more than the page shows whether there is another page
+		count, limit = "0", fmt.Sprintf("LIMIT $%d", len(args)+1)
+		args = append(args, filters.limit()+1)
+	} else {
+		args = append(args, filters.limit(), filters.offset())
+	}
+	query := fmt.Sprintf(`
+		SELECT %s, %s
+		FROM water_system
+		WHERE %s
+		%s
+		ORDER BY %s %s, id %s
+		%s`, count, columns, billListFilter, keyset, column, order, order, limit)
 
 	// Create a 3-second-timeout context
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	args := []interface{}{waterbill, priority, pq.Array(status), filters.limit(), filters.offset()}
 	// Execute query
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
@@ -233,18 +656,7 @@ func (m Todo_listModel) GetAll(waterbill string, priority string, status []strin
 	for rows.Next() {
 		var todo_List Todo_list
 		// Scan the values from the row in to the Todo_list struct
-		err := rows.Scan(
-			&totalRecords,
-			&todo_List.ID,
-			&todo_List.CreatedAt,
-			&todo_List.Waterbill,
-			&todo_List.Description,
-			&todo_List.Notes,
-			&todo_List.Category,
-			&todo_List.Priority,
-			pq.Array(&todo_List.Status),
-			&todo_List.Version,
-		)
+		err := rows.Scan(append([]interface{}{&totalRecords}, dests(&todo_List)...)...)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
@@ -255,7 +667,120 @@ func (m Todo_listModel) GetAll(waterbill string, priority string, status []strin
 	if err = rows.Err(); err != nil {
 		return nil, Metadata{}, err
 	}
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	// Work out whether there are pages either side of this one
+	var metadata Metadata
+	var hasNext, hasPrev bool
+	if from != nil {
+		more := len(todo_listD) > filters.limit()
+		if more {
+			todo_listD = todo_listD[:filters.limit()]
+		}
+		if before {
+			for i, j := 0, len(todo_listD)-1; i < j; i, j = i+1, j-1 {
+				todo_listD[i], todo_listD[j] = todo_listD[j], todo_listD[i]
+			}
+		}
+		// The cursor came from a neighbouring page, so there is always a page on its side
+		if before {
+			hasNext, hasPrev = true, more
+		} else {
+			hasNext, hasPrev = more, true
+		}
+		metadata = Metadata{PageSize: filters.limit()}
+	} else {
+		metadata = calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+		hasNext, hasPrev = filters.offset()+len(todo_listD) < totalRecords, filters.Page > 1
+	}
+	if len(todo_listD) > 0 {
+		first, last := todo_listD[0], todo_listD[len(todo_listD)-1]
+		if hasNext {
+			metadata.NextCursor = encodeCursor(filters.Sort, sortKey.value(last), last.ID)
+		}
+		if hasPrev {
+			metadata.PrevCursor = encodeCursor(filters.Sort, sortKey.value(first), first.ID)
+		}
+	}
 	// Return the slice of Todo_list
 	return todo_listD, metadata, nil
-}
\ No newline at end of file
+}
+
+// billFields are the fields of a bill a client can pick, in the order they are shown,
+// with the column each is read from
+var billFields = []struct {
+	name   string
+	column string
+	dest   func(*Todo_list) interface{}
+}{
+	{"id", "id", func(b *Todo_list) interface{} { return &b.ID }},
+	{"created_at", "created_at", func(b *Todo_list) interface{} { return &b.CreatedAt }},
+	{"waterbill", "waterbill", func(b *Todo_list) interface{} { return &b.Waterbill }},
+	{"description", "description", func(b *Todo_list) interface{} { return &b.Description }},
+	{"notes", "notes", func(b *Todo_list) interface{} { return &b.Notes }},
+	{"category", "category", func(b *Todo_list) interface{} { return &b.Category }},
+	{"priority", "priority", func(b *Todo_list) interface{} { return &b.Priority }},
+	{"status", "status", func(b *Todo_list) interface{} { return pq.Array(&b.Status) }},
+	{"state", "state", func(b *Todo_list) interface{} { return &b.State }},
+	{"user_id", "COALESCE(user_id, 0)", func(b *Todo_list) interface{} { return &b.UserID }},
+	{"amount", "amount", func(b *Todo_list) interface{} { return &b.Amount }},
+	{"amount_paid", "amount_paid", func(b *Todo_list) interface{} { return &b.AmountPaid }},
+	{"amount_credited", "amount_credited", func(b *Todo_list) interface{} { return &b.AmountCredited }},
+	{"due_date", "due_date", func(b *Todo_list) interface{} { return &b.DueDate }},
+	{"issued_at", "issued_at", func(b *Todo_list) interface{} { return &b.IssuedAt }},
+	{"delivery_status", "COALESCE(delivery_status, '')", func(b *Todo_list) interface{} { return &b.DeliveryStatus }},
+	{"version", "version", func(b *Todo_list) interface{} { return &b.Version }},
+	{"deleted_at", "deleted_at", func(b *Todo_list) interface{} { return &b.DeletedAt }},
+	{"deleted_by", "COALESCE(deleted_by, 0)", func(b *Todo_list) interface{} { return &b.DeletedBy }},
+}
+
+// BillFieldNames() returns the names of the fields a client can pick
+func BillFieldNames() []string {
+	names := make([]string, len(billFields))
+	for i, field := range billFields {
+		names[i] = field.name
+	}
+	return names
+}
+
+// billSelect() returns the columns to select for the given fields, or for every field
+// when none are given, and a function returning the scan destinations of a bill in the
+// same order. Fields given twice are read once
+func billSelect(fields []string) (string, func(*Todo_list) []interface{}) {
+	picked := map[string]bool{}
+	for _, name := range fields {
+		picked[name] = true
+	}
+	var columns []string
+	var dests []func(*Todo_list) interface{}
+	for _, field := range billFields {
+		if len(fields) == 0 || picked[field.name] {
+			columns = append(columns, field.column)
+			dests = append(dests, field.dest)
+		}
+	}
+	return strings.Join(columns, ", "), func(b *Todo_list) []interface{} {
+		values := make([]interface{}, len(dests))
+		for i, dest := range dests {
+			values[i] = dest(b)
+		}
+		return values
+	}
+}
+
+// nullDate() turns a zero time into a NULL so the database can fill in its default
+func nullDate(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// FormatAmount() renders an amount held in minor units (cents) as dollars and cents
+func FormatAmount(amount int64) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	return fmt.Sprintf("%s$%d.%02d", sign, amount/100, amount%100)
+}
@@ -0,0 +1,438 @@
+// Filename: internal/data/webhooks.go
+
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/lib/pq"
+	"water.biling.system.driane.perez.net/internal/validator"
+)
+
+// The events a webhook can subscribe to. Ping is only ever sent by the test endpoint
+const (
+	WebhookBillCreated    = "waterbill.created"
+	WebhookBillUpdated    = "waterbill.updated"
+	WebhookBillDeleted    = "waterbill.deleted"
+	WebhookBillRestored   = "waterbill.restored"
+	WebhookUserActivated  = "user.activated"
+	WebhookPaymentCreated = "payment.created"
+	WebhookPing           = "ping"
+)
+
+// WebhookEvents lists the events a subscription can ask for
+var WebhookEvents = []string{
+	WebhookBillCreated,
+	WebhookBillUpdated,
+	WebhookBillDeleted,
+	WebhookBillRestored,
+	WebhookUserActivated,
+	WebhookPaymentCreated,
+}
+
+// The states of a delivery. A delivery that keeps failing is marked as failed once it
+// has used up its attempts
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookFailed    = "failed"
+)
+
+// webhookLease is how long a claimed delivery is hidden from the other workers
+const webhookLease = 2 * time.Minute
+
+// A Webhook is a subscription to some events. The secret signs every delivery, it is
+// only shown when the subscription is created
+type Webhook struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	Version   int32     `json:"version"`
+}
+
+// A WebhookDelivery is one event sent, or waiting to be sent, to one subscription.
+// ResponseStatus is the status the receiver answered the last attempt with. Lease is
+// the claim the worker holds on the delivery while sending it
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	CreatedAt      time.Time       `json:"created_at"`
+	SubscriptionID int64           `json:"subscription_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	State          string          `json:"state"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	ResponseStatus *int            `json:"response_status,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+	Lease          int64           `json:"-"`
+	// Filled in when the delivery is claimed, so the worker knows where to send it
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+func ValidateWebhook(v *validator.Validator, webhook *Webhook) {
+	v.Check(webhook.URL != "", "url", "must be provided")
+	v.Check(len(webhook.URL) <= 2000, "url", "must not be more than 2000 bytes long")
+	u, err := url.Parse(webhook.URL)
+	v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "url", "must be an absolute http or https URL")
+	v.Check(len(webhook.Events) >= 1, "events", "must contain at least one event")
+	v.Check(validator.Unique(webhook.Events), "events", "must not contain duplicate events")
+	for _, event := range webhook.Events {
+		v.Check(validator.In(event, WebhookEvents...), "events", "contains an unknown event")
+	}
+}
+
+// WebhookPayload builds the body sent for an event
+func WebhookPayload(event string, data interface{}) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"event":       event,
+		"occurred_at": time.Now().UTC().Format(time.RFC3339),
+		"data":        data,
+	})
+}
+
+// Define the webhook model
+type WebhookModel struct {
+	DB *sql.DB
+}
+
+// Insert() creates a subscription with a fresh signing secret
+func (m WebhookModel) Insert(webhook *Webhook) error {
+	secret := make([]byte, 24)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return err
+	}
+	webhook.Secret = "whsec_" + hex.EncodeToString(secret)
+	query := `
+		INSERT INTO webhook_subscriptions (url, secret, events, active)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, version
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{webhook.URL, webhook.Secret, pq.Array(webhook.Events), webhook.Active}
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.ID, &webhook.CreatedAt, &webhook.Version)
+}
+
+// Get() returns a specific subscription
+func (m WebhookModel) Get(id int64) (*Webhook, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT id, created_at, url, secret, events, active, version
+		FROM webhook_subscriptions
+		WHERE id = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var webhook Webhook
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&webhook.ID,
+		&webhook.CreatedAt,
+		&webhook.URL,
+		&webhook.Secret,
+		pq.Array(&webhook.Events),
+		&webhook.Active,
+		&webhook.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &webhook, nil
+}
+
+// GetAll() returns every subscription
+func (m WebhookModel) GetAll() ([]*Webhook, error) {
+	query := `
+		SELECT id, created_at, url, secret, events, active, version
+		FROM webhook_subscriptions
+		ORDER BY id
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+	for rows.Next() {
+		var webhook Webhook
+		err := rows.Scan(
+			&webhook.ID,
+			&webhook.CreatedAt,
+			&webhook.URL,
+			&webhook.Secret,
+			pq.Array(&webhook.Events),
+			&webhook.Active,
+			&webhook.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, &webhook)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+// Update() changes the URL, events or active switch of a subscription
+func (m WebhookModel) Update(webhook *Webhook) error {
+	query := `
+		UPDATE webhook_subscriptions
+		SET url = $1, events = $2, active = $3, version = version + 1
+		WHERE id = $4 AND version = $5
+		RETURNING version
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{webhook.URL, pq.Array(webhook.Events), webhook.Active, webhook.ID, webhook.Version}
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete() removes a subscription along with its delivery log
+func (m WebhookModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM webhook_subscriptions WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// enqueueWebhook() queues a delivery of the event to every active subscription to it.
+// Like enqueueEmail() it runs inside the transaction of the change the event is about,
+// so the event is only sent if the change is kept
+func enqueueWebhook(ctx context.Context, tx *sql.Tx, event string, data interface{}) error {
+	payload, err := WebhookPayload(event, data)
+	if err != nil {
+		return err
+	}
+	query := `
+		INSERT INTO webhook_deliveries (subscription_id, event, payload)
+		SELECT id, $1::text, $2::jsonb
+		FROM webhook_subscriptions
+		WHERE active AND $1::text = ANY(events)
+	`
+	_, err = tx.ExecContext(ctx, query, event, payload)
+	return err
+}
+
+// Record() logs a delivery that was made straight away rather than queued, such as
+// a test ping
+func (m WebhookModel) Record(delivery *WebhookDelivery) error {
+	query := `
+		INSERT INTO webhook_deliveries (subscription_id, event, payload, state, attempts,
+		response_status, last_error, delivered_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at, next_attempt_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{
+		delivery.SubscriptionID,
+		delivery.Event,
+		[]byte(delivery.Payload),
+		delivery.State,
+		delivery.Attempts,
+		delivery.ResponseStatus,
+		delivery.LastError,
+		delivery.DeliveredAt,
+	}
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&delivery.ID, &delivery.CreatedAt, &delivery.NextAttemptAt)
+}
+
+// Claim() hands the oldest due delivery to a worker, along with where to send it.
+// The attempt is counted and the delivery is leased so that no other worker picks it
+// up. Each claim takes a new lease number, so a worker whose lease ran out can no
+// longer record an outcome. It returns nil when nothing is due
+func (m WebhookModel) Claim() (*WebhookDelivery, error) {
+	query := `
+		WITH claimed AS (
+			UPDATE webhook_deliveries
+			SET attempts = attempts + 1, lease = lease + 1, next_attempt_at = NOW() + $1 * INTERVAL '1 second'
+			WHERE id = (
+				SELECT webhook_deliveries.id FROM webhook_deliveries
+				INNER JOIN webhook_subscriptions ON webhook_subscriptions.id = webhook_deliveries.subscription_id
+				WHERE webhook_deliveries.state = 'pending' AND webhook_deliveries.next_attempt_at <= NOW()
+				AND webhook_subscriptions.active
+				ORDER BY webhook_deliveries.next_attempt_at, webhook_deliveries.id
+				FOR UPDATE OF webhook_deliveries SKIP LOCKED
+				LIMIT 1
+			)
+			RETURNING ` + webhookDeliveryColumns + `
+		)
+		SELECT claimed.*, webhook_subscriptions.url, webhook_subscriptions.secret
+		FROM claimed
+		INNER JOIN webhook_subscriptions ON webhook_subscriptions.id = claimed.subscription_id
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var delivery WebhookDelivery
+	err := m.DB.QueryRowContext(ctx, query, webhookLease.Seconds()).Scan(append(delivery.fields(), &delivery.URL, &delivery.Secret)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+	return &delivery, nil
+}
+
+// MarkDelivered() records a delivery the receiver accepted. It fails with
+// ErrEditConflict when the lease on the delivery has been lost
+func (m WebhookModel) MarkDelivered(delivery *WebhookDelivery, status int) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET state = 'delivered', delivered_at = NOW(), response_status = $3, last_error = ''
+		WHERE id = $1 AND lease = $2 AND state = 'pending'
+		RETURNING state, response_status, last_error, delivered_at
+	`
+	return m.finish(delivery, query, delivery.ID, delivery.Lease, status)
+}
+
+// MarkFailed() records a failed attempt. The delivery is retried after the backoff
+// unless it has used up its attempts, in which case it is marked as failed. A status
+// of zero means the receiver never answered. Like MarkDelivered() it needs the lease
+// to still be held
+func (m WebhookModel) MarkFailed(delivery *WebhookDelivery, status int, sendErr error, backoff time.Duration, maxAttempts int) error {
+	state := WebhookPending
+	if delivery.Attempts >= maxAttempts {
+		state = WebhookFailed
+	}
+	query := `
+		UPDATE webhook_deliveries
+		SET state = $3, response_status = NULLIF($4::integer, 0), last_error = $5,
+		next_attempt_at = NOW() + $6 * INTERVAL '1 second'
+		WHERE id = $1 AND lease = $2 AND state = 'pending'
+		RETURNING state, response_status, last_error, delivered_at
+	`
+	return m.finish(delivery, query, delivery.ID, delivery.Lease, state, status, sendErr.Error(), backoff.Seconds())
+}
+
+// finish() runs one of the state changes above
+func (m WebhookModel) finish(delivery *WebhookDelivery, query string, args ...interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&delivery.State,
+		&delivery.ResponseStatus,
+		&delivery.LastError,
+		&delivery.DeliveredAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrEditConflict
+	}
+	return err
+}
+
+// Deliveries() returns the delivery log of a subscription, newest first, optionally
+// only the deliveries in one state
+func (m WebhookModel) Deliveries(subscriptionID int64, state string, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(), %s
+		FROM webhook_deliveries
+		WHERE subscription_id = $1
+		AND (state = $2 OR $2 = '')
+		ORDER BY %s %s, id DESC
+		LIMIT $3 OFFSET $4`, webhookDeliveryColumns, filters.sortColumn(), filters.sortOrder())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, subscriptionID, state, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		var delivery WebhookDelivery
+		err := rows.Scan(append([]interface{}{&totalRecords}, delivery.fields()...)...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return deliveries, metadata, nil
+}
+
+// The columns scanned by fields(), in order
+const webhookDeliveryColumns = `id, created_at, subscription_id, event, payload, state, attempts,
+	next_attempt_at, response_status, last_error, delivered_at, lease`
+
+// fields() returns the scan destinations for webhookDeliveryColumns
+func (delivery *WebhookDelivery) fields() []interface{} {
+	return []interface{}{
+		&delivery.ID,
+		&delivery.CreatedAt,
+		&delivery.SubscriptionID,
+		&delivery.Event,
+		(*[]byte)(&delivery.Payload),
+		&delivery.State,
+		&delivery.Attempts,
+		&delivery.NextAttemptAt,
+		&delivery.ResponseStatus,
+		&delivery.LastError,
+		&delivery.DeliveredAt,
+		&delivery.Lease,
+	}
+}
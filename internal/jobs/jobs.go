@@ -0,0 +1,253 @@
+// Filename: internal/jobs/jobs.go
+
+// Package jobs runs periodic work. Every instance of the API runs the scheduler, but
+// a PostgreSQL advisory lock makes sure only one of them runs a given job at a time,
+// and each scheduled run is recorded so that it happens once however many instances
+// are up
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"water.biling.system.driane.perez.net/internal/jsonlog"
+)
+
+// Func is the work a job does. The context is cancelled when the scheduler stops
+type Func func(ctx context.Context) error
+
+// Job is a registered job
+type Job struct {
+	Name     string    `json:"name"`
+	Spec     string    `json:"schedule"`
+	NextRun  time.Time `json:"next_run"`
+	schedule Schedule
+	fn       Func
+}
+
+// Run is one recorded run of a job. Error is empty when the run succeeded
+type Run struct {
+	ID           int64      `json:"id"`
+	Job          string     `json:"job"`
+	ScheduledFor time.Time  `json:"scheduled_for"`
+	StartedAt    time.Time  `json:"started_at"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+	DurationMS   *int64     `json:"duration_ms,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// Scheduler runs the registered jobs. The loops are tracked by the wait group so that
+// a graceful shutdown waits for the runs in flight to finish
+type Scheduler struct {
+	db     *sql.DB
+	logger *jsonlog.Logger
+	wg     *sync.WaitGroup
+
+	mu     sync.Mutex
+	jobs   []*Job
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// New() creates a scheduler
+func New(db *sql.DB, logger *jsonlog.Logger, wg *sync.WaitGroup) *Scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{
+		db:     db,
+		logger: logger,
+		wg:     wg,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Register() adds a job. It must be called before Start()
+func (s *Scheduler) Register(name, spec string, fn Func) error {
+	schedule, err := Parse(spec)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range s.jobs {
+		if job.Name == name {
+			return fmt.Errorf("jobs: %q is already registered", name)
+		}
+	}
+	s.jobs = append(s.jobs, &Job{Name: name, Spec: spec, schedule: schedule, fn: fn})
+	return nil
+}
+
+// Start() starts a loop for every registered job. Each loop is added to the wait group
+// here, before Stop() can be called, so the caller never waits too early
+func (s *Scheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range s.jobs {
+		job.NextRun = job.schedule.Next(time.Now())
+		s.wg.Add(1)
+		go s.loop(job)
+	}
+}
+
+// Stop() stops scheduling new runs and cancels the context of the running ones. The
+// caller waits on the wait group for them to return
+func (s *Scheduler) Stop() {
+	s.cancel()
+}
+
+// Jobs() returns the registered jobs and when they are next due
+func (s *Scheduler) Jobs() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]Job, len(s.jobs))
+	for i, job := range s.jobs {
+		jobs[i] = *job
+	}
+	return jobs
+}
+
+// loop() waits for each scheduled time of the job and then tries to run it, until the
+// scheduler stops
+func (s *Scheduler) loop(job *Job) {
+	defer s.wg.Done()
+	for {
+		s.mu.Lock()
+		next := job.NextRun
+		s.mu.Unlock()
+		if next.IsZero() {
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		err := s.run(job, next)
+		if err != nil {
+			s.logger.PrintError(err, map[string]string{"job": job.Name})
+		}
+		s.mu.Lock()
+		job.NextRun = job.schedule.Next(time.Now())
+		s.mu.Unlock()
+	}
+}
+
+// run() runs the job for one scheduled time if this instance wins it. The advisory
+// lock keeps a run from overlapping a slow run on another instance, and the unique
+// (job, scheduled_for) row keeps a run from happening twice
+func (s *Scheduler) run(job *Job, scheduledFor time.Time) error {
+	ctx := s.ctx
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	key := lockKey(job.Name)
+	var leader bool
+	err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&leader)
+	if err != nil || !leader {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, key)
+
+	var runID int64
+	query := `
+		INSERT INTO job_runs (job, scheduled_for)
+		VALUES ($1, $2)
+		ON CONFLICT (job, scheduled_for) DO NOTHING
+		RETURNING id
+	`
+	err = conn.QueryRowContext(ctx, query, job.Name, scheduledFor).Scan(&runID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Another instance already ran it
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	started := time.Now()
+	runErr := s.call(ctx, job)
+	message := ""
+	if runErr != nil {
+		message = runErr.Error()
+	}
+	query = `
+		UPDATE job_runs
+		SET finished_at = NOW(), duration_ms = $1, error = $2
+		WHERE id = $3
+	`
+	_, err = conn.ExecContext(context.Background(), query, time.Since(started).Milliseconds(), message, runID)
+	if err != nil {
+		return err
+	}
+	return runErr
+}
+
+// call() runs the job function, turning a panic into an error so that one bad run
+// does not stop the scheduler
+func (s *Scheduler) call(ctx context.Context, job *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return job.fn(ctx)
+}
+
+// Runs() returns the most recent runs, optionally of one job only
+func (s *Scheduler) Runs(job string, limit int) ([]*Run, error) {
+	query := `
+		SELECT id, job, scheduled_for, started_at, finished_at, duration_ms, error
+		FROM job_runs
+		WHERE (job = $1 OR $1 = '')
+		ORDER BY started_at DESC, id DESC
+		LIMIT $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, job, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []*Run{}
+	for rows.Next() {
+		var run Run
+		err := rows.Scan(
+			&run.ID,
+			&run.Job,
+			&run.ScheduledFor,
+			&run.StartedAt,
+			&run.FinishedAt,
+			&run.DurationMS,
+			&run.Error,
+		)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, &run)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// lockKey() turns a job name into the key of its advisory lock
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("jobs:" + name))
+	return int64(h.Sum64())
+}
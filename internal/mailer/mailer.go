@@ -6,65 +6,85 @@ import (
 	"bytes"
 	"embed"
 	"html/template"
-	"time"
-
-	"gopkg.in/mail.v2"
 )
 
 //go:embed "templates"
 var templateFS embed.FS
-// Create a Mailer type
+
+// Create a Mailer type. It renders the templates and hands the finished message
+// to whichever Sender it was set up with
 type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+	transport Sender
+	sender    string
 }
 
-func New(host string, port int, username, password, sender string) Mailer {
-	dialer := mail.NewDialer(host, port, username, password)
-	dialer.Timeout = 5 * time.Second
+func New(transport Sender, sender string) Mailer {
 	// Return our just created mailer instance
 	return Mailer{
-		dialer: dialer,
-		sender: sender,
+		transport: transport,
+		sender:    sender,
 	}
+}
+
+// An Attachment is a file sent along with the mail
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
 
+// A Message is a rendered email, ready to be handed to a Sender. Template is the
+// file it was rendered from
+type Message struct {
+	To          string
+	Template    string
+	From        string
+	Subject     string
+	PlainBody   string
+	HTMLBody    string
+	Attachments []Attachment
 }
 
 // Send an actual mail
-func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
-	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+func (m Mailer) Send(recipient, templateFile string, data interface{}, attachments ...Attachment) error {
+	msg, err := m.Render(recipient, templateFile, data)
 	if err != nil {
 		return err
 	}
+	msg.Attachments = attachments
+	return m.transport.Send(msg)
+}
+
+// Render() builds the message from the template without sending it
+func (m Mailer) Render(recipient, templateFile string, data interface{}) (*Message, error) {
+	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+	if err != nil {
+		return nil, err
+	}
 	// Execute the template
 	subject := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(subject, "subject", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// Execute the templates again
 	plainBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// Execute the templates again
 	htmlBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
 	if err != nil {
-		return err
-	}
-	// Create a new mail message
-	msg := mail.NewMessage()
-	msg.SetHeader("To", recipient)
-	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
-	// Call DialAndSend()
-	err = m.dialer.DialAndSend(msg)
-	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return &Message{
+		To:        recipient,
+		Template:  templateFile,
+		From:      m.sender,
+		Subject:   subject.String(),
+		PlainBody: plainBody.String(),
+		HTMLBody:  htmlBody.String(),
+	}, nil
 }
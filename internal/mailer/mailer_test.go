@@ -0,0 +1,60 @@
+// Filename: internal/mailer/mailer_test.go
+
+package mailer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSend(t *testing.T) {
+	sender := NewMemorySender()
+	m := New(sender, "Water <no-reply@example.com>")
+	attachment := Attachment{Filename: "bill-1.pdf", ContentType: "application/pdf", Data: []byte("%PDF")}
+	err := m.Send("ana@example.com", "user_welcome.tmpl", map[string]interface{}{"userID": 7, "activationToken": "SECRETTOKEN"}, attachment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := sender.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(messages))
+	}
+	msg := messages[0]
+	if msg.To != "ana@example.com" || msg.From != "Water <no-reply@example.com>" || msg.Template != "user_welcome.tmpl" {
+		t.Errorf("got a message to %q from %q using %q", msg.To, msg.From, msg.Template)
+	}
+	if msg.Subject != "Welcome to Water Billing System!" {
+		t.Errorf("got subject %q", msg.Subject)
+	}
+	if !strings.Contains(msg.PlainBody, "SECRETTOKEN") || !strings.Contains(msg.HTMLBody, "SECRETTOKEN") {
+		t.Error("the token is missing from the body")
+	}
+	if len(msg.Attachments) != 1 || msg.Attachments[0].Filename != "bill-1.pdf" {
+		t.Errorf("got attachments %v", msg.Attachments)
+	}
+}
+
+func TestSendUnknownTemplate(t *testing.T) {
+	sender := NewMemorySender()
+	err := New(sender, "no-reply@example.com").Send("ana@example.com", "missing.tmpl", nil)
+	if err == nil {
+		t.Error("a missing template was sent")
+	}
+	if len(sender.Messages()) != 0 {
+		t.Error("a message was handed to the sender")
+	}
+}
+
+// The log sender never writes the body, which can hold an activation token
+func TestLogSender(t *testing.T) {
+	var out bytes.Buffer
+	m := New(NewLogSender(&out), "no-reply@example.com")
+	err := m.Send("ana@example.com", "user_welcome.tmpl", map[string]interface{}{"userID": 7, "activationToken": "SECRETTOKEN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "email to ana@example.com using user_welcome.tmpl\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,133 @@
+// Filename: internal/mailer/senders.go
+
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"gopkg.in/mail.v2"
+)
+
+// A Sender delivers rendered messages. SMTP sends them for real, the directory and
+// log senders let development run without a mail server and the memory sender keeps
+// them for tests
+type Sender interface {
+	Send(msg *Message) error
+}
+
+// SMTPSender sends the messages through an SMTP server
+type SMTPSender struct {
+	dialer *mail.Dialer
+}
+
+func NewSMTPSender(host string, port int, username, password string) *SMTPSender {
+	dialer := mail.NewDialer(host, port, username, password)
+	dialer.Timeout = 5 * time.Second
+	return &SMTPSender{dialer: dialer}
+}
+
+func (s *SMTPSender) Send(msg *Message) error {
+	return s.dialer.DialAndSend(mimeMessage(msg))
+}
+
+// DirSender writes every message to a directory as an .eml file, which any mail
+// client can open
+type DirSender struct {
+	dir string
+	mu  sync.Mutex
+	seq int
+}
+
+func NewDirSender(dir string) (*DirSender, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &DirSender{dir: dir}, nil
+}
+
+// unsafeFilename matches the characters not kept when the recipient goes into a filename
+var unsafeFilename = regexp.MustCompile(`[^a-zA-Z0-9@._-]+`)
+
+func (s *DirSender) Send(msg *Message) error {
+	s.mu.Lock()
+	s.seq++
+	name := fmt.Sprintf("%s-%04d-%s.eml", time.Now().UTC().Format("20060102T150405"), s.seq,
+		unsafeFilename.ReplaceAllString(msg.To, "_"))
+	s.mu.Unlock()
+
+	var buf bytes.Buffer
+	_, err := mimeMessage(msg).WriteTo(&buf)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.dir, name), buf.Bytes(), 0o644)
+}
+
+// LogSender only writes the recipient and template of every message. The body is
+// left out as it can hold secrets such as activation tokens
+type LogSender struct {
+	out io.Writer
+	mu  sync.Mutex
+}
+
+func NewLogSender(out io.Writer) *LogSender {
+	return &LogSender{out: out}
+}
+
+func (s *LogSender) Send(msg *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := fmt.Fprintf(s.out, "email to %s using %s\n", msg.To, msg.Template)
+	return err
+}
+
+// MemorySender keeps every message it is given, so tests can look at what was sent
+type MemorySender struct {
+	mu       sync.Mutex
+	messages []*Message
+}
+
+func NewMemorySender() *MemorySender {
+	return &MemorySender{}
+}
+
+func (s *MemorySender) Send(msg *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messages = append(s.messages, msg)
+	return nil
+}
+
+// Messages() returns the messages sent so far, oldest first
+func (s *MemorySender) Messages() []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*Message(nil), s.messages...)
+}
+
+// mimeMessage() builds the multipart message the SMTP and directory senders write
+func mimeMessage(msg *Message) *mail.Message {
+	m := mail.NewMessage()
+	m.SetHeader("To", msg.To)
+	m.SetHeader("From", msg.From)
+	m.SetHeader("Subject", msg.Subject)
+	m.SetBody("text/plain", msg.PlainBody)
+	m.AddAlternative("text/html", msg.HTMLBody)
+	for _, attachment := range msg.Attachments {
+		m.AttachReader(attachment.Filename, bytes.NewReader(attachment.Data), mail.SetHeader(map[string][]string{
+			"Content-Type": {attachment.ContentType},
+		}))
+	}
+	return m
+}
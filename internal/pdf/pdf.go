@@ -0,0 +1,176 @@
+// Filename: internal/pdf/pdf.go
+
+// Package pdf is a small PDF writer for printable documents such as bills. It only
+// knows the standard Type 1 fonts, so nothing has to be embedded and no external
+// binaries are needed. The output is deterministic: the same calls always produce
+// the same bytes
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A4 page size in points
+const (
+	PageWidth  = 595.28
+	PageHeight = 841.89
+)
+
+// Font is one of the standard fonts every PDF reader provides
+type Font int
+
+const (
+	Regular Font = iota // Helvetica
+	Bold                // Helvetica-Bold
+	Mono                // Courier
+)
+
+// The resource names and base fonts, in Font order
+var fonts = []struct {
+	name     string
+	baseFont string
+}{
+	{"F1", "Helvetica"},
+	{"F2", "Helvetica-Bold"},
+	{"F3", "Courier"},
+}
+
+// Width() returns the width of the text in points. It is exact for Mono, for the
+// proportional fonts it is an estimate based on the average glyph width
+func (f Font) Width(size float64, s string) float64 {
+	per := 0.6
+	switch f {
+	case Regular:
+		per = 0.52
+	case Bold:
+		per = 0.56
+	}
+	return float64(len([]rune(s))) * per * size
+}
+
+// Document is a PDF under construction
+type Document struct {
+	pages []*Page
+}
+
+// Page holds the content stream of a single page. Coordinates are in points with
+// the origin at the top left corner, y grows downwards
+type Page struct {
+	content bytes.Buffer
+}
+
+// New() creates an empty document
+func New() *Document {
+	return &Document{}
+}
+
+// AddPage() appends a new A4 page and returns it
+func (d *Document) AddPage() *Page {
+	p := &Page{}
+	d.pages = append(d.pages, p)
+	return p
+}
+
+// Text() writes the string with its baseline starting at (x, y)
+func (p *Page) Text(x, y, size float64, font Font, s string) {
+	fmt.Fprintf(&p.content, "BT /%s %s Tf %s %s Td (%s) Tj ET\n",
+		fonts[font].name, num(size), num(x), num(PageHeight-y), escape(s))
+}
+
+// TextRight() writes the string so that it ends at x
+func (p *Page) TextRight(x, y, size float64, font Font, s string) {
+	p.Text(x-font.Width(size, s), y, size, font, s)
+}
+
+// Line() draws a straight line
+func (p *Page) Line(x1, y1, x2, y2, width float64) {
+	fmt.Fprintf(&p.content, "%s w %s %s m %s %s l S\n",
+		num(width), num(x1), num(PageHeight-y1), num(x2), num(PageHeight-y2))
+}
+
+// Rect() fills a rectangle in a shade of grey, 0 is black and 1 is white.
+// (x, y) is the top left corner
+func (p *Page) Rect(x, y, w, h, grey float64) {
+	fmt.Fprintf(&p.content, "q %s g %s %s %s %s re f Q\n",
+		num(grey), num(x), num(PageHeight-y-h), num(w), num(h))
+}
+
+// WriteTo() writes the finished document
+func (d *Document) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	var offsets []int
+
+	// Objects are numbered from 1: the catalog, the page tree, the fonts and then
+	// a page object followed by its content stream for every page
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	firstPage := 3 + len(fonts)
+
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+	}
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+
+	resources := make([]string, len(fonts))
+	for i, f := range fonts {
+		object(fmt.Sprintf("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", f.baseFont))
+		resources[i] = fmt.Sprintf("/%s %d 0 R", f.name, 3+i)
+	}
+
+	for i, p := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] /Resources << /Font << %s >> >> /Contents %d 0 R >>",
+			num(PageWidth), num(PageHeight), strings.Join(resources, " "), firstPage+2*i+1))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", p.content.Len(), p.content.Bytes()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return buf.WriteTo(w)
+}
+
+// Bytes() returns the finished document
+func (d *Document) Bytes() []byte {
+	var buf bytes.Buffer
+	d.WriteTo(&buf)
+	return buf.Bytes()
+}
+
+// escape() makes a string safe to use as a PDF literal string. Characters outside
+// Latin-1 cannot be shown with the standard fonts and are replaced with '?'
+func escape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n' || r == '\r' || r == '\t':
+			b.WriteByte(' ')
+		case r < 0x20 || r > 0xff || (r >= 0x7f && r < 0xa0):
+			b.WriteByte('?')
+		default:
+			b.WriteByte(byte(r))
+		}
+	}
+	return b.String()
+}
+
+// num() formats a coordinate without trailing zeros
+func num(f float64) string {
+	s := strings.TrimRight(fmt.Sprintf("%.2f", f), "0")
+	return strings.TrimSuffix(s, ".")
+}
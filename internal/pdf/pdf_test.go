@@ -0,0 +1,79 @@
+// Filename: internal/pdf/pdf_test.go
+
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+func TestEscape(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{`a (b) \c`, `a \(b\) \\c`},
+		{"two\nlines\ttab", "two lines tab"},
+		{"Café", "Caf\xe9"},
+		{"€ 5", "? 5"},
+		{"\x01", "?"},
+	}
+	for _, tt := range tests {
+		if got := escape(tt.in); got != tt.want {
+			t.Errorf("escape(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNum(t *testing.T) {
+	tests := map[float64]string{0: "0", 10: "10", 10.5: "10.5", 595.28: "595.28", 1.001: "1", 841.891: "841.89"}
+	for in, want := range tests {
+		if got := num(in); got != want {
+			t.Errorf("num(%v) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// The cross-reference table has to point at the start of every object
+func TestWriteTo(t *testing.T) {
+	build := func() []byte {
+		doc := New()
+		for i := 0; i < 2; i++ {
+			page := doc.AddPage()
+			page.Text(50, 50, 12, Bold, fmt.Sprintf("Page %d", i+1))
+			page.Line(50, 60, 200, 60, 0.5)
+			page.Rect(50, 70, 100, 20, 0.9)
+		}
+		return doc.Bytes()
+	}
+	out := build()
+	if !bytes.Equal(out, build()) {
+		t.Fatal("the same document rendered to different bytes")
+	}
+	if !bytes.HasPrefix(out, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(out, []byte("%%EOF\n")) {
+		t.Fatal("the document is not framed as a PDF")
+	}
+	// 3 fonts, the catalog, the page tree and a page and its contents for each page
+	if n := bytes.Count(out, []byte(" 0 obj\n")); n != 9 {
+		t.Errorf("got %d objects, want 9", n)
+	}
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(out, -1)
+	if len(entries) != 9 {
+		t.Fatalf("got %d xref entries, want 9", len(entries))
+	}
+	for i, entry := range entries {
+		offset, _ := strconv.Atoi(string(entry[1]))
+		want := fmt.Sprintf("%d 0 obj\n", i+1)
+		if !bytes.HasPrefix(out[offset:], []byte(want)) {
+			t.Errorf("xref entry %d does not point at %q", i+1, want)
+		}
+	}
+	start := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(out)
+	offset, _ := strconv.Atoi(string(start[1]))
+	if !bytes.HasPrefix(out[offset:], []byte("xref\n")) {
+		t.Error("startxref does not point at the xref table")
+	}
+}
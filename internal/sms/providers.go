@@ -0,0 +1,87 @@
+// Filename: internal/sms/providers.go
+
+package sms
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// HTTPProvider posts every message as JSON to a gateway URL, which is how most SMS
+// providers can be reached. The body is {"from": ..., "to": ..., "body": ...} and the
+// token, when there is one, is sent as a bearer token
+type HTTPProvider struct {
+	url    string
+	token  string
+	from   string
+	client *http.Client
+}
+
+func NewHTTPProvider(url, token, from string) *HTTPProvider {
+	return &HTTPProvider{
+		url:    url,
+		token:  token,
+		from:   from,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *HTTPProvider) Send(to, body string) error {
+	payload, err := json.Marshal(map[string]string{"from": p.from, "to": to, "body": body})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("sms gateway returned %s", res.Status)
+	}
+	return nil
+}
+
+// FileProvider stands in for a gateway during development by appending every
+// message to a file
+type FileProvider struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileProvider(path string) (*FileProvider, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileProvider{path: path}, nil
+}
+
+func (p *FileProvider) Send(to, body string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	f, err := os.OpenFile(p.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "--- sms to %s at %s\n%s\n", to, time.Now().UTC().Format(time.RFC3339), body)
+	return err
+}
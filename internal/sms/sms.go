@@ -0,0 +1,51 @@
+// Filename: internal/sms/sms.go
+
+package sms
+
+import (
+	"bytes"
+	"embed"
+	"strings"
+	"text/template"
+)
+
+//go:embed "templates"
+var templateFS embed.FS
+
+// A Provider hands a text message to whoever delivers it
+type Provider interface {
+	Send(to, body string) error
+}
+
+// Create a Messenger type. It renders the templates and hands the text to the provider
+type Messenger struct {
+	provider Provider
+}
+
+func New(provider Provider) Messenger {
+	return Messenger{provider: provider}
+}
+
+// Send renders the template and sends it to the E.164 phone number
+func (m Messenger) Send(to, templateFile string, data interface{}) error {
+	body, err := Render(templateFile, data)
+	if err != nil {
+		return err
+	}
+	return m.provider.Send(to, body)
+}
+
+// Render() builds the text of the message without sending it. Every template
+// defines a single "body"
+func Render(templateFile string, data interface{}) (string, error) {
+	tmpl, err := template.New("sms").ParseFS(templateFS, "templates/"+templateFile)
+	if err != nil {
+		return "", err
+	}
+	body := new(bytes.Buffer)
+	err = tmpl.ExecuteTemplate(body, "body", data)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(body.String()), nil
+}
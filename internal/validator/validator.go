@@ -4,10 +4,13 @@ package validator
 import (
 	"net/url"
 	"regexp"
+	"strings"
 )
 var (
 	EmailRegex = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 	PhoneRegex = regexp.MustCompile(`^\+?\(?[0-9]{3}\)?\s?-\s?[0-9]{3}\s?-\s?[0-9]{4}$`)
+	E164Regex  = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+	phoneSeparators = regexp.MustCompile(`[\s().-]`)
 )
 // we create a type that wraps our validation errors map
 type Validator struct {
@@ -63,3 +66,17 @@ func Unique(values []string) bool {
 	}
 	return len(values) == len(UniqueValues)
 }
+//NormalizeE164() turns a phone number into E.164 form. Local numbers in the PhoneRegex
+//format get the country code put in front, numbers starting with + are kept as they are.
+//It returns false when the number cannot be made into a valid E.164 number
+func NormalizeE164(phone, countryCode string) (string, bool) {
+	phone = strings.TrimSpace(phone)
+	if Matches(phone, PhoneRegex) && !strings.HasPrefix(phone, "+") {
+		phone = "+" + countryCode + phone
+	}
+	phone = phoneSeparators.ReplaceAllString(phone, "")
+	if !Matches(phone, E164Regex) {
+		return "", false
+	}
+	return phone, true
+}
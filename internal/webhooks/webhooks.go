@@ -0,0 +1,140 @@
+// Filename: internal/webhooks/webhooks.go
+
+// Package webhooks signs and posts event payloads to subscriber URLs.
+//
+// Every request carries the event name, the delivery id and a Unix timestamp in the
+// X-Webhook-Event, X-Webhook-Delivery and X-Webhook-Timestamp headers. The
+// X-Webhook-Signature header is "sha256=" followed by the hex HMAC-SHA256, keyed with
+// the subscription secret, of the timestamp, a dot and the raw body. Receivers should
+// recompute it and reject requests with an old timestamp to stop replays.
+//
+// Subscriber URLs are supplied by clients, so unless the client is told otherwise it
+// refuses to connect to loopback, link-local and private addresses. The check is made
+// on the address actually dialled, which also covers redirects and host names that
+// resolve to such an address
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// The headers sent with every delivery
+const (
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// Sign() returns the signature for a body sent at the given time
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify() checks a signature the way a receiver would, rejecting timestamps more
+// than the tolerance away from now
+func Verify(secret string, timestamp int64, body []byte, signature string, tolerance time.Duration) bool {
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > tolerance || age < -tolerance {
+		return false
+	}
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// ErrBlockedAddress is returned when a delivery would connect to an address that is
+// not on the public internet
+var ErrBlockedAddress = errors.New("webhooks: the receiver address is not a public address")
+
+// carrierNAT is the shared address space of RFC 6598, which net.IP does not count
+// as private
+var carrierNAT = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// Blocked() reports whether a delivery may not connect to the address: loopback,
+// link-local, private (RFC 1918 and RFC 4193), shared, unspecified and multicast
+// addresses are all refused
+func Blocked(ip net.IP) bool {
+	return ip.IsLoopback() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() ||
+		ip.IsPrivate() ||
+		ip.IsUnspecified() ||
+		carrierNAT.Contains(ip)
+}
+
+// Client posts deliveries
+type Client struct {
+	http *http.Client
+}
+
+// NewClient() returns a client that gives receivers the timeout to answer. Only when
+// allowPrivate is set does it connect to non-public addresses, which is meant for
+// development against a receiver on the same machine
+func NewClient(timeout time.Duration, allowPrivate bool) *Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || Blocked(ip) {
+				return ErrBlockedAddress
+			}
+			return nil
+		}
+	}
+	transport := &http.Transport{
+		// A proxy would make the dialled address the proxy's, so none is used
+		Proxy:               nil,
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: timeout,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &Client{http: &http.Client{Timeout: timeout, Transport: transport}}
+}
+
+// Deliver() posts the body to the URL. It returns the response status, which is zero
+// when no response came back, and an error unless the receiver answered with a 2xx
+func (c *Client) Deliver(url, secret, event string, deliveryID int64, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "water-billing-webhooks/1.0")
+	req.Header.Set(HeaderEvent, event)
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(deliveryID, 10))
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(secret, timestamp, body))
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("receiver returned %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
@@ -0,0 +1,132 @@
+// Filename: internal/webhooks/webhooks_test.go
+
+package webhooks
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"event":"ping"}`)
+	now := time.Now().Unix()
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp int64
+		body      []byte
+		signature string
+		ok        bool
+	}{
+		{name: "valid", secret: "whsec_a", timestamp: now, body: body, signature: Sign("whsec_a", now, body), ok: true},
+		{name: "wrong secret", secret: "whsec_b", timestamp: now, body: body, signature: Sign("whsec_a", now, body)},
+		{name: "changed body", secret: "whsec_a", timestamp: now, body: []byte(`{"event":"pong"}`), signature: Sign("whsec_a", now, body)},
+		{name: "changed timestamp", secret: "whsec_a", timestamp: now - 1, body: body, signature: Sign("whsec_a", now, body)},
+		{name: "replayed", secret: "whsec_a", timestamp: now - 600, body: body, signature: Sign("whsec_a", now-600, body)},
+		{name: "from the future", secret: "whsec_a", timestamp: now + 600, body: body, signature: Sign("whsec_a", now+600, body)},
+		{name: "unsigned", secret: "whsec_a", timestamp: now, body: body},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ok := Verify(tt.secret, tt.timestamp, tt.body, tt.signature, 5*time.Minute); ok != tt.ok {
+				t.Errorf("got %t, want %t", ok, tt.ok)
+			}
+		})
+	}
+}
+
+// The signature is the hex HMAC-SHA256 of the timestamp, a dot and the body
+func TestSign(t *testing.T) {
+	got := Sign("key", 1700000000, []byte("{}"))
+	want := "sha256=9d713ed406bb7076d4123f0dc2c39d2df5c654ed4b0cd56b52c8b4c940bd63ae"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		ok     bool
+	}{
+		{name: "accepted", status: http.StatusNoContent, ok: true},
+		{name: "server error", status: http.StatusInternalServerError},
+		{name: "gone", status: http.StatusGone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := []byte(`{"event":"ping"}`)
+			receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, _ := io.ReadAll(r.Body)
+				timestamp, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+				if err != nil {
+					t.Errorf("bad timestamp header %q", r.Header.Get(HeaderTimestamp))
+				}
+				if !Verify("whsec_test", timestamp, got, r.Header.Get(HeaderSignature), time.Minute) {
+					t.Error("the signature does not verify")
+				}
+				if r.Header.Get(HeaderEvent) != "ping" || r.Header.Get(HeaderDelivery) != "42" {
+					t.Errorf("got event %q and delivery %q", r.Header.Get(HeaderEvent), r.Header.Get(HeaderDelivery))
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer receiver.Close()
+
+			status, err := NewClient(time.Second, true).Deliver(receiver.URL, "whsec_test", "ping", 42, body)
+			if status != tt.status {
+				t.Errorf("got status %d, want %d", status, tt.status)
+			}
+			if ok := err == nil; ok != tt.ok {
+				t.Errorf("got error %v, want ok %t", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestDeliverBlocked(t *testing.T) {
+	var called bool
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer receiver.Close()
+
+	status, err := NewClient(time.Second, false).Deliver(receiver.URL, "whsec_test", "ping", 1, []byte(`{}`))
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("got error %v, want %v", err, ErrBlockedAddress)
+	}
+	if status != 0 || called {
+		t.Error("the delivery reached a loopback receiver")
+	}
+}
+
+func TestBlocked(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1":       true,
+		"::1":             true,
+		"10.1.2.3":        true,
+		"172.16.0.1":      true,
+		"172.32.0.1":      false,
+		"192.168.1.10":    true,
+		"169.254.169.254": true,
+		"fe80::1":         true,
+		"fd00::1":         true,
+		"100.64.0.1":      true,
+		"0.0.0.0":         true,
+		"224.0.0.1":       true,
+		"::ffff:10.0.0.1": true,
+		"8.8.8.8":         false,
+		"2001:4860::8888": false,
+	}
+	for addr, want := range tests {
+		if got := Blocked(net.ParseIP(addr)); got != want {
+			t.Errorf("Blocked(%s) = %t, want %t", addr, got, want)
+		}
+	}
+}
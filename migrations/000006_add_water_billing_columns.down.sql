@@ -0,0 +1,8 @@
+-- Filename: migrations/000006_add_water_billing_columns.down.sql
+
+DROP INDEX IF EXISTS water_system_user_id_idx;
+ALTER TABLE water_system DROP CONSTRAINT IF EXISTS amount_paid_check;
+ALTER TABLE water_system DROP COLUMN IF EXISTS due_date;
+ALTER TABLE water_system DROP COLUMN IF EXISTS amount_paid;
+ALTER TABLE water_system DROP COLUMN IF EXISTS amount;
+ALTER TABLE water_system DROP COLUMN IF EXISTS user_id;
@@ -0,0 +1,8 @@
+-- Filename: migrations/000006_add_water_billing_columns.up.sql
+
+ALTER TABLE water_system ADD COLUMN IF NOT EXISTS user_id bigint REFERENCES users ON DELETE SET NULL;
+ALTER TABLE water_system ADD COLUMN IF NOT EXISTS amount bigint NOT NULL DEFAULT 0;
+ALTER TABLE water_system ADD COLUMN IF NOT EXISTS amount_paid bigint NOT NULL DEFAULT 0;
+ALTER TABLE water_system ADD COLUMN IF NOT EXISTS due_date date NOT NULL DEFAULT (CURRENT_DATE + 30);
+ALTER TABLE water_system ADD CONSTRAINT amount_paid_check CHECK (amount_paid BETWEEN 0 AND amount);
+CREATE INDEX IF NOT EXISTS water_system_user_id_idx ON water_system (user_id, due_date);
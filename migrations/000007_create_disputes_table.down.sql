@@ -0,0 +1,3 @@
+-- Filename: migrations/000007_create_disputes_table.down.sql
+
+DROP TABLE IF EXISTS disputes;
@@ -0,0 +1,12 @@
+-- Filename: migrations/000007_create_disputes_table.up.sql
+
+CREATE TABLE IF NOT EXISTS disputes (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    bill_id bigint REFERENCES water_system ON DELETE SET NULL,
+    reason text NOT NULL,
+    resolved_at timestamp(0) with time zone,
+    version integer NOT NULL DEFAULT 1
+);
+CREATE INDEX IF NOT EXISTS disputes_open_idx ON disputes (user_id) WHERE resolved_at IS NULL;
@@ -0,0 +1,3 @@
+-- Filename: migrations/000008_create_disconnections_table.down.sql
+
+DROP TABLE IF EXISTS disconnections;
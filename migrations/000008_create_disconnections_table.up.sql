@@ -0,0 +1,19 @@
+-- Filename: migrations/000008_create_disconnections_table.up.sql
+
+CREATE TABLE IF NOT EXISTS disconnections (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    state text NOT NULL,
+    arrears bigint NOT NULL,
+    notice_sent_at timestamp(0) with time zone,
+    scheduled_for date,
+    disconnected_at timestamp(0) with time zone,
+    reconnected_at timestamp(0) with time zone,
+    fee_bill_id bigint REFERENCES water_system ON DELETE SET NULL,
+    version integer NOT NULL DEFAULT 1,
+    CONSTRAINT disconnections_state_check CHECK (state IN ('notice_sent', 'scheduled', 'disconnected', 'reconnected', 'cancelled'))
+);
+-- Only one open disconnection case per account at a time
+CREATE UNIQUE INDEX IF NOT EXISTS disconnections_open_user_idx ON disconnections (user_id)
+    WHERE state IN ('notice_sent', 'scheduled', 'disconnected');
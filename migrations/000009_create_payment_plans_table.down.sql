@@ -0,0 +1,4 @@
+-- Filename: migrations/000009_create_payment_plans_table.down.sql
+
+DROP TABLE IF EXISTS plan_installments;
+DROP TABLE IF EXISTS payment_plans;
@@ -0,0 +1,26 @@
+-- Filename: migrations/000009_create_payment_plans_table.up.sql
+
+CREATE TABLE IF NOT EXISTS payment_plans (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    total bigint NOT NULL CHECK (total > 0),
+    frequency text NOT NULL,
+    state text NOT NULL DEFAULT 'active',
+    closed_at timestamp(0) with time zone,
+    version integer NOT NULL DEFAULT 1,
+    CONSTRAINT payment_plans_state_check CHECK (state IN ('active', 'completed', 'defaulted', 'cancelled'))
+);
+-- An account can only have one active plan at a time
+CREATE UNIQUE INDEX IF NOT EXISTS payment_plans_active_user_idx ON payment_plans (user_id) WHERE state = 'active';
+
+CREATE TABLE IF NOT EXISTS plan_installments (
+    id bigserial PRIMARY KEY,
+    plan_id bigint NOT NULL REFERENCES payment_plans ON DELETE CASCADE,
+    seq integer NOT NULL,
+    due_date date NOT NULL,
+    amount bigint NOT NULL CHECK (amount > 0),
+    amount_paid bigint NOT NULL DEFAULT 0,
+    UNIQUE (plan_id, seq),
+    CONSTRAINT plan_installments_paid_check CHECK (amount_paid BETWEEN 0 AND amount)
+);
@@ -0,0 +1,4 @@
+-- Filename: migrations/000010_create_payments_table.down.sql
+
+DROP TABLE IF EXISTS payment_allocations;
+DROP TABLE IF EXISTS payments;
@@ -0,0 +1,21 @@
+-- Filename: migrations/000010_create_payments_table.up.sql
+
+CREATE TABLE IF NOT EXISTS payments (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    amount bigint NOT NULL CHECK (amount > 0),
+    reference text NOT NULL,
+    plan_id bigint REFERENCES payment_plans ON DELETE SET NULL,
+    unapplied bigint NOT NULL DEFAULT 0
+);
+
+-- How each payment was matched against bills and plan installments
+CREATE TABLE IF NOT EXISTS payment_allocations (
+    id bigserial PRIMARY KEY,
+    payment_id bigint NOT NULL REFERENCES payments ON DELETE CASCADE,
+    bill_id bigint REFERENCES water_system ON DELETE SET NULL,
+    installment_id bigint REFERENCES plan_installments ON DELETE SET NULL,
+    amount bigint NOT NULL CHECK (amount > 0)
+);
+CREATE INDEX IF NOT EXISTS payment_allocations_payment_id_idx ON payment_allocations (payment_id);
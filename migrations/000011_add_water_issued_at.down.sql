@@ -0,0 +1,6 @@
+-- Filename: migrations/000011_add_water_issued_at.down.sql
+
+ALTER TABLE water_system DROP CONSTRAINT IF EXISTS amount_paid_check;
+ALTER TABLE water_system ADD CONSTRAINT amount_paid_check CHECK (amount_paid BETWEEN 0 AND amount);
+ALTER TABLE water_system DROP COLUMN IF EXISTS amount_credited;
+ALTER TABLE water_system DROP COLUMN IF EXISTS issued_at;
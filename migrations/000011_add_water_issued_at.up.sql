@@ -0,0 +1,9 @@
+-- Filename: migrations/000011_add_water_issued_at.up.sql
+
+ALTER TABLE water_system ADD COLUMN IF NOT EXISTS issued_at timestamp(0) with time zone;
+ALTER TABLE water_system ADD COLUMN IF NOT EXISTS amount_credited bigint NOT NULL DEFAULT 0;
+-- Bills that already exist have gone out to customers
+UPDATE water_system SET issued_at = created_at WHERE issued_at IS NULL;
+ALTER TABLE water_system DROP CONSTRAINT IF EXISTS amount_paid_check;
+ALTER TABLE water_system ADD CONSTRAINT amount_paid_check
+    CHECK (amount_paid >= 0 AND amount_credited >= 0 AND amount_paid + amount_credited <= amount);
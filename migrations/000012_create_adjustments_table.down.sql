@@ -0,0 +1,4 @@
+-- Filename: migrations/000012_create_adjustments_table.down.sql
+
+DROP TABLE IF EXISTS refunds;
+DROP TABLE IF EXISTS adjustments;
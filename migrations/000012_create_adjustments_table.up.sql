@@ -0,0 +1,21 @@
+-- Filename: migrations/000012_create_adjustments_table.up.sql
+
+CREATE TABLE IF NOT EXISTS adjustments (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    bill_id bigint NOT NULL REFERENCES water_system ON DELETE RESTRICT,
+    reason_code text NOT NULL,
+    notes text NOT NULL,
+    author_id bigint NOT NULL REFERENCES users ON DELETE RESTRICT,
+    amount bigint NOT NULL CHECK (amount < 0)
+);
+CREATE INDEX IF NOT EXISTS adjustments_bill_id_idx ON adjustments (bill_id);
+
+CREATE TABLE IF NOT EXISTS refunds (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    adjustment_id bigint NOT NULL REFERENCES adjustments ON DELETE RESTRICT,
+    bill_id bigint NOT NULL REFERENCES water_system ON DELETE RESTRICT,
+    user_id bigint REFERENCES users ON DELETE SET NULL,
+    amount bigint NOT NULL CHECK (amount > 0)
+);
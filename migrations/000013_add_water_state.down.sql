@@ -0,0 +1,6 @@
+-- Filename: migrations/000013_add_water_state.down.sql
+
+DROP TABLE IF EXISTS bill_transitions;
+DROP INDEX IF EXISTS water_system_state_idx;
+ALTER TABLE water_system DROP CONSTRAINT IF EXISTS state_check;
+ALTER TABLE water_system DROP COLUMN IF EXISTS state;
@@ -0,0 +1,24 @@
+-- Filename: migrations/000013_add_water_state.up.sql
+
+ALTER TABLE water_system ADD COLUMN IF NOT EXISTS state text NOT NULL DEFAULT 'draft';
+-- Work out where the existing bills are in their lifecycle
+UPDATE water_system SET state = CASE
+    WHEN issued_at IS NULL THEN 'draft'
+    WHEN amount_paid + amount_credited >= amount THEN 'paid'
+    WHEN due_date < CURRENT_DATE THEN 'overdue'
+    WHEN amount_paid > 0 THEN 'partially_paid'
+    ELSE 'issued'
+END;
+ALTER TABLE water_system ADD CONSTRAINT state_check
+    CHECK (state IN ('draft', 'issued', 'partially_paid', 'paid', 'overdue', 'void'));
+CREATE INDEX IF NOT EXISTS water_system_state_idx ON water_system (state);
+
+CREATE TABLE IF NOT EXISTS bill_transitions (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    bill_id bigint NOT NULL REFERENCES water_system ON DELETE CASCADE,
+    from_state text NOT NULL,
+    to_state text NOT NULL,
+    actor_id bigint REFERENCES users ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS bill_transitions_bill_id_idx ON bill_transitions (bill_id);
@@ -0,0 +1,4 @@
+-- Filename: migrations/000014_create_permissions_table.down.sql
+
+DROP TABLE IF EXISTS users_permissions;
+DROP TABLE IF EXISTS permissions;
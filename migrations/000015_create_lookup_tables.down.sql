@@ -0,0 +1,6 @@
+-- Filename: migrations/000015_create_lookup_tables.down.sql
+
+ALTER TABLE water_system DROP CONSTRAINT IF EXISTS water_system_priority_fkey;
+ALTER TABLE water_system DROP CONSTRAINT IF EXISTS water_system_category_fkey;
+DROP TABLE IF EXISTS priorities;
+DROP TABLE IF EXISTS categories;
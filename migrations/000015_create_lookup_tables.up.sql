@@ -0,0 +1,41 @@
+-- Filename: migrations/000015_create_lookup_tables.up.sql
+
+CREATE TABLE IF NOT EXISTS categories (
+    code text PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    label text NOT NULL,
+    active bool NOT NULL DEFAULT true,
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS priorities (
+    code text PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    label text NOT NULL,
+    active bool NOT NULL DEFAULT true,
+    version integer NOT NULL DEFAULT 1
+);
+
+-- Map the free text already on the bills to codes: trimmed, lower case, and with
+-- runs of spaces or dashes turned into a single underscore so "Late Fee", "late fee "
+-- and "late-fee" all end up as late_fee
+UPDATE water_system SET
+    category = regexp_replace(lower(trim(category)), '[\s-]+', '_', 'g'),
+    priority = regexp_replace(lower(trim(priority)), '[\s-]+', '_', 'g');
+
+INSERT INTO categories (code, label)
+SELECT DISTINCT category, initcap(replace(category, '_', ' ')) FROM water_system
+ON CONFLICT DO NOTHING;
+INSERT INTO priorities (code, label)
+SELECT DISTINCT priority, initcap(replace(priority, '_', ' ')) FROM water_system
+ON CONFLICT DO NOTHING;
+
+-- Values the application itself relies on
+INSERT INTO categories (code, label) VALUES ('fees', 'Fees') ON CONFLICT DO NOTHING;
+INSERT INTO priorities (code, label) VALUES ('low', 'Low'), ('normal', 'Normal'), ('high', 'High')
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE water_system ADD CONSTRAINT water_system_category_fkey
+    FOREIGN KEY (category) REFERENCES categories (code) ON UPDATE CASCADE;
+ALTER TABLE water_system ADD CONSTRAINT water_system_priority_fkey
+    FOREIGN KEY (priority) REFERENCES priorities (code) ON UPDATE CASCADE;
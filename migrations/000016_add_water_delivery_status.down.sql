@@ -0,0 +1,5 @@
+-- Filename: migrations/000016_add_water_delivery_status.down.sql
+
+ALTER TABLE water_system DROP CONSTRAINT IF EXISTS water_system_delivery_status_check;
+ALTER TABLE water_system DROP COLUMN IF EXISTS delivery_updated_at;
+ALTER TABLE water_system DROP COLUMN IF EXISTS delivery_status;
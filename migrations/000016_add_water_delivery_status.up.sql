@@ -0,0 +1,7 @@
+-- Filename: migrations/000016_add_water_delivery_status.up.sql
+
+ALTER TABLE water_system ADD COLUMN IF NOT EXISTS delivery_status text;
+ALTER TABLE water_system ADD COLUMN IF NOT EXISTS delivery_updated_at timestamp(0) with time zone;
+
+ALTER TABLE water_system ADD CONSTRAINT water_system_delivery_status_check
+    CHECK (delivery_status IN ('queued', 'sent', 'failed'));
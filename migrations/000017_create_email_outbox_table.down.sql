@@ -0,0 +1,3 @@
+-- Filename: migrations/000017_create_email_outbox_table.down.sql
+
+DROP TABLE IF EXISTS email_outbox;
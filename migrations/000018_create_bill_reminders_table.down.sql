@@ -0,0 +1,4 @@
+-- Filename: migrations/000018_create_bill_reminders_table.down.sql
+
+ALTER TABLE users DROP COLUMN IF EXISTS reminders_opt_out;
+DROP TABLE IF EXISTS bill_reminders;
@@ -0,0 +1,16 @@
+-- Filename: migrations/000018_create_bill_reminders_table.up.sql
+
+CREATE TABLE IF NOT EXISTS bill_reminders (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    bill_id bigint NOT NULL REFERENCES water_system ON DELETE CASCADE,
+    kind text NOT NULL,
+    offset_days integer NOT NULL,
+    outbox_id bigint REFERENCES email_outbox ON DELETE SET NULL,
+    UNIQUE (bill_id, kind, offset_days)
+);
+
+ALTER TABLE bill_reminders ADD CONSTRAINT bill_reminders_kind_check
+    CHECK (kind IN ('upcoming', 'overdue'));
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS reminders_opt_out boolean NOT NULL DEFAULT false;
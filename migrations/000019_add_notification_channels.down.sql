@@ -0,0 +1,8 @@
+-- Filename: migrations/000019_add_notification_channels.down.sql
+
+DELETE FROM email_outbox WHERE channel = 'sms';
+ALTER TABLE email_outbox DROP CONSTRAINT IF EXISTS email_outbox_channel_check;
+ALTER TABLE email_outbox DROP COLUMN IF EXISTS channel;
+
+ALTER TABLE users DROP COLUMN IF EXISTS channels;
+ALTER TABLE users DROP COLUMN IF EXISTS phone;
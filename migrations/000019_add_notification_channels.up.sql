@@ -0,0 +1,8 @@
+-- Filename: migrations/000019_add_notification_channels.up.sql
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS phone text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS channels text[] NOT NULL DEFAULT '{email}';
+
+ALTER TABLE email_outbox ADD COLUMN IF NOT EXISTS channel text NOT NULL DEFAULT 'email';
+ALTER TABLE email_outbox ADD CONSTRAINT email_outbox_channel_check
+    CHECK (channel IN ('email', 'sms'));
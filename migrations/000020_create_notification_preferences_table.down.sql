@@ -0,0 +1,17 @@
+-- Filename: migrations/000020_create_notification_preferences_table.down.sql
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS channels text[] NOT NULL DEFAULT '{email}';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS reminders_opt_out boolean NOT NULL DEFAULT false;
+
+UPDATE users SET channels = '{email,sms}'
+WHERE EXISTS (
+    SELECT 1 FROM notification_preferences
+    WHERE user_id = users.id AND channel = 'sms' AND enabled
+);
+UPDATE users SET reminders_opt_out = true
+WHERE EXISTS (
+    SELECT 1 FROM notification_preferences
+    WHERE user_id = users.id AND event = 'reminder' AND channel = 'email' AND NOT enabled
+);
+
+DROP TABLE IF EXISTS notification_preferences;
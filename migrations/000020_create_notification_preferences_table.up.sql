@@ -0,0 +1,26 @@
+-- Filename: migrations/000020_create_notification_preferences_table.up.sql
+
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    event text NOT NULL,
+    channel text NOT NULL,
+    enabled boolean NOT NULL,
+    PRIMARY KEY (user_id, event, channel)
+);
+
+ALTER TABLE notification_preferences ADD CONSTRAINT notification_preferences_event_check
+    CHECK (event IN ('bill_issued', 'reminder', 'payment_received', 'outage'));
+ALTER TABLE notification_preferences ADD CONSTRAINT notification_preferences_channel_check
+    CHECK (channel IN ('email', 'sms'));
+
+-- Carry the old per-user channel list and reminder opt-out over to the new switches
+INSERT INTO notification_preferences (user_id, event, channel, enabled)
+SELECT users.id, events.event, channels.channel,
+    channels.channel = ANY(users.channels) AND NOT (events.event = 'reminder' AND users.reminders_opt_out)
+FROM users
+CROSS JOIN (VALUES ('bill_issued'), ('reminder'), ('payment_received'), ('outage')) AS events (event)
+CROSS JOIN (VALUES ('email'), ('sms')) AS channels (channel)
+WHERE users.channels <> '{email}' OR users.reminders_opt_out;
+
+ALTER TABLE users DROP COLUMN IF EXISTS channels;
+ALTER TABLE users DROP COLUMN IF EXISTS reminders_opt_out;
@@ -0,0 +1,3 @@
+-- Filename: migrations/000021_create_job_runs_table.down.sql
+
+DROP TABLE IF EXISTS job_runs;
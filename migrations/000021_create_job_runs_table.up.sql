@@ -0,0 +1,14 @@
+-- Filename: migrations/000021_create_job_runs_table.up.sql
+
+CREATE TABLE IF NOT EXISTS job_runs (
+    id bigserial PRIMARY KEY,
+    job text NOT NULL,
+    scheduled_for timestamp(0) with time zone NOT NULL,
+    started_at timestamp(3) with time zone NOT NULL DEFAULT NOW(),
+    finished_at timestamp(3) with time zone,
+    duration_ms bigint,
+    error text NOT NULL DEFAULT '',
+    UNIQUE (job, scheduled_for)
+);
+
+CREATE INDEX IF NOT EXISTS job_runs_started_at_idx ON job_runs (started_at);
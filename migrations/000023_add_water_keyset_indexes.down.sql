@@ -0,0 +1,4 @@
+-- Filename: migrations/000023_add_water_keyset_indexes.down.sql
+
+DROP INDEX IF EXISTS water_system_priority_id_idx;
+DROP INDEX IF EXISTS water_system_waterbill_id_idx;
@@ -0,0 +1,5 @@
+-- Filename: migrations/000023_add_water_keyset_indexes.up.sql
+
+-- The listing pages through bills by (sort column, id) when it is given a cursor
+CREATE INDEX IF NOT EXISTS water_system_waterbill_id_idx ON water_system (waterbill, id);
+CREATE INDEX IF NOT EXISTS water_system_priority_id_idx ON water_system (priority, id);
@@ -0,0 +1,5 @@
+-- Filename: migrations/000024_add_water_filter_indexes.down.sql
+
+DROP INDEX IF EXISTS water_system_created_at_id_idx;
+DROP INDEX IF EXISTS water_system_text_idx;
+DROP INDEX IF EXISTS water_system_category_idx;
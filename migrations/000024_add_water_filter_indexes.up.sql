@@ -0,0 +1,7 @@
+-- Filename: migrations/000024_add_water_filter_indexes.up.sql
+
+-- Indexes for the filters of the listing: category, the full-text search of the
+-- description and notes, and created_at ranges, which are also a sort with cursors
+CREATE INDEX IF NOT EXISTS water_system_category_idx ON water_system (category);
+CREATE INDEX IF NOT EXISTS water_system_text_idx ON water_system USING GIN (to_tsvector('simple', description || ' ' || notes));
+CREATE INDEX IF NOT EXISTS water_system_created_at_id_idx ON water_system (created_at, id);
@@ -0,0 +1,4 @@
+-- Filename: migrations/000025_add_water_search_column.down.sql
+
+DROP INDEX IF EXISTS water_system_search_idx;
+ALTER TABLE water_system DROP COLUMN IF EXISTS search;
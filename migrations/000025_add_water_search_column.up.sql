@@ -0,0 +1,11 @@
+-- Filename: migrations/000025_add_water_search_column.up.sql
+
+-- One weighted document per bill for ranked full-text search: the waterbill weighs
+-- most, then the description, the notes and the category
+ALTER TABLE water_system ADD COLUMN IF NOT EXISTS search tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('simple', coalesce(waterbill, '')), 'A') ||
+    setweight(to_tsvector('simple', coalesce(description, '')), 'B') ||
+    setweight(to_tsvector('simple', coalesce(notes, '')), 'C') ||
+    setweight(to_tsvector('simple', coalesce(category, '')), 'D')
+) STORED;
+CREATE INDEX IF NOT EXISTS water_system_search_idx ON water_system USING GIN (search);
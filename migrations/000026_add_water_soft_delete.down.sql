@@ -0,0 +1,5 @@
+-- Filename: migrations/000026_add_water_soft_delete.down.sql
+
+DROP INDEX IF EXISTS water_system_deleted_at_id_idx;
+ALTER TABLE water_system DROP COLUMN IF EXISTS deleted_by;
+ALTER TABLE water_system DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,6 @@
+-- Filename: migrations/000026_add_water_soft_delete.up.sql
+
+-- Deleted bills go to the trash until they are restored or the retention job purges them
+ALTER TABLE water_system ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone;
+ALTER TABLE water_system ADD COLUMN IF NOT EXISTS deleted_by bigint REFERENCES users ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS water_system_deleted_at_id_idx ON water_system (deleted_at, id) WHERE deleted_at IS NOT NULL;
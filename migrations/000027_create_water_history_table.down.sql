@@ -0,0 +1,3 @@
+-- Filename: migrations/000027_create_water_history_table.down.sql
+
+DROP TABLE IF EXISTS water_system_history;
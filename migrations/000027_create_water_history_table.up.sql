@@ -0,0 +1,13 @@
+-- Filename: migrations/000027_create_water_history_table.up.sql
+
+-- Every change to a bill, with the version it replaced as it was, who made it and when
+CREATE TABLE IF NOT EXISTS water_system_history (
+    id bigserial PRIMARY KEY,
+    bill_id bigint NOT NULL REFERENCES water_system ON DELETE CASCADE,
+    version int NOT NULL,
+    action text NOT NULL,
+    actor_id bigint REFERENCES users ON DELETE SET NULL,
+    changed_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    prior jsonb
+);
+CREATE INDEX IF NOT EXISTS water_system_history_bill_id_version_idx ON water_system_history (bill_id, version);
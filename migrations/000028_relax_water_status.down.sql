@@ -0,0 +1,5 @@
+-- Filename: migrations/000028_relax_water_status.down.sql
+
+ALTER TABLE water_system DROP CONSTRAINT IF EXISTS status_length_check;
+ALTER TABLE water_system ALTER COLUMN status DROP DEFAULT;
+ALTER TABLE water_system ADD CONSTRAINT status_length_check CHECK (array_length(status, 1) BETWEEN 1 AND 5) NOT VALID;
@@ -0,0 +1,7 @@
+-- Filename: migrations/000028_relax_water_status.up.sql
+
+-- Bills no longer take status tags, the lifecycle state replaces them. The tags of
+-- existing bills are kept and new bills start without any
+ALTER TABLE water_system DROP CONSTRAINT IF EXISTS status_length_check;
+ALTER TABLE water_system ALTER COLUMN status SET DEFAULT '{}';
+ALTER TABLE water_system ADD CONSTRAINT status_length_check CHECK (COALESCE(array_length(status, 1), 0) <= 5);
@@ -0,0 +1,4 @@
+-- Filename: migrations/000029_add_delivery_leases.down.sql
+
+ALTER TABLE webhook_deliveries DROP COLUMN IF EXISTS lease;
+ALTER TABLE email_outbox DROP COLUMN IF EXISTS lease;
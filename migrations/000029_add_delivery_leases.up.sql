@@ -0,0 +1,6 @@
+-- Filename: migrations/000029_add_delivery_leases.up.sql
+
+-- Every claim of a queued message or delivery takes a new lease number, a worker can
+-- only record the outcome while its lease is still the latest one
+ALTER TABLE email_outbox ADD COLUMN IF NOT EXISTS lease bigint NOT NULL DEFAULT 0;
+ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS lease bigint NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+-- Filename: migrations/000030_add_water_search_language_indexes.down.sql
+
+DROP INDEX IF EXISTS water_system_search_spanish_idx;
+DROP INDEX IF EXISTS water_system_search_english_idx;
@@ -0,0 +1,17 @@
+-- Filename: migrations/000030_add_water_search_language_indexes.up.sql
+
+-- Searches that stem words in a language match against a document built with that
+-- language rather than the search column. These index the same expressions as
+-- searchDocument() in internal/data/search.go, which must match them exactly
+CREATE INDEX IF NOT EXISTS water_system_search_english_idx ON water_system USING GIN ((
+    setweight(to_tsvector('english'::regconfig, coalesce(waterbill, '')), 'A') ||
+    setweight(to_tsvector('english'::regconfig, coalesce(description, '')), 'B') ||
+    setweight(to_tsvector('english'::regconfig, coalesce(notes, '')), 'C') ||
+    setweight(to_tsvector('english'::regconfig, coalesce(category, '')), 'D')
+));
+CREATE INDEX IF NOT EXISTS water_system_search_spanish_idx ON water_system USING GIN ((
+    setweight(to_tsvector('spanish'::regconfig, coalesce(waterbill, '')), 'A') ||
+    setweight(to_tsvector('spanish'::regconfig, coalesce(description, '')), 'B') ||
+    setweight(to_tsvector('spanish'::regconfig, coalesce(notes, '')), 'C') ||
+    setweight(to_tsvector('spanish'::regconfig, coalesce(category, '')), 'D')
+));
@@ -0,0 +1,5 @@
+-- Filename: migrations/000031_keep_purged_bill_history.down.sql
+
+DELETE FROM water_system_history WHERE bill_id NOT IN (SELECT id FROM water_system);
+ALTER TABLE water_system_history ADD CONSTRAINT water_system_history_bill_id_fkey
+    FOREIGN KEY (bill_id) REFERENCES water_system ON DELETE CASCADE;
@@ -0,0 +1,6 @@
+-- Filename: migrations/000031_keep_purged_bill_history.up.sql
+
+-- The history of a bill is the audit trail of the money it was for, so it outlives
+-- the bill. Purging a bill records a last purged entry and leaves the rest in place,
+-- bill_id still names the bill it was
+ALTER TABLE water_system_history DROP CONSTRAINT IF EXISTS water_system_history_bill_id_fkey;